@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2016 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/felipejfc/udpx/proxy"
+	"github.com/labstack/echo"
+)
+
+// aclRuleFromQuery reads the rule to remove from the action and cidr query
+// parameters
+func aclRuleFromQuery(c echo.Context) proxy.ACLRule {
+	return proxy.ACLRule{Action: c.QueryParam("action"), CIDR: c.QueryParam("cidr")}
+}
+
+func aclError(c echo.Context, err error) error {
+	if err == proxy.ErrProxyNotFound {
+		return echo.ErrNotFound
+	}
+	return c.String(http.StatusUnprocessableEntity, err.Error())
+}
+
+func GetProxyACLHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	return c.JSON(http.StatusOK, p.ACL.Rules())
+}
+
+func AddProxyACLRuleHandler(c echo.Context) error {
+	rule := proxy.ACLRule{}
+	if err := c.Bind(&rule); err != nil {
+		return err
+	}
+	pm := proxy.GetManager()
+	if err := pm.AddACLRule(c.Param("port"), rule); err != nil {
+		return aclError(c, err)
+	}
+	return c.JSON(http.StatusCreated, rule)
+}
+
+func RemoveProxyACLRuleHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	if err := pm.RemoveACLRule(c.Param("port"), aclRuleFromQuery(c)); err != nil {
+		return echo.ErrNotFound
+	}
+	return c.String(http.StatusOK, "OK")
+}
+
+func GetGlobalACLHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	return c.JSON(http.StatusOK, pm.ACL.Rules())
+}
+
+func AddGlobalACLRuleHandler(c echo.Context) error {
+	rule := proxy.ACLRule{}
+	if err := c.Bind(&rule); err != nil {
+		return err
+	}
+	pm := proxy.GetManager()
+	if err := pm.AddGlobalACLRule(rule); err != nil {
+		return aclError(c, err)
+	}
+	return c.JSON(http.StatusCreated, rule)
+}
+
+func RemoveGlobalACLRuleHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	if err := pm.RemoveGlobalACLRule(aclRuleFromQuery(c)); err != nil {
+		return echo.ErrNotFound
+	}
+	return c.String(http.StatusOK, "OK")
+}
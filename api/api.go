@@ -54,6 +54,25 @@ func (a *API) configureAPI() {
 	a.http.POST("/proxy", NewProxyHandler)
 	a.http.GET("/proxy/:port", GetProxyByBindPortHandler)
 	a.http.DELETE("/proxy/:port", UnregisterProxyByPortHandler)
+	a.http.GET("/proxy/:port/stats", GetProxyStatsByBindPortHandler)
+	a.http.GET("/proxy/:port/sessions", GetProxySessionsByBindPortHandler)
+	a.http.GET("/proxy/:port/websocket", ProxyWebSocketHandler)
+	a.http.GET("/proxy/:port/turn/allocations", GetProxyTURNAllocationsHandler)
+	a.http.GET("/proxy/:port/bans", GetProxyBansByBindPortHandler)
+	a.http.DELETE("/proxy/:port/bans/:address", RevokeProxyBanHandler)
+	a.http.GET("/proxy/:port/auth/keys", GetProxyAuthKeysHandler)
+	a.http.POST("/proxy/:port/auth/keys", AddProxyAuthKeyHandler)
+	a.http.DELETE("/proxy/:port/auth/keys/:id", RetireProxyAuthKeyHandler)
+	a.http.GET("/proxy/:port/tunnel/keys", GetProxyTunnelKeysHandler)
+	a.http.POST("/proxy/:port/tunnel/keys", AddProxyTunnelKeyHandler)
+	a.http.PUT("/proxy/:port/tunnel/keys/:id/active", ActivateProxyTunnelKeyHandler)
+	a.http.DELETE("/proxy/:port/tunnel/keys/:id", RemoveProxyTunnelKeyHandler)
+	a.http.GET("/proxy/:port/acl", GetProxyACLHandler)
+	a.http.POST("/proxy/:port/acl", AddProxyACLRuleHandler)
+	a.http.DELETE("/proxy/:port/acl", RemoveProxyACLRuleHandler)
+	a.http.GET("/acl", GetGlobalACLHandler)
+	a.http.POST("/acl", AddGlobalACLRuleHandler)
+	a.http.DELETE("/acl", RemoveGlobalACLRuleHandler)
 	a.logger.Debug("api configured!")
 }
 
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2016 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/felipejfc/udpx/proxy"
+	"github.com/labstack/echo"
+)
+
+func GetProxyAuthKeysHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	keys, err := p.AuthKeys()
+	if err != nil {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+func AddProxyAuthKeyHandler(c echo.Context) error {
+	key := proxy.AuthKey{}
+	if err := c.Bind(&key); err != nil {
+		return err
+	}
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	if err := p.AddAuthKey(key); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	return c.String(http.StatusCreated, "OK")
+}
+
+// RetireProxyAuthKeyHandler stops accepting a key once the overlap query
+// parameter, in milliseconds, elapsed
+func RetireProxyAuthKeyHandler(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 8)
+	if err != nil {
+		return c.String(http.StatusUnprocessableEntity, "invalid key id")
+	}
+	overlap := 0
+	if o := c.QueryParam("overlap"); o != "" {
+		if overlap, err = strconv.Atoi(o); err != nil || overlap < 0 {
+			return c.String(http.StatusUnprocessableEntity, "invalid overlap")
+		}
+	}
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil || !p.RetireAuthKey(uint8(id), time.Duration(overlap)*time.Millisecond) {
+		return echo.ErrNotFound
+	}
+	return c.String(http.StatusOK, "OK")
+}
@@ -48,10 +48,88 @@ func NewProxyHandler(c echo.Context) error {
 	if p.Name == "" {
 		return c.String(http.StatusUnprocessableEntity, "name required")
 	}
-	if pm.RegisterProxy(*p) != true {
+	if err := proxy.ValidateProxyType(p.Type); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.WebSocket.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.SOCKS5.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if p.Type == proxy.ProxyTypeTURN {
+		if err := p.TURN.Validate(); err != nil {
+			return c.String(http.StatusUnprocessableEntity, err.Error())
+		}
+	}
+	if p.Type == proxy.ProxyTypeDNS {
+		if err := p.DNS.Validate(); err != nil {
+			return c.String(http.StatusUnprocessableEntity, err.Error())
+		}
+	}
+	if err := p.QUIC.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.SessionKey.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := proxy.ValidateUpstreamMode(p.UpstreamMode); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.ClientRateLimit.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.UpstreamRateLimit.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := proxy.ValidateACL(p.ACL); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.Tunnel.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.FEC.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.DTLS.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.ProxyProtocol.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.Authentication.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := proxy.ValidateFilteringMode(p.FilteringMode); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.BanPolicy.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.AmplificationGuard.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.Admission.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.UpstreamShaping.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := p.ClientShaping.Validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := proxy.ValidateOversizePolicy(p.OversizePolicy); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := proxy.ValidateSourcePorts(p.SourcePortRangeStart, p.SourcePortRangeEnd, p.SourcePortMapping); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := pm.RegisterProxy(*p); err == proxy.ErrProxyExists {
 		return c.String(http.StatusConflict, fmt.Sprintf("some proxy might already be listening on port %d", p.BindPort))
+	} else if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
 	}
-	return c.JSON(http.StatusCreated, p)
+	return c.JSON(http.StatusCreated, p.Redacted())
 }
 
 func GetProxyByBindPortHandler(c echo.Context) error {
@@ -60,7 +138,67 @@ func GetProxyByBindPortHandler(c echo.Context) error {
 	if p == nil {
 		return echo.ErrNotFound
 	}
-	return c.JSON(http.StatusOK, p)
+	return c.JSON(http.StatusOK, p.Redacted())
+}
+
+func GetProxyStatsByBindPortHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	return c.JSON(http.StatusOK, p.Stats())
+}
+
+func GetProxySessionsByBindPortHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	return c.JSON(http.StatusOK, p.Sessions())
+}
+
+func GetProxyTURNAllocationsHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	allocations, err := p.TURNAllocations()
+	if err != nil {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	return c.JSON(http.StatusOK, allocations)
+}
+
+// ProxyWebSocketHandler hands a WebSocket connection to a websocket proxy
+func ProxyWebSocketHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil || p.Type != proxy.ProxyTypeWebSocket {
+		return echo.ErrNotFound
+	}
+	p.WebSocketHandler().ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+func GetProxyBansByBindPortHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	return c.JSON(http.StatusOK, p.Bans())
+}
+
+func RevokeProxyBanHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil || !p.RevokeBan(c.Param("address")) {
+		return echo.ErrNotFound
+	}
+	return c.String(http.StatusOK, "OK")
 }
 
 func UnregisterProxyByPortHandler(c echo.Context) error {
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2016 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/felipejfc/udpx/api"
+	"github.com/felipejfc/udpx/proxy"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Proxy", func() {
+	var e *echo.Echo
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	BeforeEach(func() {
+		proxy.GetManager().Configure(false, zap.NewNop(), "localhost", 4096, 1000, 1000)
+		e = echo.New()
+		e.POST("/proxy", NewProxyHandler)
+		e.GET("/proxy/:port", GetProxyByBindPortHandler)
+	})
+
+	AfterEach(func() {
+		for _, port := range []string{"23470", "23471", "23472", "23473"} {
+			proxy.GetManager().UnregisterByBindPort(port)
+		}
+	})
+
+	It("should answer 400 and keep nothing when a proxy cannot start", func() {
+		rec := request(http.MethodPost, "/proxy", `{"bindPort": 23470, "upstreamAddress": "localhost", "upstreamPort": 34567, "name": "burst",
+			"clientRateLimit": {"bytesPerSecond": 100, "bytesBurst": 100}}`)
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Body.String()).To(ContainSubstring("bytes burst"))
+		Expect(request(http.MethodGet, "/proxy/23470", "").Code).To(Equal(http.StatusNotFound))
+
+		rec = request(http.MethodPost, "/proxy", `{"bindPort": 23470, "upstreamAddress": "localhost", "upstreamPort": 34567, "name": "valid"}`)
+		Expect(rec.Code).To(Equal(http.StatusCreated))
+		rec = request(http.MethodPost, "/proxy", `{"bindPort": 23470, "upstreamAddress": "localhost", "upstreamPort": 34567, "name": "again"}`)
+		Expect(rec.Code).To(Equal(http.StatusConflict))
+	})
+
+	It("should never answer with secrets or passwords", func() {
+		configs := map[string]string{
+			"23470": `"authentication": {"keys": [{"id": 1, "secret": "auth-secret"}]}, "tunnel": {"role": "entry", "keys": [{"id": 1, "secret": "tunnel-secret"}]}`,
+			"23471": `"dtls": {"mode": "originate", "psk": "abcdef0123", "pskIdentity": "udpx"}`,
+			"23472": `"type": "socks5", "socks5": {"users": [{"username": "user", "password": "socks5-password"}]}`,
+			"23473": `"type": "turn", "turn": {"realm": "udpx", "users": [{"username": "user", "password": "turn-password"}]}`,
+		}
+		secrets := []string{"auth-secret", "tunnel-secret", "abcdef0123", "socks5-password", "turn-password"}
+		for port, config := range configs {
+			rec := request(http.MethodPost, "/proxy", `{"bindPort": `+port+`, "upstreamAddress": "localhost", "upstreamPort": 34567, "name": "secrets", `+config+`}`)
+			Expect(rec.Code).To(Equal(http.StatusCreated), rec.Body.String())
+			get := request(http.MethodGet, "/proxy/"+port, "")
+			Expect(get.Code).To(Equal(http.StatusOK))
+			for _, secret := range secrets {
+				Expect(rec.Body.String()).NotTo(ContainSubstring(secret))
+				Expect(get.Body.String()).NotTo(ContainSubstring(secret))
+			}
+		}
+		// the proxies still run with their secrets
+		Expect(proxy.GetManager().GetConfigByBindPort("23470").Authentication.Keys[0].Secret).To(Equal("auth-secret"))
+		Expect(proxy.GetManager().GetConfigByBindPort("23473").TURN.Users[0].Password).To(Equal("turn-password"))
+	})
+})
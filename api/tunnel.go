@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2016 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/felipejfc/udpx/proxy"
+	"github.com/labstack/echo"
+)
+
+func GetProxyTunnelKeysHandler(c echo.Context) error {
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	active, keys, err := p.TunnelKeys()
+	if err != nil {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"activeKey": active, "keys": keys})
+}
+
+func AddProxyTunnelKeyHandler(c echo.Context) error {
+	key := proxy.TunnelKey{}
+	if err := c.Bind(&key); err != nil {
+		return err
+	}
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	if err := p.AddTunnelKey(key); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	return c.String(http.StatusCreated, "OK")
+}
+
+func ActivateProxyTunnelKeyHandler(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 8)
+	if err != nil {
+		return c.String(http.StatusUnprocessableEntity, "invalid key id")
+	}
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	if err := p.ActivateTunnelKey(uint8(id)); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	return c.String(http.StatusOK, "OK")
+}
+
+func RemoveProxyTunnelKeyHandler(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 8)
+	if err != nil {
+		return c.String(http.StatusUnprocessableEntity, "invalid key id")
+	}
+	pm := proxy.GetManager()
+	p := pm.GetProxyByBindPort(c.Param("port"))
+	if p == nil {
+		return echo.ErrNotFound
+	}
+	if err := p.RemoveTunnelKey(uint8(id)); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	return c.String(http.StatusOK, "OK")
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package auth_test
+
+import (
+	"time"
+
+	. "github.com/felipejfc/udpx/auth"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Auth", func() {
+	var (
+		prefix   = []byte(DefaultPrefix)
+		secret   = []byte("secret")
+		now      time.Time
+		verifier *Verifier
+	)
+
+	BeforeEach(func() {
+		now = time.Now()
+		verifier = NewVerifier(prefix, time.Minute)
+		verifier.AddKey(1, secret, time.Time{})
+	})
+
+	It("should verify and strip a token", func() {
+		b, err := Seal(prefix, 1, secret, now.Add(time.Second*30), []byte("hello"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b).To(HaveLen(TokenSize(prefix) + 5))
+
+		payload, err := verifier.Verify(b, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(payload)).To(Equal("hello"))
+	})
+
+	It("should reject replayed, expired and forged tokens", func() {
+		b, _ := Seal(prefix, 1, secret, now.Add(time.Second*30), []byte("hello"))
+		_, err := verifier.Verify(b, now)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = verifier.Verify(b, now)
+		Expect(err).To(Equal(ErrReplayed))
+
+		b, _ = Seal(prefix, 1, secret, now.Add(-time.Second), nil)
+		_, err = verifier.Verify(b, now)
+		Expect(err).To(Equal(ErrExpired))
+
+		b, _ = Seal(prefix, 1, secret, now.Add(time.Hour), nil)
+		_, err = verifier.Verify(b, now)
+		Expect(err).To(Equal(ErrTooLong))
+
+		b, _ = Seal(prefix, 1, []byte("forged"), now.Add(time.Second*30), nil)
+		_, err = verifier.Verify(b, now)
+		Expect(err).To(Equal(ErrInvalidMAC))
+
+		_, err = verifier.Verify([]byte("hello"), now)
+		Expect(err).To(Equal(ErrMissingToken))
+	})
+
+	It("should accept old and new keys during the overlap window", func() {
+		verifier.AddKey(2, []byte("new secret"), time.Time{})
+		Expect(verifier.RetireKey(1, now.Add(time.Second*10))).To(BeTrue())
+
+		old, _ := Seal(prefix, 1, secret, now.Add(time.Second*30), nil)
+		_, err := verifier.Verify(old, now)
+		Expect(err).NotTo(HaveOccurred())
+		rotated, _ := Seal(prefix, 2, []byte("new secret"), now.Add(time.Second*30), nil)
+		_, err = verifier.Verify(rotated, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		old, _ = Seal(prefix, 1, secret, now.Add(time.Second*30), nil)
+		_, err = verifier.Verify(old, now.Add(time.Second*10))
+		Expect(err).To(Equal(ErrUnknownKey))
+	})
+
+	It("should drop keys once their overlap window has passed", func() {
+		verifier.AddKey(2, []byte("new secret"), time.Time{})
+		Expect(verifier.RetireKey(1, now.Add(time.Second*10))).To(BeTrue())
+
+		later := now.Add(time.Second * 11)
+		rotated, _ := Seal(prefix, 2, []byte("new secret"), later.Add(time.Second*30), nil)
+		_, err := verifier.Verify(rotated, later)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verifier.RetireKey(1, later)).To(BeFalse())
+		Expect(verifier.Keys()).To(Equal([]KeyInfo{{ID: 2}}))
+	})
+})
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package auth implements the HMAC tokens that authenticate the first
+// datagram of a udpx session, and a Verifier with rotatable keys and replay
+// protection.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	// NonceSize is the length of the random nonce of a token
+	NonceSize = 16
+	// MACSize is the length of the truncated HMAC-SHA256 of a token
+	MACSize = 16
+	// DefaultPrefix marks the start of a token when no prefix is configured
+	DefaultPrefix = "UXAUTH"
+
+	keyIDSize  = 1
+	expirySize = 8
+)
+
+// Errors returned when a datagram does not carry a valid token
+var (
+	ErrMissingToken = errors.New("datagram does not carry a token")
+	ErrUnknownKey   = errors.New("token signed with an unknown key")
+	ErrInvalidMAC   = errors.New("token has an invalid mac")
+	ErrExpired      = errors.New("token expired")
+	ErrTooLong      = errors.New("token expires too far in the future")
+	ErrReplayed     = errors.New("token was already used")
+)
+
+// TokenSize returns the length of a token with prefix
+func TokenSize(prefix []byte) int {
+	return len(prefix) + keyIDSize + expirySize + NonceSize + MACSize
+}
+
+// Token is the header a client prepends to the first datagram of a session,
+// on the wire it is laid out as
+//
+//	+--------+--------+--------------------+-------+-----+
+//	| prefix | key id | expiry (unix secs) | nonce | mac |
+//	+--------+--------+--------------------+-------+-----+
+//
+// where the mac is the HMAC-SHA256 of everything before it truncated to
+// MACSize bytes, the expiry is big endian
+type Token struct {
+	KeyID  uint8
+	Expiry time.Time
+	Nonce  [NonceSize]byte
+}
+
+// NewToken creates a token with a random nonce
+func NewToken(keyID uint8, expiry time.Time) (Token, error) {
+	t := Token{KeyID: keyID, Expiry: expiry}
+	_, err := rand.Read(t.Nonce[:])
+	return t, err
+}
+
+// Encode writes the signed token into the first TokenSize(prefix) bytes of b
+func (t Token) Encode(b []byte, prefix []byte, secret []byte) {
+	n := copy(b, prefix)
+	b[n] = t.KeyID
+	n += keyIDSize
+	binary.BigEndian.PutUint64(b[n:], uint64(t.Expiry.Unix()))
+	n += expirySize
+	n += copy(b[n:], t.Nonce[:])
+	copy(b[n:], sign(b[:n], secret))
+}
+
+// Seal returns payload with a new token signed with secret prepended, it is
+// what a client sends as the first datagram of a session
+func Seal(prefix []byte, keyID uint8, secret []byte, expiry time.Time, payload []byte) ([]byte, error) {
+	t, err := NewToken(keyID, expiry)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, TokenSize(prefix)+len(payload))
+	t.Encode(b, prefix, secret)
+	copy(b[TokenSize(prefix):], payload)
+	return b, nil
+}
+
+// HasToken reports whether b starts with prefix and is long enough to carry
+// a token
+func HasToken(b []byte, prefix []byte) bool {
+	return len(b) >= TokenSize(prefix) && string(b[:len(prefix)]) == string(prefix)
+}
+
+// decode parses the token at the start of b without checking its mac, it
+// returns the token, the signed bytes, the mac and the payload
+func decode(b []byte, prefix []byte) (Token, []byte, []byte, []byte, error) {
+	if !HasToken(b, prefix) {
+		return Token{}, nil, nil, nil, ErrMissingToken
+	}
+	n := len(prefix)
+	t := Token{KeyID: b[n]}
+	n += keyIDSize
+	t.Expiry = time.Unix(int64(binary.BigEndian.Uint64(b[n:])), 0)
+	n += expirySize
+	n += copy(t.Nonce[:], b[n:])
+	size := TokenSize(prefix)
+	return t, b[:n], b[n:size], b[size:], nil
+}
+
+func sign(b []byte, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(b)
+	return h.Sum(nil)[:MACSize]
+}
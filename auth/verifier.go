@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMaxLifetime bounds how far in the future tokens may expire when
+// no limit is configured
+const DefaultMaxLifetime = 5 * time.Minute
+
+// KeyInfo describes a verification key without its secret
+type KeyInfo struct {
+	ID uint8 `json:"id"`
+	// NotAfter is when the key stops being accepted, zero if it does not
+	// expire
+	NotAfter time.Time `json:"notAfter,omitempty"`
+}
+
+type key struct {
+	secret   []byte
+	notAfter time.Time
+}
+
+// Verifier checks tokens against a set of keys, keys can be added and
+// retired at any time so that secrets can be rotated with an overlap window
+// in which both the old and the new key are accepted. Nonces are remembered
+// until their token expires so that no token is accepted twice. It is safe
+// for concurrent use
+type Verifier struct {
+	prefix      []byte
+	maxLifetime time.Duration
+	mutex       sync.RWMutex
+	keys        map[uint8]key
+	nonces      map[[NonceSize]byte]time.Time
+	lastPurge   time.Time
+}
+
+// NewVerifier creates a verifier for tokens starting with prefix, tokens
+// expiring later than maxLifetime from now are rejected
+func NewVerifier(prefix []byte, maxLifetime time.Duration) *Verifier {
+	if len(prefix) == 0 {
+		prefix = []byte(DefaultPrefix)
+	}
+	if maxLifetime <= 0 {
+		maxLifetime = DefaultMaxLifetime
+	}
+	return &Verifier{
+		prefix:      prefix,
+		maxLifetime: maxLifetime,
+		keys:        make(map[uint8]key),
+		nonces:      make(map[[NonceSize]byte]time.Time),
+	}
+}
+
+// Prefix returns the prefix marking the start of a token
+func (v *Verifier) Prefix() []byte {
+	return v.prefix
+}
+
+// AddKey adds or replaces a key, a zero notAfter never expires
+func (v *Verifier) AddKey(id uint8, secret []byte, notAfter time.Time) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.keys[id] = key{secret: append([]byte(nil), secret...), notAfter: notAfter}
+}
+
+// RetireKey makes a key expire at notAfter, it returns false if the key
+// does not exist
+func (v *Verifier) RetireKey(id uint8, notAfter time.Time) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	k, found := v.keys[id]
+	if !found {
+		return false
+	}
+	k.notAfter = notAfter
+	v.keys[id] = k
+	return true
+}
+
+// Keys lists the keys that are still valid sorted by id
+func (v *Verifier) Keys() []KeyInfo {
+	now := time.Now()
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	keys := []KeyInfo{}
+	for id, k := range v.keys {
+		if k.notAfter.IsZero() || now.Before(k.notAfter) {
+			keys = append(keys, KeyInfo{ID: id, NotAfter: k.notAfter})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// Verify checks the token at the start of a datagram and returns the
+// payload that follows it, the MAC is computed outside the lock so that
+// concurrent readers only serialize on the replay check
+func (v *Verifier) Verify(b []byte, now time.Time) ([]byte, error) {
+	t, signed, mac, payload, err := decode(b, v.prefix)
+	if err != nil {
+		return nil, err
+	}
+	v.mutex.RLock()
+	k, found := v.keys[t.KeyID]
+	v.mutex.RUnlock()
+	if !found || !k.notAfter.IsZero() && !now.Before(k.notAfter) {
+		return nil, ErrUnknownKey
+	}
+	if !hmac.Equal(mac, sign(signed, k.secret)) {
+		return nil, ErrInvalidMAC
+	}
+	if !now.Before(t.Expiry) {
+		return nil, ErrExpired
+	}
+	if t.Expiry.Sub(now) > v.maxLifetime {
+		return nil, ErrTooLong
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.purge(now)
+	if _, used := v.nonces[t.Nonce]; used {
+		return nil, ErrReplayed
+	}
+	v.nonces[t.Nonce] = t.Expiry
+	return payload, nil
+}
+
+// purge forgets the nonces of expired tokens and the keys whose overlap
+// window has passed, at most once a second
+func (v *Verifier) purge(now time.Time) {
+	if now.Sub(v.lastPurge) < time.Second {
+		return
+	}
+	v.lastPurge = now
+	for id, k := range v.keys {
+		if !k.notAfter.IsZero() && !now.Before(k.notAfter) {
+			delete(v.keys, id)
+		}
+	}
+	for nonce, expiry := range v.nonces {
+		if !now.Before(expiry) {
+			delete(v.nonces, nonce)
+		}
+	}
+}
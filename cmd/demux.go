@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2016 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/felipejfc/udpx/mux"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var demuxBindPort int
+var demuxUpstreamAddress string
+var demuxUpstreamPort int
+var demuxSessionTimeout int
+
+var demuxCmd = &cobra.Command{
+	Use:   "demux",
+	Short: "starts a mux upstream demuxer",
+	Long: `Starts a demuxer that accepts traffic from a udpx proxy running with
+the mux upstream mode, strips the udpx mux header and forwards every session
+through its own socket to an unmodified upstream server.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		l, _ := zap.NewProduction()
+
+		ll := l.With(
+			zap.String("bind address", bindAddress),
+			zap.Int("bind port", demuxBindPort),
+			zap.String("upstream address", demuxUpstreamAddress),
+			zap.Int("upstream port", demuxUpstreamPort),
+			zap.Int("sessionTimeout", demuxSessionTimeout),
+		)
+
+		d := mux.NewDemuxer(ll, bindAddress, demuxBindPort, demuxUpstreamAddress, demuxUpstreamPort, bufferSize, time.Duration(demuxSessionTimeout)*time.Millisecond)
+		if err := d.Start(); err != nil {
+			ll.Fatal("failed to start demuxer", zap.Error(err))
+		}
+
+		exitSignal := make(chan os.Signal)
+		<-exitSignal
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(demuxCmd)
+	demuxCmd.Flags().IntVarP(&bufferSize, "bufferSize", "B", 4096, "Datagrams buffer size")
+	demuxCmd.Flags().StringVarP(&bindAddress, "bind", "b", "0.0.0.0", "Host to bind the demuxer")
+	demuxCmd.Flags().IntVarP(&demuxBindPort, "port", "P", 0, "Port to bind the demuxer")
+	demuxCmd.Flags().StringVarP(&demuxUpstreamAddress, "upstreamAddress", "u", "localhost", "The upstream server address")
+	demuxCmd.Flags().IntVarP(&demuxUpstreamPort, "upstreamPort", "U", 0, "The upstream server port")
+	demuxCmd.Flags().IntVarP(&demuxSessionTimeout, "sessionTimeout", "t", 10000, "Milliseconds without traffic before a session socket is freed")
+	demuxCmd.MarkFlagRequired("port")
+	demuxCmd.MarkFlagRequired("upstreamPort")
+}
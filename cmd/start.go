@@ -71,8 +71,8 @@ environment variables to override configuration keys.`,
 
 		for _, proxyConfig := range proxyConfigs {
 			//TODO guardar proxies e verificar conflitos de bind port
-			if pm.RegisterProxy(proxyConfig) != true {
-				cmdL.Warn("proxy already loaded with the same bind port", zap.Int("bindPort", proxyConfig.BindPort))
+			if err := pm.RegisterProxy(proxyConfig); err != nil {
+				cmdL.Warn("proxy not loaded", zap.Int("bindPort", proxyConfig.BindPort), zap.Error(err))
 			}
 		}
 
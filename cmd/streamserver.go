@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2016 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/felipejfc/udpx/stream"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var streamServerBindPort int
+var streamServerTransport string
+var streamServerWebSocketPath string
+var streamServerUpstreamAddress string
+var streamServerUpstreamPort int
+var streamServerSessionTimeout int
+var streamServerMaxSessions int
+
+var streamServerCmd = &cobra.Command{
+	Use:   "streamserver",
+	Short: "starts a tcp or websocket stream server",
+	Long: `Starts a stream server that accepts traffic from a udpx proxy running
+with the tcp or websocket upstream mode and forwards the datagrams of every
+stream through its own socket to an unmodified upstream server.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		l, _ := zap.NewProduction()
+
+		ll := l.With(
+			zap.String("bind address", bindAddress),
+			zap.Int("bind port", streamServerBindPort),
+			zap.String("transport", streamServerTransport),
+			zap.String("upstream address", streamServerUpstreamAddress),
+			zap.Int("upstream port", streamServerUpstreamPort),
+			zap.Int("sessionTimeout", streamServerSessionTimeout),
+			zap.Int("maxSessions", streamServerMaxSessions),
+		)
+
+		s := stream.NewServer(ll, bindAddress, streamServerBindPort, streamServerTransport, streamServerUpstreamAddress, streamServerUpstreamPort, bufferSize, time.Duration(streamServerSessionTimeout)*time.Millisecond)
+		s.WebSocketPath = streamServerWebSocketPath
+		s.MaxSessions = streamServerMaxSessions
+		if err := s.Start(); err != nil {
+			ll.Fatal("failed to start stream server", zap.Error(err))
+		}
+
+		exitSignal := make(chan os.Signal)
+		<-exitSignal
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(streamServerCmd)
+	streamServerCmd.Flags().IntVarP(&bufferSize, "bufferSize", "B", 4096, "Datagrams buffer size")
+	streamServerCmd.Flags().StringVarP(&bindAddress, "bind", "b", "0.0.0.0", "Host to bind the stream server")
+	streamServerCmd.Flags().IntVarP(&streamServerBindPort, "port", "P", 0, "Port to bind the stream server")
+	streamServerCmd.Flags().StringVarP(&streamServerTransport, "transport", "T", stream.TransportTCP, "Stream transport, tcp or websocket")
+	streamServerCmd.Flags().StringVarP(&streamServerWebSocketPath, "websocketPath", "w", "/", "URL path WebSocket streams are accepted on")
+	streamServerCmd.Flags().StringVarP(&streamServerUpstreamAddress, "upstreamAddress", "u", "localhost", "The upstream server address")
+	streamServerCmd.Flags().IntVarP(&streamServerUpstreamPort, "upstreamPort", "U", 0, "The upstream server port")
+	streamServerCmd.Flags().IntVarP(&streamServerSessionTimeout, "sessionTimeout", "t", 10000, "Milliseconds without traffic before a stream is closed")
+	streamServerCmd.Flags().IntVarP(&streamServerMaxSessions, "maxSessions", "m", stream.DefaultMaxSessions, "Streams served at once, further streams are closed")
+	streamServerCmd.MarkFlagRequired("port")
+	streamServerCmd.MarkFlagRequired("upstreamPort")
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package expiry schedules the expiry of sessions on a hierarchical timing
+// wheel, so that many sessions can time out without a timer or a sweep of
+// every session each.
+package expiry
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	wheelLevels    = 4
+	wheelSlotsBits = 6
+	wheelSlots     = 1 << wheelSlotsBits
+	wheelSlotsMask = wheelSlots - 1
+	// wheelMaxTicks is the furthest a timer can be scheduled, later deadlines
+	// are clamped and rescheduled when they fire
+	wheelMaxTicks = 1<<(wheelLevels*wheelSlotsBits) - 1
+
+	minTick = 5 * time.Millisecond
+	maxTick = 250 * time.Millisecond
+)
+
+// Wheel is a hierarchical timing wheel, scheduling and firing a timer costs
+// O(1) amortised and timers fire at most one tick late. Level 0 slots are
+// one tick wide, every following level has slots wheelSlots times wider
+// whose timers are cascaded down when the lower levels wrap around.
+//
+// Timers are not cancelled, whoever is fired checks whether its session is
+// still alive and schedules it again when it saw activity meanwhile.
+type Wheel struct {
+	tick    time.Duration
+	start   time.Time
+	fire    func(interface{})
+	mutex   sync.Mutex
+	current uint64
+	slots   [wheelLevels][wheelSlots][]timer
+}
+
+type timer struct {
+	at      uint64
+	session interface{}
+}
+
+// NewWheel creates a wheel that passes due sessions to fire
+func NewWheel(tick time.Duration, fire func(interface{})) *Wheel {
+	return &Wheel{
+		tick:  tick,
+		start: time.Now(),
+		fire:  fire,
+	}
+}
+
+// Tick is the resolution of the wheel, Advance should be called that often
+func (w *Wheel) Tick() time.Duration {
+	return w.tick
+}
+
+// Schedule fires session at deadline, or in the next tick if it is already
+// due
+func (w *Wheel) Schedule(session interface{}, deadline time.Time) {
+	at := uint64(0)
+	if d := deadline.Sub(w.start); d > 0 {
+		// round up so that timers never fire before their deadline
+		at = uint64((d + w.tick - 1) / w.tick)
+	}
+	w.mutex.Lock()
+	if at <= w.current {
+		at = w.current + 1
+	}
+	w.add(timer{at: at, session: session})
+	w.mutex.Unlock()
+}
+
+// add places a timer in its slot, timers due at the current tick land in the
+// level 0 slot that is about to be fired
+func (w *Wheel) add(t timer) {
+	if t.at < w.current {
+		t.at = w.current
+	}
+	if t.at-w.current > wheelMaxTicks {
+		t.at = w.current + wheelMaxTicks
+	}
+	delta := t.at - w.current
+	level := 0
+	for delta >= 1<<(uint(level+1)*wheelSlotsBits) {
+		level++
+	}
+	slot := (t.at >> (uint(level) * wheelSlotsBits)) & wheelSlotsMask
+	w.slots[level][slot] = append(w.slots[level][slot], t)
+}
+
+// Advance processes every tick up to now and fires the due timers
+func (w *Wheel) Advance(now time.Time) {
+	target := uint64(now.Sub(w.start) / w.tick)
+	var due []timer
+	w.mutex.Lock()
+	for w.current < target {
+		w.current++
+		w.cascade()
+		slot := w.current & wheelSlotsMask
+		due = append(due, w.slots[0][slot]...)
+		w.slots[0][slot] = nil
+	}
+	w.mutex.Unlock()
+	for _, t := range due {
+		w.fire(t.session)
+	}
+}
+
+// Run advances the wheel every tick until done is closed
+func (w *Wheel) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			w.Advance(now)
+		}
+	}
+}
+
+// cascade moves the timers of the higher level slots that start at the
+// current tick down to the lower levels
+func (w *Wheel) cascade() {
+	for level := 1; level < wheelLevels; level++ {
+		if w.current&(1<<(uint(level)*wheelSlotsBits)-1) != 0 {
+			return
+		}
+		slot := (w.current >> (uint(level) * wheelSlotsBits)) & wheelSlotsMask
+		timers := w.slots[level][slot]
+		w.slots[level][slot] = nil
+		for _, t := range timers {
+			w.add(t)
+		}
+	}
+}
+
+// TickFor returns the wheel resolution used for a session timeout
+func TickFor(timeout time.Duration) time.Duration {
+	tick := timeout / wheelSlots
+	if tick < minTick {
+		return minTick
+	}
+	if tick > maxTick {
+		return maxTick
+	}
+	return tick
+}
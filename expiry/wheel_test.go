@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2016 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package expiry_test
+
+import (
+	"time"
+
+	. "github.com/felipejfc/udpx/expiry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Wheel", func() {
+	const tick = 10 * time.Millisecond
+
+	var (
+		start time.Time
+		fired []interface{}
+		wheel *Wheel
+	)
+
+	BeforeEach(func() {
+		fired = nil
+		start = time.Now()
+		wheel = NewWheel(tick, func(session interface{}) { fired = append(fired, session) })
+	})
+
+	It("should fire sessions once their deadline passed", func() {
+		wheel.Schedule(1, start.Add(2*tick))
+		wheel.Schedule(2, start.Add(time.Hour))
+
+		wheel.Advance(start.Add(tick))
+		Expect(fired).To(BeEmpty())
+		wheel.Advance(start.Add(4 * tick))
+		Expect(fired).To(Equal([]interface{}{1}))
+		wheel.Advance(start.Add(time.Hour + 2*tick))
+		Expect(fired).To(Equal([]interface{}{1, 2}))
+	})
+
+	It("should fire sessions that are already due in the next tick", func() {
+		wheel.Schedule(1, start.Add(-time.Minute))
+		wheel.Advance(start.Add(2 * tick))
+		Expect(fired).To(Equal([]interface{}{1}))
+	})
+
+	It("should cascade sessions down every level without firing them early", func() {
+		// one deadline per level, in ticks
+		deadlines := []int{5, 64*3 + 7, 64*64*2 + 64*5 + 9, 64*64*64 + 11}
+		for i, ticks := range deadlines {
+			wheel.Schedule(i, start.Add(time.Duration(ticks)*tick))
+		}
+		for i, ticks := range deadlines {
+			wheel.Advance(start.Add(time.Duration(ticks)*tick - tick/2))
+			Expect(fired).To(HaveLen(i))
+			wheel.Advance(start.Add(time.Duration(ticks)*tick + tick/2))
+			Expect(fired).To(HaveLen(i + 1))
+			Expect(fired[i]).To(Equal(i))
+		}
+		Expect(fired).To(HaveLen(4))
+	})
+
+	It("should let fire reschedule sessions while the wheel advances", func() {
+		rescheduled := false
+		wheel = NewWheel(tick, func(id interface{}) {
+			fired = append(fired, id)
+			if !rescheduled {
+				rescheduled = true
+				wheel.Schedule(id, start.Add(70*tick))
+			}
+		})
+		wheel.Schedule(1, start.Add(2*tick))
+
+		wheel.Advance(start.Add(3 * tick))
+		Expect(fired).To(Equal([]interface{}{1}))
+		wheel.Advance(start.Add(69 * tick))
+		Expect(fired).To(Equal([]interface{}{1}))
+		wheel.Advance(start.Add(70*tick + tick/2))
+		Expect(fired).To(Equal([]interface{}{1, 1}))
+	})
+
+	It("should skip sessions closed while their tick fires", func() {
+		closed := map[interface{}]bool{}
+		wheel = NewWheel(tick, func(id interface{}) {
+			if closed[id] {
+				return
+			}
+			fired = append(fired, id)
+			// the first session closes the second one of the same tick
+			closed[2] = true
+		})
+		for id := 1; id <= 3; id++ {
+			wheel.Schedule(id, start.Add(2*tick))
+		}
+
+		wheel.Advance(start.Add(3 * tick))
+		Expect(fired).To(Equal([]interface{}{1, 3}))
+		wheel.Advance(start.Add(time.Hour))
+		Expect(fired).To(Equal([]interface{}{1, 3}))
+	})
+
+	It("should pick a tick for a timeout", func() {
+		Expect(TickFor(time.Millisecond)).To(Equal(5 * time.Millisecond))
+		Expect(TickFor(6400 * time.Millisecond)).To(Equal(100 * time.Millisecond))
+		Expect(TickFor(time.Hour)).To(Equal(250 * time.Millisecond))
+	})
+})
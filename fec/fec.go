@@ -0,0 +1,362 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package fec adds Reed-Solomon forward error correction to a flow of
+// datagrams. The encoder groups datagrams into blocks and follows each block
+// with parity datagrams, from which the decoder rebuilds as many lost
+// datagrams of the block as parity datagrams it received.
+//
+// Every datagram starts with a 6 byte header:
+//
+//	+------------------+------------+------------+
+//	| block (4B, BE)   | index (1B) | count (1B) |
+//	+------------------+------------+------------+
+//
+// Data datagrams have an index below 128 and carry the original datagram as
+// is. Parity datagrams have 128 plus their number as index and the number of
+// data datagrams of their block as count, they carry the parity of the data
+// datagrams of the block, each prefixed with its 2 byte big endian length and
+// padded with zeros to the longest of them.
+package fec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// HeaderSize is the size of the header of every datagram
+	HeaderSize = 6
+	// Overhead is the most a datagram grows, parity datagrams are the
+	// longest datagram of their block plus its length prefix
+	Overhead = HeaderSize + 2
+	// MaxShards is the maximum number of data datagrams, and of parity
+	// datagrams, of a block
+	MaxShards = 128
+	// DefaultWindow is how many blocks a decoder remembers by default
+	DefaultWindow = 16
+)
+
+// ErrInvalidDatagram is returned for datagrams that are too short or whose
+// header does not match the rest of their block
+var ErrInvalidDatagram = errors.New("invalid fec datagram")
+
+func putHeader(b []byte, block uint32, index, count int) {
+	binary.BigEndian.PutUint32(b, block)
+	b[4] = byte(index)
+	b[5] = byte(count)
+}
+
+// Encoder adds parity datagrams to a flow of datagrams, it is not safe for
+// concurrent use
+type Encoder struct {
+	dataShards   int
+	parityShards int
+	block        uint32
+	shards       [][]byte
+	maxLen       int
+	out          []byte
+	padded       []byte
+}
+
+// NewEncoder creates an encoder for blocks of dataShards datagrams followed
+// by parityShards parity datagrams
+func NewEncoder(dataShards, parityShards int) (*Encoder, error) {
+	if dataShards < 1 || dataShards > MaxShards || parityShards < 1 || parityShards > MaxShards {
+		return nil, fmt.Errorf("fec blocks need 1 to %d data and parity datagrams", MaxShards)
+	}
+	return &Encoder{dataShards: dataShards, parityShards: parityShards}, nil
+}
+
+// Add encodes a datagram, emit is called with the data datagram and, when it
+// completes a block, with the parity datagrams of the block. emit must not
+// keep the slices it is given
+func (e *Encoder) Add(datagram []byte, emit func([]byte)) {
+	e.out = append(e.out[:0], make([]byte, HeaderSize)...)
+	putHeader(e.out, e.block, len(e.shards), 0)
+	e.out = append(e.out, datagram...)
+	emit(e.out)
+	e.shards = append(e.shards, append([]byte(nil), datagram...))
+	if len(datagram) > e.maxLen {
+		e.maxLen = len(datagram)
+	}
+	if len(e.shards) == e.dataShards {
+		e.Flush(emit)
+	}
+}
+
+// Pending returns how many datagrams the current block holds
+func (e *Encoder) Pending() int {
+	return len(e.shards)
+}
+
+// Flush ends the current block, even if it is not full yet, emitting its
+// parity datagrams
+func (e *Encoder) Flush(emit func([]byte)) {
+	if len(e.shards) == 0 {
+		return
+	}
+	shardLen := e.maxLen + 2
+	parity := make([][]byte, e.parityShards)
+	for j := range parity {
+		parity[j] = make([]byte, HeaderSize+shardLen)
+		putHeader(parity[j], e.block, MaxShards+j, len(e.shards))
+	}
+	if cap(e.padded) < shardLen {
+		e.padded = make([]byte, shardLen)
+	}
+	padded := e.padded[:shardLen]
+	for i, shard := range e.shards {
+		pad(padded, shard)
+		for j := range parity {
+			mulAdd(parity[j][HeaderSize:], padded, coefficient(j, i))
+		}
+	}
+	for _, p := range parity {
+		emit(p)
+	}
+	e.shards = e.shards[:0]
+	e.maxLen = 0
+	e.block++
+}
+
+// pad writes the length prefixed datagram to shard and zeroes the rest
+func pad(shard, datagram []byte) {
+	binary.BigEndian.PutUint16(shard, uint16(len(datagram)))
+	n := 2 + copy(shard[2:], datagram)
+	for i := n; i < len(shard); i++ {
+		shard[i] = 0
+	}
+}
+
+// block is what a decoder knows of a block, data and parity are released
+// once every data datagram was delivered
+type block struct {
+	count    int
+	shardLen int
+	maxIndex int
+	have     [2]uint64
+	received int
+	data     map[int][]byte
+	parity   map[int][]byte
+}
+
+func (b *block) has(index int) bool {
+	return b.have[index/64]&(1<<uint(index%64)) != 0
+}
+
+func (b *block) mark(index int) {
+	b.have[index/64] |= 1 << uint(index%64)
+	b.received++
+}
+
+func (b *block) complete() bool {
+	return b.count > 0 && b.received == b.count
+}
+
+// missing is how many data datagrams of the block were not delivered, it is
+// a lower bound when no parity datagram told the size of the block
+func (b *block) missing() int {
+	if b.count > 0 {
+		return b.count - b.received
+	}
+	return b.maxIndex + 1 - b.received
+}
+
+// Result tells what decoding a datagram did besides delivering it
+type Result struct {
+	// Recovered is how many lost datagrams were rebuilt
+	Recovered int
+	// Lost is how many datagrams of the blocks that were forgotten were
+	// neither received nor rebuilt
+	Lost int
+	// Duplicate is set for datagrams that were already received
+	Duplicate bool
+	// Late is set for datagrams of blocks that were already forgotten
+	Late bool
+}
+
+// Decoder rebuilds lost datagrams and drops duplicates, it is not safe for
+// concurrent use
+type Decoder struct {
+	window  int
+	highest uint32
+	started bool
+	blocks  map[uint32]*block
+}
+
+// NewDecoder creates a decoder that remembers the last window blocks, a
+// window of 0 means DefaultWindow
+func NewDecoder(window int) *Decoder {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Decoder{window: window, blocks: make(map[uint32]*block)}
+}
+
+// Decode processes a datagram, deliver is called with the datagram it
+// carried, if any, and with every datagram it allowed to rebuild. deliver
+// must not keep the slices it is given
+func (d *Decoder) Decode(datagram []byte, deliver func([]byte)) (Result, error) {
+	var result Result
+	if len(datagram) < HeaderSize {
+		return result, ErrInvalidDatagram
+	}
+	id := binary.BigEndian.Uint32(datagram)
+	index, count := int(datagram[4]), int(datagram[5])
+	payload := datagram[HeaderSize:]
+	if index >= MaxShards && (count == 0 || count > MaxShards || len(payload) < 2) {
+		return result, ErrInvalidDatagram
+	}
+	if d.started && int32(id-d.highest) <= -int32(d.window) {
+		result.Late = true
+		return result, nil
+	}
+	if !d.started || int32(id-d.highest) > 0 {
+		d.started = true
+		d.highest = id
+		result.Lost = d.forget()
+	}
+	b, found := d.blocks[id]
+	if !found {
+		b = &block{data: make(map[int][]byte), parity: make(map[int][]byte)}
+		d.blocks[id] = b
+	}
+	if index < MaxShards {
+		if b.count > 0 && index >= b.count {
+			return result, ErrInvalidDatagram
+		}
+		if b.has(index) {
+			result.Duplicate = true
+			return result, nil
+		}
+		b.mark(index)
+		if index > b.maxIndex {
+			b.maxIndex = index
+		}
+		deliver(payload)
+		if b.data != nil {
+			b.data[index] = append([]byte(nil), payload...)
+		}
+	} else {
+		if b.count == 0 {
+			if b.maxIndex >= count {
+				return result, ErrInvalidDatagram
+			}
+			b.count, b.shardLen = count, len(payload)
+		} else if count != b.count || len(payload) != b.shardLen {
+			return result, ErrInvalidDatagram
+		}
+		if b.complete() {
+			// every data datagram arrived, the parity is not needed
+			return result, nil
+		}
+		if _, found := b.parity[index-MaxShards]; found {
+			result.Duplicate = true
+			return result, nil
+		}
+		if b.parity != nil {
+			b.parity[index-MaxShards] = append([]byte(nil), payload...)
+		}
+	}
+	result.Recovered = b.recover(deliver)
+	if b.complete() {
+		b.data, b.parity = nil, nil
+	}
+	return result, nil
+}
+
+// forget drops the blocks that fell out of the window and returns how many
+// of their datagrams were lost
+func (d *Decoder) forget() int {
+	lost := 0
+	for id, b := range d.blocks {
+		if int32(id-d.highest) <= -int32(d.window) {
+			lost += b.missing()
+			delete(d.blocks, id)
+		}
+	}
+	return lost
+}
+
+// recover rebuilds the missing data datagrams of the block once it received
+// as many datagrams as it has data datagrams
+func (b *block) recover(deliver func([]byte)) int {
+	if b.count == 0 || b.complete() || b.received+len(b.parity) < b.count {
+		return 0
+	}
+	var missing, rows []int
+	for i := 0; i < b.count; i++ {
+		if !b.has(i) {
+			missing = append(missing, i)
+		}
+	}
+	for j := range b.parity {
+		if len(rows) == len(missing) {
+			break
+		}
+		rows = append(rows, j)
+	}
+	// remove the contribution of the received datagrams from the parity,
+	// what is left is a linear combination of the missing ones
+	padded := make([]byte, b.shardLen)
+	syndromes := make([][]byte, len(rows))
+	for r, j := range rows {
+		syndromes[r] = append([]byte(nil), b.parity[j]...)
+	}
+	for i, datagram := range b.data {
+		if len(datagram)+2 > b.shardLen {
+			return 0
+		}
+		pad(padded, datagram)
+		for r, j := range rows {
+			mulAdd(syndromes[r], padded, coefficient(j, i))
+		}
+	}
+	matrix := make([][]byte, len(rows))
+	for r, j := range rows {
+		matrix[r] = make([]byte, len(missing))
+		for c, i := range missing {
+			matrix[r][c] = coefficient(j, i)
+		}
+	}
+	if !invert(matrix) {
+		return 0
+	}
+	recovered := 0
+	for c, i := range missing {
+		shard := make([]byte, b.shardLen)
+		for r := range rows {
+			mulAdd(shard, syndromes[r], matrix[c][r])
+		}
+		length := int(binary.BigEndian.Uint16(shard))
+		if length+2 > b.shardLen {
+			continue
+		}
+		b.mark(i)
+		b.data[i] = shard[2 : 2+length]
+		deliver(shard[2 : 2+length])
+		recovered++
+	}
+	return recovered
+}
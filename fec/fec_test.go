@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package fec_test
+
+import (
+	"fmt"
+	"math/rand"
+
+	. "github.com/felipejfc/udpx/fec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FEC", func() {
+	var (
+		encoder   *Encoder
+		decoder   *Decoder
+		sent      [][]byte
+		delivered []string
+	)
+
+	emit := func(b []byte) { sent = append(sent, append([]byte(nil), b...)) }
+	deliver := func(b []byte) { delivered = append(delivered, string(b)) }
+
+	BeforeEach(func() {
+		var err error
+		encoder, err = NewEncoder(4, 2)
+		Expect(err).NotTo(HaveOccurred())
+		decoder = NewDecoder(0)
+		sent, delivered = nil, nil
+	})
+
+	It("should add parity datagrams after each block", func() {
+		for i := 0; i < 4; i++ {
+			encoder.Add([]byte(fmt.Sprintf("datagram %d", i)), emit)
+		}
+		Expect(sent).To(HaveLen(6))
+		Expect(sent[0]).To(HaveLen(HeaderSize + 10))
+		Expect(sent[4]).To(HaveLen(HeaderSize + 12))
+		Expect(encoder.Pending()).To(Equal(0))
+	})
+
+	It("should rebuild as many lost datagrams as parity datagrams received", func() {
+		datagrams := []string{"a", "bb", "", "dddd"}
+		for _, d := range datagrams {
+			encoder.Add([]byte(d), emit)
+		}
+		recovered := 0
+		// lose two of the data datagrams
+		for _, i := range []int{0, 3, 4, 5} {
+			r, err := decoder.Decode(sent[i], deliver)
+			Expect(err).NotTo(HaveOccurred())
+			recovered += r.Recovered
+		}
+		Expect(recovered).To(Equal(2))
+		Expect(delivered).To(ConsistOf(datagrams))
+	})
+
+	It("should rebuild any combination of lost datagrams", func() {
+		encoder, _ = NewEncoder(10, 4)
+		rnd := rand.New(rand.NewSource(1))
+		var datagrams []string
+		for i := 0; i < 10; i++ {
+			d := make([]byte, rnd.Intn(200))
+			rnd.Read(d)
+			datagrams = append(datagrams, string(d))
+			encoder.Add(d, emit)
+		}
+		for _, i := range rnd.Perm(len(sent))[:10] {
+			_, err := decoder.Decode(sent[i], deliver)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(delivered).To(ConsistOf(datagrams))
+	})
+
+	It("should rebuild datagrams of blocks flushed early", func() {
+		encoder.Add([]byte("first"), emit)
+		encoder.Add([]byte("second"), emit)
+		encoder.Flush(emit)
+		encoder.Add([]byte("next block"), emit)
+		Expect(sent).To(HaveLen(5))
+
+		for _, i := range []int{1, 2, 4} {
+			_, err := decoder.Decode(sent[i], deliver)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(delivered).To(ConsistOf("second", "first", "next block"))
+	})
+
+	It("should drop duplicates and count lost and late datagrams", func() {
+		for i := 0; i < 4; i++ {
+			encoder.Add([]byte{byte(i)}, emit)
+		}
+		r, _ := decoder.Decode(sent[0], deliver)
+		Expect(r.Duplicate).To(BeFalse())
+		r, _ = decoder.Decode(sent[0], deliver)
+		Expect(r.Duplicate).To(BeTrue())
+		Expect(delivered).To(HaveLen(1))
+
+		window := NewDecoder(2)
+		window.Decode(sent[0], deliver)
+		window.Decode(sent[4], deliver)
+		for i := 0; i < 8; i++ {
+			encoder.Add([]byte{byte(i)}, emit)
+		}
+		// the last block pushes the first one out of the window
+		r, _ = window.Decode(sent[len(sent)-1], deliver)
+		Expect(r.Lost).To(Equal(3))
+		r, _ = window.Decode(sent[1], deliver)
+		Expect(r.Late).To(BeTrue())
+	})
+
+	It("should reject malformed datagrams", func() {
+		_, err := decoder.Decode([]byte{0, 0, 0}, deliver)
+		Expect(err).To(Equal(ErrInvalidDatagram))
+		_, err = decoder.Decode([]byte{0, 0, 0, 0, MaxShards, 0, 0, 0}, deliver)
+		Expect(err).To(Equal(ErrInvalidDatagram))
+	})
+})
@@ -7,6 +7,10 @@ require (
 	github.com/labstack/gommon v0.3.0 // indirect
 	github.com/onsi/ginkgo v1.11.0
 	github.com/onsi/gomega v1.8.1
+	github.com/pion/dtls/v2 v2.1.5
+	github.com/pion/transport v0.13.0
 	github.com/spf13/cobra v0.0.5
 	go.uber.org/zap v1.13.0
+	golang.org/x/crypto v0.0.0-20220427172511-eb4f295cb31f
+	golang.org/x/net v0.0.0-20220425223048-2871e0cb64e4
 )
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package mux
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type sessionKey struct {
+	peer      string
+	sessionID uint32
+}
+
+type session struct {
+	key          sessionKey
+	peer         *net.UDPAddr
+	udp          *net.UDPConn
+	mutex        sync.Mutex
+	lastActivity time.Time
+	closeOnce    sync.Once
+}
+
+func (s *session) touch() {
+	s.mutex.Lock()
+	s.lastActivity = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *session) idleSince(t time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastActivity.Before(t)
+}
+
+// Demuxer receives datagrams carrying the mux header from udpx, strips the
+// header and forwards each session through its own socket to the upstream,
+// so the upstream server sees one source port per client
+type Demuxer struct {
+	Logger          *zap.Logger
+	BindAddress     string
+	BindPort        int
+	UpstreamAddress string
+	UpstreamPort    int
+	BufferSize      int
+	SessionTimeout  time.Duration
+	listenerConn    *net.UDPConn
+	upstream        *net.UDPAddr
+	sessions        sync.Map
+	done            chan struct{}
+	closeOnce       sync.Once
+}
+
+// NewDemuxer creates a demuxer, call Start to begin serving
+func NewDemuxer(logger *zap.Logger, bindAddress string, bindPort int, upstreamAddress string, upstreamPort int, bufferSize int, sessionTimeout time.Duration) *Demuxer {
+	return &Demuxer{
+		Logger:          logger,
+		BindAddress:     bindAddress,
+		BindPort:        bindPort,
+		UpstreamAddress: upstreamAddress,
+		UpstreamPort:    upstreamPort,
+		BufferSize:      bufferSize,
+		SessionTimeout:  sessionTimeout,
+		done:            make(chan struct{}),
+	}
+}
+
+// Start binds the demuxer port and starts forwarding
+func (d *Demuxer) Start() error {
+	bindAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", d.BindAddress, d.BindPort))
+	if err != nil {
+		return err
+	}
+	d.upstream, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", d.UpstreamAddress, d.UpstreamPort))
+	if err != nil {
+		return err
+	}
+	d.listenerConn, err = net.ListenUDP("udp", bindAddr)
+	if err != nil {
+		return err
+	}
+	d.Logger.Info("demuxer started!")
+	if d.SessionTimeout > 0 {
+		go d.freeIdleSessionsLoop()
+	}
+	go d.readLoop()
+	return nil
+}
+
+// Close stops the demuxer and closes every session socket
+func (d *Demuxer) Close() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		if d.listenerConn != nil {
+			d.listenerConn.Close()
+		}
+		d.sessions.Range(func(k, s interface{}) bool {
+			d.closeSession(s.(*session), false)
+			return true
+		})
+	})
+}
+
+func (d *Demuxer) readLoop() {
+	buf := make([]byte, d.BufferSize+HeaderSize)
+	for {
+		size, peer, err := d.listenerConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+			d.Logger.Error("demuxer read error", zap.Error(err))
+			continue
+		}
+		header, payload, err := Decode(buf[:size])
+		if err != nil {
+			d.Logger.Debug("dropping invalid datagram", zap.String("peer", peer.String()), zap.Error(err))
+			continue
+		}
+		key := sessionKey{peer: peer.String(), sessionID: header.SessionID}
+		if header.Flags&FlagClose != 0 {
+			if s, found := d.sessions.Load(key); found {
+				d.closeSession(s.(*session), false)
+			}
+			continue
+		}
+		s, err := d.getSession(key, peer)
+		if err != nil {
+			d.Logger.Error("demuxer failed to open session socket, dropping packet", zap.Error(err))
+			continue
+		}
+		s.touch()
+		if _, err := s.udp.Write(payload); err != nil {
+			d.Logger.Debug("failed to write to upstream", zap.Error(err))
+		}
+	}
+}
+
+func (d *Demuxer) getSession(key sessionKey, peer *net.UDPAddr) (*session, error) {
+	if s, found := d.sessions.Load(key); found {
+		return s.(*session), nil
+	}
+	conn, err := net.DialUDP("udp", nil, d.upstream)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{key: key, peer: peer, udp: conn, lastActivity: time.Now()}
+	d.sessions.Store(key, s)
+	d.Logger.Debug("new demuxed session", zap.String("peer", key.peer), zap.Uint32("session", key.sessionID), zap.String("local address", conn.LocalAddr().String()))
+	go d.sessionReadLoop(s)
+	return s, nil
+}
+
+func (d *Demuxer) sessionReadLoop(s *session) {
+	buf := make([]byte, d.BufferSize+HeaderSize)
+	header := Header{SessionID: s.key.sessionID}
+	for {
+		size, err := s.udp.Read(buf[HeaderSize:])
+		if err != nil {
+			d.closeSession(s, false)
+			return
+		}
+		s.touch()
+		header.Encode(buf)
+		d.listenerConn.WriteToUDP(buf[:HeaderSize+size], s.peer)
+	}
+}
+
+// closeSession releases the session socket, notifying the peer if asked to
+func (d *Demuxer) closeSession(s *session, notifyPeer bool) {
+	s.closeOnce.Do(func() {
+		s.udp.Close()
+		d.sessions.Delete(s.key)
+		if notifyPeer {
+			buf := make([]byte, HeaderSize)
+			Header{Flags: FlagClose, SessionID: s.key.sessionID}.Encode(buf)
+			d.listenerConn.WriteToUDP(buf, s.peer)
+		}
+	})
+}
+
+func (d *Demuxer) freeIdleSessionsLoop() {
+	ticker := time.NewTicker(d.SessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+		deadline := time.Now().Add(-d.SessionTimeout)
+		d.sessions.Range(func(k, s interface{}) bool {
+			if s.(*session).idleSince(deadline) {
+				d.Logger.Debug("session timeout", zap.String("peer", k.(sessionKey).peer), zap.Uint32("session", k.(sessionKey).sessionID))
+				d.closeSession(s.(*session), true)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package mux implements the udpx mux header used to carry many client
+// sessions over a single UDP socket, and a Demuxer that restores one socket
+// per session in front of an unmodified server.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// HeaderSize is the length of the mux header prepended to every datagram
+const HeaderSize = 8
+
+// Version is the current mux header version
+const Version = 1
+
+const (
+	magic0 = 'U'
+	magic1 = 'X'
+)
+
+// FlagClose tells the other side that the session was closed, datagrams
+// carrying it have no payload
+const FlagClose uint8 = 1 << 0
+
+// ErrShortDatagram is returned when a datagram is smaller than the header
+var ErrShortDatagram = errors.New("datagram shorter than mux header")
+
+// ErrInvalidHeader is returned when a datagram does not start with a valid
+// mux header
+var ErrInvalidHeader = errors.New("invalid mux header")
+
+// Header is the udpx mux header, on the wire it is laid out as
+//
+//	0       1       2         3       4                        8
+//	+-------+-------+---------+-------+------------------------+
+//	|  'U'  |  'X'  | version | flags | session id (big endian)|
+//	+-------+-------+---------+-------+------------------------+
+type Header struct {
+	Flags     uint8
+	SessionID uint32
+}
+
+// Encode writes h into the first HeaderSize bytes of b
+func (h Header) Encode(b []byte) {
+	b[0] = magic0
+	b[1] = magic1
+	b[2] = Version
+	b[3] = h.Flags
+	binary.BigEndian.PutUint32(b[4:HeaderSize], h.SessionID)
+}
+
+// Decode parses the mux header of a datagram and returns it with the payload
+func Decode(b []byte) (Header, []byte, error) {
+	if len(b) < HeaderSize {
+		return Header{}, nil, ErrShortDatagram
+	}
+	if b[0] != magic0 || b[1] != magic1 || b[2] != Version {
+		return Header{}, nil, ErrInvalidHeader
+	}
+	h := Header{
+		Flags:     b[3],
+		SessionID: binary.BigEndian.Uint32(b[4:HeaderSize]),
+	}
+	return h, b[HeaderSize:], nil
+}
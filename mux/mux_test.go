@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package mux_test
+
+import (
+	"net"
+	"time"
+
+	. "github.com/felipejfc/udpx/mux"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mux", func() {
+
+	Describe("Header", func() {
+		It("should encode and decode", func() {
+			buf := make([]byte, HeaderSize+5)
+			Header{Flags: FlagClose, SessionID: 0xdeadbeef}.Encode(buf)
+			copy(buf[HeaderSize:], "hello")
+
+			h, payload, err := Decode(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h.Flags).To(Equal(FlagClose))
+			Expect(h.SessionID).To(Equal(uint32(0xdeadbeef)))
+			Expect(string(payload)).To(Equal("hello"))
+		})
+
+		It("should reject invalid datagrams", func() {
+			_, _, err := Decode([]byte("UX"))
+			Expect(err).To(Equal(ErrShortDatagram))
+			_, _, err = Decode([]byte("not a mux datagram"))
+			Expect(err).To(Equal(ErrInvalidHeader))
+		})
+	})
+
+	Describe("Demuxer", func() {
+		var (
+			demuxer  *Demuxer
+			upstream *net.UDPConn
+			peer     *net.UDPConn
+		)
+
+		BeforeEach(func() {
+			var err error
+			upstream, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 34667})
+			Expect(err).NotTo(HaveOccurred())
+			logger, _ := zap.NewProduction()
+			demuxer = NewDemuxer(logger, "127.0.0.1", 34668, "127.0.0.1", 34667, 4096, time.Second)
+			Expect(demuxer.Start()).To(Succeed())
+			peer, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 34668})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			peer.Close()
+			demuxer.Close()
+			upstream.Close()
+		})
+
+		send := func(sessionID uint32, payload string) {
+			buf := make([]byte, HeaderSize+len(payload))
+			Header{SessionID: sessionID}.Encode(buf)
+			copy(buf[HeaderSize:], payload)
+			_, err := peer.Write(buf)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		receiveUpstream := func() (string, *net.UDPAddr) {
+			buf := make([]byte, 4096)
+			upstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, src, err := upstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			return string(buf[:n]), src
+		}
+
+		It("should give every session its own socket", func() {
+			send(1, "first")
+			payload, src1 := receiveUpstream()
+			Expect(payload).To(Equal("first"))
+
+			send(2, "second")
+			payload, src2 := receiveUpstream()
+			Expect(payload).To(Equal("second"))
+			Expect(src2.Port).NotTo(Equal(src1.Port))
+
+			_, err := upstream.WriteToUDP([]byte("reply"), src2)
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 4096)
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := peer.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			h, reply, err := Decode(buf[:n])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h.SessionID).To(Equal(uint32(2)))
+			Expect(string(reply)).To(Equal("reply"))
+		})
+	})
+})
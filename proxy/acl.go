@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ACL rule actions
+const (
+	ACLActionAllow = "allow"
+	ACLActionDeny  = "deny"
+)
+
+var errACLRuleNotFound = errors.New("acl rule not found")
+
+// ACLRule allows or denies the source addresses of a CIDR, a plain address
+// is taken as a single host
+type ACLRule struct {
+	Action string `json:"action"`
+	CIDR   string `json:"cidr"`
+}
+
+func (r ACLRule) network() (*net.IPNet, error) {
+	cidr := r.CIDR
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid acl cidr %q", r.CIDR)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid acl cidr %q", r.CIDR)
+	}
+	return network, nil
+}
+
+// Validate checks the action and CIDR of the rule
+func (r ACLRule) Validate() error {
+	if r.Action != ACLActionAllow && r.Action != ACLActionDeny {
+		return fmt.Errorf("invalid acl action %q", r.Action)
+	}
+	_, err := r.network()
+	return err
+}
+
+// ValidateACL checks every rule of an ACL
+func ValidateACL(rules []ACLRule) error {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type aclEntry struct {
+	rule    ACLRule
+	network *net.IPNet
+}
+
+// ACL is an ordered list of rules, the first rule matching an address
+// decides whether it is allowed, addresses matching no rule are allowed.
+// It is safe for concurrent use
+type ACL struct {
+	mutex   sync.RWMutex
+	entries []aclEntry
+}
+
+// NewACL creates an ACL with rules
+func NewACL(rules []ACLRule) (*ACL, error) {
+	a := &ACL{}
+	for _, rule := range rules {
+		if err := a.Add(rule); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Add appends a rule to the ACL
+func (a *ACL) Add(rule ACLRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	network, _ := rule.network()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.entries = append(a.entries, aclEntry{rule: rule, network: network})
+	return nil
+}
+
+// Remove deletes every rule with the same action and CIDR as rule
+func (a *ACL) Remove(rule ACLRule) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	entries := a.entries[:0:0]
+	for _, e := range a.entries {
+		if e.rule != rule {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == len(a.entries) {
+		return errACLRuleNotFound
+	}
+	a.entries = entries
+	return nil
+}
+
+// Rules returns a copy of the rules in evaluation order
+func (a *ACL) Rules() []ACLRule {
+	rules := []ACLRule{}
+	if a == nil {
+		return rules
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, e := range a.entries {
+		rules = append(rules, e.rule)
+	}
+	return rules
+}
+
+// Allows reports whether ip is allowed by the ACL
+func (a *ACL) Allows(ip net.IP) bool {
+	allowed, _ := a.match(ip)
+	return allowed
+}
+
+// match returns the action of the first rule matching ip, and false when no
+// rule matches and ip is allowed by default
+func (a *ACL) match(ip net.IP) (bool, bool) {
+	if a == nil {
+		return true, false
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, e := range a.entries {
+		if e.network.Contains(ip) {
+			return e.rule.Action == ACLActionAllow, true
+		}
+	}
+	return true, false
+}
+
+// internalNetworks are the loopback, private and link-local networks relays
+// do not send to unless they are explicitly allowed
+var internalNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// allowsDestination reports whether a relay may send to ip, destinations
+// no rule matches are allowed unless they are internal
+func allowsDestination(destinations *ACL, ip net.IP) bool {
+	if allowed, matched := destinations.match(ip); matched {
+		return allowed
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsSource reports whether both the global and the proxy ACL allow ip
+func (p *Proxy) allowsSource(ip net.IP) bool {
+	return p.GlobalACL.Allows(ip) && p.ACL.Allows(ip)
+}
+
+// allowsClient reports whether the ACLs allow both the client and the peer
+// its datagrams come from, which differ behind a PROXY protocol balancer
+func (p *Proxy) allowsClient(client, peer *net.UDPAddr) bool {
+	return p.allowsSource(client.IP) && (peer.IP.Equal(client.IP) || p.allowsSource(peer.IP))
+}
+
+// EnforceACL closes the sessions of clients that are not allowed anymore,
+// it has to be called after rules are added to the proxy or global ACL
+func (p *Proxy) EnforceACL() {
+	p.connsMap.Range(func(_, c interface{}) bool {
+		conn := c.(*connection)
+		if !p.allowsClient(conn.clientAddr(), conn.replyAddr()) {
+			p.stats.inc(statACLSessionsClosed)
+			p.Logger.Info("closing session denied by acl", zap.String("client", conn.key))
+			p.closeConnection(conn)
+			p.removeConnection(conn)
+		}
+		return true
+	})
+}
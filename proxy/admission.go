@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Eviction policies applied when a proxy reaches its maximum sessions
+const (
+	// EvictionPolicyReject drops datagrams of new clients
+	EvictionPolicyReject = "reject"
+	// EvictionPolicyLRU closes the least recently active session to make
+	// room for the new client
+	EvictionPolicyLRU = "lru"
+)
+
+const (
+	defaultIPv4AdmissionPrefix = 24
+	defaultIPv6AdmissionPrefix = 64
+	// evictionSampleSize is how many sessions are looked at to pick the
+	// least recently active one, like in redis the LRU is approximated to
+	// keep eviction cheap under a flood of new clients
+	evictionSampleSize = 16
+)
+
+// Admission limits the sessions a proxy accepts, zero values disable the
+// corresponding limit
+type Admission struct {
+	MaxSessions int `json:"maxSessions"`
+	// EvictionPolicy is either EvictionPolicyReject, the default, or
+	// EvictionPolicyLRU
+	EvictionPolicy       string `json:"evictionPolicy"`
+	MaxSessionsPerIP     int    `json:"maxSessionsPerIp"`
+	MaxSessionsPerPrefix int    `json:"maxSessionsPerPrefix"`
+	// IPv4PrefixLength and IPv6PrefixLength size the prefixes counted by
+	// MaxSessionsPerPrefix, they default to /24 and /64
+	IPv4PrefixLength     int     `json:"ipv4PrefixLength"`
+	IPv6PrefixLength     int     `json:"ipv6PrefixLength"`
+	NewSessionsPerSecond float64 `json:"newSessionsPerSecond"`
+	NewSessionsBurst     int     `json:"newSessionsBurst"`
+}
+
+func (a Admission) enabled() bool {
+	return a.MaxSessions > 0 || a.MaxSessionsPerIP > 0 || a.MaxSessionsPerPrefix > 0 || a.NewSessionsPerSecond > 0
+}
+
+// Validate checks the admission limits
+func (a Admission) Validate() error {
+	switch a.EvictionPolicy {
+	case "", EvictionPolicyReject, EvictionPolicyLRU:
+	default:
+		return fmt.Errorf("invalid eviction policy %q", a.EvictionPolicy)
+	}
+	if a.MaxSessions < 0 || a.MaxSessionsPerIP < 0 || a.MaxSessionsPerPrefix < 0 || a.NewSessionsPerSecond < 0 || a.NewSessionsBurst < 0 {
+		return errors.New("admission limits must not be negative")
+	}
+	if a.IPv4PrefixLength < 0 || a.IPv4PrefixLength > 32 || a.IPv6PrefixLength < 0 || a.IPv6PrefixLength > 128 {
+		return errors.New("invalid admission prefix length")
+	}
+	return nil
+}
+
+// admission keeps track of the admitted sessions per source ip and prefix
+type admission struct {
+	config     Admission
+	ipv4Mask   net.IPMask
+	ipv6Mask   net.IPMask
+	mutex      sync.Mutex
+	sessions   int
+	perIP      map[string]int
+	perPrefix  map[string]int
+	newSession *tokenBucket
+}
+
+func newAdmission(config Admission, now time.Time) *admission {
+	if !config.enabled() {
+		return nil
+	}
+	ipv4Prefix := config.IPv4PrefixLength
+	if ipv4Prefix == 0 {
+		ipv4Prefix = defaultIPv4AdmissionPrefix
+	}
+	ipv6Prefix := config.IPv6PrefixLength
+	if ipv6Prefix == 0 {
+		ipv6Prefix = defaultIPv6AdmissionPrefix
+	}
+	return &admission{
+		config:     config,
+		ipv4Mask:   net.CIDRMask(ipv4Prefix, 32),
+		ipv6Mask:   net.CIDRMask(ipv6Prefix, 128),
+		perIP:      make(map[string]int),
+		perPrefix:  make(map[string]int),
+		newSession: newTokenBucket(config.NewSessionsPerSecond, config.NewSessionsBurst, 1, now),
+	}
+}
+
+func (a *admission) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(a.ipv4Mask).String()
+	}
+	return ip.Mask(a.ipv6Mask).String()
+}
+
+// admit accounts a new session of ip, when it is rejected the stat that
+// counts the reason is returned, evict is set when a session has to be
+// closed to stay within MaxSessions
+func (a *admission) admit(ip net.IP, now time.Time) (evict bool, rejected stat, ok bool) {
+	ipKey := ip.String()
+	prefixKey := a.prefix(ip)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.config.MaxSessionsPerIP > 0 && a.perIP[ipKey] >= a.config.MaxSessionsPerIP {
+		return false, statAdmissionRejectsPerIP, false
+	}
+	if a.config.MaxSessionsPerPrefix > 0 && a.perPrefix[prefixKey] >= a.config.MaxSessionsPerPrefix {
+		return false, statAdmissionRejectsPerPrefix, false
+	}
+	full := a.config.MaxSessions > 0 && a.sessions >= a.config.MaxSessions
+	if full && a.config.EvictionPolicy != EvictionPolicyLRU {
+		return false, statAdmissionRejectsMaxSessions, false
+	}
+	if a.newSession != nil {
+		a.newSession.refill(now)
+		if a.newSession.tokens < 1 {
+			return false, statAdmissionRejectsRate, false
+		}
+		a.newSession.tokens--
+	}
+	a.sessions++
+	a.perIP[ipKey]++
+	a.perPrefix[prefixKey]++
+	return full, 0, true
+}
+
+// release gives back the accounting of a session of ip
+func (a *admission) release(ip net.IP) {
+	if a == nil {
+		return
+	}
+	ipKey := ip.String()
+	prefixKey := a.prefix(ip)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.sessions--
+	if a.perIP[ipKey]--; a.perIP[ipKey] <= 0 {
+		delete(a.perIP, ipKey)
+	}
+	if a.perPrefix[prefixKey]--; a.perPrefix[prefixKey] <= 0 {
+		delete(a.perPrefix, prefixKey)
+	}
+}
+
+// move transfers the accounting of a session from one ip to another, when
+// the new ip is over its limits the stat that counts the reason is returned
+func (a *admission) move(from, to net.IP) (rejected stat, ok bool) {
+	fromIP, toIP := from.String(), to.String()
+	fromPrefix, toPrefix := a.prefix(from), a.prefix(to)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if fromIP != toIP && a.config.MaxSessionsPerIP > 0 && a.perIP[toIP] >= a.config.MaxSessionsPerIP {
+		return statAdmissionRejectsPerIP, false
+	}
+	if fromPrefix != toPrefix && a.config.MaxSessionsPerPrefix > 0 && a.perPrefix[toPrefix] >= a.config.MaxSessionsPerPrefix {
+		return statAdmissionRejectsPerPrefix, false
+	}
+	if a.perIP[fromIP]--; a.perIP[fromIP] <= 0 {
+		delete(a.perIP, fromIP)
+	}
+	if a.perPrefix[fromPrefix]--; a.perPrefix[fromPrefix] <= 0 {
+		delete(a.perPrefix, fromPrefix)
+	}
+	a.perIP[toIP]++
+	a.perPrefix[toPrefix]++
+	return 0, true
+}
+
+// admitClient applies the admission limits to a new client, it returns false
+// if the client must not get a session
+func (p *Proxy) admitClient(client *net.UDPAddr) bool {
+	if p.admission == nil {
+		return true
+	}
+	evict, rejected, ok := p.admission.admit(client.IP, time.Now())
+	if !ok {
+		p.stats.inc(rejected)
+		return false
+	}
+	if evict {
+		p.evictLeastRecentlyActive()
+	}
+	return true
+}
+
+// evictLeastRecentlyActive closes the least recently active of a sample of
+// the sessions
+func (p *Proxy) evictLeastRecentlyActive() {
+	var victim *connection
+	sampled := 0
+	p.connsMap.Range(func(_, c interface{}) bool {
+		conn := c.(*connection)
+		if victim == nil || conn.lastActive().Before(victim.lastActive()) {
+			victim = conn
+		}
+		sampled++
+		return sampled < evictionSampleSize
+	})
+	if victim == nil {
+		return
+	}
+	p.stats.inc(statAdmissionEvictions)
+	p.Logger.Debug("evicting session", zap.String("client", victim.key))
+	p.closeConnection(victim)
+	p.removeConnection(victim)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+const defaultAmplificationValidationPackets = 3
+
+// Values of connection.validated, sessions whose handshake proved their
+// client is reachable are never limited
+const (
+	validatedByPackets int32 = iota + 1
+	validatedByHandshake
+)
+
+// AmplificationGuard keeps the proxy from being used to amplify traffic
+// toward spoofed sources, until a client proved it is reachable the upstream
+// can only send it Factor times the bytes the client sent, a zero factor
+// disables the guard
+type AmplificationGuard struct {
+	Factor float64 `json:"factor"`
+	// ValidationPackets is how many datagrams a client has to send before it
+	// is considered reachable, it defaults to 3
+	ValidationPackets int `json:"validationPackets"`
+	// ValidatedFactor optionally bounds what clients validated by their
+	// datagrams receive, as spoofed sources can send ValidationPackets small
+	// datagrams too. Zero, the default, leaves them unbounded
+	ValidatedFactor float64 `json:"validatedFactor"`
+}
+
+// Validate checks the amplification guard values
+func (g AmplificationGuard) Validate() error {
+	if g.Factor < 0 || g.ValidationPackets < 0 || g.ValidatedFactor < 0 {
+		return errors.New("amplification guard values must not be negative")
+	}
+	if g.ValidatedFactor > 0 && g.ValidatedFactor < g.Factor {
+		return errors.New("amplification guard validated factor must not be smaller than the factor")
+	}
+	return nil
+}
+
+func (g AmplificationGuard) validationPackets() uint64 {
+	if g.ValidationPackets == 0 {
+		return defaultAmplificationValidationPackets
+	}
+	return uint64(g.ValidationPackets)
+}
+
+// accountFromClient records a datagram the client sent to the upstream
+func (p *Proxy) accountFromClient(conn *connection, size int) {
+	if p.AmplificationGuard.Factor <= 0 {
+		return
+	}
+	atomic.AddUint64(&conn.bytesFromClient, uint64(size))
+	if conn.isValidated() {
+		return
+	}
+	if atomic.AddUint64(&conn.packetsFromClient, 1) >= p.AmplificationGuard.validationPackets() {
+		if atomic.CompareAndSwapInt32(&conn.validated, 0, validatedByPackets) {
+			p.stats.inc(statAmplificationValidatedSessions)
+		}
+	}
+}
+
+// allowToClient reports whether a datagram of size bytes can be sent to a
+// client without exceeding the factor of the bytes it sent that applies to
+// it, validated clients have the validated factor if any
+func (p *Proxy) allowToClient(conn *connection, size int) bool {
+	if p.AmplificationGuard.Factor <= 0 {
+		return true
+	}
+	factor := p.AmplificationGuard.Factor
+	switch atomic.LoadInt32(&conn.validated) {
+	case validatedByHandshake:
+		return true
+	case validatedByPackets:
+		if p.AmplificationGuard.ValidatedFactor == 0 {
+			return true
+		}
+		factor = p.AmplificationGuard.ValidatedFactor
+	}
+	budget := uint64(factor * float64(atomic.LoadUint64(&conn.bytesFromClient)))
+	for {
+		sent := atomic.LoadUint64(&conn.bytesToClient)
+		if sent+uint64(size) > budget {
+			p.stats.inc(statAmplificationDrops)
+			p.stats.add(statAmplificationDroppedBytes, uint64(size))
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&conn.bytesToClient, sent, sent+uint64(size)) {
+			return true
+		}
+	}
+}
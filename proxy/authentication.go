@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/felipejfc/udpx/auth"
+	"go.uber.org/zap"
+)
+
+var errAuthenticationDisabled = errors.New("authentication is not enabled")
+
+// AuthKey is a shared secret clients sign their tokens with
+type AuthKey struct {
+	ID     uint8  `json:"id"`
+	Secret string `json:"secret"`
+	// NotAfter is the unix time in milliseconds after which the key is not
+	// accepted anymore, 0 if it does not expire
+	NotAfter int64 `json:"notAfter"`
+}
+
+func (k AuthKey) notAfter() time.Time {
+	if k.NotAfter == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, k.NotAfter*int64(time.Millisecond))
+}
+
+// Validate checks the key
+func (k AuthKey) Validate() error {
+	if k.Secret == "" {
+		return fmt.Errorf("auth key %d has no secret", k.ID)
+	}
+	return nil
+}
+
+// Authentication requires the first datagram of every session to carry an
+// auth token signed with one of Keys, see the auth package. Authentication
+// is enabled when there is at least one key
+type Authentication struct {
+	// Header is the prefix that marks the start of a token, it defaults to
+	// auth.DefaultPrefix
+	Header string `json:"header"`
+	// MaxTokenLifetime is how far in the future tokens may expire in
+	// milliseconds, it defaults to 5 minutes
+	MaxTokenLifetime int       `json:"maxTokenLifetime"`
+	Keys             []AuthKey `json:"keys"`
+}
+
+// Validate checks the authentication settings
+func (a Authentication) Validate() error {
+	if a.MaxTokenLifetime < 0 {
+		return errors.New("max token lifetime must not be negative")
+	}
+	for _, k := range a.Keys {
+		if err := k.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newAuthVerifier(config Authentication) *auth.Verifier {
+	if len(config.Keys) == 0 {
+		return nil
+	}
+	v := auth.NewVerifier([]byte(config.Header), time.Duration(config.MaxTokenLifetime)*time.Millisecond)
+	for _, k := range config.Keys {
+		v.AddKey(k.ID, []byte(k.Secret), k.notAfter())
+	}
+	return v
+}
+
+// authenticate verifies the token of the first datagram of a session and
+// returns the payload that follows it
+func (p *Proxy) authenticate(src *net.UDPAddr, data []byte) ([]byte, bool) {
+	if p.authVerifier == nil {
+		return data, true
+	}
+	payload, err := p.authVerifier.Verify(data, time.Now())
+	if err != nil {
+		p.stats.inc(statAuthFailures)
+		p.Logger.Debug("authentication failed", zap.String("client", src.String()), zap.Error(err))
+		p.reportOffense(src.IP, OffenseAuthFailed)
+		return nil, false
+	}
+	p.stats.inc(statAuthSuccesses)
+	return payload, true
+}
+
+// stripToken removes the token the session of conn was opened or last
+// rebound with from a datagram, clients may keep sending it until they get a
+// reply. Other datagrams are forwarded untouched even when they look like
+// tokens, as their tokens were not verified
+func (p *Proxy) stripToken(conn *connection, data []byte) []byte {
+	if token, _ := conn.authToken.Load().([]byte); len(token) > 0 && bytes.HasPrefix(data, token) {
+		return data[len(token):]
+	}
+	return data
+}
+
+// AuthKeys lists the keys that are still accepted
+func (p *Proxy) AuthKeys() ([]auth.KeyInfo, error) {
+	if p.authVerifier == nil {
+		return nil, errAuthenticationDisabled
+	}
+	return p.authVerifier.Keys(), nil
+}
+
+// AddAuthKey adds or replaces a key
+func (p *Proxy) AddAuthKey(key AuthKey) error {
+	if p.authVerifier == nil {
+		return errAuthenticationDisabled
+	}
+	if err := key.Validate(); err != nil {
+		return err
+	}
+	p.authVerifier.AddKey(key.ID, []byte(key.Secret), key.notAfter())
+	return nil
+}
+
+// RetireAuthKey stops accepting a key once overlap elapsed, it returns false
+// if the key does not exist
+func (p *Proxy) RetireAuthKey(id uint8, overlap time.Duration) bool {
+	if p.authVerifier == nil {
+		return false
+	}
+	return p.authVerifier.RetireKey(id, time.Now().Add(overlap))
+}
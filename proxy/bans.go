@@ -0,0 +1,356 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Offenses that count toward a ban
+const (
+	OffenseRateLimit  = "rateLimit"
+	OffenseOversize   = "oversize"
+	OffenseMalformed  = "malformed"
+	OffenseAuthFailed = "authFailed"
+)
+
+const (
+	defaultBanWindow      = 10 * time.Second
+	defaultBanDuration    = time.Minute
+	defaultBanMaxDuration = 24 * time.Hour
+	banCleanupInterval    = time.Minute
+	// banPersistDelay gathers the bans of a burst of offenses into a single
+	// write of the persist file
+	banPersistDelay = 500 * time.Millisecond
+)
+
+// BanPolicy bans sources that keep offending, a source that commits
+// Threshold offenses within Window milliseconds is banned for Duration
+// milliseconds, doubled on each new ban up to MaxDuration. A source is
+// forgotten once it behaved for MaxDuration after its last ban. A zero
+// threshold disables banning
+type BanPolicy struct {
+	Threshold   int `json:"threshold"`
+	Window      int `json:"window"`
+	Duration    int `json:"duration"`
+	MaxDuration int `json:"maxDuration"`
+	// PersistFile keeps the bans across restarts when set
+	PersistFile string `json:"persistFile"`
+}
+
+// Validate checks the ban policy values
+func (b BanPolicy) Validate() error {
+	if b.Threshold < 0 || b.Window < 0 || b.Duration < 0 || b.MaxDuration < 0 {
+		return errors.New("ban policy values must not be negative")
+	}
+	return nil
+}
+
+func millisOr(value int, def time.Duration) time.Duration {
+	if value <= 0 {
+		return def
+	}
+	return time.Duration(value) * time.Millisecond
+}
+
+// Ban describes a banned source address
+type Ban struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	// Count is how many times the address was banned, it drives the
+	// escalation of the ban duration
+	Count int `json:"count"`
+}
+
+type offenses struct {
+	count       int
+	windowStart time.Time
+}
+
+// banList counts the offenses of each source address and keeps its bans
+type banList struct {
+	threshold   int
+	window      time.Duration
+	duration    time.Duration
+	maxDuration time.Duration
+	mutex       sync.RWMutex
+	offenses    map[string]*offenses
+	bans        map[string]*Ban
+}
+
+func newBanList(policy BanPolicy) *banList {
+	if policy.Threshold <= 0 {
+		return nil
+	}
+	return &banList{
+		threshold:   policy.Threshold,
+		window:      millisOr(policy.Window, defaultBanWindow),
+		duration:    millisOr(policy.Duration, defaultBanDuration),
+		maxDuration: millisOr(policy.MaxDuration, defaultBanMaxDuration),
+		offenses:    make(map[string]*offenses),
+		bans:        make(map[string]*Ban),
+	}
+}
+
+// banned reports whether address is currently banned
+func (b *banList) banned(address string, now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	ban, found := b.bans[address]
+	return found && now.Before(ban.Until)
+}
+
+// offend records an offense of address, it returns the ban when the offense
+// got the address banned
+func (b *banList) offend(address, reason string, now time.Time) (Ban, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if ban, found := b.bans[address]; found && now.Before(ban.Until) {
+		return Ban{}, false
+	}
+	o, found := b.offenses[address]
+	if !found || now.Sub(o.windowStart) > b.window {
+		o = &offenses{windowStart: now}
+		b.offenses[address] = o
+	}
+	o.count++
+	if o.count < b.threshold {
+		return Ban{}, false
+	}
+	delete(b.offenses, address)
+	ban, found := b.bans[address]
+	if !found {
+		ban = &Ban{Address: address}
+		b.bans[address] = ban
+	}
+	duration := b.duration
+	for i := 0; i < ban.Count && duration < b.maxDuration; i++ {
+		duration *= 2
+	}
+	if duration > b.maxDuration {
+		duration = b.maxDuration
+	}
+	ban.Count++
+	ban.Reason = reason
+	ban.Since = now
+	ban.Until = now.Add(duration)
+	return *ban, true
+}
+
+// list returns the active bans sorted by address
+func (b *banList) list(now time.Time) []Ban {
+	bans := []Ban{}
+	if b == nil {
+		return bans
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Address < bans[j].Address
+	})
+	return bans
+}
+
+// revoke lifts the ban of address and forgets its history
+func (b *banList) revoke(address string) bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.offenses, address)
+	ban, found := b.bans[address]
+	delete(b.bans, address)
+	return found && time.Now().Before(ban.Until)
+}
+
+// cleanup forgets stale offenses and the bans that expired longer than
+// maxDuration ago
+func (b *banList) cleanup(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for address, o := range b.offenses {
+		if now.Sub(o.windowStart) > b.window {
+			delete(b.offenses, address)
+		}
+	}
+	for address, ban := range b.bans {
+		if now.Sub(ban.Until) > b.maxDuration {
+			delete(b.bans, address)
+		}
+	}
+}
+
+func (b *banList) save(path string) error {
+	b.mutex.RLock()
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		bans = append(bans, *ban)
+	}
+	b.mutex.RUnlock()
+	data, err := json.Marshal(bans)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (b *banList) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i := range bans {
+		b.bans[bans[i].Address] = &bans[i]
+	}
+	return nil
+}
+
+// reportOffense counts an offense of a client address, banning it and
+// closing its sessions once it offended too often
+func (p *Proxy) reportOffense(ip net.IP, reason string) {
+	if p.banList == nil {
+		return
+	}
+	ban, banned := p.banList.offend(ip.String(), reason, time.Now())
+	if !banned {
+		return
+	}
+	p.stats.inc(statBans)
+	p.Logger.Warn("banning client",
+		zap.String("address", ban.Address),
+		zap.String("reason", ban.Reason),
+		zap.Time("until", ban.Until),
+	)
+	p.connsMap.Range(func(_, c interface{}) bool {
+		conn := c.(*connection)
+		if conn.clientAddr().IP.Equal(ip) {
+			p.closeConnection(conn)
+			p.removeConnection(conn)
+		}
+		return true
+	})
+	p.persistBans()
+}
+
+// persistBans asks banPersistLoop to save the bans, it does not block as
+// it is called on the datagram path
+func (p *Proxy) persistBans() {
+	if p.banPersist == nil {
+		return
+	}
+	select {
+	case p.banPersist <- struct{}{}:
+	default:
+	}
+}
+
+// banPersistLoop saves the bans banPersistDelay after they changed, and once
+// more on close if they changed since
+func (p *Proxy) banPersistLoop() {
+	for {
+		select {
+		case <-p.ctx.Done():
+			select {
+			case <-p.banPersist:
+				p.saveBans()
+			default:
+			}
+			return
+		case <-p.banPersist:
+		}
+		select {
+		case <-p.ctx.Done():
+		case <-time.After(banPersistDelay):
+		}
+		p.saveBans()
+	}
+}
+
+func (p *Proxy) saveBans() {
+	if err := p.banList.save(p.BanPolicy.PersistFile); err != nil {
+		p.Logger.Error("failed to persist bans", zap.Error(err))
+	}
+}
+
+// Bans returns the active bans of the proxy
+func (p *Proxy) Bans() []Ban {
+	return p.banList.list(time.Now())
+}
+
+// RevokeBan lifts the ban of address, it returns false if it was not banned
+func (p *Proxy) RevokeBan(address string) bool {
+	if ip := net.ParseIP(address); ip != nil {
+		address = ip.String()
+	}
+	if !p.banList.revoke(address) {
+		return false
+	}
+	p.persistBans()
+	return true
+}
+
+func (p *Proxy) banCleanupLoop() {
+	ticker := time.NewTicker(banCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.banList.cleanup(now)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/felipejfc/udpx/fec"
+	"github.com/felipejfc/udpx/socks5"
+	"github.com/felipejfc/udpx/tunnel"
+	"go.uber.org/zap"
+)
+
+// Oversize policies, they decide what happens to datagrams that were larger
+// than BufferSize and got truncated when read
+const (
+	// OversizePolicyDrop drops truncated datagrams
+	OversizePolicyDrop = "drop"
+	// OversizePolicyTruncate forwards the first BufferSize bytes
+	OversizePolicyTruncate = "truncate"
+	// OversizePolicyLog drops truncated datagrams and logs their source
+	OversizePolicyLog = "log"
+)
+
+// ValidateOversizePolicy checks an oversize policy
+func ValidateOversizePolicy(policy string) error {
+	switch policy {
+	case "", OversizePolicyDrop, OversizePolicyTruncate, OversizePolicyLog:
+		return nil
+	}
+	return fmt.Errorf("invalid oversize policy %q", policy)
+}
+
+// readDatagram reads a datagram into buf, which must have one byte more than
+// BufferSize plus overhead so that truncation can be detected where
+// MSG_TRUNC is missing, overhead accounts for tunnel encryption
+func (p *Proxy) readDatagram(conn *net.UDPConn, buf []byte, overhead int) (int, *net.UDPAddr, bool, error) {
+	n, _, flags, addr, err := conn.ReadMsgUDP(buf[:cap(buf)], nil)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	limit := p.BufferSize + overhead
+	truncated := flags&msgTrunc != 0 || n > limit
+	if n > limit {
+		n = limit
+	}
+	return n, addr, truncated, nil
+}
+
+// clientOverhead and upstreamOverhead are how many bytes SOCKS, TURN, FEC,
+// the tunnel or DTLS add to the datagrams exchanged with each side
+func (p *Proxy) clientOverhead() int {
+	overhead := 0
+	if p.isSOCKS5() {
+		overhead += socks5.MaxUDPHeaderSize
+	}
+	if p.isTURN() {
+		overhead += turnOverhead
+	}
+	if p.FEC.Role == FECRoleExit {
+		overhead += fec.Overhead
+	}
+	if p.Tunnel.Role == TunnelRoleExit {
+		overhead += tunnel.Overhead
+	}
+	if p.DTLS.Mode == DTLSModeTerminate {
+		overhead += dtlsOverhead
+	}
+	return overhead
+}
+
+func (p *Proxy) upstreamOverhead() int {
+	overhead := 0
+	if p.FEC.Role == FECRoleEntry {
+		overhead += fec.Overhead
+	}
+	if p.Tunnel.Role == TunnelRoleEntry {
+		overhead += tunnel.Overhead
+	}
+	if p.DTLS.Mode == DTLSModeOriginate {
+		overhead += dtlsOverhead
+	}
+	return overhead
+}
+
+// acceptTruncated applies the oversize policy to a truncated datagram and
+// returns whether it should still be forwarded
+func (p *Proxy) acceptTruncated(src *net.UDPAddr, fromClient bool) bool {
+	if fromClient {
+		p.stats.inc(statTruncatedFromClients)
+		p.reportOffense(src.IP, OffenseOversize)
+	} else {
+		p.stats.inc(statTruncatedFromUpstream)
+	}
+	switch p.OversizePolicy {
+	case OversizePolicyTruncate:
+		return true
+	case OversizePolicyLog:
+		p.Logger.Warn("dropping datagram larger than buffer size",
+			zap.String("src address", src.String()),
+			zap.Bool("from client", fromClient),
+			zap.Int("bufferSize", p.BufferSize),
+		)
+	}
+	p.stats.inc(statOversizeDrops)
+	return false
+}
+
+// writeToUpstream sends data to the upstream, or to dst for socks5 clients,
+// policing its size and accounting for write errors
+func (p *Proxy) writeToUpstream(conn *connection, data []byte, dst *net.UDPAddr) {
+	if p.MaxUpstreamDatagramSize > 0 && len(data) > p.MaxUpstreamDatagramSize {
+		p.stats.inc(statMaxSizeDropsToUpstream)
+		p.reportOffense(conn.clientAddr().IP, OffenseOversize)
+		return
+	}
+	if p.ProxyProtocol.Egress != "" {
+		data = p.withProxyHeader(conn, data)
+	}
+	if dst != nil {
+		if _, err := conn.udp.WriteToUDP(data, dst); err != nil {
+			p.countWriteError(err, statMsgSizeErrorsToUpstream, statWriteErrorsToUpstream)
+		}
+		return
+	}
+	if p.FEC.Role == FECRoleEntry {
+		p.encodeFEC(conn, data)
+		return
+	}
+	p.sendToUpstream(conn, data)
+}
+
+// sendToUpstream encrypts data when needed and writes it to the upstream
+func (p *Proxy) sendToUpstream(conn *connection, data []byte) {
+	if p.Tunnel.Role == TunnelRoleEntry {
+		var ok bool
+		if data, ok = p.sealTunnel(conn, data); !ok {
+			return
+		}
+	}
+	if p.DTLS.Mode == DTLSModeOriginate {
+		p.writeDTLS(conn, data, statMsgSizeErrorsToUpstream, statWriteErrorsToUpstream)
+		return
+	}
+	if _, err := p.writeUpstream(conn, data); err != nil {
+		p.countWriteError(err, statMsgSizeErrorsToUpstream, statWriteErrorsToUpstream)
+	}
+}
+
+// writeToClient sends data to a client, policing its size and accounting for
+// write errors
+func (p *Proxy) writeToClient(conn *connection, data []byte, client *net.UDPAddr) {
+	if p.MaxClientDatagramSize > 0 && len(data) > p.MaxClientDatagramSize {
+		p.stats.inc(statMaxSizeDropsToClients)
+		return
+	}
+	if p.FEC.Role == FECRoleExit {
+		p.encodeFEC(conn, data)
+		return
+	}
+	p.sendToClient(conn, data, client)
+}
+
+// sendToClient encrypts data when needed and writes it to a client
+func (p *Proxy) sendToClient(conn *connection, data []byte, client *net.UDPAddr) {
+	if p.Tunnel.Role == TunnelRoleExit {
+		var ok bool
+		if data, ok = p.sealTunnel(conn, data); !ok {
+			return
+		}
+	}
+	if p.DTLS.Mode == DTLSModeTerminate {
+		p.writeDTLS(conn, data, statMsgSizeErrorsToClients, statWriteErrorsToClients)
+		return
+	}
+	if conn.clientStream != nil {
+		if err := conn.clientStream.WriteDatagram(data); err != nil {
+			p.countWriteError(err, statMsgSizeErrorsToClients, statWriteErrorsToClients)
+		}
+		return
+	}
+	if _, err := p.listenerConn.WriteToUDP(data, client); err != nil {
+		p.countWriteError(err, statMsgSizeErrorsToClients, statWriteErrorsToClients)
+	}
+}
+
+func (p *Proxy) countWriteError(err error, msgSizeStat, otherStat stat) {
+	if p.closing() {
+		return
+	}
+	if isMsgSizeError(err) {
+		p.stats.inc(msgSizeStat)
+		return
+	}
+	p.stats.inc(otherStat)
+	p.Logger.Debug("write error", zap.Error(err))
+}
+
+// isMsgSizeError reports whether err is EMSGSIZE, which is returned for
+// datagrams larger than the socket buffer or the path MTU
+func isMsgSizeError(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
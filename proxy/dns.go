@@ -0,0 +1,508 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSSockets      = 4
+	defaultDNSQueryTimeout = 5 * time.Second
+	// dnsMaxPending bounds the queries waiting for a response on each
+	// upstream socket, out of the 65536 transaction ids
+	dnsMaxPending = 4096
+	// defaultDNSMaxClientPending bounds the queries of a client IP waiting
+	// for a response, so one client cannot use up the transaction ids
+	defaultDNSMaxClientPending = 256
+)
+
+var rcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// DNSRoute sends the queries for a domain and its subdomains to a resolver
+type DNSRoute struct {
+	Suffix          string `json:"suffix"`
+	UpstreamAddress string `json:"upstreamAddress"`
+	UpstreamPort    int    `json:"upstreamPort"`
+}
+
+// DNS configures a dns proxy, queries no route matches go to the proxy
+// upstream
+type DNS struct {
+	Routes []DNSRoute `json:"routes"`
+	// Sockets is how many upstream sockets the queries to each resolver are
+	// spread over, it defaults to 4
+	Sockets int `json:"sockets"`
+	// QueryTimeout is how many milliseconds a query waits for its response,
+	// it defaults to 5 seconds
+	QueryTimeout int `json:"queryTimeout"`
+	// LogQueries logs every query with its response code and latency
+	LogQueries bool `json:"logQueries"`
+	// MaxClientPending is how many queries of a client IP may wait for a
+	// response, it defaults to 256
+	MaxClientPending int `json:"maxClientPending"`
+}
+
+// Validate checks the dns settings
+func (d DNS) Validate() error {
+	if d.Sockets < 0 || d.Sockets > 256 {
+		return fmt.Errorf("invalid dns sockets %d", d.Sockets)
+	}
+	if d.QueryTimeout < 0 {
+		return errors.New("dns query timeout must not be negative")
+	}
+	if d.MaxClientPending < 0 {
+		return errors.New("dns max client pending must not be negative")
+	}
+	for _, r := range d.Routes {
+		if normalizeDNSName(r.Suffix) == "" || r.UpstreamAddress == "" || r.UpstreamPort <= 0 || r.UpstreamPort > 65535 {
+			return fmt.Errorf("invalid dns route %q", r.Suffix)
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) isDNS() bool {
+	return p.Type == ProxyTypeDNS
+}
+
+// validateDNS checks that a dns proxy can be combined with the rest of the
+// config, its upstream sockets are shared by every client
+func (p *Proxy) validateDNS() error {
+	if !p.isDNS() {
+		return nil
+	}
+	if err := p.DNS.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case !p.usesUpstreamSockets():
+		return errors.New("a dns proxy requires the socket upstream mode")
+	case p.Tunnel.Role != "":
+		return errors.New("a dns proxy cannot be part of a tunnel")
+	case p.DTLS.Mode != "":
+		return errors.New("a dns proxy cannot be combined with dtls")
+	case p.FEC.Role != "":
+		return errors.New("a dns proxy cannot be combined with fec")
+	case p.ProxyProtocol.Egress != "":
+		return errors.New("a dns proxy cannot send the proxy protocol")
+	case len(p.Authentication.Keys) > 0:
+		return errors.New("a dns proxy cannot be combined with authentication")
+	// queries do not get sessions, so the per session limits would never
+	// apply
+	case p.ClientRateLimit.enabled() || p.UpstreamRateLimit.enabled():
+		return errors.New("a dns proxy cannot be combined with rate limits")
+	case p.UpstreamShaping.BytesPerSecond > 0 || p.ClientShaping.BytesPerSecond > 0:
+		return errors.New("a dns proxy cannot be combined with shaping")
+	case p.Admission.enabled():
+		return errors.New("a dns proxy cannot be combined with admission limits")
+	case p.AmplificationGuard.Factor > 0:
+		return errors.New("a dns proxy cannot be combined with the amplification guard")
+	// an open resolver reflects amplified responses to spoofed sources
+	case !p.client.IP.IsLoopback() && len(p.ACL.Rules()) == 0 && len(p.GlobalACL.Rules()) == 0:
+		return errors.New("a dns proxy without an acl must bind a loopback address")
+	}
+	return nil
+}
+
+// normalizeDNSName lowercases a name and removes its trailing dot
+func normalizeDNSName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// dnsQuery is a query waiting for its response
+type dnsQuery struct {
+	client   *net.UDPAddr
+	peer     *net.UDPAddr
+	id       uint16
+	question dnsmessage.Question
+	sent     time.Time
+}
+
+// dnsSocket is an upstream socket shared by the queries to a resolver, they
+// are told apart by the transaction ids the proxy gives them
+type dnsSocket struct {
+	udp     *net.UDPConn
+	route   *dnsRoute
+	mutex   sync.Mutex
+	pending map[uint16]*dnsQuery
+}
+
+// reserve gives query a random transaction id that is not in use
+func (s *dnsSocket) reserve(query *dnsQuery) (uint16, bool) {
+	var b [2]byte
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.pending) >= dnsMaxPending {
+		return 0, false
+	}
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, false
+		}
+		id := binary.BigEndian.Uint16(b[:])
+		if _, found := s.pending[id]; !found {
+			s.pending[id] = query
+			return id, true
+		}
+	}
+}
+
+// take returns the query a response is for, the response has to repeat the
+// question of the query
+func (s *dnsSocket) take(id uint16, question dnsmessage.Question) *dnsQuery {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	query, found := s.pending[id]
+	if !found || query.question.Type != question.Type || query.question.Class != question.Class ||
+		!strings.EqualFold(query.question.Name.String(), question.Name.String()) {
+		return nil
+	}
+	delete(s.pending, id)
+	return query
+}
+
+func (s *dnsSocket) release(id uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.pending, id)
+}
+
+// expire removes the queries sent before deadline
+func (s *dnsSocket) expire(deadline time.Time) []*dnsQuery {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var expired []*dnsQuery
+	for id, query := range s.pending {
+		if query.sent.Before(deadline) {
+			delete(s.pending, id)
+			expired = append(expired, query)
+		}
+	}
+	return expired
+}
+
+type dnsRoute struct {
+	suffix string
+	config DNSRoute
+	// upstream is the proxy upstream for the default route
+	upstream *atomic.Value
+	sockets  []*dnsSocket
+	next     uint32
+}
+
+func (r *dnsRoute) addr() *net.UDPAddr {
+	addr, _ := r.upstream.Load().(*net.UDPAddr)
+	return addr
+}
+
+func (r *dnsRoute) matches(name string) bool {
+	return name == r.suffix || strings.HasSuffix(name, "."+r.suffix)
+}
+
+func (r *dnsRoute) resolve() error {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", r.config.UpstreamAddress, r.config.UpstreamPort))
+	if err != nil {
+		return err
+	}
+	if current := r.addr(); current == nil || current.String() != addr.String() {
+		r.upstream.Store(addr)
+	}
+	return nil
+}
+
+// socket spreads the queries of a route over its sockets
+func (r *dnsRoute) socket() *dnsSocket {
+	return r.sockets[atomic.AddUint32(&r.next, 1)%uint32(len(r.sockets))]
+}
+
+// dnsForwarder holds the routes of a dns proxy, the most specific route
+// comes first and the default route last
+type dnsForwarder struct {
+	routes  []*dnsRoute
+	timeout time.Duration
+	log     bool
+	// maxClientPending bounds the entries of clientPending, the queries
+	// waiting for a response by client IP
+	maxClientPending int
+	clientsMutex     sync.Mutex
+	clientPending    map[string]int
+}
+
+// admit counts a query of client as pending, it reports false when client
+// already has too many queries waiting for a response
+func (f *dnsForwarder) admit(client net.IP) bool {
+	key := client.String()
+	f.clientsMutex.Lock()
+	defer f.clientsMutex.Unlock()
+	if f.clientPending[key] >= f.maxClientPending {
+		return false
+	}
+	f.clientPending[key]++
+	return true
+}
+
+// done forgets a pending query of client
+func (f *dnsForwarder) done(client net.IP) {
+	key := client.String()
+	f.clientsMutex.Lock()
+	defer f.clientsMutex.Unlock()
+	if f.clientPending[key] <= 1 {
+		delete(f.clientPending, key)
+		return
+	}
+	f.clientPending[key]--
+}
+
+func (f *dnsForwarder) match(name string) *dnsRoute {
+	name = normalizeDNSName(name)
+	for _, route := range f.routes[:len(f.routes)-1] {
+		if route.matches(name) {
+			return route
+		}
+	}
+	return f.routes[len(f.routes)-1]
+}
+
+func (f *dnsForwarder) close(p *Proxy) {
+	for _, route := range f.routes {
+		for _, s := range route.sockets {
+			p.closeUpstreamSocket(s.udp)
+		}
+	}
+}
+
+// startDNS binds the upstream sockets of every route and starts reading the
+// responses
+func (p *Proxy) startDNS() error {
+	f := &dnsForwarder{
+		timeout:          millisOr(p.DNS.QueryTimeout, defaultDNSQueryTimeout),
+		log:              p.DNS.LogQueries,
+		maxClientPending: p.DNS.MaxClientPending,
+		clientPending:    map[string]int{},
+	}
+	if f.maxClientPending == 0 {
+		f.maxClientPending = defaultDNSMaxClientPending
+	}
+	for _, c := range p.DNS.Routes {
+		f.routes = append(f.routes, &dnsRoute{suffix: normalizeDNSName(c.Suffix), config: c, upstream: &atomic.Value{}})
+	}
+	sort.SliceStable(f.routes, func(i, j int) bool {
+		return len(f.routes[i].suffix) > len(f.routes[j].suffix)
+	})
+	f.routes = append(f.routes, &dnsRoute{upstream: &p.upstream})
+	sockets := p.DNS.Sockets
+	if sockets == 0 {
+		sockets = defaultDNSSockets
+	}
+	for _, route := range f.routes {
+		for i := 0; i < sockets; i++ {
+			conn, err := p.bindUpstreamSocket()
+			if err != nil {
+				f.close(p)
+				return err
+			}
+			route.sockets = append(route.sockets, &dnsSocket{udp: conn, route: route, pending: map[uint16]*dnsQuery{}})
+		}
+	}
+	p.dns = f
+	p.resolveDNSRoutes()
+	for _, route := range f.routes {
+		for _, s := range route.sockets {
+			s := s
+			p.goTracked(&p.sessionsWg, func() { p.dnsReadLoop(s) })
+		}
+	}
+	p.goTracked(&p.backgroundWg, p.dnsExpireLoop)
+	return nil
+}
+
+func (p *Proxy) resolveDNSRoutes() {
+	for _, route := range p.dns.routes[:len(p.dns.routes)-1] {
+		if err := route.resolve(); err != nil {
+			p.Logger.Error("failed to resolve dns route upstream", zap.String("suffix", route.config.Suffix), zap.Error(err))
+		}
+	}
+}
+
+// fromDNSClient routes a query by its name and sends it to the resolver
+// with a transaction id of the upstream socket it is sent on
+func (p *Proxy) fromDNSClient(pa packet) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(pa.data)
+	if err != nil || header.Response {
+		p.stats.inc(statDNSInvalidQueries)
+		p.reportOffense(pa.src.IP, OffenseMalformed)
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		p.stats.inc(statDNSInvalidQueries)
+		p.reportOffense(pa.src.IP, OffenseMalformed)
+		return
+	}
+	route := p.dns.match(question.Name.String())
+	upstream := route.addr()
+	if upstream == nil {
+		p.stats.inc(statPacketsDropped)
+		return
+	}
+	if !p.dns.admit(pa.src.IP) {
+		p.stats.inc(statDNSClientPendingDrops)
+		return
+	}
+	s := route.socket()
+	query := &dnsQuery{client: pa.src, peer: pa.peer, id: header.ID, question: question, sent: time.Now()}
+	id, ok := s.reserve(query)
+	if !ok {
+		p.dns.done(pa.src.IP)
+		p.stats.inc(statDNSOverloadDrops)
+		return
+	}
+	binary.BigEndian.PutUint16(pa.data, id)
+	if _, err := s.udp.WriteToUDP(pa.data, upstream); err != nil {
+		s.release(id)
+		p.dns.done(pa.src.IP)
+		p.countWriteError(err, statMsgSizeErrorsToUpstream, statWriteErrorsToUpstream)
+		return
+	}
+	p.stats.inc(statDNSQueries)
+	p.stats.inc(statDNSPendingQueries)
+}
+
+// dnsReadLoop hands the responses read on an upstream socket back to the
+// clients with their original transaction id
+func (p *Proxy) dnsReadLoop(s *dnsSocket) {
+	for {
+		msg := p.bufferPool.Get().([]byte)
+		size, src, truncated, err := p.readDatagram(s.udp, msg, 0)
+		if err != nil {
+			p.bufferPool.Put(msg)
+			if p.closing() {
+				return
+			}
+			p.Logger.Error("dns read error", zap.Error(err))
+			continue
+		}
+		if !p.acceptReply(src, s.route.addr()) || truncated && !p.acceptTruncated(src, false) {
+			p.bufferPool.Put(msg)
+			continue
+		}
+		p.fromDNSUpstream(s, msg[:size])
+		p.bufferPool.Put(msg)
+	}
+}
+
+func (p *Proxy) fromDNSUpstream(s *dnsSocket, data []byte) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(data)
+	if err != nil || !header.Response {
+		p.stats.inc(statDNSUnexpectedResponses)
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		p.stats.inc(statDNSUnexpectedResponses)
+		return
+	}
+	query := s.take(header.ID, question)
+	if query == nil {
+		p.stats.inc(statDNSUnexpectedResponses)
+		return
+	}
+	p.dns.done(query.client.IP)
+	p.stats.inc(statDNSResponses)
+	p.stats.dec(statDNSPendingQueries)
+	p.logDNSQuery(s, query, rcodeName(header.RCode))
+	binary.BigEndian.PutUint16(data, query.id)
+	if _, err := p.listenerConn.WriteToUDP(data, query.peer); err != nil {
+		p.countWriteError(err, statMsgSizeErrorsToClients, statWriteErrorsToClients)
+	}
+}
+
+func (p *Proxy) logDNSQuery(s *dnsSocket, query *dnsQuery, rcode string) {
+	if !p.dns.log {
+		return
+	}
+	var upstream string
+	if addr := s.route.addr(); addr != nil {
+		upstream = addr.String()
+	}
+	p.Logger.Info("dns query",
+		zap.String("client", query.client.String()),
+		zap.String("qname", query.question.Name.String()),
+		zap.String("qtype", strings.TrimPrefix(query.question.Type.String(), "Type")),
+		zap.String("rcode", rcode),
+		zap.Duration("latency", time.Since(query.sent)),
+		zap.String("upstream", upstream),
+	)
+}
+
+func rcodeName(rcode dnsmessage.RCode) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// dnsExpireLoop forgets the queries that got no response in time
+func (p *Proxy) dnsExpireLoop() {
+	ticker := time.NewTicker(p.dns.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, route := range p.dns.routes {
+				for _, s := range route.sockets {
+					for _, query := range s.expire(now.Add(-p.dns.timeout)) {
+						p.dns.done(query.client.IP)
+						p.stats.inc(statDNSTimeouts)
+						p.stats.dec(statDNSPendingQueries)
+						p.logDNSQuery(s, query, "TIMEOUT")
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,643 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/transport/deadline"
+	"go.uber.org/zap"
+)
+
+// DTLS modes, terminate accepts DTLS from clients and forwards plaintext to
+// the upstream, originate wraps the plaintext of clients in DTLS toward the
+// upstream
+const (
+	DTLSModeTerminate = "terminate"
+	DTLSModeOriginate = "originate"
+)
+
+const (
+	defaultDTLSHandshakeTimeout = 10 * time.Second
+	// dtlsOverhead bounds what a DTLS record adds to its plaintext: the
+	// record header, an explicit IV and the MAC and padding of CBC suites
+	dtlsOverhead = 80
+	// dtlsMaxPending is how many datagrams are kept for a session while its
+	// handshake is in progress
+	dtlsMaxPending = 32
+	// dtlsPipeSize is how many received datagrams can wait for a session
+	dtlsPipeSize = 64
+	// defaultDTLSMaxHandshakes is how many clients can be in the middle of
+	// a handshake at once when DTLS is terminated
+	defaultDTLSMaxHandshakes = 1024
+	// defaultDTLSMaxHandshakesPerIP is how many of them can come from the
+	// same client IP, so that one host cannot take every slot
+	defaultDTLSMaxHandshakesPerIP = 8
+)
+
+// dtlsPSKCipherSuites are offered and accepted with a pre-shared key, the
+// library only enables certificate suites by default
+var dtlsPSKCipherSuites = []dtls.CipherSuiteID{
+	dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_PSK_WITH_AES_128_CCM,
+	dtls.TLS_PSK_WITH_AES_128_CBC_SHA256,
+}
+
+var (
+	errDTLSPending    = errors.New("too many datagrams waiting for the dtls handshake")
+	errDTLSClosed     = errors.New("dtls session closed")
+	errDTLSPipeExpiry = &pipeTimeoutError{}
+)
+
+// DTLS terminates DTLS 1.2 from clients or originates it toward the
+// upstream, either with certificates or with a pre-shared key. An empty mode
+// disables it
+type DTLS struct {
+	Mode string `json:"mode"`
+	// CertFile and KeyFile are the PEM certificate chain and private key
+	// presented to the peer, they are required to terminate without a PSK
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// CAFile holds PEM CA certificates, when terminating clients must
+	// present a certificate signed by one of them, when originating the
+	// upstream certificate is verified against them instead of the system
+	// roots
+	CAFile string `json:"caFile"`
+	// ServerName is the name the upstream certificate is verified for, it
+	// defaults to the upstream address
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	// PSK is the hex encoded pre-shared key, it cannot be combined with
+	// certificates. PSKIdentity is sent by the originating side and, when
+	// set, is the only identity a terminating side accepts
+	PSK         string `json:"psk"`
+	PSKIdentity string `json:"pskIdentity"`
+	// HandshakeTimeout is how many milliseconds a handshake may take, it
+	// defaults to 10s
+	HandshakeTimeout int `json:"handshakeTimeout"`
+	// MTU caps the size of the handshake datagrams, it defaults to 1200
+	MTU int `json:"mtu"`
+	// MaxHandshakes is how many clients can be in the middle of a handshake
+	// at once when terminating, it defaults to 1024
+	MaxHandshakes int `json:"maxHandshakes"`
+	// MaxHandshakesPerIP is how many of them can come from the same client
+	// IP, it defaults to 8
+	MaxHandshakesPerIP int `json:"maxHandshakesPerIP"`
+}
+
+// Validate checks the DTLS settings
+func (d DTLS) Validate() error {
+	switch d.Mode {
+	case "":
+		return nil
+	case DTLSModeTerminate, DTLSModeOriginate:
+	default:
+		return fmt.Errorf("invalid dtls mode %q", d.Mode)
+	}
+	if (d.CertFile == "") != (d.KeyFile == "") {
+		return errors.New("dtls certFile and keyFile must be set together")
+	}
+	if d.PSK != "" {
+		if d.CertFile != "" {
+			return errors.New("dtls psk cannot be combined with certificates")
+		}
+		if _, err := hex.DecodeString(d.PSK); err != nil {
+			return fmt.Errorf("invalid dtls psk: %s", err)
+		}
+		if d.Mode == DTLSModeOriginate && d.PSKIdentity == "" {
+			return errors.New("dtls pskIdentity is required to originate with a psk")
+		}
+	} else if d.Mode == DTLSModeTerminate && d.CertFile == "" {
+		return errors.New("terminating dtls requires a certificate or a psk")
+	}
+	if d.HandshakeTimeout < 0 || d.MTU < 0 || d.MaxHandshakes < 0 || d.MaxHandshakesPerIP < 0 {
+		return errors.New("dtls values must not be negative")
+	}
+	return nil
+}
+
+// validateDTLS checks that DTLS can be combined with the rest of the config
+func (p *Proxy) validateDTLS() error {
+	if err := p.DTLS.Validate(); err != nil {
+		return err
+	}
+	switch p.DTLS.Mode {
+	case DTLSModeTerminate:
+		if p.Tunnel.Role == TunnelRoleExit {
+			return errors.New("dtls cannot be terminated by a tunnel exit")
+		}
+		if len(p.Authentication.Keys) > 0 {
+			return errors.New("dtls cannot be terminated with authentication enabled")
+		}
+	case DTLSModeOriginate:
+		if !p.usesUpstreamSockets() {
+			return errors.New("originating dtls requires the socket upstream mode")
+		}
+		if p.Tunnel.Role == TunnelRoleEntry {
+			return errors.New("dtls cannot be originated by a tunnel entry")
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) newDTLSConfig() (*dtls.Config, error) {
+	d := p.DTLS
+	if d.Mode == "" {
+		return nil, nil
+	}
+	config := &dtls.Config{
+		ExtendedMasterSecret: dtls.RequestExtendedMasterSecret,
+		MTU:                  d.MTU,
+	}
+	if d.PSK != "" {
+		psk, _ := hex.DecodeString(d.PSK)
+		config.PSK = func(identity []byte) ([]byte, error) {
+			if d.Mode == DTLSModeTerminate && d.PSKIdentity != "" && string(identity) != d.PSKIdentity {
+				return nil, fmt.Errorf("unknown psk identity %q", identity)
+			}
+			return psk, nil
+		}
+		config.PSKIdentityHint = []byte(d.PSKIdentity)
+		config.CipherSuites = dtlsPSKCipherSuites
+	}
+	if d.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(d.CertFile, d.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	var pool *x509.CertPool
+	if d.CAFile != "" {
+		pem, err := ioutil.ReadFile(d.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", d.CAFile)
+		}
+	}
+	if d.Mode == DTLSModeTerminate {
+		if pool != nil {
+			config.ClientCAs = pool
+			config.ClientAuth = dtls.RequireAndVerifyClientCert
+		}
+		return config, nil
+	}
+	config.RootCAs = pool
+	config.ServerName = d.ServerName
+	if config.ServerName == "" {
+		config.ServerName = p.UpstreamAddress
+	}
+	config.InsecureSkipVerify = d.InsecureSkipVerify
+	return config, nil
+}
+
+// pipeTimeoutError is returned by reads of a datagramPipe past its deadline
+type pipeTimeoutError struct{}
+
+func (*pipeTimeoutError) Error() string   { return "i/o timeout" }
+func (*pipeTimeoutError) Timeout() bool   { return true }
+func (*pipeTimeoutError) Temporary() bool { return true }
+
+// datagramPipe is the net.Conn a DTLS session runs over, the proxy feeds it
+// the datagrams it reads from the peer and what the session writes is handed
+// to send
+type datagramPipe struct {
+	in           chan []byte
+	send         func([]byte) (int, error)
+	pool         *sync.Pool
+	local        net.Addr
+	remote       net.Addr
+	readDeadline *deadline.Deadline
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// feed queues a copy of a datagram, it returns false when the pipe is full
+// or closed
+func (d *datagramPipe) feed(data []byte) bool {
+	select {
+	case <-d.closed:
+		return false
+	default:
+	}
+	buf := d.pool.Get().([]byte)
+	n := copy(buf[:cap(buf)], data)
+	select {
+	case d.in <- buf[:n]:
+		return true
+	default:
+		d.pool.Put(buf)
+		return false
+	}
+}
+
+func (d *datagramPipe) Read(b []byte) (int, error) {
+	select {
+	case data := <-d.in:
+		n := copy(b, data)
+		d.pool.Put(data)
+		return n, nil
+	case <-d.closed:
+		return 0, io.EOF
+	case <-d.readDeadline.Done():
+		return 0, errDTLSPipeExpiry
+	}
+}
+
+func (d *datagramPipe) Write(b []byte) (int, error) {
+	select {
+	case <-d.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return d.send(b)
+}
+
+func (d *datagramPipe) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+func (d *datagramPipe) LocalAddr() net.Addr  { return d.local }
+func (d *datagramPipe) RemoteAddr() net.Addr { return d.remote }
+
+func (d *datagramPipe) SetDeadline(t time.Time) error {
+	return d.SetReadDeadline(t)
+}
+
+func (d *datagramPipe) SetReadDeadline(t time.Time) error {
+	d.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block
+func (d *datagramPipe) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// dtlsSession is the DTLS side of a client session, what is written before
+// the handshake completes is kept until it does
+type dtlsSession struct {
+	pipe    *datagramPipe
+	mutex   sync.Mutex
+	conn    *dtls.Conn
+	pending [][]byte
+	closed  bool
+}
+
+// newDTLSSession creates a session whose records are handed to send, it runs
+// over the listener socket when DTLS is terminated and over the upstream
+// socket of the connection when it is originated
+func (p *Proxy) newDTLSSession(local, remote net.Addr, send func([]byte) (int, error)) *dtlsSession {
+	return &dtlsSession{pipe: &datagramPipe{
+		in:           make(chan []byte, dtlsPipeSize),
+		send:         send,
+		pool:         &p.bufferPool,
+		local:        local,
+		remote:       remote,
+		readDeadline: deadline.New(),
+		closed:       make(chan struct{}),
+	}}
+}
+
+// write encrypts data for the peer or keeps it until the handshake completes
+func (s *dtlsSession) write(data []byte) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return errDTLSClosed
+	}
+	if s.conn == nil {
+		defer s.mutex.Unlock()
+		if len(s.pending) >= dtlsMaxPending {
+			return errDTLSPending
+		}
+		s.pending = append(s.pending, append([]byte(nil), data...))
+		return nil
+	}
+	conn := s.conn
+	s.mutex.Unlock()
+	_, err := conn.Write(data)
+	return err
+}
+
+// established makes conn the session connection and flushes what was kept
+// during the handshake, it returns false if the session was closed meanwhile
+func (s *dtlsSession) established(conn *dtls.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conn = conn
+	for _, data := range s.pending {
+		conn.Write(data)
+	}
+	s.pending = nil
+	return true
+}
+
+// close ends the session, notifying the peer when the handshake completed,
+// and returns whether it was established
+func (s *dtlsSession) close() bool {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return false
+	}
+	s.closed = true
+	conn := s.conn
+	s.mutex.Unlock()
+	s.pipe.Close()
+	if conn != nil {
+		conn.Close()
+	}
+	return conn != nil
+}
+
+func (s *dtlsSession) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *dtlsSession) state() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return "handshaking"
+	}
+	return "established"
+}
+
+// closeDTLS is called when a connection is closed
+func (p *Proxy) closeDTLS(conn *connection) {
+	if conn.dtls != nil && conn.dtls.close() {
+		p.stats.dec(statDTLSSessions)
+	}
+}
+
+// feedDTLS hands a datagram read from the peer to a DTLS session
+func (p *Proxy) feedDTLS(s *dtlsSession, data []byte) {
+	if !s.pipe.feed(data) {
+		p.stats.inc(statDTLSInputDrops)
+	}
+}
+
+// writeDTLS encrypts data for the peer of the DTLS session of conn
+func (p *Proxy) writeDTLS(conn *connection, data []byte, msgSizeStat, otherStat stat) {
+	if err := conn.dtls.write(data); err != nil {
+		if err == errDTLSPending {
+			p.stats.inc(statDTLSPendingDrops)
+			return
+		}
+		p.countWriteError(err, msgSizeStat, otherStat)
+	}
+}
+
+// handshakeDTLS hands a datagram of a client without a session to its DTLS
+// handshake, starting one when there is room. Sessions, and their upstream
+// sockets, are only created once the handshake completes, so sources that
+// never answer the cookie exchange cost nothing but the handshake state
+func (p *Proxy) handshakeDTLS(key string, pa packet) {
+	if s, found := p.dtlsHandshakes.Load(key); found {
+		p.feedDTLS(s.(*dtlsSession), pa.data)
+		return
+	}
+	if !p.takeDTLSHandshakeSlot(pa.src.IP) {
+		p.stats.inc(statDTLSHandshakeDrops)
+		return
+	}
+	client, peer := pa.src, pa.peer
+	s := p.newDTLSSession(p.listenerConn.LocalAddr(), client, func(b []byte) (int, error) {
+		return p.listenerConn.WriteToUDP(b, peer)
+	})
+	if actual, loaded := p.dtlsHandshakes.LoadOrStore(key, s); loaded {
+		p.releaseDTLSHandshakeSlot(client.IP)
+		s = actual.(*dtlsSession)
+	} else {
+		p.goTracked(&p.sessionsWg, func() { p.dtlsHandshakeLoop(key, client, peer, s) })
+	}
+	p.feedDTLS(s, pa.data)
+}
+
+// takeDTLSHandshakeSlot reserves room for a handshake of a client, it returns
+// false when maxHandshakes handshakes are in progress or maxHandshakesPerIP
+// of them come from its IP
+func (p *Proxy) takeDTLSHandshakeSlot(ip net.IP) bool {
+	select {
+	case p.dtlsHandshakeSlots <- struct{}{}:
+	default:
+		return false
+	}
+	key := ip.String()
+	p.dtlsHandshakesMutex.Lock()
+	defer p.dtlsHandshakesMutex.Unlock()
+	if p.dtlsHandshakesPerIP[key] >= p.DTLS.maxHandshakesPerIP() {
+		<-p.dtlsHandshakeSlots
+		return false
+	}
+	p.dtlsHandshakesPerIP[key]++
+	return true
+}
+
+// releaseDTLSHandshakeSlot frees the room taken by a handshake of a client
+func (p *Proxy) releaseDTLSHandshakeSlot(ip net.IP) {
+	key := ip.String()
+	p.dtlsHandshakesMutex.Lock()
+	if p.dtlsHandshakesPerIP[key]--; p.dtlsHandshakesPerIP[key] <= 0 {
+		delete(p.dtlsHandshakesPerIP, key)
+	}
+	p.dtlsHandshakesMutex.Unlock()
+	<-p.dtlsHandshakeSlots
+}
+
+// dtlsHandshakeLoop completes the handshake of a client, creates its session
+// and then forwards its plaintext to the upstream
+func (p *Proxy) dtlsHandshakeLoop(key string, client, peer *net.UDPAddr, s *dtlsSession) {
+	dconn, err := p.dtlsHandshake(s, client, true)
+	var conn *connection
+	if err == nil {
+		conn = p.newDTLSConnection(key, client, peer, s, dconn)
+	}
+	// the session is stored before the handshake is forgotten so that no
+	// datagram of the client starts a second one
+	p.dtlsHandshakes.Delete(key)
+	p.releaseDTLSHandshakeSlot(client.IP)
+	if conn == nil {
+		if dconn != nil {
+			dconn.Close()
+		}
+		s.close()
+		return
+	}
+	p.dtlsReadLoop(conn, dconn)
+}
+
+// newDTLSConnection creates the session of a client whose handshake
+// completed, it returns nil when the client cannot be admitted
+func (p *Proxy) newDTLSConnection(key string, client, peer *net.UDPAddr, s *dtlsSession, dconn *dtls.Conn) *connection {
+	if p.closing() || !p.admitClient(client) {
+		p.stats.inc(statPacketsDropped)
+		return nil
+	}
+	conn, err := p.newConnection(key, client, peer)
+	if err != nil {
+		p.admission.release(client.IP)
+		p.stats.inc(statPacketsDropped)
+		p.countConnectionError(err, client.String())
+		return nil
+	}
+	conn.dtls = s
+	if !s.established(dconn) {
+		conn.dtls = nil
+		p.discardConnection(conn)
+		p.admission.release(client.IP)
+		return nil
+	}
+	p.stats.inc(statDTLSHandshakes)
+	p.stats.inc(statDTLSSessions)
+	p.connsMap.Store(key, conn)
+	if p.expiryWheel != nil {
+		p.expiryWheel.Schedule(conn, p.sessionDeadline(conn))
+	}
+	if conn.udp != nil {
+		p.goTracked(&p.sessionsWg, func() { p.clientConnectionReadLoop(conn) })
+	}
+	if p.closing() {
+		// Close may have swept the sessions before this one was stored
+		p.closeConnection(conn)
+		p.removeConnection(conn)
+	}
+	return conn
+}
+
+// dtlsSessionLoop performs the handshake of a DTLS session originated toward
+// the upstream and then forwards its plaintext to the client
+func (p *Proxy) dtlsSessionLoop(conn *connection) {
+	dconn, err := p.dtlsHandshake(conn.dtls, conn.clientAddr(), false)
+	if err != nil {
+		p.closeConnection(conn)
+		p.removeConnection(conn)
+		return
+	}
+	if !conn.dtls.established(dconn) {
+		dconn.Close()
+		return
+	}
+	p.stats.inc(statDTLSHandshakes)
+	p.stats.inc(statDTLSSessions)
+	p.dtlsReadLoop(conn, dconn)
+}
+
+// dtlsHandshake performs the handshake of a DTLS session, as the server when
+// terminating and as the client when originating
+func (p *Proxy) dtlsHandshake(s *dtlsSession, client *net.UDPAddr, terminate bool) (*dtls.Conn, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, millisOr(p.DTLS.HandshakeTimeout, defaultDTLSHandshakeTimeout))
+	defer cancel()
+	var dconn *dtls.Conn
+	var err error
+	if terminate {
+		dconn, err = dtls.ServerWithContext(ctx, s.pipe, p.dtlsConfig)
+	} else {
+		dconn, err = dtls.ClientWithContext(ctx, s.pipe, p.dtlsConfig)
+	}
+	if err != nil && !s.isClosed() && !p.closing() {
+		if errors.Is(err, context.DeadlineExceeded) {
+			p.stats.inc(statDTLSHandshakeTimeouts)
+		} else {
+			p.stats.inc(statDTLSHandshakeFailures)
+		}
+		if terminate {
+			p.reportOffense(client.IP, OffenseMalformed)
+		}
+		p.Logger.Debug("dtls handshake failed", zap.String("client", client.String()), zap.Error(err))
+	}
+	return dconn, err
+}
+
+// dtlsReadLoop forwards the plaintext of an established DTLS session, to the
+// upstream when terminating and to the client when originating
+func (p *Proxy) dtlsReadLoop(conn *connection, dconn *dtls.Conn) {
+	terminate := p.DTLS.Mode == DTLSModeTerminate
+	for {
+		msg := p.bufferPool.Get().([]byte)
+		n, err := dconn.Read(msg[:cap(msg)])
+		if err != nil {
+			p.bufferPool.Put(msg)
+			if err == io.EOF || conn.isClosed() {
+				p.closeConnection(conn)
+				p.removeConnection(conn)
+				return
+			}
+			p.stats.inc(statDTLSRecordErrors)
+			continue
+		}
+		if n > p.BufferSize {
+			if !p.acceptTruncated(conn.clientAddr(), terminate) {
+				p.bufferPool.Put(msg)
+				continue
+			}
+			n = p.BufferSize
+		}
+		conn.touch()
+		if terminate {
+			p.forwardToUpstream(conn, msg[:n], nil)
+			p.bufferPool.Put(msg)
+			continue
+		}
+		if !p.sendUpstreamPacket(packet{src: conn.replyAddr(), conn: conn, data: msg[:n]}) {
+			return
+		}
+	}
+}
+
+// maxHandshakes is how many clients can be in the middle of a handshake
+func (d DTLS) maxHandshakes() int {
+	if d.MaxHandshakes > 0 {
+		return d.MaxHandshakes
+	}
+	return defaultDTLSMaxHandshakes
+}
+
+// maxHandshakesPerIP is how many of them can come from the same client IP
+func (d DTLS) maxHandshakesPerIP() int {
+	if d.MaxHandshakesPerIP > 0 {
+		return d.MaxHandshakesPerIP
+	}
+	return defaultDTLSMaxHandshakesPerIP
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/felipejfc/udpx/fec"
+	"go.uber.org/zap"
+)
+
+// FEC roles, the entry adds parity to what it sends to its upstream, which
+// has to be the bind port of an exit, and the exit adds parity to what it
+// sends back, each side rebuilds what the other one protected
+const (
+	FECRoleEntry = "entry"
+	FECRoleExit  = "exit"
+)
+
+const (
+	defaultFECBlockSize     = 10
+	defaultFECRedundancy    = 0.2
+	defaultFECFlushInterval = 20 * time.Millisecond
+	// defaultFECPeerIdle is how long the decoder of a silent peer is kept
+	// when sessions never time out
+	defaultFECPeerIdle = time.Minute
+)
+
+// FEC adds Reed-Solomon forward error correction between a FEC entry and a
+// FEC exit, see the fec package. An empty role disables it
+type FEC struct {
+	Role string `json:"role"`
+	// BlockSize is how many datagrams are protected together, default 10
+	BlockSize int `json:"blockSize"`
+	// Redundancy is how many parity datagrams are sent per datagram of a
+	// block, rounded up, default 0.2
+	Redundancy float64 `json:"redundancy"`
+	// FlushInterval is how many milliseconds an incomplete block waits for
+	// more datagrams before its parity is sent, default 20
+	FlushInterval int `json:"flushInterval"`
+	// Window is how many blocks of each peer are kept to rebuild lost
+	// datagrams and drop duplicates, default fec.DefaultWindow
+	Window int `json:"window"`
+}
+
+// Validate checks the FEC settings
+func (f FEC) Validate() error {
+	switch f.Role {
+	case "":
+		return nil
+	case FECRoleEntry, FECRoleExit:
+	default:
+		return fmt.Errorf("invalid fec role %q", f.Role)
+	}
+	if f.BlockSize < 0 || f.Redundancy < 0 || f.FlushInterval < 0 || f.Window < 0 {
+		return errors.New("fec values must not be negative")
+	}
+	data, parity := f.shards()
+	if data > fec.MaxShards || parity > fec.MaxShards {
+		return fmt.Errorf("fec blocks are limited to %d datagrams and %d parity datagrams", fec.MaxShards, fec.MaxShards)
+	}
+	return nil
+}
+
+// shards returns the number of data and parity datagrams of a block
+func (f FEC) shards() (int, int) {
+	data := f.BlockSize
+	if data == 0 {
+		data = defaultFECBlockSize
+	}
+	redundancy := f.Redundancy
+	if redundancy == 0 {
+		redundancy = defaultFECRedundancy
+	}
+	return data, int(math.Ceil(float64(data) * redundancy))
+}
+
+// validateFEC checks that FEC can be combined with the rest of the config
+func (p *Proxy) validateFEC() error {
+	if err := p.FEC.Validate(); err != nil {
+		return err
+	}
+	if p.FEC.Role == "" {
+		return nil
+	}
+	if p.FEC.Role == FECRoleEntry && !p.usesUpstreamSockets() {
+		return errors.New("a fec entry requires the socket upstream mode")
+	}
+	if p.DTLS.Mode != "" {
+		return errors.New("fec cannot be combined with dtls")
+	}
+	return nil
+}
+
+// fecEncoder protects what a connection sends to the other side, blocks
+// that stay incomplete for the flush interval are flushed by a timer
+type fecEncoder struct {
+	mutex   sync.Mutex
+	encoder *fec.Encoder
+	parity  int
+	timer   *time.Timer
+	send    func([]byte)
+}
+
+func (p *Proxy) newFECEncoder(conn *connection) (*fecEncoder, error) {
+	data, parity := p.FEC.shards()
+	encoder, err := fec.NewEncoder(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	e := &fecEncoder{encoder: encoder, parity: parity}
+	if p.FEC.Role == FECRoleEntry {
+		e.send = func(b []byte) { p.sendToUpstream(conn, b) }
+	} else {
+		e.send = func(b []byte) { p.sendToClient(conn, b, conn.replyAddr()) }
+	}
+	interval := millisOr(p.FEC.FlushInterval, defaultFECFlushInterval)
+	e.timer = time.AfterFunc(interval, func() { p.flushFEC(conn) })
+	e.timer.Stop()
+	return e, nil
+}
+
+// encodeFEC sends a datagram of conn followed, when it completes a block,
+// by the parity datagrams of the block
+func (p *Proxy) encodeFEC(conn *connection, data []byte) {
+	e := conn.fecEncoder
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.encoder.Add(data, e.send)
+	switch e.encoder.Pending() {
+	case 0:
+		e.timer.Stop()
+		p.stats.add(statFECParityDatagrams, uint64(e.parity))
+	case 1:
+		e.timer.Reset(millisOr(p.FEC.FlushInterval, defaultFECFlushInterval))
+	}
+}
+
+func (p *Proxy) flushFEC(conn *connection) {
+	e := conn.fecEncoder
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if conn.isClosed() || e.encoder.Pending() == 0 {
+		return
+	}
+	e.encoder.Flush(e.send)
+	p.stats.add(statFECParityDatagrams, uint64(e.parity))
+}
+
+// decodeFEC passes what a datagram carried or allowed to rebuild to
+// deliver, it returns false if deliver did
+func (p *Proxy) decodeFEC(decoder *fec.Decoder, src *net.UDPAddr, datagram []byte, deliver func([]byte) bool) bool {
+	ok := true
+	result, err := decoder.Decode(datagram, func(b []byte) {
+		if ok {
+			ok = deliver(b)
+		}
+	})
+	if err != nil {
+		p.stats.inc(statFECInvalid)
+		if p.FEC.Role == FECRoleExit {
+			p.reportOffense(src.IP, OffenseMalformed)
+		}
+		p.Logger.Debug("invalid fec datagram", zap.String("src address", src.String()), zap.Error(err))
+		return true
+	}
+	switch {
+	case result.Duplicate:
+		p.stats.inc(statFECDuplicates)
+	case result.Late:
+		p.stats.inc(statFECLate)
+	}
+	p.stats.add(statFECRecovered, uint64(result.Recovered))
+	p.stats.add(statFECLost, uint64(result.Lost))
+	return ok
+}
+
+// fecDecoders holds the decoder of every peer sending to a FEC exit, which
+// are identified by their address before sessions are looked up
+type fecDecoders struct {
+	mutex  sync.Mutex
+	window int
+	peers  map[string]*fecPeer
+}
+
+// fecPeer is the decoder of a peer, the readers of the listener socket
+// share it so it has to be locked while in use
+type fecPeer struct {
+	mutex    sync.Mutex
+	decoder  *fec.Decoder
+	lastSeen time.Time
+}
+
+func newFECDecoders(window int) *fecDecoders {
+	return &fecDecoders{window: window, peers: make(map[string]*fecPeer)}
+}
+
+func (d *fecDecoders) get(addr *net.UDPAddr, now time.Time) *fecPeer {
+	key := addr.String()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	peer, found := d.peers[key]
+	if !found {
+		peer = &fecPeer{decoder: fec.NewDecoder(d.window)}
+		d.peers[key] = peer
+	}
+	peer.lastSeen = now
+	return peer
+}
+
+// expire forgets the peers that were idle for longer than idle
+func (d *fecDecoders) expire(now time.Time, idle time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for key, peer := range d.peers {
+		if now.Sub(peer.lastSeen) > idle {
+			delete(d.peers, key)
+		}
+	}
+}
+
+func (p *Proxy) fecExpireLoop() {
+	idle := 2 * p.ConnTimeout
+	if idle <= 0 {
+		idle = defaultFECPeerIdle
+	}
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.fecDecoders.expire(now, idle)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// Filtering modes of the upstream facing sockets, named after the filtering
+// behaviours of RFC 4787
+const (
+	// FilteringEndpointIndependent forwards datagrams from any source to the
+	// client
+	FilteringEndpointIndependent = "endpoint-independent"
+	// FilteringAddressDependent only forwards datagrams sent from the
+	// upstream address, from any port
+	FilteringAddressDependent = "address-dependent"
+	// FilteringAddressAndPortDependent only forwards datagrams sent from the
+	// upstream address and port, it is the default
+	FilteringAddressAndPortDependent = "address-and-port-dependent"
+)
+
+// ValidateFilteringMode checks a filtering mode
+func ValidateFilteringMode(mode string) error {
+	switch mode {
+	case "", FilteringEndpointIndependent, FilteringAddressDependent, FilteringAddressAndPortDependent:
+		return nil
+	}
+	return fmt.Errorf("invalid filtering mode %q", mode)
+}
+
+// acceptReply applies the filtering mode to a datagram received on an
+// upstream facing socket, replies are validated against the currently
+// resolved address of the upstream the socket sends to
+func (p *Proxy) acceptReply(src, upstream *net.UDPAddr) bool {
+	if p.FilteringMode == FilteringEndpointIndependent {
+		return true
+	}
+	accepted := upstream != nil && src.IP.Equal(upstream.IP)
+	if accepted && p.FilteringMode != FilteringAddressDependent {
+		accepted = src.Port == upstream.Port
+	}
+	if !accepted {
+		p.stats.inc(statFilteredReplies)
+		p.Logger.Debug("dropping datagram from unexpected source", zap.String("src address", src.String()))
+	}
+	return accepted
+}
@@ -23,6 +23,7 @@
 package proxy
 
 import (
+	"errors"
 	"strconv"
 	"sync"
 	"time"
@@ -37,16 +38,24 @@ type Manager struct {
 	BufferSize           int
 	DefaultClientTimeout int
 	DefaultResolveTTL    int
+	// ACL is evaluated by every proxy before its own ACL
+	ACL *ACL
 }
 
+// ErrProxyNotFound is returned when no proxy is bound to a port
+var ErrProxyNotFound = errors.New("proxy not found")
+
 var ProxyConfigStorage = make(map[string]*ProxyInstance)
 var ProxyStorage = make(map[string]*Proxy)
+
+// storageMutex guards ProxyConfigStorage and ProxyStorage
+var storageMutex sync.RWMutex
 var instance *Manager
 var once sync.Once
 
 func GetManager() *Manager {
 	once.Do(func() {
-		instance = &Manager{}
+		instance = &Manager{ACL: &ACL{}}
 	})
 	return instance
 }
@@ -61,11 +70,26 @@ func (p *Manager) Configure(debug bool, logger *zap.Logger, bindAddress string,
 	p.Logger.Info("proxy manager configured!", zap.Bool("debug", p.Debug), zap.String("bindAddress", p.BindAddress), zap.Int("bufferSize", p.BufferSize), zap.Int("defaultResolveTTL", defaultResolveTTL), zap.Int("defaultClientTimeout", defaultClientTimeout))
 }
 
-func (p *Manager) RegisterProxy(proxyInstance ProxyInstance) bool {
+// ErrProxyExists is returned by RegisterProxy when a proxy is already bound
+// to the port
+var ErrProxyExists = errors.New("a proxy is already bound to this port")
+
+// RegisterProxy starts a proxy, it returns ErrProxyExists when a proxy is
+// already bound to its port and the reason the proxy could not start when its
+// config is invalid, such as an invalid acl as starting without the acl
+// would let every client in. Proxies that did not start are not stored
+func (p *Manager) RegisterProxy(proxyInstance ProxyInstance) error {
 	bindPortString := strconv.Itoa(proxyInstance.BindPort)
+	acl, err := NewACL(proxyInstance.ACL)
+	if err != nil {
+		p.Logger.Error("invalid acl, not starting proxy", zap.Int("bind port", proxyInstance.BindPort), zap.String("name", proxyInstance.Name), zap.Error(err))
+		return err
+	}
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
 	_, found := ProxyConfigStorage[bindPortString]
 	if found {
-		return false
+		return ErrProxyExists
 	}
 	ProxyConfigStorage[bindPortString] = &proxyInstance
 	if proxyInstance.ClientTimeout == 0 {
@@ -80,21 +104,80 @@ func (p *Manager) RegisterProxy(proxyInstance ProxyInstance) bool {
 		zap.String("upstream address", proxyInstance.UpstreamAddress),
 		zap.Int("upstream port", proxyInstance.UpstreamPort),
 		zap.String("name", proxyInstance.Name),
+		zap.String("type", proxyInstance.Type),
 		zap.Int("resolveTTL", proxyInstance.ResolveTTL),
 		zap.Int("clientTimeout", proxyInstance.ClientTimeout),
+		zap.Int("socketPoolSize", proxyInstance.SocketPoolSize),
+		zap.Int("sourcePortRangeStart", proxyInstance.SourcePortRangeStart),
+		zap.Int("sourcePortRangeEnd", proxyInstance.SourcePortRangeEnd),
+		zap.String("sourcePortMapping", proxyInstance.SourcePortMapping),
+		zap.String("upstreamMode", proxyInstance.UpstreamMode),
+		zap.String("oversizePolicy", proxyInstance.OversizePolicy),
+		zap.String("filteringMode", proxyInstance.FilteringMode),
+		zap.String("tunnelRole", proxyInstance.Tunnel.Role),
+		zap.String("dtlsMode", proxyInstance.DTLS.Mode),
+		zap.String("fecRole", proxyInstance.FEC.Role),
 	)
 	pp := GetProxy(p.Debug, ll, proxyInstance.BindPort, p.BindAddress, proxyInstance.UpstreamAddress, proxyInstance.UpstreamPort, p.BufferSize, time.Duration(proxyInstance.ClientTimeout)*time.Millisecond, time.Duration(proxyInstance.ResolveTTL)*time.Millisecond)
+	pp.Type = proxyInstance.Type
+	pp.WebSocket = proxyInstance.WebSocket
+	pp.SOCKS5 = proxyInstance.SOCKS5
+	pp.TURN = proxyInstance.TURN
+	pp.QUIC = proxyInstance.QUIC
+	pp.DNS = proxyInstance.DNS
+	pp.SessionKey = proxyInstance.SessionKey
+	pp.SocketPoolSize = proxyInstance.SocketPoolSize
+	pp.SocketPoolRefillInterval = time.Duration(proxyInstance.SocketPoolRefillInterval) * time.Millisecond
+	pp.SourcePortRangeStart = proxyInstance.SourcePortRangeStart
+	pp.SourcePortRangeEnd = proxyInstance.SourcePortRangeEnd
+	pp.SourcePortMapping = proxyInstance.SourcePortMapping
+	pp.UpstreamMode = proxyInstance.UpstreamMode
+	pp.UpstreamWebSocketPath = proxyInstance.UpstreamWebSocketPath
+	pp.OversizePolicy = proxyInstance.OversizePolicy
+	pp.MaxUpstreamDatagramSize = proxyInstance.MaxUpstreamDatagramSize
+	pp.MaxClientDatagramSize = proxyInstance.MaxClientDatagramSize
+	pp.ClientRateLimit = proxyInstance.ClientRateLimit
+	pp.UpstreamRateLimit = proxyInstance.UpstreamRateLimit
+	pp.UpstreamShaping = proxyInstance.UpstreamShaping
+	pp.ClientShaping = proxyInstance.ClientShaping
+	pp.Admission = proxyInstance.Admission
+	pp.AmplificationGuard = proxyInstance.AmplificationGuard
+	pp.BanPolicy = proxyInstance.BanPolicy
+	pp.FilteringMode = proxyInstance.FilteringMode
+	pp.Authentication = proxyInstance.Authentication
+	pp.ProxyProtocol = proxyInstance.ProxyProtocol
+	pp.Tunnel = proxyInstance.Tunnel
+	pp.DTLS = proxyInstance.DTLS
+	pp.FEC = proxyInstance.FEC
+	pp.GlobalACL = p.ACL
+	pp.ACL = acl
 	ProxyStorage[bindPortString] = pp
-	pp.Start()
-	return true
+	if err := pp.Start(); err != nil {
+		ll.Error("proxy not started", zap.Error(err))
+		delete(ProxyConfigStorage, bindPortString)
+		delete(ProxyStorage, bindPortString)
+		return err
+	}
+	return nil
 }
 
 func (p *Manager) GetConfigByBindPort(port string) *ProxyInstance {
+	storageMutex.RLock()
+	defer storageMutex.RUnlock()
 	pi, _ := ProxyConfigStorage[port]
 	return pi
 }
 
+func (p *Manager) GetProxyByBindPort(port string) *Proxy {
+	storageMutex.RLock()
+	defer storageMutex.RUnlock()
+	pp, _ := ProxyStorage[port]
+	return pp
+}
+
 func (p *Manager) UnregisterByBindPort(port string) bool {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
 	pp, _ := ProxyStorage[port]
 	if pp == nil {
 		return false
@@ -105,6 +188,57 @@ func (p *Manager) UnregisterByBindPort(port string) bool {
 	return true
 }
 
+// AddACLRule appends a rule to the ACL of a proxy and closes the sessions it
+// denies
+func (p *Manager) AddACLRule(port string, rule ACLRule) error {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	pp, _ := ProxyStorage[port]
+	if pp == nil {
+		return ErrProxyNotFound
+	}
+	if err := pp.ACL.Add(rule); err != nil {
+		return err
+	}
+	ProxyConfigStorage[port].ACL = pp.ACL.Rules()
+	pp.EnforceACL()
+	return nil
+}
+
+// RemoveACLRule removes a rule from the ACL of a proxy
+func (p *Manager) RemoveACLRule(port string, rule ACLRule) error {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	pp, _ := ProxyStorage[port]
+	if pp == nil {
+		return ErrProxyNotFound
+	}
+	if err := pp.ACL.Remove(rule); err != nil {
+		return err
+	}
+	ProxyConfigStorage[port].ACL = pp.ACL.Rules()
+	return nil
+}
+
+// AddGlobalACLRule appends a rule to the global ACL and closes the sessions
+// it denies on every proxy
+func (p *Manager) AddGlobalACLRule(rule ACLRule) error {
+	if err := p.ACL.Add(rule); err != nil {
+		return err
+	}
+	storageMutex.RLock()
+	defer storageMutex.RUnlock()
+	for _, pp := range ProxyStorage {
+		pp.EnforceACL()
+	}
+	return nil
+}
+
+// RemoveGlobalACLRule removes a rule from the global ACL
+func (p *Manager) RemoveGlobalACLRule(rule ACLRule) error {
+	return p.ACL.Remove(rule)
+}
+
 func (p *Manager) PersistProxyConfig(proxy *ProxyInstance) error {
 	//TODO
 	return nil
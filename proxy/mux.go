@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/felipejfc/udpx/mux"
+	"github.com/felipejfc/udpx/stream"
+	"go.uber.org/zap"
+)
+
+// Upstream modes, they select how client sessions reach the upstream
+const (
+	// UpstreamModeSocket gives every client its own upstream socket
+	UpstreamModeSocket = "socket"
+	// UpstreamModeMux sends every client through a single upstream socket,
+	// prefixing each datagram with the udpx mux header. The upstream must be
+	// a udpx demuxer (see the mux package)
+	UpstreamModeMux = "mux"
+	// UpstreamModeTCP and UpstreamModeWebSocket carry every client session
+	// over its own TCP or WebSocket stream, for networks that block UDP. The
+	// upstream must be a udpx stream server (see the stream package)
+	UpstreamModeTCP       = stream.TransportTCP
+	UpstreamModeWebSocket = stream.TransportWebSocket
+)
+
+// ValidateUpstreamMode checks an upstream mode
+func ValidateUpstreamMode(mode string) error {
+	switch mode {
+	case "", UpstreamModeSocket, UpstreamModeMux, UpstreamModeTCP, UpstreamModeWebSocket:
+		return nil
+	}
+	return fmt.Errorf("invalid upstream mode %q", mode)
+}
+
+// muxer holds the shared upstream socket and the sessions multiplexed on it
+type muxer struct {
+	udp           *net.UDPConn
+	sessions      sync.Map
+	lastSessionID uint32
+	bufferPool    sync.Pool
+}
+
+func (p *Proxy) isMux() bool {
+	return p.UpstreamMode == UpstreamModeMux
+}
+
+func (p *Proxy) startMux() error {
+	conn, err := p.bindUpstreamSocket()
+	if err != nil {
+		return err
+	}
+	bufferSize := p.BufferSize + mux.HeaderSize + 1
+	p.muxer = &muxer{
+		udp:        conn,
+		bufferPool: sync.Pool{New: func() interface{} { return make([]byte, bufferSize) }},
+	}
+	p.Logger.Info("mux upstream socket bound", zap.String("local address", conn.LocalAddr().String()))
+	p.goTracked(&p.sessionsWg, p.muxReadLoop)
+	return nil
+}
+
+// assignMuxSession gives a new connection its session id
+func (p *Proxy) assignMuxSession(conn *connection) {
+	for {
+		id := atomic.AddUint32(&p.muxer.lastSessionID, 1)
+		if id == 0 {
+			continue
+		}
+		conn.sessionID = id
+		if _, loaded := p.muxer.sessions.LoadOrStore(id, conn); !loaded {
+			p.stats.inc(statMuxSessions)
+			return
+		}
+	}
+}
+
+func (p *Proxy) writeMux(conn *connection, data []byte) (int, error) {
+	buf := p.muxer.bufferPool.Get().([]byte)
+	defer p.muxer.bufferPool.Put(buf)
+	mux.Header{SessionID: conn.sessionID}.Encode(buf)
+	n := copy(buf[mux.HeaderSize:], data)
+	return p.muxer.udp.WriteToUDP(buf[:mux.HeaderSize+n], p.upstreamAddr())
+}
+
+// closeMuxSession forgets a session, notifying the demuxer if asked to
+func (p *Proxy) closeMuxSession(conn *connection, notify bool) {
+	p.muxer.sessions.Delete(conn.sessionID)
+	p.stats.dec(statMuxSessions)
+	if notify {
+		buf := make([]byte, mux.HeaderSize)
+		mux.Header{Flags: mux.FlagClose, SessionID: conn.sessionID}.Encode(buf)
+		p.muxer.udp.WriteToUDP(buf, p.upstreamAddr())
+	}
+}
+
+func (p *Proxy) muxReadLoop() {
+	for {
+		buf := p.muxer.bufferPool.Get().([]byte)
+		size, _, flags, src, err := p.muxer.udp.ReadMsgUDP(buf[:cap(buf)], nil)
+		if err != nil {
+			p.muxer.bufferPool.Put(buf)
+			if p.closing() {
+				return
+			}
+			p.Logger.Error("mux read error", zap.Error(err))
+			continue
+		}
+		if !p.acceptReply(src, p.upstreamAddr()) {
+			p.muxer.bufferPool.Put(buf)
+			continue
+		}
+		if flags&msgTrunc != 0 || size > p.BufferSize+mux.HeaderSize {
+			size = p.BufferSize + mux.HeaderSize
+			if !p.acceptTruncated(src, false) {
+				p.muxer.bufferPool.Put(buf)
+				continue
+			}
+		}
+		header, payload, err := mux.Decode(buf[:size])
+		if err != nil {
+			p.muxer.bufferPool.Put(buf)
+			p.stats.inc(statMuxInvalidDatagrams)
+			continue
+		}
+		c, found := p.muxer.sessions.Load(header.SessionID)
+		if !found {
+			p.muxer.bufferPool.Put(buf)
+			p.stats.inc(statMuxUnknownSessions)
+			continue
+		}
+		conn := c.(*connection)
+		if header.Flags&mux.FlagClose != 0 {
+			p.muxer.bufferPool.Put(buf)
+			p.Logger.Debug("mux session closed by upstream", zap.Uint32("session", header.SessionID))
+			p.closeConnectionWith(conn, false)
+			p.removeConnection(conn)
+			continue
+		}
+		msg := p.bufferPool.Get().([]byte)
+		n := copy(msg[:cap(msg)], payload)
+		p.muxer.bufferPool.Put(buf)
+		conn.touch()
+		if !p.sendUpstreamPacket(packet{src: conn.replyAddr(), conn: conn, data: msg[:n]}) {
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// Source port mapping modes for the upstream facing sockets
+const (
+	// SourcePortMappingRandom binds to any free port
+	SourcePortMappingRandom = "random"
+	// SourcePortMappingDeterministic binds the same client ip:port to the
+	// same source port whenever it is free
+	SourcePortMappingDeterministic = "deterministic"
+	// SourcePortMappingPreserve tries to bind to the client's own source port
+	SourcePortMappingPreserve = "preserve"
+)
+
+var errPortRangeExhausted = errors.New("source port range exhausted")
+
+// ValidateSourcePorts checks a source port range and mapping mode, a zero
+// range means that the operating system chooses the ports
+func ValidateSourcePorts(start, end int, mapping string) error {
+	switch mapping {
+	case "", SourcePortMappingRandom, SourcePortMappingDeterministic, SourcePortMappingPreserve:
+	default:
+		return fmt.Errorf("invalid source port mapping %q", mapping)
+	}
+	if start == 0 && end == 0 {
+		if mapping == SourcePortMappingDeterministic {
+			return errors.New("deterministic source port mapping requires a source port range")
+		}
+		return nil
+	}
+	if start < 1 || end > 65535 || start > end {
+		return fmt.Errorf("invalid source port range %d-%d", start, end)
+	}
+	return nil
+}
+
+// portAllocator keeps track of which ports of a range are in use
+type portAllocator struct {
+	start int
+	end   int
+	mutex sync.Mutex
+	inUse []bool
+	used  int
+}
+
+func newPortAllocator(start, end int) *portAllocator {
+	return &portAllocator{
+		start: start,
+		end:   end,
+		inUse: make([]bool, end-start+1),
+	}
+}
+
+func (a *portAllocator) contains(port int) bool {
+	return port >= a.start && port <= a.end
+}
+
+func (a *portAllocator) size() int {
+	return len(a.inUse)
+}
+
+// reserve marks port as used, it returns false if it was already taken
+func (a *portAllocator) reserve(port int) bool {
+	if !a.contains(port) {
+		return false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.inUse[port-a.start] {
+		return false
+	}
+	a.inUse[port-a.start] = true
+	a.used++
+	return true
+}
+
+// reserveAny marks a random free port as used
+func (a *portAllocator) reserveAny() (int, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.used == len(a.inUse) {
+		return 0, false
+	}
+	offset := rand.Intn(len(a.inUse))
+	for i := range a.inUse {
+		idx := (offset + i) % len(a.inUse)
+		if !a.inUse[idx] {
+			a.inUse[idx] = true
+			a.used++
+			return a.start + idx, true
+		}
+	}
+	return 0, false
+}
+
+func (a *portAllocator) release(port int) {
+	if !a.contains(port) {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.inUse[port-a.start] {
+		a.inUse[port-a.start] = false
+		a.used--
+	}
+}
+
+func (a *portAllocator) inUseCount() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.used
+}
+
+// deterministicPort maps a client address to a port of the range
+func (a *portAllocator) deterministicPort(client *net.UDPAddr) int {
+	h := fnv.New32a()
+	h.Write(client.IP.To16())
+	h.Write([]byte{byte(client.Port >> 8), byte(client.Port)})
+	return a.start + int(h.Sum32()%uint32(a.size()))
+}
@@ -23,15 +23,27 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/felipejfc/udpx/auth"
+	"github.com/felipejfc/udpx/expiry"
+	"github.com/felipejfc/udpx/fec"
+	"github.com/felipejfc/udpx/stream"
+	"github.com/felipejfc/udpx/tunnel"
+	"github.com/felipejfc/udpx/turn"
+	"github.com/pion/dtls/v2"
 	"go.uber.org/zap"
 )
 
+const defaultSocketPoolRefillInterval = 100 * time.Millisecond
+
 // CheckError checks for error
 func CheckError(err error) {
 	logger, err := zap.NewProduction()
@@ -41,15 +53,118 @@ func CheckError(err error) {
 }
 
 type connection struct {
-	udp          *net.UDPConn
-	lastActivity time.Time
+	// 64 bit values accessed atomically go first to keep them aligned on
+	// 32 bit platforms
+	lastActivity             int64
+	rateLimitDropsToUpstream uint64
+	rateLimitDropsToClient   uint64
+	bytesFromClient          uint64
+	packetsFromClient        uint64
+	bytesToClient            uint64
+	lastRebind               int64
+	udp                      *net.UDPConn
+	// addrs holds the *sessionAddrs of the client, replies follow the
+	// clients of QUIC sessions and sessions not keyed by address when they
+	// move to another address
+	addrs atomic.Value
+	// key is the session key the connection is stored under
+	key               string
+	sessionID         uint32
+	closed            int32
+	validated         int32
+	proxyHeaderSent   int32
+	closeOnce         sync.Once
+	toUpstreamLimiter *rateLimiter
+	toClientLimiter   *rateLimiter
+	tunnelSender      *tunnel.Sender
+	dtls              *dtlsSession
+	stream            *streamSession
+	fecEncoder        *fecEncoder
+	fecDecoder        *fec.Decoder
+	socks             *socksSession
+	allocation        *turnAllocation
+	quic              *quicSession
+	// authToken holds the []byte token the session was opened or last
+	// rebound with
+	authToken atomic.Value
+	// clientStream carries the datagrams of websocket clients
+	clientStream stream.Conn
+}
+
+// touch records activity on the connection, it is cheap enough to be called
+// for every datagram
+func (c *connection) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *connection) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
+// sessionAddrs are the addresses of the client of a session, they are
+// swapped together when the session moves
+type sessionAddrs struct {
+	client *net.UDPAddr
+	// peer is where replies are sent, it differs from client when the
+	// client address came in a PROXY protocol header
+	peer *net.UDPAddr
+}
+
+// clientAddr returns the address of the client, the one the ACL, bans,
+// admission limits and PROXY protocol headers apply to
+func (c *connection) clientAddr() *net.UDPAddr {
+	return c.addrs.Load().(*sessionAddrs).client
+}
+
+// replyAddr returns where replies to the client are sent
+func (c *connection) replyAddr() *net.UDPAddr {
+	return c.addrs.Load().(*sessionAddrs).peer
+}
+
+// moveTo makes client the address of the client and sends its replies to
+// peer
+func (c *connection) moveTo(client, peer *net.UDPAddr) {
+	c.addrs.Store(&sessionAddrs{client: client, peer: peer})
+}
+
+func (c *connection) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// isValidated reports whether the client proved it is reachable
+func (c *connection) isValidated() bool {
+	return atomic.LoadInt32(&c.validated) != 0
 }
 
 type packet struct {
 	src  *net.UDPAddr
+	peer *net.UDPAddr
+	conn *connection
 	data []byte
 }
 
+// Proxy types, a udp proxy accepts clients on its UDP bind port, a websocket
+// proxy accepts them over WebSocket, every binary message being a datagram,
+// a socks5 proxy relays the datagrams of SOCKS 5 UDP ASSOCIATE clients, a
+// turn proxy relays the datagrams of TURN clients and a dns proxy forwards
+// DNS queries to resolvers chosen by query name
+const (
+	ProxyTypeUDP       = "udp"
+	ProxyTypeWebSocket = "websocket"
+	ProxyTypeSOCKS5    = "socks5"
+	ProxyTypeTURN      = "turn"
+	ProxyTypeDNS       = "dns"
+)
+
+// ValidateProxyType checks a proxy type
+func ValidateProxyType(proxyType string) error {
+	switch proxyType {
+	case "", ProxyTypeUDP, ProxyTypeWebSocket, ProxyTypeSOCKS5, ProxyTypeTURN, ProxyTypeDNS:
+		return nil
+	}
+	return fmt.Errorf("invalid proxy type %q", proxyType)
+}
+
 // Proxy struct
 type Proxy struct {
 	Logger                 *zap.Logger
@@ -60,19 +175,136 @@ type Proxy struct {
 	Debug                  bool
 	listenerConn           *net.UDPConn
 	client                 *net.UDPAddr
-	upstream               *net.UDPAddr
+	upstream               atomic.Value
 	BufferSize             int
 	ConnTimeout            time.Duration
 	ResolveTTL             time.Duration
 	connsMap               sync.Map
-	closed                 bool
+	ctx                    context.Context
+	cancel                 context.CancelFunc
+	closeOnce              sync.Once
+	readersWg              sync.WaitGroup
+	handlersWg             sync.WaitGroup
+	sessionsWg             sync.WaitGroup
+	upstreamHandlersWg     sync.WaitGroup
+	backgroundWg           sync.WaitGroup
 	clientMessageChannel   chan (packet)
 	upstreamMessageChannel chan (packet)
 	bufferPool             sync.Pool
+	// SocketPoolSize is the number of pre-bound upstream sockets kept ready
+	// for new clients, 0 disables the pool
+	SocketPoolSize int
+	// SocketPoolRefillInterval is how often the pool is topped up, besides
+	// being refilled whenever a socket is taken from it
+	SocketPoolRefillInterval time.Duration
+	// SourcePortRangeStart and SourcePortRangeEnd restrict the ports of the
+	// upstream facing sockets, 0 lets the operating system choose them
+	SourcePortRangeStart int
+	SourcePortRangeEnd   int
+	// SourcePortMapping selects how a source port is chosen for a client,
+	// see SourcePortMappingRandom, SourcePortMappingDeterministic and
+	// SourcePortMappingPreserve
+	SourcePortMapping string
+	// UpstreamMode selects how clients reach the upstream, see
+	// UpstreamModeSocket, UpstreamModeMux, UpstreamModeTCP and
+	// UpstreamModeWebSocket
+	UpstreamMode string
+	// UpstreamWebSocketPath is the URL path of the stream server for the
+	// websocket upstream mode, it defaults to /
+	UpstreamWebSocketPath string
+	// OversizePolicy decides what happens to datagrams larger than
+	// BufferSize, see OversizePolicyDrop, OversizePolicyTruncate and
+	// OversizePolicyLog
+	OversizePolicy string
+	// MaxUpstreamDatagramSize and MaxClientDatagramSize drop datagrams larger
+	// than them before they are sent to each side, 0 disables the check
+	MaxUpstreamDatagramSize int
+	MaxClientDatagramSize   int
+	// ClientRateLimit polices what each client sends to the upstream and
+	// UpstreamRateLimit what the upstream sends to each client
+	ClientRateLimit   RateLimit
+	UpstreamRateLimit RateLimit
+	// UpstreamShaping caps the aggregate traffic sent to the upstream and
+	// ClientShaping the aggregate traffic sent to the clients
+	UpstreamShaping Shaping
+	ClientShaping   Shaping
+	// FilteringMode decides which sources may send datagrams to the clients
+	// through the upstream facing sockets, see FilteringEndpointIndependent,
+	// FilteringAddressDependent and FilteringAddressAndPortDependent
+	FilteringMode string
+	// ACL allows or denies client source addresses, GlobalACL is shared by
+	// every proxy of a manager, a datagram has to be allowed by both
+	ACL       *ACL
+	GlobalACL *ACL
+	// Tunnel encrypts the traffic between a tunnel entry and a tunnel exit
+	Tunnel      Tunnel
+	tunnelCodec *tunnel.Codec
+	// DTLS terminates DTLS from clients or originates it toward the upstream
+	DTLS       DTLS
+	dtlsConfig *dtls.Config
+	// dtlsHandshakes are the handshakes of clients without a session yet
+	// when DTLS is terminated, bounded by the slots and by the count of
+	// each client IP
+	dtlsHandshakes      sync.Map
+	dtlsHandshakeSlots  chan struct{}
+	dtlsHandshakesMutex sync.Mutex
+	dtlsHandshakesPerIP map[string]int
+	// FEC adds parity datagrams between a FEC entry and a FEC exit
+	FEC         FEC
+	fecDecoders *fecDecoders
+	// Type is ProxyTypeUDP, the default, ProxyTypeWebSocket, which accepts
+	// clients over WebSocket as configured by WebSocket, ProxyTypeSOCKS5,
+	// ProxyTypeTURN or ProxyTypeDNS
+	Type      string
+	WebSocket WebSocketGateway
+	gateway   *gateway
+	// SOCKS5 configures socks5 proxies
+	SOCKS5 SOCKS5
+	socks  *socksServer
+	// TURN configures turn proxies
+	TURN       TURN
+	turnServer *turnServer
+	// QUIC routes QUIC connections by server name and connection id
+	QUIC       QUIC
+	quicRouter *quicRouter
+	// DNS routes the queries of a dns proxy to resolvers
+	DNS DNS
+	dns *dnsForwarder
+	// SessionKey decides which session a client datagram belongs to
+	SessionKey SessionKey
+	sessionKey func(pa packet) (string, bool)
+	// ProxyProtocol adds PROXY protocol v2 headers to what is sent to the
+	// upstream and parses them in what is received from clients
+	ProxyProtocol      ProxyProtocol
+	proxyProtocolPeers []*net.IPNet
+	// Authentication requires the first datagram of a session to carry a
+	// valid token
+	Authentication Authentication
+	authVerifier   *auth.Verifier
+	// BanPolicy temporarily bans clients that keep exceeding the rate limit
+	// or sending oversized datagrams
+	BanPolicy BanPolicy
+	banList   *banList
+	// banPersist wakes up the loop that saves the bans to the persist file
+	banPersist chan struct{}
+	// AmplificationGuard limits what is sent to clients that did not prove
+	// they are reachable yet
+	AmplificationGuard AmplificationGuard
+	// Admission limits the sessions accepted from clients
+	Admission      Admission
+	admission      *admission
+	upstreamShaper *shaper
+	clientShaper   *shaper
+	socketPool     *socketPool
+	portAllocator  *portAllocator
+	muxer          *muxer
+	expiryWheel    *expiry.Wheel
+	stats          *stats
 }
 
 // GetProxy gets the proxy
 func GetProxy(debug bool, logger *zap.Logger, bindPort int, bindAddress string, upstreamAddress string, upstreamPort int, bufferSize int, connTimeout time.Duration, resolveTTL time.Duration) *Proxy {
+	ctx, cancel := context.WithCancel(context.Background())
 	proxy := &Proxy{
 		Debug:                  debug,
 		Logger:                 logger,
@@ -82,45 +314,155 @@ func GetProxy(debug bool, logger *zap.Logger, bindPort int, bindAddress string,
 		ConnTimeout:            connTimeout,
 		UpstreamAddress:        upstreamAddress,
 		UpstreamPort:           upstreamPort,
-		closed:                 false,
+		ctx:                    ctx,
+		cancel:                 cancel,
 		ResolveTTL:             resolveTTL,
+		ACL:                    &ACL{},
 		clientMessageChannel:   make(chan packet),
 		upstreamMessageChannel: make(chan packet),
-		bufferPool:             sync.Pool{New: func() interface{} { return make([]byte, bufferSize) }},
+		// one guard byte more than bufferSize, so truncation can always be detected
+		bufferPool: sync.Pool{New: func() interface{} { return make([]byte, bufferSize+1) }},
+		stats:      &stats{},
 	}
 
 	return proxy
 }
 
-func (p *Proxy) updateClientLastActivity(clientAddrString string) {
-	p.Logger.Debug("updating client last activity", zap.String("client", clientAddrString))
-	if connWrapper, found := p.connsMap.Load(clientAddrString); found {
-		connWrapper.(*connection).lastActivity = time.Now()
-	}
+// upstreamAddr returns the last resolved upstream address
+func (p *Proxy) upstreamAddr() *net.UDPAddr {
+	addr, _ := p.upstream.Load().(*net.UDPAddr)
+	return addr
+}
+
+// closing reports whether Close was called
+func (p *Proxy) closing() bool {
+	return p.ctx.Err() != nil
+}
+
+// goTracked runs f in a goroutine tracked by wg and by the goroutines gauge
+func (p *Proxy) goTracked(wg *sync.WaitGroup, f func()) {
+	wg.Add(1)
+	p.stats.inc(statGoroutines)
+	go func() {
+		defer wg.Done()
+		defer p.stats.dec(statGoroutines)
+		f()
+	}()
 }
 
-func (p *Proxy) clientConnectionReadLoop(clientAddr *net.UDPAddr, upstreamConn *net.UDPConn) {
-	clientAddrString := clientAddr.String()
+func (p *Proxy) clientConnectionReadLoop(conn *connection) {
 	for {
 		msg := p.bufferPool.Get().([]byte)
-		size, _, err := upstreamConn.ReadFromUDP(msg[0:])
+		size, src, truncated, err := p.readDatagram(conn.udp, msg, p.upstreamOverhead())
 		if err != nil {
-			upstreamConn.Close()
-			p.connsMap.Delete(clientAddrString)
+			p.bufferPool.Put(msg)
+			p.closeConnection(conn)
+			p.removeConnection(conn)
 			return
 		}
-		p.updateClientLastActivity(clientAddrString)
-		p.upstreamMessageChannel <- packet{
-			src:  clientAddr,
-			data: msg[:size],
+		if conn.allocation != nil {
+			if truncated && !p.acceptTruncated(src, false) {
+				p.bufferPool.Put(msg)
+				continue
+			}
+			data, ok := p.toTURNClient(conn, msg, size, src)
+			p.bufferPool.Put(msg)
+			if !ok {
+				continue
+			}
+			conn.touch()
+			if !p.sendUpstreamPacket(packet{src: conn.replyAddr(), conn: conn, data: data}) {
+				return
+			}
+			continue
+		}
+		if conn.socks != nil {
+			if !p.acceptSOCKSReply(conn, src) || truncated && !p.acceptTruncated(src, false) {
+				p.bufferPool.Put(msg)
+				continue
+			}
+			conn.touch()
+			size = withSOCKSHeader(msg, size, src)
+			if !p.sendUpstreamPacket(packet{src: conn.replyAddr(), conn: conn, data: msg[:size]}) {
+				return
+			}
+			continue
+		}
+		if !p.acceptReply(src, p.sessionUpstream(conn)) || truncated && !p.acceptTruncated(src, false) {
+			p.bufferPool.Put(msg)
+			continue
+		}
+		if conn.quic != nil {
+			p.fromQUICUpstream(conn, msg[:size])
+		}
+		if p.DTLS.Mode == DTLSModeOriginate {
+			p.feedDTLS(conn.dtls, msg[:size])
+			p.bufferPool.Put(msg)
+			continue
+		}
+		if p.Tunnel.Role == TunnelRoleEntry {
+			var ok bool
+			if size, ok = p.openTunnel(tunnel.Reverse, msg, size); !ok {
+				p.bufferPool.Put(msg)
+				continue
+			}
 		}
+		conn.touch()
+		if p.FEC.Role == FECRoleEntry {
+			ok := p.decodeFEC(conn.fecDecoder, src, msg[:size], func(datagram []byte) bool {
+				buf := p.bufferPool.Get().([]byte)
+				n := copy(buf[:cap(buf)], datagram)
+				return p.sendUpstreamPacket(packet{src: conn.replyAddr(), conn: conn, data: buf[:n]})
+			})
+			p.bufferPool.Put(msg)
+			if !ok {
+				return
+			}
+			continue
+		}
+		if !p.sendUpstreamPacket(packet{src: conn.replyAddr(), conn: conn, data: msg[:size]}) {
+			return
+		}
+	}
+}
+
+// sendUpstreamPacket queues a datagram for the client, it returns false if
+// the proxy is closing
+func (p *Proxy) sendUpstreamPacket(pa packet) bool {
+	select {
+	case p.upstreamMessageChannel <- pa:
+		return true
+	case <-p.ctx.Done():
+		p.bufferPool.Put(pa.data)
+		return false
+	}
+}
+
+// removeConnection deletes conn from the connections map unless it was
+// already replaced by a newer connection for the same client
+func (p *Proxy) removeConnection(conn *connection) {
+	if current, found := p.connsMap.Load(conn.key); found && current == conn {
+		p.connsMap.Delete(conn.key)
 	}
 }
 
 func (p *Proxy) handlerUpstreamPackets() {
 	for pa := range p.upstreamMessageChannel {
 		p.Logger.Debug("forwarded data from upstream", zap.Int("size", len(pa.data)), zap.String("data", string(pa.data)))
-		p.listenerConn.WriteTo(pa.data, pa.src)
+		if !p.allowToClient(pa.conn, len(pa.data)) {
+			p.bufferPool.Put(pa.data)
+			continue
+		}
+		if pa.conn.toClientLimiter.allow(len(pa.data), time.Now()) {
+			if p.clientShaper != nil {
+				p.clientShaper.enqueue(pa.conn, pa.src, pa.data)
+			} else {
+				p.writeToClient(pa.conn, pa.data, pa.src)
+			}
+		} else {
+			atomic.AddUint64(&pa.conn.rateLimitDropsToClient, 1)
+			p.stats.inc(statRateLimitDropsToClients)
+		}
 		p.bufferPool.Put(pa.data)
 	}
 }
@@ -134,147 +476,824 @@ func (p *Proxy) handleClientPackets() {
 			zap.String("packet", string(pa.data)),
 			zap.Int("size", len(pa.data)),
 		)
+		if !p.allowsClient(pa.src, pa.peer) {
+			p.stats.inc(statACLDrops)
+			p.bufferPool.Put(pa.data)
+			continue
+		}
+		if p.banList.banned(pa.src.IP.String(), time.Now()) {
+			p.stats.inc(statBanDrops)
+			p.bufferPool.Put(pa.data)
+			continue
+		}
 
-		conn, found := p.connsMap.Load(packetSourceString)
-		if !found {
-			conn, err := net.ListenUDP("udp", p.client)
-			p.Logger.Debug("new client connection",
-				zap.String("local port", conn.LocalAddr().String()),
-			)
+		// dns proxies have no sessions, queries are told apart by their
+		// transaction ids
+		if p.dns != nil {
+			p.fromDNSClient(pa)
+			p.bufferPool.Put(pa.data)
+			continue
+		}
 
+		key, ok := p.sessionKey(pa)
+		if !ok {
+			p.stats.inc(statSessionKeyDrops)
+			p.bufferPool.Put(pa.data)
+			continue
+		}
+
+		conn, found := p.connsMap.Load(key)
+		if !found {
+			if p.closing() {
+				p.bufferPool.Put(pa.data)
+				continue
+			}
+			if p.DTLS.Mode == DTLSModeTerminate {
+				p.handshakeDTLS(key, pa)
+				p.bufferPool.Put(pa.data)
+				continue
+			}
+			data, ok := p.authenticate(pa.src, pa.data)
+			if !ok {
+				p.bufferPool.Put(pa.data)
+				continue
+			}
+			// only authenticated Allocate requests create turn sessions
+			var turnKey []byte
+			if p.turnServer != nil {
+				if turnKey = p.acceptTURNAllocation(pa.src, data); turnKey == nil {
+					p.bufferPool.Put(pa.data)
+					continue
+				}
+			}
+			// quic clients that migrated keep their session, new ones are
+			// routed by their ClientHello
+			var decision quicDecision
+			if p.quicRouter != nil {
+				if decision, ok = p.routeQUIC(pa.src, data); !ok {
+					p.bufferPool.Put(pa.data)
+					continue
+				}
+				if decision.conn != nil {
+					p.migrateQUIC(decision.conn, pa)
+					p.fromClient(decision.conn, data)
+					decision.conn.touch()
+					p.bufferPool.Put(pa.data)
+					continue
+				}
+			}
+			if !p.admitClient(pa.src) {
+				p.stats.inc(statPacketsDropped)
+				p.refuseTURNAllocation(pa.src, data, turnKey, turn.CodeAllocationQuotaReached, "Allocation Quota Reached")
+				p.bufferPool.Put(pa.data)
+				continue
+			}
+			newConn, err := p.newConnection(key, pa.src, pa.peer)
 			if err != nil {
-				p.Logger.Error("upd proxy failed to dial", zap.Error(err))
-				return
+				p.admission.release(pa.src.IP)
+				p.stats.inc(statPacketsDropped)
+				p.refuseTURNAllocation(pa.src, data, turnKey, turn.CodeInsufficientCapacity, "Insufficient Capacity")
+				p.countConnectionError(err, packetSourceString)
+				p.bufferPool.Put(pa.data)
+				continue
 			}
 
-			p.connsMap.Store(packetSourceString, &connection{
-				udp:          conn,
-				lastActivity: time.Now(),
-			})
+			if newConn.quic != nil {
+				newConn.quic.route, newConn.quic.serverName = decision.route, decision.serverName
+			}
+			if p.authVerifier != nil {
+				newConn.authToken.Store(append([]byte(nil), pa.data[:len(pa.data)-len(data)]...))
+			}
 
-			conn.WriteTo(pa.data, p.upstream)
-			go p.clientConnectionReadLoop(pa.src, conn)
-		} else {
-			conn.(*connection).udp.WriteTo(pa.data, p.upstream)
-			shouldUpdateLastActivity := false
-			if conn, found := p.connsMap.Load(packetSourceString); found {
-				if conn.(*connection).lastActivity.Before(
-					time.Now().Add(-p.ConnTimeout / 4)) {
-					shouldUpdateLastActivity = true
+			actual, loaded := p.connsMap.LoadOrStore(key, newConn)
+			if loaded {
+				// another worker created the session first
+				p.discardConnection(newConn)
+				p.admission.release(pa.src.IP)
+				if !p.SessionKey.byAddress() {
+					if data, ok = p.rebind(actual.(*connection), pa, data, true); !ok {
+						p.bufferPool.Put(pa.data)
+						continue
+					}
 				}
+				for _, held := range decision.held {
+					p.fromClient(actual.(*connection), held)
+				}
+				p.fromClient(actual.(*connection), data)
+				p.bufferPool.Put(pa.data)
+				continue
+			}
+
+			if newConn.dtls != nil {
+				p.goTracked(&p.sessionsWg, func() { p.dtlsSessionLoop(newConn) })
+			}
+			if newConn.stream != nil {
+				p.goTracked(&p.sessionsWg, func() { p.streamSessionLoop(newConn) })
+			}
+			for _, held := range decision.held {
+				p.fromClient(newConn, held)
+			}
+			p.fromClient(newConn, data)
+			if newConn.quic != nil {
+				p.learnQUICConnectionID(newConn, decision.cid)
 			}
-			if shouldUpdateLastActivity {
-				p.updateClientLastActivity(packetSourceString)
+			if p.expiryWheel != nil {
+				p.expiryWheel.Schedule(newConn, p.sessionDeadline(newConn))
 			}
+			if newConn.udp != nil {
+				p.goTracked(&p.sessionsWg, func() { p.clientConnectionReadLoop(newConn) })
+			}
+		} else {
+			c := conn.(*connection)
+			data := p.stripToken(c, pa.data)
+			if c.quic != nil {
+				p.fromQUICClient(c, pa)
+			} else if !p.SessionKey.byAddress() {
+				if data, ok = p.rebind(c, pa, data, false); !ok {
+					p.bufferPool.Put(pa.data)
+					continue
+				}
+			}
+			p.fromClient(c, data)
+			c.touch()
 		}
 		p.bufferPool.Put(pa.data)
 	}
 }
 
+// countConnectionError accounts for a session of client that could not be
+// created
+func (p *Proxy) countConnectionError(err error, client string) {
+	if err == errSOCKS5NotAssociated {
+		p.stats.inc(statSOCKS5UnassociatedDrops)
+	} else if err == errClientGone {
+		p.Logger.Debug("client stream closed, dropping packet", zap.String("client", client))
+	} else if err == errPortRangeExhausted {
+		p.stats.inc(statSourcePortsExhausted)
+		p.Logger.Warn("source port range exhausted, dropping packet", zap.String("client", client))
+	} else {
+		p.stats.inc(statSocketBindErrors)
+		p.Logger.Error("udp proxy failed to bind upstream socket, dropping packet", zap.Error(err), zap.String("client", client))
+	}
+}
+
+// fromClient hands a client datagram to the DTLS session of conn when DTLS
+// is terminated and forwards it to the upstream otherwise
+func (p *Proxy) fromClient(conn *connection, data []byte) {
+	if p.DTLS.Mode == DTLSModeTerminate {
+		p.feedDTLS(conn.dtls, data)
+		return
+	}
+	if conn.socks != nil {
+		p.fromSOCKSClient(conn, data)
+		return
+	}
+	if conn.allocation != nil {
+		p.fromTURNClient(conn, data)
+		return
+	}
+	p.forwardToUpstream(conn, data, nil)
+}
+
+// forwardToUpstream polices a client datagram and sends it to dst, or to
+// the upstream when dst is nil
+func (p *Proxy) forwardToUpstream(conn *connection, data []byte, dst *net.UDPAddr) {
+	if !conn.toUpstreamLimiter.allow(len(data), time.Now()) {
+		atomic.AddUint64(&conn.rateLimitDropsToUpstream, 1)
+		p.stats.inc(statRateLimitDropsToUpstream)
+		p.reportOffense(conn.clientAddr().IP, OffenseRateLimit)
+		return
+	}
+	p.accountFromClient(conn, len(data))
+	if p.upstreamShaper != nil {
+		p.upstreamShaper.enqueue(conn, dst, data)
+		return
+	}
+	p.writeToUpstream(conn, data, dst)
+}
+
+// newConnection creates the upstream side of a new client session
+func (p *Proxy) newConnection(key string, client, peer *net.UDPAddr) (*connection, error) {
+	now := time.Now()
+	conn := &connection{
+		key:               key,
+		lastActivity:      now.UnixNano(),
+		toUpstreamLimiter: newRateLimiter(p.ClientRateLimit, p.BufferSize, now),
+		toClientLimiter:   newRateLimiter(p.UpstreamRateLimit, p.BufferSize, now),
+	}
+	conn.moveTo(client, peer)
+	sender, err := p.newTunnelSender()
+	if err != nil {
+		return nil, err
+	}
+	conn.tunnelSender = sender
+	if p.socks != nil {
+		if conn.socks, err = p.newSOCKSSession(client); err != nil {
+			return nil, err
+		}
+	}
+	if p.quicRouter != nil {
+		conn.quic = &quicSession{}
+	}
+	if p.turnServer != nil {
+		conn.allocation = newTURNAllocation()
+		// the nonce round trip proved the client is reachable
+		conn.validated = validatedByHandshake
+	}
+	if p.gateway != nil {
+		if conn.clientStream = p.gateway.stream(conn.key); conn.clientStream == nil {
+			return nil, errClientGone
+		}
+		// the TCP handshake already proved the client is reachable
+		conn.validated = validatedByHandshake
+	}
+	if p.FEC.Role != "" {
+		if conn.fecEncoder, err = p.newFECEncoder(conn); err != nil {
+			return nil, err
+		}
+		if p.FEC.Role == FECRoleEntry {
+			conn.fecDecoder = fec.NewDecoder(p.FEC.Window)
+		}
+	}
+	if p.isMux() {
+		p.assignMuxSession(conn)
+	} else if p.isStream() {
+		conn.stream = &streamSession{}
+	} else {
+		udp, err := p.newUpstreamSocket(client)
+		if err != nil {
+			return nil, err
+		}
+		p.Logger.Debug("new client connection",
+			zap.String("local port", udp.LocalAddr().String()),
+		)
+		conn.udp = udp
+	}
+	if p.DTLS.Mode == DTLSModeOriginate {
+		udp := conn.udp
+		conn.dtls = p.newDTLSSession(udp.LocalAddr(), p.upstreamAddr(), func(b []byte) (int, error) {
+			return udp.WriteToUDP(b, p.upstreamAddr())
+		})
+	}
+	if conn.socks != nil && !conn.socks.association.add(conn) {
+		// the association ended meanwhile
+		p.discardConnection(conn)
+		return nil, errSOCKS5NotAssociated
+	}
+	return conn, nil
+}
+
+// discardConnection releases a connection that was never used
+func (p *Proxy) discardConnection(conn *connection) {
+	if conn.dtls != nil {
+		conn.dtls.close()
+	}
+	if conn.socks != nil {
+		conn.socks.association.remove(conn)
+	}
+	if conn.stream != nil {
+		conn.stream.close()
+		return
+	}
+	if conn.udp == nil {
+		p.closeMuxSession(conn, false)
+		return
+	}
+	p.releaseUnusedSocket(conn.udp)
+}
+
+func (p *Proxy) writeUpstream(conn *connection, data []byte) (int, error) {
+	switch {
+	case conn.stream != nil:
+		return p.writeStream(conn, data)
+	case conn.udp == nil:
+		return p.writeMux(conn, data)
+	}
+	return conn.udp.WriteToUDP(data, p.sessionUpstream(conn))
+}
+
+// newUpstreamSocket returns a socket for a new client, honoring the source
+// port mapping mode and taking it from the socket pool when enabled
+func (p *Proxy) newUpstreamSocket(client *net.UDPAddr) (*net.UDPConn, error) {
+	if port, ok := p.preferredSourcePort(client); ok {
+		conn, err := p.bindUpstreamSocketOnPort(port)
+		if err == nil {
+			p.stats.inc(statSourcePortMappingHits)
+			return conn, nil
+		}
+		p.stats.inc(statSourcePortMappingMisses)
+		p.Logger.Debug("preferred source port unavailable", zap.Int("port", port), zap.Error(err))
+	}
+	if p.socketPool != nil {
+		return p.socketPool.get()
+	}
+	return p.bindUpstreamSocket()
+}
+
+// preferredSourcePort returns the port a client should be mapped to, if any
+func (p *Proxy) preferredSourcePort(client *net.UDPAddr) (int, bool) {
+	switch p.SourcePortMapping {
+	case SourcePortMappingDeterministic:
+		return p.portAllocator.deterministicPort(client), true
+	case SourcePortMappingPreserve:
+		if p.portAllocator != nil && !p.portAllocator.contains(client.Port) {
+			return 0, false
+		}
+		return client.Port, true
+	}
+	return 0, false
+}
+
+// bindUpstreamSocket binds a socket to any free port of the source port range
+func (p *Proxy) bindUpstreamSocket() (*net.UDPConn, error) {
+	if p.portAllocator == nil {
+		return net.ListenUDP("udp", p.client)
+	}
+	for i := 0; i < p.portAllocator.size(); i++ {
+		port, ok := p.portAllocator.reserveAny()
+		if !ok {
+			break
+		}
+		conn, err := p.listenUpstream(port)
+		if err == nil {
+			return conn, nil
+		}
+		// the port is probably taken by another process, try the next one
+		p.portAllocator.release(port)
+		p.Logger.Debug("failed to bind source port", zap.Int("port", port), zap.Error(err))
+	}
+	return nil, errPortRangeExhausted
+}
+
+func (p *Proxy) bindUpstreamSocketOnPort(port int) (*net.UDPConn, error) {
+	if p.portAllocator != nil && !p.portAllocator.reserve(port) {
+		return nil, errPortRangeExhausted
+	}
+	conn, err := p.listenUpstream(port)
+	if err != nil && p.portAllocator != nil {
+		p.portAllocator.release(port)
+	}
+	return conn, err
+}
+
+func (p *Proxy) listenUpstream(port int) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: p.client.IP, Port: port, Zone: p.client.Zone})
+	if err == nil && p.portAllocator != nil {
+		p.stats.set(statSourcePortsInUse, uint64(p.portAllocator.inUseCount()))
+	}
+	return conn, err
+}
+
+// closeConnection releases the socket of a client connection, it is safe to
+// call it more than once
+func (p *Proxy) closeConnection(conn *connection) {
+	p.closeConnectionWith(conn, true)
+}
+
+// closeConnectionWith is closeConnection for the sessions that the upstream
+// may have closed already, notifyUpstream tells whether a mux session close
+// is sent to the upstream
+func (p *Proxy) closeConnectionWith(conn *connection, notifyUpstream bool) {
+	conn.closeOnce.Do(func() {
+		atomic.StoreInt32(&conn.closed, 1)
+		p.admission.release(conn.clientAddr().IP)
+		p.closeDTLS(conn)
+		if conn.clientStream != nil {
+			conn.clientStream.Close()
+		}
+		if conn.socks != nil {
+			conn.socks.association.remove(conn)
+		}
+		if conn.allocation != nil && conn.allocation.release() {
+			p.stats.dec(statTURNAllocations)
+		}
+		if conn.quic != nil {
+			p.closeQUICSession(conn)
+		}
+		if conn.fecEncoder != nil {
+			conn.fecEncoder.timer.Stop()
+		}
+		if conn.stream != nil {
+			p.closeStream(conn)
+			return
+		}
+		if conn.udp == nil {
+			p.closeMuxSession(conn, notifyUpstream)
+			return
+		}
+		p.closeUpstreamSocket(conn.udp)
+	})
+}
+
+// closeUpstreamSocket closes an upstream socket and gives back its port
+func (p *Proxy) closeUpstreamSocket(conn *net.UDPConn) {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	if p.portAllocator != nil {
+		p.portAllocator.release(port)
+		p.stats.set(statSourcePortsInUse, uint64(p.portAllocator.inUseCount()))
+	}
+}
+
+func (p *Proxy) releaseUnusedSocket(conn *net.UDPConn) {
+	if p.socketPool != nil {
+		p.socketPool.put(conn)
+		return
+	}
+	p.closeUpstreamSocket(conn)
+}
+
+// Stats returns a snapshot of the proxy counters
+func (p *Proxy) Stats() map[string]uint64 {
+	return p.stats.snapshot()
+}
+
 func (p *Proxy) readLoop() {
-	for !p.closed {
+	for {
 		msg := p.bufferPool.Get().([]byte)
-		size, srcAddress, err := p.listenerConn.ReadFromUDP(msg[0:])
+		size, srcAddress, truncated, err := p.readDatagram(p.listenerConn, msg, p.clientOverhead())
 		if err != nil {
+			p.bufferPool.Put(msg)
+			if p.closing() {
+				return
+			}
 			p.Logger.Error("error", zap.Error(err))
 			continue
 		}
-		p.clientMessageChannel <- packet{
-			src:  srcAddress,
-			data: msg[:size],
+		if p.Tunnel.Role == TunnelRoleExit {
+			var ok bool
+			if size, ok = p.openTunnel(tunnel.Forward, msg, size); !ok {
+				p.bufferPool.Put(msg)
+				continue
+			}
+		}
+		if p.FEC.Role != FECRoleExit {
+			if !p.dispatchClientDatagram(srcAddress, msg, size, truncated) {
+				return
+			}
+			continue
+		}
+		if truncated && !p.acceptTruncated(srcAddress, true) {
+			p.bufferPool.Put(msg)
+			continue
+		}
+		peer := p.fecDecoders.get(srcAddress, time.Now())
+		peer.mutex.Lock()
+		ok := p.decodeFEC(peer.decoder, srcAddress, msg[:size], func(datagram []byte) bool {
+			buf := p.bufferPool.Get().([]byte)
+			n := copy(buf[:cap(buf)], datagram)
+			return p.dispatchClientDatagram(srcAddress, buf, n, false)
+		})
+		peer.mutex.Unlock()
+		p.bufferPool.Put(msg)
+		if !ok {
+			return
+		}
+	}
+}
+
+// dispatchClientDatagram hands a datagram read from srcAddress to the client
+// handlers, it returns false if the proxy is closing
+func (p *Proxy) dispatchClientDatagram(srcAddress *net.UDPAddr, msg []byte, size int, truncated bool) bool {
+	client := srcAddress
+	if p.ProxyProtocol.Ingress != "" {
+		var ok bool
+		if client, size, ok = p.stripProxyHeader(srcAddress, msg, size); !ok {
+			p.bufferPool.Put(msg)
+			return true
 		}
 	}
+	if truncated && !p.acceptTruncated(client, true) {
+		p.bufferPool.Put(msg)
+		return true
+	}
+	select {
+	case p.clientMessageChannel <- packet{src: client, peer: srcAddress, data: msg[:size]}:
+		return true
+	case <-p.ctx.Done():
+		p.bufferPool.Put(msg)
+		return false
+	}
 }
 
 func (p *Proxy) resolveUpstreamLoop() {
-	for !p.closed {
-		time.Sleep(p.ResolveTTL)
+	ticker := time.NewTicker(p.ResolveTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		upstreamAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.UpstreamAddress, p.UpstreamPort))
 		if err != nil {
 			p.Logger.Error("resolve error", zap.Error(err))
 			continue
 		}
-		if p.upstream.String() != upstreamAddr.String() {
-			p.upstream = upstreamAddr
-			p.Logger.Info("upstream addr changed", zap.String("upstreamAddr", p.upstream.String()))
+		if current := p.upstreamAddr(); current == nil || current.String() != upstreamAddr.String() {
+			p.upstream.Store(upstreamAddr)
+			p.Logger.Info("upstream addr changed", zap.String("upstreamAddr", upstreamAddr.String()))
+		}
+		if p.quicRouter != nil {
+			p.resolveQUICRoutes()
+		}
+		if p.dns != nil {
+			p.resolveDNSRoutes()
 		}
 	}
 }
 
-func (p *Proxy) freeIdleSocketsLoop() {
-	for !p.closed {
-		time.Sleep(p.ConnTimeout)
-		var clientsToTimeout []string
+// expireConnection is fired by the expiry wheel when a connection may have
+// timed out, connections that saw activity or were refreshed since they were
+// scheduled are scheduled again for their new deadline
+func (p *Proxy) expireConnection(session interface{}) {
+	conn := session.(*connection)
+	if conn.isClosed() {
+		return
+	}
+	now := time.Now()
+	deadline := p.sessionDeadline(conn)
+	if now.Before(deadline) {
+		p.expiryWheel.Schedule(conn, deadline)
+		return
+	}
+	lag := uint64(now.Sub(deadline) / time.Microsecond)
+	p.stats.inc(statSessionsExpired)
+	p.stats.set(statExpiryLagLastMicros, lag)
+	p.stats.max(statExpiryLagMaxMicros, lag)
+	p.stats.add(statExpiryLagTotalMicros, lag)
+	p.Logger.Debug("client timeout", zap.String("client", conn.key))
+	p.closeConnection(conn)
+	p.removeConnection(conn)
+}
 
+// Close stops the proxy, when it returns every goroutine of the proxy has
+// exited and every socket was released
+func (p *Proxy) Close() {
+	p.closeOnce.Do(func() {
+		p.Logger.Warn("Closing proxy")
+		p.cancel()
+
+		// stop reading from clients and let the handlers drain what was read
+		if p.listenerConn != nil {
+			p.listenerConn.Close()
+		}
+		if p.gateway != nil {
+			p.gateway.close()
+		}
+		if p.socks != nil {
+			p.socks.close()
+		}
+		p.readersWg.Wait()
+		close(p.clientMessageChannel)
+		p.handlersWg.Wait()
+
+		// no sessions can be created anymore, release every upstream socket
+		if p.socketPool != nil {
+			p.socketPool.close()
+		}
 		p.connsMap.Range(func(k, conn interface{}) bool {
-			if conn.(*connection).lastActivity.Before(time.Now().Add(-p.ConnTimeout)) {
-				clientsToTimeout = append(clientsToTimeout, k.(string))
-			}
+			p.closeConnection(conn.(*connection))
+			p.connsMap.Delete(k)
 			return true
 		})
-
-		for _, client := range clientsToTimeout {
-			p.Logger.Debug("client timeout", zap.String("client", client))
-			conn, ok := p.connsMap.Load(client)
-			if ok {
-				conn.(*connection).udp.Close()
-				p.connsMap.Delete(client)
-			}
+		if p.muxer != nil {
+			p.muxer.udp.Close()
 		}
-	}
-}
+		if p.dns != nil {
+			p.dns.close(p)
+		}
+		p.sessionsWg.Wait()
+		close(p.upstreamMessageChannel)
+		p.upstreamHandlersWg.Wait()
 
-// Close stops the proxy
-func (p *Proxy) Close() {
-	p.Logger.Warn("Closing proxy")
-	p.closed = true
-	p.connsMap.Range(func(k, conn interface{}) bool {
-		conn.(*connection).udp.Close()
-		return true
+		p.backgroundWg.Wait()
+		p.Logger.Info("proxy closed")
 	})
-	if p.listenerConn != nil {
-		p.listenerConn.Close()
-	}
 }
 
-// Start starts the proxy
-func (p *Proxy) Start() {
+// Start starts the proxy, when its config is invalid or a socket cannot be
+// bound it releases what it bound and returns why
+func (p *Proxy) Start() (err error) {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	p.Logger.Info("Starting proxy")
+	defer func() {
+		if err != nil {
+			// release whatever was bound before the failure
+			p.Close()
+		}
+	}()
 
 	ProxyAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.BindAddress, p.BindPort))
 	if err != nil {
-		p.Logger.Error("error resolving bind address", zap.Error(err))
-		return
+		return fmt.Errorf("error resolving bind address: %s", err)
 	}
-	p.upstream, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.UpstreamAddress, p.UpstreamPort))
+	upstreamAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.UpstreamAddress, p.UpstreamPort))
 	if err != nil {
 		p.Logger.Error("error resolving upstream address", zap.Error(err))
 	}
+	p.upstream.Store(upstreamAddr)
 	p.client = &net.UDPAddr{
 		IP:   ProxyAddr.IP,
 		Port: 0,
 		Zone: ProxyAddr.Zone,
 	}
-	p.listenerConn, err = net.ListenUDP("udp", ProxyAddr)
+	if err := ValidateSourcePorts(p.SourcePortRangeStart, p.SourcePortRangeEnd, p.SourcePortMapping); err != nil {
+		return fmt.Errorf("invalid source port config: %s", err)
+	}
+	if err := ValidateUpstreamMode(p.UpstreamMode); err != nil {
+		return fmt.Errorf("invalid upstream mode: %s", err)
+	}
+	if err := ValidateOversizePolicy(p.OversizePolicy); err != nil {
+		return fmt.Errorf("invalid oversize policy: %s", err)
+	}
+	if err := p.ClientRateLimit.Validate(); err != nil {
+		return fmt.Errorf("invalid client rate limit: %s", err)
+	}
+	if err := p.ClientRateLimit.validateDatagramSize(p.BufferSize); err != nil {
+		return fmt.Errorf("invalid client rate limit: %s", err)
+	}
+	if err := p.UpstreamRateLimit.Validate(); err != nil {
+		return fmt.Errorf("invalid upstream rate limit: %s", err)
+	}
+	if err := p.UpstreamRateLimit.validateDatagramSize(p.BufferSize); err != nil {
+		return fmt.Errorf("invalid upstream rate limit: %s", err)
+	}
+	if err := p.Tunnel.Validate(); err != nil {
+		return fmt.Errorf("invalid tunnel: %s", err)
+	}
+	if p.Tunnel.Role == TunnelRoleEntry && !p.usesUpstreamSockets() {
+		return errors.New("a tunnel entry requires the socket upstream mode")
+	}
+	if p.tunnelCodec, err = newTunnelCodec(p.Tunnel); err != nil {
+		return fmt.Errorf("invalid tunnel: %s", err)
+	}
+	if err := p.validateDTLS(); err != nil {
+		return fmt.Errorf("invalid dtls: %s", err)
+	}
+	if p.dtlsConfig, err = p.newDTLSConfig(); err != nil {
+		return fmt.Errorf("invalid dtls: %s", err)
+	}
+	if p.DTLS.Mode == DTLSModeTerminate {
+		p.dtlsHandshakeSlots = make(chan struct{}, p.DTLS.maxHandshakes())
+		p.dtlsHandshakesPerIP = make(map[string]int)
+	}
+	if err := p.validateFEC(); err != nil {
+		return fmt.Errorf("invalid fec: %s", err)
+	}
+	if err := ValidateProxyType(p.Type); err != nil {
+		return fmt.Errorf("invalid proxy type: %s", err)
+	}
+	if err := p.validateWebSocketGateway(); err != nil {
+		return fmt.Errorf("invalid websocket gateway: %s", err)
+	}
+	if err := p.validateSOCKS5(); err != nil {
+		return fmt.Errorf("invalid socks5: %s", err)
+	}
+	if err := p.validateTURN(); err != nil {
+		return fmt.Errorf("invalid turn: %s", err)
+	}
+	if err := p.validateQUIC(); err != nil {
+		return fmt.Errorf("invalid quic routing: %s", err)
+	}
+	if err := p.validateDNS(); err != nil {
+		return fmt.Errorf("invalid dns: %s", err)
+	}
+	if err := p.validateSessionKey(); err != nil {
+		return fmt.Errorf("invalid session key: %s", err)
+	}
+	p.sessionKey = newSessionKeyFunc(p.SessionKey)
+	if p.QUIC.enabled() {
+		p.quicRouter = newQUICRouter(p.QUIC)
+		p.resolveQUICRoutes()
+	}
+	if p.FEC.Role == FECRoleExit {
+		p.fecDecoders = newFECDecoders(p.FEC.Window)
+	}
+	if overhead := p.clientOverhead() + p.upstreamOverhead(); overhead > 0 {
+		// encrypted datagrams are larger than the plaintext ones
+		p.bufferPool.New = func() interface{} { return make([]byte, p.BufferSize+overhead+1) }
+	}
+	if err := p.ProxyProtocol.Validate(); err != nil {
+		return fmt.Errorf("invalid proxy protocol: %s", err)
+	}
+	p.proxyProtocolPeers, _ = p.ProxyProtocol.trustedNetworks()
+	if err := p.Authentication.Validate(); err != nil {
+		return fmt.Errorf("invalid authentication: %s", err)
+	}
+	if err := ValidateFilteringMode(p.FilteringMode); err != nil {
+		return fmt.Errorf("invalid filtering mode: %s", err)
+	}
+	if err := p.BanPolicy.Validate(); err != nil {
+		return fmt.Errorf("invalid ban policy: %s", err)
+	}
+	if err := p.AmplificationGuard.Validate(); err != nil {
+		return fmt.Errorf("invalid amplification guard: %s", err)
+	}
+	if err := p.Admission.Validate(); err != nil {
+		return fmt.Errorf("invalid admission limits: %s", err)
+	}
+	if err := p.UpstreamShaping.Validate(); err != nil {
+		return fmt.Errorf("invalid upstream shaping: %s", err)
+	}
+	if err := p.ClientShaping.Validate(); err != nil {
+		return fmt.Errorf("invalid client shaping: %s", err)
+	}
+	// background loops only start once the whole config is known to be valid
+	if p.tunnelCodec != nil {
+		p.goTracked(&p.backgroundWg, p.tunnelExpireLoop)
+	}
+	if p.quicRouter != nil {
+		p.goTracked(&p.backgroundWg, p.quicExpireLoop)
+	}
+	if p.fecDecoders != nil {
+		p.goTracked(&p.backgroundWg, p.fecExpireLoop)
+	}
+	p.admission = newAdmission(p.Admission, time.Now())
+	p.authVerifier = newAuthVerifier(p.Authentication)
+	p.banList = newBanList(p.BanPolicy)
+	if p.banList != nil && p.BanPolicy.PersistFile != "" {
+		if err := p.banList.load(p.BanPolicy.PersistFile); err != nil {
+			p.Logger.Error("failed to load persisted bans", zap.Error(err))
+		}
+		p.banPersist = make(chan struct{}, 1)
+		p.goTracked(&p.backgroundWg, p.banPersistLoop)
+	}
+	if p.banList != nil {
+		p.goTracked(&p.backgroundWg, p.banCleanupLoop)
+	}
+	if p.SourcePortRangeStart > 0 {
+		p.portAllocator = newPortAllocator(p.SourcePortRangeStart, p.SourcePortRangeEnd)
+	}
+	if p.isWebSocketGateway() {
+		err = p.startWebSocketGateway()
+	} else {
+		p.listenerConn, err = net.ListenUDP("udp", ProxyAddr)
+	}
 	if err != nil {
-		p.Logger.Error("error listening on bind port", zap.Error(err))
-		return
+		return fmt.Errorf("error listening on bind port: %s", err)
+	}
+	if p.isTURN() {
+		if p.turnServer, err = p.newTURNServer(); err != nil {
+			return fmt.Errorf("invalid turn: %s", err)
+		}
+	}
+	if p.isDNS() {
+		if err := p.startDNS(); err != nil {
+			return fmt.Errorf("error binding dns upstream sockets: %s", err)
+		}
+	}
+	if p.isSOCKS5() {
+		if err := p.startSOCKS5(); err != nil {
+			return fmt.Errorf("error listening on socks5 bind port: %s", err)
+		}
+	}
+	if p.isMux() {
+		if err := p.startMux(); err != nil {
+			return fmt.Errorf("error binding mux upstream socket: %s", err)
+		}
+	} else if p.usesUpstreamSockets() && p.SocketPoolSize > 0 && !p.isDNS() {
+		refillInterval := p.SocketPoolRefillInterval
+		if refillInterval <= 0 {
+			refillInterval = defaultSocketPoolRefillInterval
+		}
+		p.socketPool = newSocketPool(p.Logger, p.stats, p.SocketPoolSize, refillInterval, p.bindUpstreamSocket, p.closeUpstreamSocket)
+		p.goTracked(&p.backgroundWg, p.socketPool.refillLoop)
+	}
+	if p.UpstreamShaping.BytesPerSecond > 0 {
+		p.upstreamShaper = newShaper(p.UpstreamShaping, p.stats, upstreamShaperStats, func(conn *connection, dst *net.UDPAddr, data []byte) {
+			p.writeToUpstream(conn, data, dst)
+		})
+		p.goTracked(&p.backgroundWg, func() { p.upstreamShaper.paceLoop(p.ctx) })
+	}
+	if p.ClientShaping.BytesPerSecond > 0 {
+		p.clientShaper = newShaper(p.ClientShaping, p.stats, clientShaperStats, func(conn *connection, addr *net.UDPAddr, data []byte) {
+			p.writeToClient(conn, data, addr)
+		})
+		p.goTracked(&p.backgroundWg, func() { p.clientShaper.paceLoop(p.ctx) })
 	}
 	p.Logger.Info("UDP Proxy started!")
-	if p.ConnTimeout.Nanoseconds() > 0 {
-		go p.freeIdleSocketsLoop()
+	if p.isTURN() {
+		// allocations expire at the end of their lifetime
+		p.expiryWheel = expiry.NewWheel(expiry.TickFor(p.TURN.maxLifetime()), p.expireConnection)
+		p.goTracked(&p.backgroundWg, func() { p.expiryWheel.Run(p.ctx.Done()) })
+	} else if p.ConnTimeout.Nanoseconds() > 0 {
+		p.expiryWheel = expiry.NewWheel(expiry.TickFor(p.ConnTimeout), p.expireConnection)
+		p.goTracked(&p.backgroundWg, func() { p.expiryWheel.Run(p.ctx.Done()) })
 	} else {
 		p.Logger.Warn("be warned that running without timeout to clients may be dangerous")
 	}
 	if p.ResolveTTL.Nanoseconds() > 0 {
-		go p.resolveUpstreamLoop()
+		p.goTracked(&p.backgroundWg, p.resolveUpstreamLoop)
 	} else {
 		p.Logger.Warn("not refreshing upstream addr")
 	}
 	for i := 0; i < runtime.NumCPU(); i++ {
-		go p.readLoop()
-		go p.handleClientPackets()
-		go p.handlerUpstreamPackets()
+		if p.listenerConn != nil {
+			p.goTracked(&p.readersWg, p.readLoop)
+		}
+		p.goTracked(&p.handlersWg, p.handleClientPackets)
+		p.goTracked(&p.upstreamHandlersWg, p.handlerUpstreamPackets)
 	}
+	return nil
 }
@@ -30,12 +30,82 @@ import (
 )
 
 type ProxyInstance struct {
-	BindPort        int    `json:"bindPort"`
-	ClientTimeout   int    `json:"clientTimeout"`
-	UpstreamAddress string `json:"upstreamAddress"`
-	UpstreamPort    int    `json:"upstreamPort"`
-	Name            string `json:"name"`
-	ResolveTTL      int    `json:"resolveTTL"`
+	Type                     string             `json:"type"`
+	BindPort                 int                `json:"bindPort"`
+	ClientTimeout            int                `json:"clientTimeout"`
+	UpstreamAddress          string             `json:"upstreamAddress"`
+	UpstreamPort             int                `json:"upstreamPort"`
+	Name                     string             `json:"name"`
+	ResolveTTL               int                `json:"resolveTTL"`
+	SocketPoolSize           int                `json:"socketPoolSize"`
+	SocketPoolRefillInterval int                `json:"socketPoolRefillInterval"`
+	SourcePortRangeStart     int                `json:"sourcePortRangeStart"`
+	SourcePortRangeEnd       int                `json:"sourcePortRangeEnd"`
+	SourcePortMapping        string             `json:"sourcePortMapping"`
+	UpstreamMode             string             `json:"upstreamMode"`
+	UpstreamWebSocketPath    string             `json:"upstreamWebSocketPath"`
+	OversizePolicy           string             `json:"oversizePolicy"`
+	MaxUpstreamDatagramSize  int                `json:"maxUpstreamDatagramSize"`
+	MaxClientDatagramSize    int                `json:"maxClientDatagramSize"`
+	ClientRateLimit          RateLimit          `json:"clientRateLimit"`
+	UpstreamRateLimit        RateLimit          `json:"upstreamRateLimit"`
+	UpstreamShaping          Shaping            `json:"upstreamShaping"`
+	ClientShaping            Shaping            `json:"clientShaping"`
+	Admission                Admission          `json:"admission"`
+	AmplificationGuard       AmplificationGuard `json:"amplificationGuard"`
+	ACL                      []ACLRule          `json:"acl"`
+	BanPolicy                BanPolicy          `json:"banPolicy"`
+	FilteringMode            string             `json:"filteringMode"`
+	Authentication           Authentication     `json:"authentication"`
+	ProxyProtocol            ProxyProtocol      `json:"proxyProtocol"`
+	Tunnel                   Tunnel             `json:"tunnel"`
+	DTLS                     DTLS               `json:"dtls"`
+	FEC                      FEC                `json:"fec"`
+	WebSocket                WebSocketGateway   `json:"webSocket"`
+	SOCKS5                   SOCKS5             `json:"socks5"`
+	TURN                     TURN               `json:"turn"`
+	QUIC                     QUIC               `json:"quic"`
+	DNS                      DNS                `json:"dns"`
+	SessionKey               SessionKey         `json:"sessionKey"`
+}
+
+// Redacted returns a copy of the config without its secrets and passwords,
+// the API answers with it while only config files keep them
+func (p ProxyInstance) Redacted() ProxyInstance {
+	if p.Authentication.Keys != nil {
+		keys := make([]AuthKey, len(p.Authentication.Keys))
+		for i, k := range p.Authentication.Keys {
+			k.Secret = ""
+			keys[i] = k
+		}
+		p.Authentication.Keys = keys
+	}
+	if p.Tunnel.Keys != nil {
+		keys := make([]TunnelKey, len(p.Tunnel.Keys))
+		for i, k := range p.Tunnel.Keys {
+			k.Secret = ""
+			keys[i] = k
+		}
+		p.Tunnel.Keys = keys
+	}
+	p.DTLS.PSK = ""
+	if p.SOCKS5.Users != nil {
+		users := make([]SOCKS5User, len(p.SOCKS5.Users))
+		for i, u := range p.SOCKS5.Users {
+			u.Password = ""
+			users[i] = u
+		}
+		p.SOCKS5.Users = users
+	}
+	if p.TURN.Users != nil {
+		users := make([]TURNUser, len(p.TURN.Users))
+		for i, u := range p.TURN.Users {
+			u.Password = ""
+			users[i] = u
+		}
+		p.TURN.Users = users
+	}
+	return p
 }
 
 type ProxyConfig struct {
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/felipejfc/udpx/proxyproto"
+)
+
+// PROXY protocol v2 modes
+const (
+	// ProxyProtocolFirst prepends the header to the first datagram of each
+	// session sent to the upstream
+	ProxyProtocolFirst = "first"
+	// ProxyProtocolEvery prepends the header to every datagram sent to the
+	// upstream
+	ProxyProtocolEvery = "every"
+	// ProxyProtocolOptional strips the header from the datagrams of clients
+	// that carry one
+	ProxyProtocolOptional = "optional"
+	// ProxyProtocolRequired drops datagrams of clients that carry no header
+	ProxyProtocolRequired = "required"
+)
+
+// ProxyProtocol configures PROXY protocol v2 headers on both sides of a
+// proxy, empty modes disable them
+type ProxyProtocol struct {
+	// Egress is ProxyProtocolFirst or ProxyProtocolEvery
+	Egress string `json:"egress"`
+	// Ingress is ProxyProtocolOptional or ProxyProtocolRequired, the address
+	// in the header is then used as the client address while replies are
+	// still sent to the address the datagram came from
+	Ingress string `json:"ingress"`
+	// TrustedPeers are the CIDRs or IPs of the load balancers allowed to
+	// send headers, required with Ingress
+	TrustedPeers []string `json:"trustedPeers"`
+}
+
+// Validate checks the PROXY protocol modes
+func (pp ProxyProtocol) Validate() error {
+	switch pp.Egress {
+	case "", ProxyProtocolFirst, ProxyProtocolEvery:
+	default:
+		return fmt.Errorf("invalid proxy protocol egress mode %q", pp.Egress)
+	}
+	switch pp.Ingress {
+	case "", ProxyProtocolOptional, ProxyProtocolRequired:
+	default:
+		return fmt.Errorf("invalid proxy protocol ingress mode %q", pp.Ingress)
+	}
+	if pp.Ingress != "" && len(pp.TrustedPeers) == 0 {
+		return fmt.Errorf("proxy protocol ingress requires trusted peers")
+	}
+	_, err := pp.trustedNetworks()
+	return err
+}
+
+// trustedNetworks parses the trusted peers
+func (pp ProxyProtocol) trustedNetworks() ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(pp.TrustedPeers))
+	for _, peer := range pp.TrustedPeers {
+		network, err := ACLRule{CIDR: peer}.network()
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy protocol trusted peer %q", peer)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// trustsPeer tells if headers sent by peer can be decoded
+func (p *Proxy) trustsPeer(peer *net.UDPAddr) bool {
+	for _, network := range p.proxyProtocolPeers {
+		if network.Contains(peer.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripProxyHeader removes the PROXY protocol header of a datagram read
+// into buf, moving the payload to the start of buf, it returns the client
+// address and payload size, or false if the datagram must be dropped.
+// Datagrams of untrusted peers are never decoded, they are forwarded as
+// they are in optional mode and dropped in required mode
+func (p *Proxy) stripProxyHeader(peer *net.UDPAddr, buf []byte, size int) (*net.UDPAddr, int, bool) {
+	if !p.trustsPeer(peer) {
+		if p.ProxyProtocol.Ingress == ProxyProtocolOptional {
+			return peer, size, true
+		}
+		p.stats.inc(statProxyProtocolUntrusted)
+		return nil, 0, false
+	}
+	h, payload, err := proxyproto.Decode(buf[:size])
+	if err == proxyproto.ErrNoSignature && p.ProxyProtocol.Ingress == ProxyProtocolOptional {
+		return peer, size, true
+	}
+	if err != nil {
+		p.stats.inc(statProxyProtocolInvalid)
+		p.reportOffense(peer.IP, OffenseMalformed)
+		return nil, 0, false
+	}
+	n := copy(buf, payload)
+	if h.Source == nil {
+		return peer, n, true
+	}
+	return h.Source, n, true
+}
+
+// withProxyHeader prepends the PROXY protocol header of conn to data when
+// the egress mode asks for it
+func (p *Proxy) withProxyHeader(conn *connection, data []byte) []byte {
+	if p.ProxyProtocol.Egress == ProxyProtocolFirst && !atomic.CompareAndSwapInt32(&conn.proxyHeaderSent, 0, 1) {
+		return data
+	}
+	h := proxyproto.Header{Source: conn.clientAddr(), Destination: p.localAddr()}
+	return append(h.Append(make([]byte, 0, h.Size()+len(data))), data...)
+}
+
+// localAddr is the address clients send their datagrams to
+func (p *Proxy) localAddr() *net.UDPAddr {
+	if p.listenerConn == nil {
+		// websocket clients connect to the bind port over TCP
+		return &net.UDPAddr{IP: p.client.IP, Port: p.BindPort, Zone: p.client.Zone}
+	}
+	return p.listenerConn.LocalAddr().(*net.UDPAddr)
+}
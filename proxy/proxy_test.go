@@ -23,13 +23,32 @@
 package proxy_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/felipejfc/udpx/auth"
+	"github.com/felipejfc/udpx/fec"
+	"github.com/felipejfc/udpx/mux"
 	. "github.com/felipejfc/udpx/proxy"
+	"github.com/felipejfc/udpx/proxyproto"
+	"github.com/felipejfc/udpx/quic"
+	"github.com/felipejfc/udpx/socks5"
+	"github.com/felipejfc/udpx/stream"
+	"github.com/felipejfc/udpx/turn"
+	"github.com/pion/dtls/v2"
 	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/websocket"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -80,4 +99,2119 @@ var _ = Describe("Proxy", func() {
 		})
 	})
 
+	Describe("SocketPool", func() {
+		It("should serve new clients from pre-bound sockets", func() {
+			testProxy.SocketPoolSize = 2
+			testProxy.Start()
+			Eventually(func() uint64 {
+				return testProxy.Stats()["socketPoolSize"]
+			}).Should(Equal(uint64(2)))
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("hello"))
+			Expect(testProxy.Stats()["socketPoolHits"]).To(Equal(uint64(1)))
+			Expect(testProxy.Stats()["socketPoolMisses"]).To(Equal(uint64(0)))
+		})
+	})
+
+	Describe("SourcePorts", func() {
+		sendFrom := func(port int, payload string) {
+			client, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte(payload))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		It("should bind upstream sockets inside the configured range", func() {
+			testProxy.SourcePortRangeStart = 40100
+			testProxy.SourcePortRangeEnd = 40109
+			testProxy.SourcePortMapping = SourcePortMappingDeterministic
+			testProxy.Start()
+
+			sendFrom(40200, "hello")
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			_, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(src.Port).To(BeNumerically(">=", 40100))
+			Expect(src.Port).To(BeNumerically("<=", 40109))
+			Expect(testProxy.Stats()["sourcePortMappingHits"]).To(Equal(uint64(1)))
+			Expect(testProxy.Stats()["sourcePortsInUse"]).To(Equal(uint64(1)))
+		})
+
+		It("should preserve the client source port", func() {
+			testProxy.SourcePortMapping = SourcePortMappingPreserve
+			testProxy.Start()
+
+			sendFrom(40300, "hello")
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			_, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(src.Port).To(Equal(40300))
+		})
+
+		It("should drop packets from new clients when the range is exhausted", func() {
+			testProxy.SourcePortRangeStart = 40400
+			testProxy.SourcePortRangeEnd = 40400
+			testProxy.Start()
+
+			sendFrom(40401, "first")
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			_, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(src.Port).To(Equal(40400))
+
+			sendFrom(40402, "second")
+			Eventually(func() uint64 {
+				return testProxy.Stats()["sourcePortsExhausted"]
+			}).Should(Equal(uint64(1)))
+		})
+	})
+
+	Describe("MuxUpstream", func() {
+		It("should carry every client over a single upstream socket", func() {
+			logger, _ := zap.NewProduction()
+			demuxer := mux.NewDemuxer(logger, "localhost", 34568, "localhost", 34567, 4096, time.Second)
+			Expect(demuxer.Start()).To(Succeed())
+			defer demuxer.Close()
+
+			testProxy.UpstreamPort = 34568
+			testProxy.UpstreamMode = UpstreamModeMux
+			testProxy.Start()
+
+			proxyAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456}
+			buf := make([]byte, 64)
+			var sources []*net.UDPAddr
+			var clients []*net.UDPConn
+			for _, payload := range []string{"first", "second"} {
+				client, err := net.DialUDP("udp", nil, proxyAddr)
+				Expect(err).NotTo(HaveOccurred())
+				defer client.Close()
+				clients = append(clients, client)
+				_, err = client.Write([]byte(payload))
+				Expect(err).NotTo(HaveOccurred())
+
+				testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+				n, src, err := testUpstream.ReadFromUDP(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(buf[:n])).To(Equal(payload))
+				sources = append(sources, src)
+			}
+			Expect(sources[0].Port).NotTo(Equal(sources[1].Port))
+			Expect(testProxy.Stats()["muxSessions"]).To(Equal(uint64(2)))
+
+			_, err := testUpstream.WriteToUDP([]byte("reply"), sources[1])
+			Expect(err).NotTo(HaveOccurred())
+			clients[1].SetReadDeadline(time.Now().Add(time.Second))
+			n, err := clients[1].Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("reply"))
+		})
+
+		It("should tear the whole session down when the upstream closes it", func() {
+			demuxer := mux.NewDemuxer(zap.NewNop(), "localhost", 34568, "localhost", 34567, 4096, 200*time.Millisecond)
+			Expect(demuxer.Start()).To(Succeed())
+			defer demuxer.Close()
+
+			testProxy.UpstreamPort = 34568
+			testProxy.UpstreamMode = UpstreamModeMux
+			testProxy.Type = ProxyTypeWebSocket
+			testProxy.WebSocket = WebSocketGateway{Path: "/ws"}
+			testProxy.Start()
+
+			client, err := stream.Dial(context.Background(), stream.TransportWebSocket, "localhost:23456", "/ws")
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			Expect(client.WriteDatagram([]byte("ping"))).To(Succeed())
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the demuxer closes the idle session, which closes the stream of
+			// the websocket client
+			readErr := make(chan error, 1)
+			go func() {
+				_, _, err := client.ReadDatagram(buf)
+				readErr <- err
+			}()
+			Eventually(readErr, 2*time.Second).Should(Receive(HaveOccurred()))
+			Eventually(func() int { return len(testProxy.Sessions()) }).Should(Equal(0))
+			Eventually(func() uint64 { return testProxy.Stats()["webSocketConnections"] }).Should(Equal(uint64(0)))
+		})
+	})
+
+	Describe("StreamUpstream", func() {
+		for i, mode := range []string{UpstreamModeTCP, UpstreamModeWebSocket} {
+			mode, port := mode, 34569+i
+			It("should carry every client over its own "+mode+" stream", func() {
+				server := stream.NewServer(zap.NewNop(), "localhost", port, mode, "localhost", 34567, 4096, time.Second)
+				server.WebSocketPath = "/udp"
+				Expect(server.Start()).To(Succeed())
+				defer server.Close()
+
+				testProxy.UpstreamPort = port
+				testProxy.UpstreamMode = mode
+				testProxy.UpstreamWebSocketPath = "/udp"
+				testProxy.Start()
+
+				client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+				Expect(err).NotTo(HaveOccurred())
+				defer client.Close()
+				for _, payload := range []string{"first", "second"} {
+					_, err = client.Write([]byte(payload))
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				buf := make([]byte, 64)
+				var src *net.UDPAddr
+				for _, payload := range []string{"first", "second"} {
+					testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+					var n int
+					n, src, err = testUpstream.ReadFromUDP(buf)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(buf[:n])).To(Equal(payload))
+				}
+				Expect(testProxy.Stats()["streamSessions"]).To(Equal(uint64(1)))
+
+				_, err = testUpstream.WriteToUDP([]byte("reply"), src)
+				Expect(err).NotTo(HaveOccurred())
+				client.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := client.Read(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(buf[:n])).To(Equal("reply"))
+			})
+		}
+
+		It("should close sessions whose stream cannot be dialed", func() {
+			testProxy.UpstreamPort = 34571
+			testProxy.UpstreamMode = UpstreamModeTCP
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 { return testProxy.Stats()["streamDialErrors"] }).Should(Equal(uint64(1)))
+			Eventually(func() int { return len(testProxy.Sessions()) }).Should(Equal(0))
+		})
+	})
+
+	Describe("WebSocket", func() {
+		BeforeEach(func() {
+			testProxy.Type = ProxyTypeWebSocket
+			testProxy.WebSocket = WebSocketGateway{Path: "/ws"}
+		})
+
+		It("should relay datagrams between websocket clients and the upstream", func() {
+			testProxy.Start()
+
+			client, err := stream.Dial(context.Background(), stream.TransportWebSocket, "localhost:23456", "/ws")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.WriteDatagram([]byte("ping"))).To(Succeed())
+
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("ping"))
+			Expect(testProxy.Stats()["webSocketConnections"]).To(Equal(uint64(1)))
+
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			n, _, err = client.ReadDatagram(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("pong"))
+
+			client.Close()
+			Eventually(func() int { return len(testProxy.Sessions()) }).Should(Equal(0))
+			Eventually(func() uint64 { return testProxy.Stats()["webSocketConnections"] }).Should(Equal(uint64(0)))
+		})
+
+		It("should refuse origins that are not allowed", func() {
+			testProxy.WebSocket.AllowedOrigins = []string{"https://example.com"}
+			testProxy.Start()
+
+			dial := func(origin string) error {
+				config, err := websocket.NewConfig("ws://localhost:23456/ws", origin)
+				Expect(err).NotTo(HaveOccurred())
+				ws, err := websocket.DialConfig(config)
+				if err == nil {
+					ws.Close()
+				}
+				return err
+			}
+			Expect(dial("https://elsewhere.example.com")).NotTo(Succeed())
+			Expect(testProxy.Stats()["webSocketRejectedOrigins"]).To(Equal(uint64(1)))
+			Expect(dial("https://example.com")).To(Succeed())
+			Expect(dial("http://localhost:23456")).To(Succeed())
+		})
+
+		It("should refuse cross origin requests when no origin is allowed", func() {
+			testProxy.Start()
+
+			config, err := websocket.NewConfig("ws://localhost:23456/ws", "https://elsewhere.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = websocket.DialConfig(config)
+			Expect(err).To(HaveOccurred())
+			Expect(testProxy.Stats()["webSocketRejectedOrigins"]).To(Equal(uint64(1)))
+		})
+	})
+
+	Describe("SOCKS5", func() {
+		var control net.Conn
+
+		associate := func(username, password string) (socks5.Addr, error) {
+			var err error
+			control, err = net.Dial("tcp", "localhost:23456")
+			Expect(err).NotTo(HaveOccurred())
+			return socks5.ClientHandshake(control, username, password, socks5.Request{Command: socks5.CommandUDPAssociate, Addr: socks5.Addr{IP: net.IPv4zero}})
+		}
+
+		BeforeEach(func() {
+			testProxy.Type = ProxyTypeSOCKS5
+			testProxy.SOCKS5 = SOCKS5{
+				Users:        []SOCKS5User{{Username: "user", Password: "secret"}},
+				Destinations: []ACLRule{{Action: ACLActionAllow, CIDR: "127.0.0.1"}},
+			}
+		})
+
+		AfterEach(func() {
+			if control != nil {
+				control.Close()
+			}
+		})
+
+		It("should relay the datagrams of an udp association", func() {
+			testProxy.Start()
+			bound, err := associate("user", "secret")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bound.Port).To(Equal(23456))
+			Expect(testProxy.Stats()["socks5Associations"]).To(Equal(uint64(1)))
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: bound.IP, Port: bound.Port})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			upstream := socks5.Addr{IP: net.ParseIP("127.0.0.1"), Port: 34567}
+			_, err = client.Write(append(socks5.AppendUDPHeader(nil, upstream), "ping"...))
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("ping"))
+
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err = client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			from, payload, err := socks5.DecodeUDP(buf[:n])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(from.String()).To(Equal("127.0.0.1:34567"))
+			Expect(string(payload)).To(Equal("pong"))
+
+			control.Close()
+			Eventually(func() int { return len(testProxy.Sessions()) }).Should(Equal(0))
+			Eventually(func() uint64 { return testProxy.Stats()["socks5Associations"] }).Should(Equal(uint64(0)))
+		})
+
+		It("should refuse wrong credentials, unassociated clients and denied destinations", func() {
+			testProxy.SOCKS5.Destinations = []ACLRule{{Action: ACLActionDeny, CIDR: "127.0.0.1"}}
+			testProxy.Start()
+			_, err := associate("user", "wrong")
+			Expect(err).To(Equal(socks5.ErrAuthFailed))
+			Eventually(func() uint64 { return testProxy.Stats()["socks5AuthFailures"] }).Should(Equal(uint64(1)))
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			datagram := append(socks5.AppendUDPHeader(nil, socks5.Addr{IP: net.ParseIP("127.0.0.1"), Port: 34567}), "ping"...)
+			_, err = client.Write(datagram)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 { return testProxy.Stats()["socks5UnassociatedDrops"] }).Should(Equal(uint64(1)))
+
+			control.Close()
+			_, err = associate("user", "secret")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.Write(datagram)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 { return testProxy.Stats()["socks5DeniedDestinations"] }).Should(Equal(uint64(1)))
+		})
+
+		It("should deny internal destinations unless they are allowed", func() {
+			testProxy.SOCKS5.Destinations = nil
+			testProxy.Start()
+			_, err := associate("user", "secret")
+			Expect(err).NotTo(HaveOccurred())
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "::1"} {
+				_, err = client.Write(append(socks5.AppendUDPHeader(nil, socks5.Addr{IP: net.ParseIP(ip), Port: 34567}), "ping"...))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Eventually(func() uint64 { return testProxy.Stats()["socks5DeniedDestinations"] }).Should(Equal(uint64(5)))
+			Expect(testProxy.Sessions()).To(HaveLen(1))
+		})
+
+		It("should refuse to start without users on a public address", func() {
+			testProxy.BindAddress = "0.0.0.0"
+			testProxy.SOCKS5.Users = nil
+			Expect(testProxy.Start()).To(HaveOccurred())
+			_, err := net.Dial("tcp", "localhost:23456")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("TURN", func() {
+		var (
+			client *net.UDPConn
+			nonce  []byte
+			key    = turn.LongTermKey("user", "udpx.test", "secret")
+		)
+
+		BeforeEach(func() {
+			testProxy.Type = ProxyTypeTURN
+			testProxy.TURN = TURN{
+				Realm: "udpx.test",
+				Users: []TURNUser{{Username: "user", Password: "secret"}},
+				Peers: []ACLRule{{Action: ACLActionAllow, CIDR: "127.0.0.1"}},
+			}
+			nonce = nil
+			var err error
+			client, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			client.Close()
+		})
+
+		read := func() []byte {
+			buf := make([]byte, 4096)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			return buf[:n]
+		}
+
+		// request sends a request built by build, which may be nil, signed
+		// with password once a nonce was received
+		request := func(method uint16, password string, build func(*turn.Message)) *turn.Message {
+			var transactionID [turn.TransactionIDSize]byte
+			rand.Read(transactionID[:])
+			m := turn.NewMessage(method, turn.ClassRequest, transactionID)
+			if build != nil {
+				build(m)
+			}
+			var signingKey []byte
+			if nonce != nil {
+				m.Add(turn.AttrUsername, []byte("user"))
+				m.Add(turn.AttrRealm, []byte("udpx.test"))
+				m.Add(turn.AttrNonce, nonce)
+				signingKey = turn.LongTermKey("user", "udpx.test", password)
+			}
+			_, err := client.Write(m.Encode(nil, signingKey))
+			Expect(err).NotTo(HaveOccurred())
+			response, err := turn.Decode(read())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.TransactionID).To(Equal(m.TransactionID))
+			return response
+		}
+
+		errorCode := func(m *turn.Message) int {
+			Expect(m.Class).To(Equal(uint16(turn.ClassError)))
+			value, ok := m.Get(turn.AttrErrorCode)
+			Expect(ok).To(BeTrue())
+			code, _, err := turn.DecodeErrorCode(value)
+			Expect(err).NotTo(HaveOccurred())
+			return code
+		}
+
+		transport := func(protocol byte) func(*turn.Message) {
+			return func(m *turn.Message) {
+				m.Add(turn.AttrRequestedTransport, []byte{protocol, 0, 0, 0})
+			}
+		}
+		udpTransport := transport(turn.ProtocolUDP)
+
+		allocate := func() *net.UDPAddr {
+			challenge := request(turn.MethodAllocate, "", udpTransport)
+			Expect(errorCode(challenge)).To(Equal(turn.CodeUnauthorized))
+			nonce, _ = challenge.Get(turn.AttrNonce)
+			Expect(nonce).NotTo(BeEmpty())
+
+			response := request(turn.MethodAllocate, "secret", udpTransport)
+			Expect(response.Class).To(Equal(uint16(turn.ClassSuccess)))
+			Expect(response.CheckIntegrity(key)).To(BeTrue())
+			value, ok := response.Get(turn.AttrXORRelayedAddress)
+			Expect(ok).To(BeTrue())
+			relayed, err := turn.XORAddress(value, response.TransactionID)
+			Expect(err).NotTo(HaveOccurred())
+			return relayed
+		}
+
+		withPeer := func(peer *net.UDPAddr, channel ...byte) func(*turn.Message) {
+			return func(m *turn.Message) {
+				if channel != nil {
+					m.Add(turn.AttrChannelNumber, channel)
+				}
+				m.Add(turn.AttrXORPeerAddress, turn.AppendXORAddress(nil, peer, m.TransactionID))
+			}
+		}
+
+		It("should relay the datagrams of an allocation", func() {
+			testProxy.Start()
+			relayed := allocate()
+			Expect(relayed.IP.String()).To(Equal("127.0.0.1"))
+			Expect(testProxy.Stats()["turnAllocations"]).To(Equal(uint64(1)))
+			peer := testUpstream.LocalAddr().(*net.UDPAddr)
+
+			// the peer has no permission yet
+			_, err := testUpstream.WriteToUDP([]byte("early"), relayed)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 { return testProxy.Stats()["turnPermissionDrops"] }).Should(Equal(uint64(1)))
+
+			response := request(turn.MethodCreatePermission, "secret", withPeer(peer))
+			Expect(response.Class).To(Equal(uint16(turn.ClassSuccess)))
+
+			var transactionID [turn.TransactionIDSize]byte
+			send := turn.NewMessage(turn.MethodSend, turn.ClassIndication, transactionID)
+			withPeer(peer)(send)
+			send.Add(turn.AttrData, []byte("ping"))
+			_, err = client.Write(send.Encode(nil, nil))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("ping"))
+			Expect(src.Port).To(Equal(relayed.Port))
+
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			data, err := turn.Decode(read())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data.Method).To(Equal(uint16(turn.MethodData)))
+			Expect(data.Class).To(Equal(uint16(turn.ClassIndication)))
+			value, _ := data.Get(turn.AttrXORPeerAddress)
+			from, err := turn.XORAddress(value, data.TransactionID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(from.String()).To(Equal(peer.String()))
+			payload, _ := data.Get(turn.AttrData)
+			Expect(string(payload)).To(Equal("pong"))
+
+			response = request(turn.MethodChannelBind, "secret", withPeer(peer, 0x40, 0x00, 0, 0))
+			Expect(response.Class).To(Equal(uint16(turn.ClassSuccess)))
+
+			_, err = client.Write(turn.AppendChannelData(nil, 0x4000, []byte("ping")))
+			Expect(err).NotTo(HaveOccurred())
+			n, src, err = testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("ping"))
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			channel, payload, err := turn.DecodeChannelData(read())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(channel).To(Equal(uint16(0x4000)))
+			Expect(string(payload)).To(Equal("pong"))
+
+			allocations, err := testProxy.TURNAllocations()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(allocations).To(HaveLen(1))
+			Expect(allocations[0].Username).To(Equal("user"))
+			Expect(allocations[0].RelayedAddress).To(Equal(relayed.String()))
+			Expect(allocations[0].Permissions).To(Equal([]string{"127.0.0.1"}))
+			Expect(allocations[0].Channels).To(Equal(map[uint16]string{0x4000: peer.String()}))
+
+			response = request(turn.MethodRefresh, "secret", func(m *turn.Message) {
+				m.Add(turn.AttrLifetime, turn.Uint32(0))
+			})
+			Expect(response.Class).To(Equal(uint16(turn.ClassSuccess)))
+			Eventually(func() int { return len(testProxy.Sessions()) }).Should(Equal(0))
+			Expect(testProxy.Stats()["turnAllocations"]).To(Equal(uint64(0)))
+		})
+
+		It("should refuse internal peers unless they are allowed", func() {
+			testProxy.TURN.Peers = nil
+			testProxy.Start()
+			allocate()
+
+			for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "169.254.169.254"} {
+				peer := &net.UDPAddr{IP: net.ParseIP(ip), Port: 34567}
+				Expect(errorCode(request(turn.MethodCreatePermission, "secret", withPeer(peer)))).To(Equal(turn.CodeForbidden))
+			}
+			response := request(turn.MethodCreatePermission, "secret", withPeer(&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 34567}))
+			Expect(response.Class).To(Equal(uint16(turn.ClassSuccess)))
+		})
+
+		It("should refuse wrong credentials, stale nonces and unauthenticated clients", func() {
+			testProxy.TURN.NonceLifetime = 1
+			testProxy.Start()
+
+			binding := request(turn.MethodBinding, "", nil)
+			Expect(binding.Class).To(Equal(uint16(turn.ClassSuccess)))
+			value, ok := binding.Get(turn.AttrXORMappedAddress)
+			Expect(ok).To(BeTrue())
+			mapped, err := turn.XORAddress(value, binding.TransactionID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mapped.String()).To(Equal(client.LocalAddr().String()))
+
+			Expect(errorCode(request(turn.MethodRefresh, "", nil))).To(Equal(turn.CodeAllocationMismatch))
+
+			challenge := request(turn.MethodAllocate, "", udpTransport)
+			nonce, _ = challenge.Get(turn.AttrNonce)
+			Expect(errorCode(request(turn.MethodAllocate, "wrong", udpTransport))).To(Equal(turn.CodeUnauthorized))
+			Expect(testProxy.Stats()["turnAuthFailures"]).To(Equal(uint64(1)))
+
+			Expect(errorCode(request(turn.MethodAllocate, "secret", transport(6)))).To(Equal(turn.CodeUnsupportedTransport))
+
+			time.Sleep(1100 * time.Millisecond)
+			Expect(errorCode(request(turn.MethodAllocate, "secret", udpTransport))).To(Equal(turn.CodeStaleNonce))
+			Expect(testProxy.Stats()["turnStaleNonces"]).To(Equal(uint64(1)))
+			Expect(testProxy.Sessions()).To(BeEmpty())
+		})
+	})
+
+	Describe("SessionExpiry", func() {
+		It("should expire idle sessions close to their timeout", func() {
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(func() uint64 {
+				return testProxy.Stats()["sessionsExpired"]
+			}, 2*time.Second).Should(Equal(uint64(1)))
+			Expect(testProxy.Stats()["expiryLagMaxMicros"]).To(BeNumerically("<", 100*1000))
+		})
+	})
+
+	Describe("Close", func() {
+		It("should stop every goroutine and release every socket under load", func() {
+			testProxy.SocketPoolSize = 4
+			testProxy.Start()
+
+			echoDone := make(chan struct{})
+			go func() {
+				defer close(echoDone)
+				buf := make([]byte, 4096)
+				for {
+					n, src, err := testUpstream.ReadFromUDP(buf)
+					if err != nil {
+						return
+					}
+					testUpstream.WriteToUDP(buf[:n], src)
+				}
+			}()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+					Expect(err).NotTo(HaveOccurred())
+					defer client.Close()
+					for j := 0; j < 200; j++ {
+						client.Write([]byte("ping"))
+					}
+				}()
+			}
+			wg.Wait()
+
+			testProxy.Close()
+			testUpstream.Close()
+			<-echoDone
+			// Close waited for every goroutine of the proxy
+			Expect(testProxy.Stats()["goroutines"]).To(BeZero())
+
+			// every socket was released, so the ports can be bound again
+			listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			listener.Close()
+		})
+	})
+
+	Describe("Oversize", func() {
+		var client *net.UDPConn
+
+		BeforeEach(func() {
+			var err error
+			client, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			client.Close()
+		})
+
+		It("should drop datagrams larger than the buffer size by default", func() {
+			testProxy.Start()
+			_, err := client.Write(make([]byte, 5000))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["oversizeDrops"]
+			}).Should(Equal(uint64(1)))
+			Expect(testProxy.Stats()["truncatedFromClients"]).To(Equal(uint64(1)))
+		})
+
+		It("should forward truncated datagrams with the truncate policy", func() {
+			testProxy.OversizePolicy = OversizePolicyTruncate
+			testProxy.Start()
+			_, err := client.Write(make([]byte, 5000))
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := make([]byte, 8192)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(4096))
+		})
+
+		It("should police the maximum datagram size toward the upstream", func() {
+			testProxy.MaxUpstreamDatagramSize = 10
+			testProxy.Start()
+			_, err := client.Write(make([]byte, 20))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["maxSizeDropsToUpstream"]
+			}).Should(Equal(uint64(1)))
+		})
+	})
+
+	Describe("RateLimit", func() {
+		It("should police each client and count its drops", func() {
+			testProxy.ClientRateLimit = RateLimit{PacketsPerSecond: 1, PacketsBurst: 5}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			for i := 0; i < 20; i++ {
+				_, err = client.Write([]byte("ping"))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			Eventually(func() uint64 {
+				return testProxy.Stats()["rateLimitDropsToUpstream"]
+			}).Should(BeNumerically(">=", 14))
+			sessions := testProxy.Sessions()
+			Expect(sessions).To(HaveLen(1))
+			Expect(sessions[0].Client).To(Equal(client.LocalAddr().String()))
+			Expect(sessions[0].RateLimitDropsToUpstream).To(Equal(testProxy.Stats()["rateLimitDropsToUpstream"]))
+		})
+
+		It("should let a datagram through when the byte rate is below its size", func() {
+			testProxy.ClientRateLimit = RateLimit{BytesPerSecond: 100}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write(make([]byte, 500))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 1024)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(500))
+		})
+
+		It("should refuse byte bursts smaller than the largest datagram", func() {
+			Expect(RateLimit{BytesPerSecond: 100, BytesBurst: 100}.Validate()).To(Succeed())
+			testProxy.ClientRateLimit = RateLimit{BytesPerSecond: 100, BytesBurst: 100}
+			Expect(testProxy.Start()).To(MatchError(ContainSubstring("bytes burst")))
+			Expect(testProxy.Stats()["goroutines"]).To(BeZero())
+		})
+	})
+
+	Describe("Shaping", func() {
+		It("should pace upstream traffic and drop what exceeds the latency budget", func() {
+			testProxy.UpstreamShaping = Shaping{BytesPerSecond: 1000, MaxDelay: 20}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			payload := make([]byte, 100)
+			for i := 0; i < 20; i++ {
+				_, err = client.Write(payload)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			Eventually(func() uint64 {
+				return testProxy.Stats()["shapingToUpstreamSent"]
+			}).Should(BeNumerically(">=", 1))
+			Eventually(func() uint64 {
+				return testProxy.Stats()["shapingToUpstreamDrops"]
+			}).Should(BeNumerically(">=", 10))
+		})
+	})
+
+	Describe("Admission", func() {
+		dial := func() *net.UDPConn {
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			return client
+		}
+
+		It("should reject clients over the per ip limit", func() {
+			testProxy.Admission = Admission{MaxSessionsPerIP: 2}
+			testProxy.Start()
+
+			for i := 0; i < 4; i++ {
+				defer dial().Close()
+			}
+
+			Eventually(func() uint64 {
+				return testProxy.Stats()["admissionRejectsPerIp"]
+			}).Should(BeNumerically("==", 2))
+			Expect(testProxy.Sessions()).To(HaveLen(2))
+		})
+
+		It("should evict the least recently active session", func() {
+			testProxy.Admission = Admission{MaxSessions: 2, EvictionPolicy: EvictionPolicyLRU}
+			testProxy.Start()
+
+			first := dial()
+			defer first.Close()
+			Eventually(testProxy.Sessions).Should(HaveLen(1))
+			time.Sleep(10 * time.Millisecond)
+			second := dial()
+			defer second.Close()
+			Eventually(testProxy.Sessions).Should(HaveLen(2))
+			third := dial()
+			defer third.Close()
+
+			Eventually(func() uint64 {
+				return testProxy.Stats()["admissionEvictions"]
+			}).Should(BeNumerically("==", 1))
+			Eventually(func() []string {
+				var clients []string
+				for _, s := range testProxy.Sessions() {
+					clients = append(clients, s.Client)
+				}
+				return clients
+			}).Should(ConsistOf(second.LocalAddr().String(), third.LocalAddr().String()))
+		})
+	})
+
+	Describe("AmplificationGuard", func() {
+		It("should limit replies to clients that are not validated", func() {
+			upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			Expect(err).NotTo(HaveOccurred())
+			defer upstream.Close()
+			go func() {
+				buf := make([]byte, 2048)
+				for {
+					_, src, err := upstream.ReadFromUDP(buf)
+					if err != nil {
+						return
+					}
+					upstream.WriteToUDP(make([]byte, 1000), src)
+				}
+			}()
+			testProxy.UpstreamPort = upstream.LocalAddr().(*net.UDPAddr).Port
+			testProxy.AmplificationGuard = AmplificationGuard{Factor: 3, ValidationPackets: 2}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write(make([]byte, 100))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["amplificationDrops"]
+			}).Should(BeNumerically("==", 1))
+
+			_, err = client.Write(make([]byte, 100))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 2048)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(1000))
+			Expect(testProxy.Stats()["amplificationValidatedSessions"]).To(BeNumerically("==", 1))
+		})
+
+		It("should still limit the reply bytes of validated clients", func() {
+			upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			Expect(err).NotTo(HaveOccurred())
+			defer upstream.Close()
+			go func() {
+				buf := make([]byte, 2048)
+				for {
+					_, src, err := upstream.ReadFromUDP(buf)
+					if err != nil {
+						return
+					}
+					upstream.WriteToUDP(make([]byte, 1000), src)
+				}
+			}()
+			testProxy.UpstreamPort = upstream.LocalAddr().(*net.UDPAddr).Port
+			testProxy.AmplificationGuard = AmplificationGuard{Factor: 3, ValidationPackets: 2, ValidatedFactor: 50}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			for i := 0; i < 4; i++ {
+				_, err = client.Write([]byte("x"))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Eventually(func() uint64 {
+				return testProxy.Stats()["amplificationDrops"]
+			}).Should(BeNumerically("==", 4))
+			Expect(testProxy.Stats()["amplificationValidatedSessions"]).To(BeNumerically("==", 1))
+		})
+
+		// floodingUpstream answers every datagram with ten 1000 byte replies
+		floodingUpstream := func() *net.UDPConn {
+			upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			Expect(err).NotTo(HaveOccurred())
+			go func() {
+				buf := make([]byte, 2048)
+				for {
+					_, src, err := upstream.ReadFromUDP(buf)
+					if err != nil {
+						return
+					}
+					for i := 0; i < 10; i++ {
+						upstream.WriteToUDP(make([]byte, 1000), src)
+					}
+				}
+			}()
+			return upstream
+		}
+
+		It("should not limit the long asymmetric sessions of validated clients by default", func() {
+			upstream := floodingUpstream()
+			defer upstream.Close()
+			testProxy.UpstreamPort = upstream.LocalAddr().(*net.UDPAddr).Port
+			testProxy.AmplificationGuard = AmplificationGuard{Factor: 3, ValidationPackets: 1}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			buf := make([]byte, 2048)
+			for round := 0; round < 5; round++ {
+				_, err = client.Write([]byte("x"))
+				Expect(err).NotTo(HaveOccurred())
+				for i := 0; i < 10; i++ {
+					client.SetReadDeadline(time.Now().Add(time.Second))
+					n, err := client.Read(buf)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(n).To(Equal(1000))
+				}
+			}
+			Expect(testProxy.Stats()["amplificationDrops"]).To(BeZero())
+		})
+
+		It("should not limit sessions whose handshake proved their client is reachable", func() {
+			upstream := floodingUpstream()
+			defer upstream.Close()
+			testProxy.UpstreamPort = upstream.LocalAddr().(*net.UDPAddr).Port
+			testProxy.AmplificationGuard = AmplificationGuard{Factor: 3, ValidatedFactor: 3}
+			testProxy.Type = ProxyTypeWebSocket
+			testProxy.WebSocket = WebSocketGateway{Path: "/ws"}
+			testProxy.Start()
+
+			client, err := stream.Dial(context.Background(), stream.TransportWebSocket, "localhost:23456", "/ws")
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			received := make(chan int, 10)
+			go func() {
+				buf := make([]byte, 2048)
+				for {
+					n, _, err := client.ReadDatagram(buf)
+					if err != nil {
+						return
+					}
+					received <- n
+				}
+			}()
+			Expect(client.WriteDatagram([]byte("x"))).To(Succeed())
+			for i := 0; i < 10; i++ {
+				Eventually(received).Should(Receive(Equal(1000)))
+			}
+			Expect(testProxy.Stats()["amplificationDrops"]).To(BeZero())
+		})
+	})
+
+	Describe("Manager", func() {
+		It("should not start proxies with an invalid acl", func() {
+			pm := GetManager()
+			logger, _ := zap.NewProduction()
+			pm.Configure(false, logger, "localhost", 4096, 1000, 1000)
+			Expect(pm.RegisterProxy(ProxyInstance{
+				BindPort:        23460,
+				UpstreamAddress: "localhost",
+				UpstreamPort:    34567,
+				Name:            "invalid-acl",
+				ACL:             []ACLRule{{Action: "allow", CIDR: "not a cidr"}},
+			})).To(HaveOccurred())
+			Expect(pm.GetProxyByBindPort("23460")).To(BeNil())
+			Expect(pm.GetConfigByBindPort("23460")).To(BeNil())
+		})
+
+		It("should not keep proxies that fail to start", func() {
+			pm := GetManager()
+			pm.Configure(false, zap.NewNop(), "localhost", 4096, 1000, 1000)
+			instance := ProxyInstance{
+				BindPort:        23460,
+				UpstreamAddress: "localhost",
+				UpstreamPort:    34567,
+				Name:            "invalid-dns",
+				Type:            ProxyTypeDNS,
+				UpstreamMode:    UpstreamModeMux,
+			}
+			Expect(pm.RegisterProxy(instance)).To(MatchError(ContainSubstring("invalid dns")))
+			Expect(pm.GetProxyByBindPort("23460")).To(BeNil())
+			Expect(pm.GetConfigByBindPort("23460")).To(BeNil())
+
+			instance.Type, instance.UpstreamMode = "", ""
+			Expect(pm.RegisterProxy(instance)).To(Succeed())
+			defer pm.UnregisterByBindPort("23460")
+			Expect(pm.RegisterProxy(instance)).To(Equal(ErrProxyExists))
+		})
+	})
+
+	Describe("ACL", func() {
+		It("should evaluate the first matching rule", func() {
+			acl, err := NewACL([]ACLRule{
+				{Action: ACLActionAllow, CIDR: "10.1.2.3"},
+				{Action: ACLActionDeny, CIDR: "10.0.0.0/8"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acl.Allows(net.ParseIP("10.1.2.3"))).To(BeTrue())
+			Expect(acl.Allows(net.ParseIP("10.1.2.4"))).To(BeFalse())
+			Expect(acl.Allows(net.ParseIP("192.0.2.1"))).To(BeTrue())
+			Expect(acl.Remove(ACLRule{Action: ACLActionDeny, CIDR: "10.0.0.0/8"})).To(Succeed())
+			Expect(acl.Allows(net.ParseIP("10.1.2.4"))).To(BeTrue())
+			Expect(acl.Add(ACLRule{Action: "block", CIDR: "10.0.0.0/8"})).NotTo(Succeed())
+		})
+
+		It("should drop denied datagrams and close sessions of newly denied clients", func() {
+			testProxy.GlobalACL = &ACL{}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(testProxy.Sessions).Should(HaveLen(1))
+
+			Expect(testProxy.GlobalACL.Add(ACLRule{Action: ACLActionDeny, CIDR: "127.0.0.0/8"})).To(Succeed())
+			testProxy.EnforceACL()
+			Expect(testProxy.Sessions()).To(BeEmpty())
+			Expect(testProxy.Stats()["aclSessionsClosed"]).To(BeNumerically("==", 1))
+
+			_, err = client.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["aclDrops"]
+			}).Should(BeNumerically("==", 1))
+			Expect(testProxy.Sessions()).To(BeEmpty())
+		})
+	})
+
+	Describe("Bans", func() {
+		It("should ban clients that keep exceeding the rate limit and persist the ban", func() {
+			dir, err := ioutil.TempDir("", "udpx")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			persistFile := filepath.Join(dir, "bans.json")
+			testProxy.ClientRateLimit = RateLimit{PacketsPerSecond: 1, PacketsBurst: 1}
+			testProxy.BanPolicy = BanPolicy{Threshold: 3, PersistFile: persistFile}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			for i := 0; i < 10; i++ {
+				_, err = client.Write([]byte("ping"))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			Eventually(testProxy.Bans).Should(HaveLen(1))
+			ban := testProxy.Bans()[0]
+			Expect(ban.Address).To(Equal("127.0.0.1"))
+			Expect(ban.Reason).To(Equal(OffenseRateLimit))
+			Eventually(func() uint64 {
+				return testProxy.Stats()["banDrops"]
+			}).Should(BeNumerically(">=", 1))
+			Expect(testProxy.Sessions()).To(BeEmpty())
+			Eventually(persistFile, 2*time.Second).Should(BeAnExistingFile())
+
+			restarted := GetProxy(false, testProxy.Logger, 23457, "localhost", "localhost", 34567, 4096, time.Second, time.Second)
+			restarted.BanPolicy = testProxy.BanPolicy
+			restarted.Start()
+			defer restarted.Close()
+			Expect(restarted.Bans()).To(HaveLen(1))
+			Expect(restarted.RevokeBan("127.0.0.1")).To(BeTrue())
+			Expect(restarted.Bans()).To(BeEmpty())
+		})
+
+		It("should ban clients that send malformed datagrams", func() {
+			testProxy.Type = ProxyTypeDNS
+			testProxy.BanPolicy = BanPolicy{Threshold: 2}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			for i := 0; i < 2; i++ {
+				_, err = client.Write([]byte("not dns"))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Eventually(testProxy.Bans).Should(HaveLen(1))
+			Expect(testProxy.Bans()[0].Reason).To(Equal(OffenseMalformed))
+		})
+	})
+
+	Describe("Filtering", func() {
+		It("should only forward replies from the upstream by default", func() {
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(testProxy.Sessions).Should(HaveLen(1))
+			_, port, err := net.SplitHostPort(testProxy.Sessions()[0].LocalAddress)
+			Expect(err).NotTo(HaveOccurred())
+			sessionAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:"+port)
+			Expect(err).NotTo(HaveOccurred())
+
+			attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			Expect(err).NotTo(HaveOccurred())
+			defer attacker.Close()
+			_, err = attacker.WriteToUDP([]byte("injected"), sessionAddr)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["filteredReplies"]
+			}).Should(BeNumerically("==", 1))
+
+			buf := make([]byte, 64)
+			_, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("pong"))
+		})
+	})
+
+	Describe("Authentication", func() {
+		It("should only open sessions for datagrams with a valid token", func() {
+			testProxy.Authentication = Authentication{Keys: []AuthKey{{ID: 1, Secret: "secret"}}}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["authFailures"]
+			}).Should(BeNumerically("==", 1))
+			Expect(testProxy.Sessions()).To(BeEmpty())
+
+			sealed, err := auth.Seal([]byte(auth.DefaultPrefix), 1, []byte("secret"), time.Now().Add(time.Minute), []byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.Write(sealed)
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("hello"))
+			Expect(testProxy.Sessions()).To(HaveLen(1))
+
+			// retransmissions lose their token, other datagrams that look
+			// like tokens are not touched
+			_, err = client.Write(sealed)
+			Expect(err).NotTo(HaveOccurred())
+			n, _, err = testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("hello"))
+			other, err := auth.Seal([]byte(auth.DefaultPrefix), 1, []byte("wrong"), time.Now().Add(time.Minute), []byte("data"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.Write(other)
+			Expect(err).NotTo(HaveOccurred())
+			n, _, err = testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf[:n]).To(Equal(other))
+		})
+	})
+
+	Describe("ProxyProtocol", func() {
+		It("should prepend a header to every datagram sent upstream", func() {
+			testProxy.ProxyProtocol = ProxyProtocol{Egress: ProxyProtocolEvery}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			buf := make([]byte, 128)
+			for i := 0; i < 2; i++ {
+				_, err = client.Write([]byte("ping"))
+				Expect(err).NotTo(HaveOccurred())
+				testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+				n, _, err := testUpstream.ReadFromUDP(buf)
+				Expect(err).NotTo(HaveOccurred())
+				h, payload, err := proxyproto.Decode(buf[:n])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(h.Source.String()).To(Equal(client.LocalAddr().String()))
+				Expect(string(payload)).To(Equal("ping"))
+			}
+		})
+
+		It("should key sessions by the address of the ingress header", func() {
+			testProxy.ProxyProtocol = ProxyProtocol{Ingress: ProxyProtocolRequired, TrustedPeers: []string{"127.0.0.1"}}
+			testProxy.Start()
+
+			balancer, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer balancer.Close()
+			_, err = balancer.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["proxyProtocolInvalid"]
+			}).Should(BeNumerically("==", 1))
+
+			h := proxyproto.Header{Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+			_, err = balancer.Write(append(h.Append(nil), "ping"...))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 128)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("ping"))
+			sessions := testProxy.Sessions()
+			Expect(sessions).To(HaveLen(1))
+			Expect(sessions[0].Client).To(Equal("192.0.2.1:1234"))
+			Expect(sessions[0].Peer).To(Equal(balancer.LocalAddr().String()))
+
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			balancer.SetReadDeadline(time.Now().Add(time.Second))
+			n, err = balancer.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("pong"))
+		})
+
+		It("should not decode the headers of untrusted peers", func() {
+			testProxy.ProxyProtocol = ProxyProtocol{Ingress: ProxyProtocolOptional, TrustedPeers: []string{"192.0.2.0/24"}}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			h := proxyproto.Header{Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+			datagram := append(h.Append(nil), "ping"...)
+			_, err = client.Write(datagram)
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 128)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf[:n]).To(Equal(datagram))
+			sessions := testProxy.Sessions()
+			Expect(sessions).To(HaveLen(1))
+			Expect(sessions[0].Client).To(Equal(client.LocalAddr().String()))
+		})
+
+		It("should drop the datagrams of untrusted peers when headers are required", func() {
+			testProxy.ProxyProtocol = ProxyProtocol{Ingress: ProxyProtocolRequired, TrustedPeers: []string{"192.0.2.0/24"}}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			h := proxyproto.Header{Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+			_, err = client.Write(append(h.Append(nil), "ping"...))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["proxyProtocolUntrusted"]
+			}).Should(BeNumerically("==", 1))
+			Expect(testProxy.Sessions()).To(BeEmpty())
+		})
+
+		It("should apply the acl to the peer the header came from", func() {
+			testProxy.ProxyProtocol = ProxyProtocol{Ingress: ProxyProtocolRequired, TrustedPeers: []string{"127.0.0.1"}}
+			testProxy.ACL, _ = NewACL([]ACLRule{{Action: ACLActionDeny, CIDR: "127.0.0.1"}})
+			testProxy.Start()
+
+			balancer, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer balancer.Close()
+			h := proxyproto.Header{Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+			_, err = balancer.Write(append(h.Append(nil), "ping"...))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["aclDrops"]
+			}).Should(BeNumerically("==", 1))
+			Expect(testProxy.Sessions()).To(BeEmpty())
+		})
+
+		It("should require trusted peers with ingress", func() {
+			Expect(ProxyProtocol{Ingress: ProxyProtocolRequired}.Validate()).To(HaveOccurred())
+			Expect(ProxyProtocol{Ingress: ProxyProtocolRequired, TrustedPeers: []string{"nope"}}.Validate()).To(HaveOccurred())
+			Expect(ProxyProtocol{Ingress: ProxyProtocolRequired, TrustedPeers: []string{"10.0.0.0/8"}}.Validate()).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("Tunnel", func() {
+		It("should carry datagrams sealed between an entry and an exit", func() {
+			keys := []TunnelKey{{ID: 1, Secret: "secret"}}
+			exit := GetProxy(false, testProxy.Logger, 23460, "localhost", "localhost", 34567, 4096, time.Second, time.Second)
+			exit.Tunnel = Tunnel{Role: TunnelRoleExit, Keys: keys}
+			exit.Start()
+			defer exit.Close()
+			testProxy.UpstreamPort = 23460
+			testProxy.Tunnel = Tunnel{Role: TunnelRoleEntry, Keys: keys}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 128)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("ping"))
+
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err = client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("pong"))
+
+			plain, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23460})
+			Expect(err).NotTo(HaveOccurred())
+			defer plain.Close()
+			_, err = plain.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return exit.Stats()["tunnelOpenErrors"]
+			}).Should(BeNumerically("==", 1))
+		})
+
+		It("should run without a session timeout", func() {
+			exit := GetProxy(false, testProxy.Logger, 23460, "localhost", "localhost", 34567, 4096, 0, time.Second)
+			exit.Tunnel = Tunnel{Role: TunnelRoleExit, Keys: []TunnelKey{{ID: 1, Secret: "secret"}}}
+			exit.Start()
+			exit.Close()
+			Expect(exit.Stats()["goroutines"]).To(BeZero())
+		})
+
+		It("should not leave background loops running when the config is invalid", func() {
+			testProxy.Tunnel = Tunnel{Role: TunnelRoleEntry, Keys: []TunnelKey{{ID: 1, Secret: "secret"}}}
+			testProxy.Type = "nope"
+			Expect(testProxy.Start()).To(HaveOccurred())
+			Expect(testProxy.Stats()["goroutines"]).To(BeZero())
+		})
+	})
+
+	Describe("DTLS", func() {
+		psk := DTLS{PSK: "abc123", PSKIdentity: "udpx"}
+
+		// captureClientHello returns the first ClientHello of a client, so
+		// that it can be sent from sources that never answer the cookie
+		// exchange
+		captureClientHello := func() []byte {
+			sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			Expect(err).NotTo(HaveOccurred())
+			defer sink.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				raw, err := net.DialUDP("udp", nil, sink.LocalAddr().(*net.UDPAddr))
+				if err != nil {
+					return
+				}
+				defer raw.Close()
+				dtls.ClientWithContext(ctx, raw, &dtls.Config{
+					PSK:             func([]byte) ([]byte, error) { return []byte{0xab, 0xc1, 0x23}, nil },
+					PSKIdentityHint: []byte("udpx"),
+					CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+				})
+			}()
+			hello := make([]byte, 2048)
+			sink.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := sink.ReadFromUDP(hello)
+			Expect(err).NotTo(HaveOccurred())
+			return hello[:n]
+		}
+
+		It("should terminate DTLS from clients", func() {
+			testProxy.DTLS = psk
+			testProxy.DTLS.Mode = DTLSModeTerminate
+			testProxy.Start()
+
+			raw, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			client, err := dtls.Client(raw, &dtls.Config{
+				PSK:             func([]byte) ([]byte, error) { return []byte{0xab, 0xc1, 0x23}, nil },
+				PSKIdentityHint: []byte("udpx"),
+				CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 128)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("ping"))
+
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err = client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("pong"))
+			Expect(testProxy.Stats()["dtlsHandshakes"]).To(BeNumerically("==", 1))
+			Expect(testProxy.Stats()["dtlsSessions"]).To(BeNumerically("==", 1))
+			Expect(testProxy.Sessions()[0].DTLS).To(Equal("established"))
+		})
+
+		It("should originate DTLS toward the upstream", func() {
+			terminator := GetProxy(false, testProxy.Logger, 23461, "localhost", "localhost", 34567, 4096, time.Second, time.Second)
+			terminator.DTLS = psk
+			terminator.DTLS.Mode = DTLSModeTerminate
+			terminator.Start()
+			defer terminator.Close()
+			testProxy.UpstreamPort = 23461
+			testProxy.DTLS = psk
+			testProxy.DTLS.Mode = DTLSModeOriginate
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 128)
+			testUpstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("ping"))
+
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err = client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("pong"))
+		})
+
+		It("should count failed handshakes", func() {
+			testProxy.DTLS = psk
+			testProxy.DTLS.Mode = DTLSModeTerminate
+			testProxy.Start()
+
+			raw, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer raw.Close()
+			_, err = dtls.Client(raw, &dtls.Config{
+				PSK:             func([]byte) ([]byte, error) { return []byte{0xab, 0xc1, 0x23}, nil },
+				PSKIdentityHint: []byte("someone else"),
+				CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+			})
+			Expect(err).To(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dtlsHandshakeFailures"]
+			}).Should(BeNumerically("==", 1))
+			Eventually(testProxy.Sessions).Should(BeEmpty())
+		})
+
+		It("should only create sessions once the handshake completes", func() {
+			testProxy.DTLS = psk
+			testProxy.DTLS.Mode = DTLSModeTerminate
+			testProxy.DTLS.MaxHandshakes = 1
+			testProxy.Start()
+
+			hello := captureClientHello()
+			for i := 0; i < 2; i++ {
+				raw, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+				Expect(err).NotTo(HaveOccurred())
+				defer raw.Close()
+				_, err = raw.Write(hello)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dtlsHandshakeDrops"]
+			}).Should(BeNumerically("==", 1))
+			Expect(testProxy.Sessions()).To(BeEmpty())
+			Expect(testProxy.Stats()["socketBindErrors"]).To(BeZero())
+		})
+
+		It("should bound the handshakes of each client IP", func() {
+			testProxy.DTLS = psk
+			testProxy.DTLS.Mode = DTLSModeTerminate
+			testProxy.DTLS.MaxHandshakesPerIP = 2
+			Expect(testProxy.Start()).To(Succeed())
+
+			hello := captureClientHello()
+			send := func(ip string) {
+				raw, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip)}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+				Expect(err).NotTo(HaveOccurred())
+				defer raw.Close()
+				_, err = raw.Write(hello)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			for i := 0; i < 3; i++ {
+				send("127.0.0.1")
+			}
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dtlsHandshakeDrops"]
+			}).Should(BeNumerically("==", 1))
+
+			// another host still gets a handshake
+			send("127.0.0.2")
+			Consistently(func() uint64 {
+				return testProxy.Stats()["dtlsHandshakeDrops"]
+			}, 200*time.Millisecond).Should(BeNumerically("==", 1))
+		})
+	})
+
+	Describe("FEC", func() {
+		It("should carry datagrams and parity between an entry and an exit", func() {
+			exit := GetProxy(false, testProxy.Logger, 23462, "localhost", "localhost", 34567, 4096, time.Second, time.Second)
+			exit.FEC = FEC{Role: FECRoleExit, BlockSize: 2, Redundancy: 1}
+			exit.Start()
+			defer exit.Close()
+			testProxy.UpstreamPort = 23462
+			testProxy.FEC = FEC{Role: FECRoleEntry, BlockSize: 2, Redundancy: 1}
+			testProxy.Start()
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			buf := make([]byte, 128)
+			var src *net.UDPAddr
+			for _, d := range []string{"ping 1", "ping 2"} {
+				_, err = client.Write([]byte(d))
+				Expect(err).NotTo(HaveOccurred())
+				testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+				var n int
+				n, src, err = testUpstream.ReadFromUDP(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(buf[:n])).To(Equal(d))
+			}
+			Expect(testProxy.Stats()["fecParityDatagrams"]).To(BeNumerically("==", 2))
+			Expect(exit.Stats()["fecRecovered"]).To(BeNumerically("==", 0))
+
+			// incomplete blocks are flushed after the flush interval
+			_, err = testUpstream.WriteToUDP([]byte("pong"), src)
+			Expect(err).NotTo(HaveOccurred())
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("pong"))
+			Eventually(func() uint64 {
+				return exit.Stats()["fecParityDatagrams"]
+			}).Should(BeNumerically("==", 2))
+		})
+
+		It("should rebuild datagrams lost on the way to the exit", func() {
+			testProxy.FEC = FEC{Role: FECRoleExit, BlockSize: 2, Redundancy: 0.5}
+			testProxy.Start()
+
+			encoder, err := fec.NewEncoder(2, 1)
+			Expect(err).NotTo(HaveOccurred())
+			var sent [][]byte
+			for _, d := range []string{"lost", "kept"} {
+				encoder.Add([]byte(d), func(b []byte) { sent = append(sent, append([]byte(nil), b...)) })
+			}
+			entry, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer entry.Close()
+			for _, b := range sent[1:] {
+				_, err = entry.Write(b)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			received := []string{}
+			buf := make([]byte, 128)
+			for i := 0; i < 2; i++ {
+				testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+				n, _, err := testUpstream.ReadFromUDP(buf)
+				Expect(err).NotTo(HaveOccurred())
+				received = append(received, string(buf[:n]))
+			}
+			Expect(received).To(ConsistOf("lost", "kept"))
+			Expect(testProxy.Stats()["fecRecovered"]).To(BeNumerically("==", 1))
+		})
+
+		It("should share the decoder of a peer between the readers", func() {
+			testProxy.FEC = FEC{Role: FECRoleExit, BlockSize: 2, Redundancy: 0.5}
+			testProxy.Start()
+
+			encoder, err := fec.NewEncoder(2, 1)
+			Expect(err).NotTo(HaveOccurred())
+			var sent [][]byte
+			for i := 0; i < 200; i++ {
+				encoder.Add([]byte(fmt.Sprintf("ping %d", i)), func(b []byte) { sent = append(sent, append([]byte(nil), b...)) })
+			}
+			entry, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer entry.Close()
+			for _, b := range sent {
+				_, err = entry.Write(b)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			buf := make([]byte, 128)
+			received := 0
+			for {
+				testUpstream.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+				if _, _, err := testUpstream.ReadFromUDP(buf); err != nil {
+					break
+				}
+				received++
+			}
+			Expect(received).To(BeNumerically(">", 0))
+			Expect(testProxy.Stats()["fecInvalid"]).To(BeZero())
+		})
+
+		It("should run without a session timeout", func() {
+			exit := GetProxy(false, testProxy.Logger, 23462, "localhost", "localhost", 34567, 4096, 0, time.Second)
+			exit.FEC = FEC{Role: FECRoleExit}
+			exit.Start()
+			exit.Close()
+			Expect(exit.Stats()["goroutines"]).To(BeZero())
+		})
+	})
+
+	Describe("SessionKey", func() {
+		var clients []*net.UDPConn
+
+		BeforeEach(func() {
+			clients = nil
+		})
+
+		AfterEach(func() {
+			for _, c := range clients {
+				c.Close()
+			}
+		})
+
+		send := func(payload string) *net.UDPConn {
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			clients = append(clients, client)
+			_, err = client.Write([]byte(payload))
+			Expect(err).NotTo(HaveOccurred())
+			return client
+		}
+
+		receive := func() *net.UDPAddr {
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			_, src, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			return src
+		}
+
+		It("should keep the session of a client whose address changed", func() {
+			testProxy.SessionKey = SessionKey{Mode: SessionKeyPayload, Offset: 0, Length: 4}
+			testProxy.Start()
+
+			send("tok1hello")
+			session := receive()
+			rebound := send("tok1again")
+			Expect(receive().String()).To(Equal(session.String()))
+			send("tok2other")
+			Expect(receive().String()).NotTo(Equal(session.String()))
+			Expect(testProxy.Sessions()).To(HaveLen(2))
+			Expect(testProxy.Stats()["sessionRebinds"]).To(BeNumerically("==", 1))
+
+			_, err := testUpstream.WriteToUDP([]byte("pong"), session)
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 64)
+			rebound.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := rebound.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("pong"))
+
+			send("tok")
+			Eventually(func() uint64 {
+				return testProxy.Stats()["sessionKeyDrops"]
+			}).Should(BeNumerically("==", 1))
+		})
+
+		It("should key sessions by client ip", func() {
+			testProxy.SessionKey = SessionKey{Mode: SessionKeyIP}
+			testProxy.Start()
+
+			send("first")
+			session := receive()
+			send("second")
+			Expect(receive().String()).To(Equal(session.String()))
+			Expect(testProxy.Sessions()).To(HaveLen(1))
+			Expect(testProxy.Sessions()[0].Key).To(Equal("127.0.0.1"))
+		})
+
+		It("should key sessions with a registered extractor", func() {
+			RegisterSessionKeyExtractor("prefix", func(src *net.UDPAddr, data []byte) (string, bool) {
+				i := bytes.IndexByte(data, ':')
+				return string(data[:i+1]), i > 0
+			})
+			testProxy.SessionKey = SessionKey{Mode: SessionKeyExtractor, Extractor: "prefix"}
+			testProxy.Start()
+
+			send("player:move")
+			session := receive()
+			send("player:jump")
+			Expect(receive().String()).To(Equal(session.String()))
+			send("nokey")
+			Eventually(func() uint64 {
+				return testProxy.Stats()["sessionKeyDrops"]
+			}).Should(BeNumerically("==", 1))
+		})
+
+		It("should refuse unknown extractors", func() {
+			Expect(SessionKey{Mode: SessionKeyExtractor, Extractor: "missing"}.Validate()).To(HaveOccurred())
+			Expect(SessionKey{Mode: SessionKeyPayload}.Validate()).To(HaveOccurred())
+			Expect(SessionKey{RebindInterval: -1}.Validate()).To(HaveOccurred())
+		})
+
+		reply := func(session *net.UDPAddr, client *net.UDPConn) (string, error) {
+			_, err := testUpstream.WriteToUDP([]byte("pong"), session)
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 64)
+			client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, err := client.Read(buf)
+			return string(buf[:n]), err
+		}
+
+		It("should only move an authenticated session for a new token", func() {
+			RegisterSessionKeyExtractor("suffix", func(src *net.UDPAddr, data []byte) (string, bool) {
+				return string(data[len(data)-4:]), len(data) >= 4
+			})
+			testProxy.SessionKey = SessionKey{Mode: SessionKeyExtractor, Extractor: "suffix"}
+			testProxy.Authentication = Authentication{Keys: []AuthKey{{ID: 1, Secret: "secret"}}}
+			testProxy.Start()
+			seal := func(payload string) string {
+				sealed, err := auth.Seal([]byte(auth.DefaultPrefix), 1, []byte("secret"), time.Now().Add(time.Minute), []byte(payload))
+				Expect(err).NotTo(HaveOccurred())
+				return string(sealed)
+			}
+
+			opened := seal("helloKEY1")
+			owner := send(opened)
+			session := receive()
+
+			// neither the key alone nor a replayed token move the session
+			send("spoofKEY1")
+			send(opened)
+			Eventually(func() uint64 {
+				return testProxy.Stats()["sessionRebindDrops"]
+			}).Should(BeNumerically("==", 2))
+			Expect(reply(session, owner)).To(Equal("pong"))
+
+			moved := seal("movedKEY1")
+			rebound := send(moved)
+			Expect(receive().String()).To(Equal(session.String()))
+			Expect(testProxy.Stats()["sessionRebinds"]).To(BeNumerically("==", 1))
+			Expect(reply(session, rebound)).To(Equal("pong"))
+
+			// retransmissions of the new token lose it
+			_, err := rebound.Write([]byte(moved))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 64)
+			testUpstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := testUpstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("movedKEY1"))
+		})
+
+		It("should move a session at most once per rebind interval", func() {
+			testProxy.SessionKey = SessionKey{Mode: SessionKeyPayload, Offset: 0, Length: 4, RebindInterval: 300}
+			testProxy.Start()
+
+			owner := send("tok1hello")
+			session := receive()
+			first := send("tok1first")
+			receive()
+			send("tok1again")
+			Eventually(func() uint64 {
+				return testProxy.Stats()["sessionRebindDrops"]
+			}).Should(BeNumerically("==", 1))
+			Expect(reply(session, first)).To(Equal("pong"))
+
+			time.Sleep(300 * time.Millisecond)
+			_, err := owner.Write([]byte("tok1back"))
+			Expect(err).NotTo(HaveOccurred())
+			receive()
+			Expect(reply(session, owner)).To(Equal("pong"))
+			Expect(testProxy.Stats()["sessionRebinds"]).To(BeNumerically("==", 2))
+		})
+
+		It("should move the client address and admission of a session with it", func() {
+			testProxy.SessionKey = SessionKey{Mode: SessionKeyPayload, Offset: 0, Length: 4, RebindInterval: 1}
+			testProxy.Admission = Admission{MaxSessionsPerIP: 1}
+			Expect(testProxy.Start()).To(Succeed())
+
+			sendFrom := func(ip, payload string) {
+				client, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip)}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+				Expect(err).NotTo(HaveOccurred())
+				clients = append(clients, client)
+				_, err = client.Write([]byte(payload))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			clientOf := func(key string) string {
+				for _, s := range testProxy.Sessions() {
+					if s.Key == key {
+						return s.Client
+					}
+				}
+				return ""
+			}
+
+			sendFrom("127.0.0.1", "tok1hello")
+			receive()
+			sendFrom("127.0.0.2", "tok2hello")
+			receive()
+
+			// 127.0.0.2 already has its session
+			sendFrom("127.0.0.2", "tok1moved")
+			Eventually(func() uint64 {
+				return testProxy.Stats()["sessionRebindDrops"]
+			}).Should(BeNumerically("==", 1))
+			Expect(testProxy.Stats()["admissionRejectsPerIp"]).To(BeNumerically("==", 1))
+			Expect(clientOf("746f6b31")).To(HavePrefix("127.0.0.1:"))
+
+			sendFrom("127.0.0.3", "tok1moved")
+			receive()
+			Expect(clientOf("746f6b31")).To(HavePrefix("127.0.0.3:"))
+
+			// the session no longer counts for 127.0.0.1
+			sendFrom("127.0.0.1", "tok3hello")
+			receive()
+			Expect(testProxy.Sessions()).To(HaveLen(3))
+		})
+	})
+
+	Describe("DNS", func() {
+		var (
+			resolver *net.UDPConn
+			client   *net.UDPConn
+		)
+
+		BeforeEach(func() {
+			var err error
+			resolver, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 34573})
+			Expect(err).NotTo(HaveOccurred())
+			client, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			testProxy.Type = ProxyTypeDNS
+			testProxy.DNS = DNS{Routes: []DNSRoute{{Suffix: "example.com", UpstreamAddress: "localhost", UpstreamPort: 34573}}, Sockets: 2}
+		})
+
+		AfterEach(func() {
+			resolver.Close()
+			client.Close()
+		})
+
+		message := func(header dnsmessage.Header, name string) []byte {
+			builder := dnsmessage.NewBuilder(nil, header)
+			Expect(builder.StartQuestions()).To(Succeed())
+			Expect(builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})).To(Succeed())
+			b, err := builder.Finish()
+			Expect(err).NotTo(HaveOccurred())
+			return b
+		}
+
+		receive := func(conn *net.UDPConn) (dnsmessage.Header, *net.UDPAddr) {
+			buf := make([]byte, 512)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, src, err := conn.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buf[:n])
+			Expect(err).NotTo(HaveOccurred())
+			return header, src
+		}
+
+		It("should route queries by name and restore their transaction ids", func() {
+			testProxy.Start()
+
+			_, err := client.Write(message(dnsmessage.Header{ID: 0x1234, RecursionDesired: true}, "www.Example.com."))
+			Expect(err).NotTo(HaveOccurred())
+			query, src := receive(resolver)
+			_, err = resolver.WriteToUDP(message(dnsmessage.Header{ID: query.ID, Response: true, RCode: dnsmessage.RCodeNameError}, "www.Example.com."), src)
+			Expect(err).NotTo(HaveOccurred())
+			response, _ := receive(client)
+			Expect(response.ID).To(Equal(uint16(0x1234)))
+			Expect(response.RCode).To(Equal(dnsmessage.RCodeNameError))
+
+			_, err = client.Write(message(dnsmessage.Header{ID: 0x4321}, "other.org."))
+			Expect(err).NotTo(HaveOccurred())
+			query, src = receive(testUpstream)
+			_, err = testUpstream.WriteToUDP(message(dnsmessage.Header{ID: query.ID, Response: true}, "other.org."), src)
+			Expect(err).NotTo(HaveOccurred())
+			response, _ = receive(client)
+			Expect(response.ID).To(Equal(uint16(0x4321)))
+
+			Expect(testProxy.Stats()["dnsQueries"]).To(BeNumerically("==", 2))
+			Expect(testProxy.Stats()["dnsResponses"]).To(BeNumerically("==", 2))
+			Expect(testProxy.Stats()["dnsPendingQueries"]).To(BeNumerically("==", 0))
+			Expect(testProxy.Sessions()).To(BeEmpty())
+		})
+
+		It("should drop responses that match no query", func() {
+			testProxy.Start()
+
+			_, err := client.Write(message(dnsmessage.Header{ID: 1}, "www.example.com."))
+			Expect(err).NotTo(HaveOccurred())
+			query, src := receive(resolver)
+			_, err = resolver.WriteToUDP(message(dnsmessage.Header{ID: query.ID, Response: true}, "evil.example.com."), src)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = resolver.WriteToUDP(message(dnsmessage.Header{ID: query.ID + 1, Response: true}, "www.example.com."), src)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dnsUnexpectedResponses"]
+			}).Should(BeNumerically("==", 2))
+			Expect(testProxy.Stats()["dnsPendingQueries"]).To(BeNumerically("==", 1))
+
+			_, err = client.Write([]byte("not dns"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dnsInvalidQueries"]
+			}).Should(BeNumerically("==", 1))
+		})
+
+		It("should forget queries that got no response", func() {
+			testProxy.DNS.QueryTimeout = 100
+			testProxy.Start()
+
+			_, err := client.Write(message(dnsmessage.Header{ID: 1}, "www.example.com."))
+			Expect(err).NotTo(HaveOccurred())
+			receive(resolver)
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dnsTimeouts"]
+			}).Should(BeNumerically("==", 1))
+			Expect(testProxy.Stats()["dnsPendingQueries"]).To(BeNumerically("==", 0))
+		})
+
+		It("should refuse session limits and an open resolver", func() {
+			refused := func(configure func(p *Proxy), reason string) {
+				p := GetProxy(false, testProxy.Logger, 23462, "localhost", "localhost", 34573, 4096, time.Second, time.Second)
+				p.Type, p.DNS = testProxy.Type, testProxy.DNS
+				configure(p)
+				Expect(p.Start()).To(MatchError(ContainSubstring(reason)))
+			}
+			refused(func(p *Proxy) { p.ClientRateLimit = RateLimit{PacketsPerSecond: 10} }, "rate limits")
+			refused(func(p *Proxy) { p.ClientShaping = Shaping{BytesPerSecond: 1000} }, "shaping")
+			refused(func(p *Proxy) { p.Admission = Admission{MaxSessionsPerIP: 1} }, "admission")
+			refused(func(p *Proxy) { p.AmplificationGuard = AmplificationGuard{Factor: 3} }, "amplification")
+			refused(func(p *Proxy) { p.BindAddress = "0.0.0.0" }, "loopback")
+
+			testProxy.BindAddress = "0.0.0.0"
+			testProxy.ACL, _ = NewACL([]ACLRule{{Action: ACLActionAllow, CIDR: "127.0.0.1"}})
+			Expect(testProxy.Start()).To(Succeed())
+		})
+
+		It("should bound the pending queries of each client", func() {
+			testProxy.DNS.MaxClientPending = 2
+			testProxy.DNS.QueryTimeout = 200
+			testProxy.Start()
+
+			for id := uint16(1); id <= 3; id++ {
+				_, err := client.Write(message(dnsmessage.Header{ID: id}, "www.example.com."))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dnsClientPendingDrops"]
+			}).Should(BeNumerically("==", 1))
+			Expect(testProxy.Stats()["dnsQueries"]).To(BeNumerically("==", 2))
+
+			other, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2")}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			defer other.Close()
+			_, err = other.Write(message(dnsmessage.Header{ID: 4}, "www.example.com."))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dnsQueries"]
+			}).Should(BeNumerically("==", 3))
+
+			// the client gets its slots back once its queries time out
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dnsTimeouts"]
+			}).Should(BeNumerically("==", 3))
+			_, err = client.Write(message(dnsmessage.Header{ID: 5}, "www.example.com."))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["dnsQueries"]
+			}).Should(BeNumerically("==", 4))
+			Expect(testProxy.Stats()["dnsClientPendingDrops"]).To(BeNumerically("==", 1))
+		})
+	})
+
+	Describe("QUIC", func() {
+		var (
+			routed  *net.UDPConn
+			clients []*net.UDPConn
+		)
+
+		BeforeEach(func() {
+			var err error
+			routed, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 34572})
+			Expect(err).NotTo(HaveOccurred())
+			testProxy.QUIC = QUIC{Routes: []QUICRoute{{ServerName: "*.example.com", UpstreamAddress: "localhost", UpstreamPort: 34572}}}
+			clients = nil
+		})
+
+		AfterEach(func() {
+			routed.Close()
+			for _, c := range clients {
+				c.Close()
+			}
+		})
+
+		dial := func() *net.UDPConn {
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23456})
+			Expect(err).NotTo(HaveOccurred())
+			clients = append(clients, client)
+			return client
+		}
+
+		// initial returns the Initial packet of a client connecting to
+		// serverName, carrying the ClientHello crypto/tls sends
+		initial := func(serverName string, dcid, scid []byte) []byte {
+			client, server := net.Pipe()
+			defer server.Close()
+			go tls.Client(client, &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS13}).Handshake()
+			header := make([]byte, 5)
+			_, err := io.ReadFull(server, header)
+			Expect(err).NotTo(HaveOccurred())
+			hello := make([]byte, int(header[3])<<8|int(header[4]))
+			_, err = io.ReadFull(server, hello)
+			Expect(err).NotTo(HaveOccurred())
+			client.Close()
+			// a crypto frame at offset 0
+			frame := quic.AppendVarint([]byte{0x06, 0x00}, uint64(len(hello)))
+			packet, err := quic.SealInitial(quic.Version1, dcid, scid, nil, 0, append(frame, hello...))
+			Expect(err).NotTo(HaveOccurred())
+			return packet
+		}
+
+		receive := func(upstream *net.UDPConn) ([]byte, *net.UDPAddr) {
+			buf := make([]byte, 4096)
+			upstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, src, err := upstream.ReadFromUDP(buf)
+			Expect(err).NotTo(HaveOccurred())
+			return buf[:n], src
+		}
+
+		It("should route sessions by the server name of their ClientHello", func() {
+			testProxy.Start()
+
+			packet := initial("www.example.com", []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{9})
+			_, err := dial().Write(packet)
+			Expect(err).NotTo(HaveOccurred())
+			data, _ := receive(routed)
+			Expect(data).To(Equal(packet))
+
+			packet = initial("other.org", []byte{8, 7, 6, 5, 4, 3, 2, 1}, []byte{9})
+			_, err = dial().Write(packet)
+			Expect(err).NotTo(HaveOccurred())
+			data, _ = receive(testUpstream)
+			Expect(data).To(Equal(packet))
+
+			Expect(testProxy.Stats()["quicRoutedSessions"]).To(BeNumerically("==", 1))
+			Expect(testProxy.Stats()["quicUnmatched"]).To(BeNumerically("==", 1))
+			Eventually(testProxy.Sessions).Should(HaveLen(2))
+		})
+
+		It("should drop unmatched sessions when asked to", func() {
+			testProxy.QUIC.DropUnmatched = true
+			testProxy.Start()
+
+			_, err := dial().Write(initial("other.org", []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = dial().Write([]byte("not quic"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() uint64 {
+				return testProxy.Stats()["quicUnmatchedDrops"]
+			}).Should(BeNumerically("==", 2))
+			Expect(testProxy.Sessions()).To(BeEmpty())
+		})
+
+		It("should keep the session of a client that migrated", func() {
+			testProxy.Start()
+
+			client := dial()
+			_, err := client.Write(initial("www.example.com", []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{9}))
+			Expect(err).NotTo(HaveOccurred())
+			_, session := receive(routed)
+
+			// the upstream picks its connection id in its handshake
+			serverCID := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+			reply, err := quic.SealInitial(quic.Version1, []byte{9}, serverCID, nil, 0, []byte{0x01})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = routed.WriteToUDP(reply, session)
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 4096)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := client.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf[:n]).To(Equal(reply))
+
+			migrated := dial()
+			short := append([]byte{0x40}, append(serverCID, "payload"...)...)
+			_, err = migrated.Write(short)
+			Expect(err).NotTo(HaveOccurred())
+			data, src := receive(routed)
+			Expect(data).To(Equal(short))
+			Expect(src.String()).To(Equal(session.String()))
+			Expect(testProxy.Stats()["quicMigrations"]).To(BeNumerically("==", 1))
+			Expect(testProxy.Sessions()).To(HaveLen(1))
+
+			_, err = routed.WriteToUDP([]byte("to the new address"), session)
+			Expect(err).NotTo(HaveOccurred())
+			migrated.SetReadDeadline(time.Now().Add(time.Second))
+			n, err = migrated.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("to the new address"))
+		})
+	})
+
 })
@@ -0,0 +1,568 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/felipejfc/udpx/quic"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultQUICHoldTimeout = time.Second
+	// quicMaxPending bounds the clients whose Initial packets are held,
+	// quicMaxHeld the packets held for each and quicMaxCrypto the size of
+	// their ClientHello
+	quicMaxPending = 4096
+	quicMaxHeld    = 8
+	quicMaxCrypto  = 16 * 1024
+	// quicMaxConnectionIDs and quicMaxAliases bound the connection ids and
+	// the addresses a session is known by
+	quicMaxConnectionIDs = 16
+	quicMaxAliases       = 8
+)
+
+// QUICRoute sends the QUIC connections for a server name to an upstream
+type QUICRoute struct {
+	// ServerName is matched against the server name of the ClientHello,
+	// "*.example.com" matches every subdomain of example.com
+	ServerName      string `json:"serverName"`
+	UpstreamAddress string `json:"upstreamAddress"`
+	UpstreamPort    int    `json:"upstreamPort"`
+	// ServerID is the hex encoded id the upstream puts in the connection
+	// ids it chooses, see QUIC.ServerIDLength
+	ServerID string `json:"serverId"`
+}
+
+// QUIC routes QUIC connections to upstreams by the server name of their
+// ClientHello without terminating QUIC, it is enabled by having routes
+type QUIC struct {
+	Routes []QUICRoute `json:"routes"`
+	// DropUnmatched drops the connections no route matches instead of
+	// sending them to the proxy upstream
+	DropUnmatched bool `json:"dropUnmatched"`
+	// ServerIDLength routes packets with unknown connection ids by the
+	// server id upstreams encode after the first byte of their connection
+	// ids, as the plaintext algorithm of QUIC-LB does, 0 disables it
+	ServerIDLength int `json:"serverIdLength"`
+	// HoldTimeout is how many milliseconds the Initial packets of a client
+	// are held while its ClientHello is incomplete, it defaults to 1 second
+	HoldTimeout int `json:"holdTimeout"`
+}
+
+// Validate checks the quic settings
+func (q QUIC) Validate() error {
+	if q.ServerIDLength < 0 || q.ServerIDLength >= quic.MaxConnectionIDSize {
+		return fmt.Errorf("invalid quic server id length %d", q.ServerIDLength)
+	}
+	if q.HoldTimeout < 0 {
+		return errors.New("quic hold timeout must not be negative")
+	}
+	serverIDs := map[string]bool{}
+	for _, r := range q.Routes {
+		if r.ServerName == "" || r.UpstreamAddress == "" || r.UpstreamPort <= 0 || r.UpstreamPort > 65535 {
+			return fmt.Errorf("invalid quic route %q", r.ServerName)
+		}
+		if r.ServerID == "" {
+			continue
+		}
+		id, err := hex.DecodeString(r.ServerID)
+		if err != nil || len(id) != q.ServerIDLength {
+			return fmt.Errorf("quic route %q needs a server id of %d hex encoded bytes", r.ServerName, q.ServerIDLength)
+		}
+		if serverIDs[r.ServerID] {
+			return fmt.Errorf("duplicate quic server id %q", r.ServerID)
+		}
+		serverIDs[r.ServerID] = true
+	}
+	return nil
+}
+
+func (q QUIC) enabled() bool {
+	return len(q.Routes) > 0
+}
+
+// validateQUIC checks that quic routing can be combined with the rest of the
+// config, the QUIC packets of clients and upstreams have to be readable
+func (p *Proxy) validateQUIC() error {
+	if !p.QUIC.enabled() {
+		return nil
+	}
+	if err := p.QUIC.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case p.Type != "" && p.Type != ProxyTypeUDP:
+		return errors.New("quic routing requires the udp proxy type")
+	case !p.usesUpstreamSockets():
+		return errors.New("quic routing requires the socket upstream mode")
+	case p.Tunnel.Role != "":
+		return errors.New("quic routing cannot be combined with a tunnel")
+	case p.DTLS.Mode != "":
+		return errors.New("quic routing cannot be combined with dtls")
+	case p.FEC.Role != "":
+		return errors.New("quic routing cannot be combined with fec")
+	case p.ProxyProtocol.Ingress != "":
+		return errors.New("quic routing cannot be combined with proxy protocol ingress")
+	case len(p.Authentication.Keys) > 0:
+		return errors.New("quic routing cannot be combined with authentication")
+	}
+	return nil
+}
+
+type quicRoute struct {
+	config   QUICRoute
+	suffix   string
+	serverID []byte
+	upstream atomic.Value
+}
+
+func (r *quicRoute) addr() *net.UDPAddr {
+	addr, _ := r.upstream.Load().(*net.UDPAddr)
+	return addr
+}
+
+func (r *quicRoute) matches(serverName string) bool {
+	if r.suffix != "" {
+		return strings.HasSuffix(serverName, r.suffix) && len(serverName) > len(r.suffix)
+	}
+	return strings.EqualFold(serverName, r.config.ServerName)
+}
+
+func (r *quicRoute) resolve() error {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", r.config.UpstreamAddress, r.config.UpstreamPort))
+	if err != nil {
+		return err
+	}
+	if current := r.addr(); current == nil || current.String() != addr.String() {
+		r.upstream.Store(addr)
+	}
+	return nil
+}
+
+// quicPending holds the Initial packets of a client until its ClientHello
+// is complete
+type quicPending struct {
+	created time.Time
+	crypto  *quic.CryptoStream
+	held    [][]byte
+}
+
+// quicRouter chooses the upstream of new QUIC sessions and finds the
+// session of the connection ids clients migrate with
+type quicRouter struct {
+	routes        []*quicRoute
+	dropUnmatched bool
+	serverIDSize  int
+	holdTimeout   time.Duration
+	mutex         sync.Mutex
+	pending       map[string]*quicPending
+	// cidSizes are the sizes of the connection ids upstreams chose, short
+	// headers do not carry it
+	cidSizes []int
+	cids     sync.Map
+}
+
+func newQUICRouter(config QUIC) *quicRouter {
+	r := &quicRouter{
+		dropUnmatched: config.DropUnmatched,
+		serverIDSize:  config.ServerIDLength,
+		holdTimeout:   millisOr(config.HoldTimeout, defaultQUICHoldTimeout),
+		pending:       map[string]*quicPending{},
+	}
+	for _, c := range config.Routes {
+		route := &quicRoute{config: c}
+		if strings.HasPrefix(c.ServerName, "*.") {
+			route.suffix = strings.ToLower(c.ServerName[1:])
+		}
+		route.serverID, _ = hex.DecodeString(c.ServerID)
+		r.routes = append(r.routes, route)
+	}
+	return r
+}
+
+func (r *quicRouter) match(serverName string) *quicRoute {
+	serverName = strings.ToLower(serverName)
+	for _, route := range r.routes {
+		if route.matches(serverName) {
+			return route
+		}
+	}
+	return nil
+}
+
+// matchServerID returns the route of the server id that follows the first
+// byte of a connection id
+func (r *quicRouter) matchServerID(cid []byte) *quicRoute {
+	if r.serverIDSize == 0 || len(cid) < 1+r.serverIDSize {
+		return nil
+	}
+	id := cid[1 : 1+r.serverIDSize]
+	for _, route := range r.routes {
+		if route.serverID != nil && bytes.Equal(route.serverID, id) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (r *quicRouter) lookup(cid []byte) *connection {
+	if len(cid) == 0 {
+		return nil
+	}
+	if conn, found := r.cids.Load(string(cid)); found {
+		return conn.(*connection)
+	}
+	return nil
+}
+
+// lookupShort finds the session of a short header packet, trying every
+// connection id size upstreams chose
+func (r *quicRouter) lookupShort(data []byte) *connection {
+	r.mutex.Lock()
+	sizes := r.cidSizes
+	r.mutex.Unlock()
+	for _, size := range sizes {
+		if cid, ok := quic.ShortHeaderDCID(data, size); ok {
+			if conn := r.lookup(cid); conn != nil {
+				return conn
+			}
+		}
+	}
+	return nil
+}
+
+func (r *quicRouter) addSize(size int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, s := range r.cidSizes {
+		if s == size {
+			return
+		}
+	}
+	// copied so that lookupShort can use the slice without the lock
+	r.cidSizes = append(append([]int(nil), r.cidSizes...), size)
+}
+
+// expire drops the clients whose ClientHello did not complete in time
+func (r *quicRouter) expire(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, pending := range r.pending {
+		if now.Sub(pending.created) > r.holdTimeout {
+			delete(r.pending, key)
+		}
+	}
+}
+
+// quicSession is the QUIC state of a client session, it is known by the
+// connection ids of its QUIC connection and by every address the client
+// migrated from
+type quicSession struct {
+	route      *quicRoute
+	serverName string
+	mutex      sync.Mutex
+	closed     bool
+	cidSize    int
+	lastCID    string
+	cids       []string
+	aliases    []string
+}
+
+// quicDecision is what routeQUIC decided for a datagram of a client without
+// a session
+type quicDecision struct {
+	// conn is the session of the connection id the client used
+	conn *connection
+	// route, serverName, held and cid describe the new session
+	route      *quicRoute
+	serverName string
+	held       [][]byte
+	cid        []byte
+}
+
+// routeQUIC finds the session of a datagram from an unknown client address
+// or decides where its new session goes, it returns false while the
+// datagram is held or when it is dropped
+func (p *Proxy) routeQUIC(src *net.UDPAddr, data []byte) (quicDecision, bool) {
+	r := p.quicRouter
+	switch {
+	case quic.IsShortHeader(data):
+		if conn := r.lookupShort(data); conn != nil {
+			return quicDecision{conn: conn}, true
+		}
+		return p.routeUnknownConnection(data[1:])
+	case quic.IsLongHeader(data):
+		header, err := quic.ParseLongHeader(data)
+		if err != nil {
+			p.stats.inc(statQUICInvalidPackets)
+			p.reportOffense(src.IP, OffenseMalformed)
+			return quicDecision{}, !r.dropUnmatched
+		}
+		if conn := r.lookup(header.DCID); conn != nil {
+			return quicDecision{conn: conn}, true
+		}
+		if !header.Initial {
+			return p.routeUnknownConnection(header.DCID)
+		}
+		return p.holdInitial(src, data, header)
+	}
+	p.stats.inc(statQUICInvalidPackets)
+	p.reportOffense(src.IP, OffenseMalformed)
+	return quicDecision{}, !r.dropUnmatched
+}
+
+// routeUnknownConnection routes a packet whose connection id no session
+// knows by the server id in it, the connection id of short headers runs to
+// the end of the packet as its size is not known
+func (p *Proxy) routeUnknownConnection(cid []byte) (quicDecision, bool) {
+	if route := p.quicRouter.matchServerID(cid); route != nil {
+		p.stats.inc(statQUICServerIDRoutes)
+		return quicDecision{route: route}, true
+	}
+	return p.unmatchedQUIC()
+}
+
+func (p *Proxy) unmatchedQUIC() (quicDecision, bool) {
+	if p.quicRouter.dropUnmatched {
+		p.stats.inc(statQUICUnmatchedDrops)
+		return quicDecision{}, false
+	}
+	p.stats.inc(statQUICUnmatched)
+	return quicDecision{}, true
+}
+
+// holdInitial reads the ClientHello of a client Initial packet, holding the
+// packet until the ClientHello is complete
+func (p *Proxy) holdInitial(src *net.UDPAddr, data []byte, header quic.LongHeader) (quicDecision, bool) {
+	r := p.quicRouter
+	_, frames, err := quic.OpenInitial(data)
+	if err != nil {
+		p.stats.inc(statQUICInitialErrors)
+		p.Logger.Debug("failed to open quic initial packet", zap.String("client", src.String()), zap.Error(err))
+		return p.unmatchedQUIC()
+	}
+	now := time.Now()
+	key := src.String()
+	r.mutex.Lock()
+	pending, found := r.pending[key]
+	if !found || now.Sub(pending.created) > r.holdTimeout {
+		if !found && len(r.pending) >= quicMaxPending {
+			r.mutex.Unlock()
+			p.stats.inc(statQUICHoldDrops)
+			return quicDecision{}, false
+		}
+		pending = &quicPending{created: now, crypto: quic.NewCryptoStream(quicMaxCrypto)}
+		r.pending[key] = pending
+	}
+	serverName, complete, err := "", false, quic.CryptoFrames(frames, pending.crypto.Add)
+	if err == nil {
+		serverName, complete, err = quic.ServerName(pending.crypto.Contiguous())
+	}
+	if err == nil && !complete {
+		if len(pending.held) < quicMaxHeld {
+			pending.held = append(pending.held, append([]byte(nil), data...))
+			r.mutex.Unlock()
+			p.stats.inc(statQUICHeldPackets)
+			return quicDecision{}, false
+		}
+		err = quic.ErrCryptoTooLarge
+	}
+	delete(r.pending, key)
+	r.mutex.Unlock()
+	if err != nil {
+		p.stats.inc(statQUICInitialErrors)
+		p.Logger.Debug("failed to read quic client hello", zap.String("client", key), zap.Error(err))
+		decision, ok := p.unmatchedQUIC()
+		decision.held, decision.cid = pending.held, header.DCID
+		return decision, ok
+	}
+	route := r.match(serverName)
+	if route == nil {
+		decision, ok := p.unmatchedQUIC()
+		decision.serverName, decision.held, decision.cid = serverName, pending.held, header.DCID
+		return decision, ok
+	}
+	p.stats.inc(statQUICRoutedSessions)
+	return quicDecision{route: route, serverName: serverName, held: pending.held, cid: header.DCID}, true
+}
+
+// migrateQUIC makes the address of a packet another address of the session
+// of its connection id, replies follow the latest address
+func (p *Proxy) migrateQUIC(conn *connection, pa packet) {
+	key := pa.src.String()
+	if _, loaded := p.connsMap.LoadOrStore(key, conn); loaded {
+		return
+	}
+	s := conn.quic
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		p.connsMap.Delete(key)
+		return
+	}
+	s.aliases = append(s.aliases, key)
+	var evicted string
+	if len(s.aliases) > quicMaxAliases {
+		evicted, s.aliases = s.aliases[0], s.aliases[1:]
+	}
+	s.mutex.Unlock()
+	if evicted != "" {
+		p.deleteAlias(conn, evicted)
+	}
+	conn.moveTo(conn.clientAddr(), pa.peer)
+	p.stats.inc(statQUICMigrations)
+	p.Logger.Debug("quic client migrated", zap.String("client", conn.key), zap.String("address", key))
+}
+
+func (p *Proxy) deleteAlias(conn *connection, key string) {
+	if current, found := p.connsMap.Load(key); found && current == conn {
+		p.connsMap.Delete(key)
+	}
+}
+
+// learnQUICConnectionID makes cid find the session of conn
+func (p *Proxy) learnQUICConnectionID(conn *connection, cid []byte) {
+	if len(cid) == 0 {
+		return
+	}
+	key := string(cid)
+	s := conn.quic
+	s.mutex.Lock()
+	if s.closed || s.lastCID == key {
+		s.mutex.Unlock()
+		return
+	}
+	s.lastCID = key
+	for _, known := range s.cids {
+		if known == key {
+			s.mutex.Unlock()
+			return
+		}
+	}
+	s.cids = append(s.cids, key)
+	var evicted string
+	if len(s.cids) > quicMaxConnectionIDs {
+		evicted, s.cids = s.cids[0], s.cids[1:]
+	}
+	p.quicRouter.cids.Store(key, conn)
+	s.mutex.Unlock()
+	if evicted != "" {
+		p.forgetQUICConnectionID(conn, evicted)
+	}
+}
+
+func (p *Proxy) forgetQUICConnectionID(conn *connection, key string) {
+	if current, found := p.quicRouter.cids.Load(key); found && current == conn {
+		p.quicRouter.cids.Delete(key)
+	}
+}
+
+// fromQUICUpstream learns the connection id an upstream chose from the long
+// header packets it sends during the handshake
+func (p *Proxy) fromQUICUpstream(conn *connection, data []byte) {
+	if !quic.IsLongHeader(data) {
+		return
+	}
+	header, err := quic.ParseLongHeader(data)
+	if err != nil || len(header.SCID) == 0 {
+		return
+	}
+	conn.quic.mutex.Lock()
+	conn.quic.cidSize = len(header.SCID)
+	conn.quic.mutex.Unlock()
+	p.quicRouter.addSize(len(header.SCID))
+	p.learnQUICConnectionID(conn, header.SCID)
+}
+
+// fromQUICClient learns the connection ids a client uses, once the
+// handshake is over they are the ones the upstream issued, and sends the
+// replies to the address the client came back to after migrating
+func (p *Proxy) fromQUICClient(conn *connection, pa packet) {
+	if reply := conn.replyAddr(); reply.Port != pa.peer.Port || !reply.IP.Equal(pa.peer.IP) {
+		conn.moveTo(conn.clientAddr(), pa.peer)
+	}
+	data := pa.data
+	conn.quic.mutex.Lock()
+	size := conn.quic.cidSize
+	conn.quic.mutex.Unlock()
+	if size == 0 {
+		return
+	}
+	if cid, ok := quic.ShortHeaderDCID(data, size); ok {
+		p.learnQUICConnectionID(conn, cid)
+	}
+}
+
+// closeQUICSession forgets the connection ids and the aliases of a session
+func (p *Proxy) closeQUICSession(conn *connection) {
+	s := conn.quic
+	s.mutex.Lock()
+	s.closed = true
+	cids, aliases := s.cids, s.aliases
+	s.mutex.Unlock()
+	for _, key := range cids {
+		p.forgetQUICConnectionID(conn, key)
+	}
+	for _, key := range aliases {
+		p.deleteAlias(conn, key)
+	}
+}
+
+// sessionUpstream is where the datagrams of conn are sent
+func (p *Proxy) sessionUpstream(conn *connection) *net.UDPAddr {
+	if conn.quic != nil && conn.quic.route != nil {
+		return conn.quic.route.addr()
+	}
+	return p.upstreamAddr()
+}
+
+func (p *Proxy) resolveQUICRoutes() {
+	for _, route := range p.quicRouter.routes {
+		if err := route.resolve(); err != nil {
+			p.Logger.Error("failed to resolve quic route upstream", zap.String("serverName", route.config.ServerName), zap.Error(err))
+		}
+	}
+}
+
+func (p *Proxy) quicExpireLoop() {
+	ticker := time.NewTicker(p.quicRouter.holdTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.quicRouter.expire(now)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit configures token bucket policing of a traffic direction, zero
+// rates disable the corresponding bucket and zero bursts default to one
+// second worth of tokens, but no less than one datagram
+type RateLimit struct {
+	PacketsPerSecond float64 `json:"packetsPerSecond"`
+	PacketsBurst     int     `json:"packetsBurst"`
+	BytesPerSecond   float64 `json:"bytesPerSecond"`
+	BytesBurst       int     `json:"bytesBurst"`
+}
+
+func (r RateLimit) enabled() bool {
+	return r.PacketsPerSecond > 0 || r.BytesPerSecond > 0
+}
+
+// Validate checks the rate limit values
+func (r RateLimit) Validate() error {
+	if r.PacketsPerSecond < 0 || r.BytesPerSecond < 0 || r.PacketsBurst < 0 || r.BytesBurst < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	return nil
+}
+
+// validateDatagramSize checks that datagrams of up to size bytes can conform
+// to the limit, a smaller bytes burst would drop them forever
+func (r RateLimit) validateDatagramSize(size int) error {
+	if r.BytesPerSecond > 0 && r.BytesBurst > 0 && r.BytesBurst < size {
+		return fmt.Errorf("bytes burst %d is smaller than the largest datagram of %d bytes", r.BytesBurst, size)
+	}
+	return nil
+}
+
+// tokenBucket holds up to burst tokens and is refilled at rate tokens per
+// second, it is not safe for concurrent use
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket whose default burst is one second worth of
+// tokens but no less than min, the cost of the largest datagram
+func newTokenBucket(rate float64, burst, min int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(rate, float64(min))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// rateLimiter polices one traffic direction of a session on both packets
+// and bytes, a datagram only takes tokens if both buckets can afford it
+type rateLimiter struct {
+	mutex   sync.Mutex
+	packets *tokenBucket
+	bytes   *tokenBucket
+}
+
+// newRateLimiter returns the limiter of a direction whose datagrams are up to
+// maxDatagram bytes long
+func newRateLimiter(limit RateLimit, maxDatagram int, now time.Time) *rateLimiter {
+	if !limit.enabled() {
+		return nil
+	}
+	return &rateLimiter{
+		packets: newTokenBucket(limit.PacketsPerSecond, limit.PacketsBurst, 1, now),
+		bytes:   newTokenBucket(limit.BytesPerSecond, limit.BytesBurst, maxDatagram, now),
+	}
+}
+
+// allow reports whether a datagram of size bytes conforms to the limits
+func (l *rateLimiter) allow(size int, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.packets != nil {
+		l.packets.refill(now)
+		if l.packets.tokens < 1 {
+			return false
+		}
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+		if l.bytes.tokens < float64(size) {
+			return false
+		}
+		l.bytes.tokens -= float64(size)
+	}
+	if l.packets != nil {
+		l.packets.tokens--
+	}
+	return true
+}
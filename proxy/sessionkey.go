@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Session key modes, they decide which session a client datagram belongs to
+const (
+	// SessionKeyAddress keys sessions by client address and port, it is the
+	// default
+	SessionKeyAddress = "address"
+	// SessionKeyIP keys sessions by client IP, so a client keeps its session
+	// when its NAT rebinds it to another port
+	SessionKeyIP = "ip"
+	// SessionKeyPayload keys sessions by the bytes at an offset of the
+	// datagrams, such as a token the client puts in every datagram. Without
+	// authentication whoever knows the key of a session can move its
+	// replies, so keys must not be guessable
+	SessionKeyPayload = "payload"
+	// SessionKeyExtractor keys sessions with an extractor registered with
+	// RegisterSessionKeyExtractor
+	SessionKeyExtractor = "extractor"
+)
+
+// KeyExtractor returns the key of the session of a datagram a client sent
+// from src, or false to drop the datagram. It is called for every datagram
+// from several goroutines and must not keep data
+type KeyExtractor func(src *net.UDPAddr, data []byte) (string, bool)
+
+var (
+	sessionKeyExtractorsMutex sync.RWMutex
+	sessionKeyExtractors      = map[string]KeyExtractor{}
+)
+
+// RegisterSessionKeyExtractor makes extractor available to the proxies with
+// the extractor session key mode under name, it replaces any extractor
+// registered with the same name
+func RegisterSessionKeyExtractor(name string, extractor KeyExtractor) {
+	sessionKeyExtractorsMutex.Lock()
+	defer sessionKeyExtractorsMutex.Unlock()
+	sessionKeyExtractors[name] = extractor
+}
+
+func sessionKeyExtractor(name string) KeyExtractor {
+	sessionKeyExtractorsMutex.RLock()
+	defer sessionKeyExtractorsMutex.RUnlock()
+	return sessionKeyExtractors[name]
+}
+
+// SessionKey decides which session a client datagram belongs to, replies
+// go to the address the session last received a datagram from
+type SessionKey struct {
+	Mode string `json:"mode"`
+	// Offset and Length locate the key of the payload mode in the datagrams
+	// as clients send them, after any PROXY protocol header
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+	// Extractor is the name of the extractor of the extractor mode
+	Extractor string `json:"extractor"`
+	// RebindInterval is how long in milliseconds a session keeps its reply
+	// address after moving, it defaults to 1 second
+	RebindInterval int `json:"rebindInterval"`
+}
+
+const defaultRebindInterval = time.Second
+
+// Validate checks the session key settings
+func (k SessionKey) Validate() error {
+	if k.RebindInterval < 0 {
+		return errors.New("rebind interval must not be negative")
+	}
+	switch k.Mode {
+	case "", SessionKeyAddress, SessionKeyIP:
+	case SessionKeyPayload:
+		if k.Offset < 0 || k.Length <= 0 {
+			return errors.New("payload session keys need a length and an offset that is not negative")
+		}
+	case SessionKeyExtractor:
+		if sessionKeyExtractor(k.Extractor) == nil {
+			return fmt.Errorf("unknown session key extractor %q", k.Extractor)
+		}
+	default:
+		return fmt.Errorf("invalid session key mode %q", k.Mode)
+	}
+	return nil
+}
+
+// byAddress reports whether sessions are keyed by client address
+func (k SessionKey) byAddress() bool {
+	return k.Mode == "" || k.Mode == SessionKeyAddress
+}
+
+// validateSessionKey checks that the session key mode can be combined with
+// the rest of the config, sessions of other proxy types are bound to their
+// client address
+func (p *Proxy) validateSessionKey() error {
+	if err := p.SessionKey.Validate(); err != nil {
+		return err
+	}
+	if p.SessionKey.byAddress() {
+		return nil
+	}
+	switch {
+	case p.Type != "" && p.Type != ProxyTypeUDP:
+		return errors.New("session keys other than the client address require the udp proxy type")
+	case p.DTLS.Mode == DTLSModeTerminate:
+		return errors.New("session keys other than the client address cannot be combined with dtls termination")
+	case p.QUIC.enabled():
+		return errors.New("session keys other than the client address cannot be combined with quic routing")
+	}
+	return nil
+}
+
+// newSessionKeyFunc returns the function that keys the datagrams of clients
+func newSessionKeyFunc(config SessionKey) func(pa packet) (string, bool) {
+	switch config.Mode {
+	case SessionKeyIP:
+		return func(pa packet) (string, bool) {
+			return pa.src.IP.String(), true
+		}
+	case SessionKeyPayload:
+		end := config.Offset + config.Length
+		return func(pa packet) (string, bool) {
+			if len(pa.data) < end {
+				return "", false
+			}
+			return hex.EncodeToString(pa.data[config.Offset:end]), true
+		}
+	case SessionKeyExtractor:
+		extractor := sessionKeyExtractor(config.Extractor)
+		return func(pa packet) (string, bool) {
+			return extractor(pa.src, pa.data)
+		}
+	}
+	return func(pa packet) (string, bool) {
+		return pa.src.String(), true
+	}
+}
+
+// rebind moves conn to the address of a datagram it received, its replies
+// and the ACL, bans, admission limits and PROXY protocol headers then
+// following the client, and returns the payload to forward, or false to drop
+// the datagram. As the key of a session may be known to others, sessions
+// move at most once per rebind interval and, with authentication, only for
+// datagrams that carry a new valid token. verified tells whether the token
+// of the datagram was already verified, data being the payload that follows
+// it
+func (p *Proxy) rebind(conn *connection, pa packet, data []byte, verified bool) ([]byte, bool) {
+	client := conn.clientAddr()
+	if reply := conn.replyAddr(); reply.Port == pa.peer.Port && reply.IP.Equal(pa.peer.IP) &&
+		client.Port == pa.src.Port && client.IP.Equal(pa.src.IP) {
+		return data, true
+	}
+	if p.authVerifier != nil && !verified {
+		payload, ok := p.authenticate(pa.src, pa.data)
+		if !ok {
+			p.stats.inc(statSessionRebindDrops)
+			return nil, false
+		}
+		data = payload
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&conn.lastRebind)
+	if last != 0 && now-last < int64(millisOr(p.SessionKey.RebindInterval, defaultRebindInterval)) ||
+		!atomic.CompareAndSwapInt64(&conn.lastRebind, last, now) {
+		p.stats.inc(statSessionRebindDrops)
+		return nil, false
+	}
+	if p.admission != nil && !client.IP.Equal(pa.src.IP) {
+		if rejected, ok := p.admission.move(client.IP, pa.src.IP); !ok {
+			p.stats.inc(rejected)
+			p.stats.inc(statSessionRebindDrops)
+			return nil, false
+		}
+	}
+	if p.authVerifier != nil {
+		conn.authToken.Store(append([]byte(nil), pa.data[:len(pa.data)-len(data)]...))
+	}
+	conn.moveTo(pa.src, pa.peer)
+	// the upstream learns the new address from the next PROXY protocol
+	// header
+	atomic.StoreInt32(&conn.proxyHeaderSent, 0)
+	p.stats.inc(statSessionRebinds)
+	p.Logger.Debug("session rebound", zap.String("client", client.String()), zap.String("address", pa.src.String()))
+	return data, true
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo describes a client session of a proxy
+type SessionInfo struct {
+	Client string `json:"client"`
+	// Key is set when sessions are not keyed by client address
+	Key                      string    `json:"key,omitempty"`
+	Peer                     string    `json:"peer,omitempty"`
+	LocalAddress             string    `json:"localAddress,omitempty"`
+	MuxSessionID             uint32    `json:"muxSessionId,omitempty"`
+	LastActivity             time.Time `json:"lastActivity"`
+	RateLimitDropsToUpstream uint64    `json:"rateLimitDropsToUpstream"`
+	RateLimitDropsToClient   uint64    `json:"rateLimitDropsToClient"`
+	// DTLS is handshaking or established for sessions of DTLS proxies
+	DTLS string `json:"dtls,omitempty"`
+	// ServerName and Upstream are set for sessions routed by QUIC routes
+	ServerName string `json:"serverName,omitempty"`
+	Upstream   string `json:"upstream,omitempty"`
+}
+
+func (c *connection) info() SessionInfo {
+	info := SessionInfo{
+		Client:                   c.clientAddr().String(),
+		MuxSessionID:             c.sessionID,
+		LastActivity:             c.lastActive(),
+		RateLimitDropsToUpstream: atomic.LoadUint64(&c.rateLimitDropsToUpstream),
+		RateLimitDropsToClient:   atomic.LoadUint64(&c.rateLimitDropsToClient),
+	}
+	if c.key != info.Client {
+		info.Key = c.key
+	}
+	if peer := c.replyAddr(); peer != nil && peer.String() != info.Client {
+		info.Peer = peer.String()
+	}
+	if c.udp != nil {
+		info.LocalAddress = c.udp.LocalAddr().String()
+	}
+	if c.dtls != nil {
+		info.DTLS = c.dtls.state()
+	}
+	if c.quic != nil {
+		info.ServerName = c.quic.serverName
+		if c.quic.route != nil {
+			if upstream := c.quic.route.addr(); upstream != nil {
+				info.Upstream = upstream.String()
+			}
+		}
+	}
+	return info
+}
+
+// Sessions returns the active client sessions sorted by client address
+func (p *Proxy) Sessions() []SessionInfo {
+	sessions := []SessionInfo{}
+	p.connsMap.Range(func(k, c interface{}) bool {
+		// sessions of quic clients that migrated are also stored under
+		// their other addresses
+		if conn := c.(*connection); k == conn.key {
+			sessions = append(sessions, conn.info())
+		}
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Client < sessions[j].Client
+	})
+	return sessions
+}
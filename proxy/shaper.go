@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShapingMaxDelay = 50 * time.Millisecond
+	// shaperMinDatagramSize is only used to size the shaper queue
+	shaperMinDatagramSize = 64
+	shaperMinQueueLength  = 64
+	shaperMaxQueueLength  = 1 << 16
+)
+
+// Shaping configures aggregate bandwidth shaping of a traffic direction of
+// a proxy, excess datagrams are queued up to MaxDelay milliseconds and paced
+// out at BytesPerSecond, a zero rate disables shaping
+type Shaping struct {
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	MaxDelay       int     `json:"maxDelay"`
+}
+
+// Validate checks the shaping values
+func (s Shaping) Validate() error {
+	if s.BytesPerSecond < 0 || s.MaxDelay < 0 {
+		return errors.New("shaping values must not be negative")
+	}
+	return nil
+}
+
+// shaperStats are the stats updated by a shaper
+type shaperStats struct {
+	queueDepth stat
+	delayLast  stat
+	delayMax   stat
+	delayTotal stat
+	sent       stat
+	drops      stat
+}
+
+type shapedDatagram struct {
+	conn     *connection
+	addr     *net.UDPAddr
+	data     []byte
+	queuedAt time.Time
+	sendAt   time.Time
+}
+
+// shaper paces the datagrams of a traffic direction out at a fixed rate,
+// datagrams that would wait longer than the latency budget are dropped
+type shaper struct {
+	rate     float64
+	maxDelay time.Duration
+	send     func(*connection, *net.UDPAddr, []byte)
+	stats    *stats
+	names    shaperStats
+	mutex    sync.Mutex
+	next     time.Time
+	queue    chan shapedDatagram
+}
+
+func newShaper(config Shaping, st *stats, names shaperStats, send func(*connection, *net.UDPAddr, []byte)) *shaper {
+	maxDelay := time.Duration(config.MaxDelay) * time.Millisecond
+	if maxDelay <= 0 {
+		maxDelay = defaultShapingMaxDelay
+	}
+	queueLength := int(config.BytesPerSecond * maxDelay.Seconds() / shaperMinDatagramSize)
+	if queueLength < shaperMinQueueLength {
+		queueLength = shaperMinQueueLength
+	}
+	if queueLength > shaperMaxQueueLength {
+		queueLength = shaperMaxQueueLength
+	}
+	return &shaper{
+		rate:     config.BytesPerSecond,
+		maxDelay: maxDelay,
+		send:     send,
+		stats:    st,
+		names:    names,
+		queue:    make(chan shapedDatagram, queueLength),
+	}
+}
+
+// enqueue schedules a copy of data to be sent, dropping it if it would wait
+// longer than the latency budget
+func (s *shaper) enqueue(conn *connection, addr *net.UDPAddr, data []byte) {
+	now := time.Now()
+	s.mutex.Lock()
+	start := s.next
+	if start.Before(now) {
+		start = now
+	}
+	if start.Sub(now) > s.maxDelay {
+		s.mutex.Unlock()
+		s.stats.inc(s.names.drops)
+		return
+	}
+	d := shapedDatagram{
+		conn:     conn,
+		addr:     addr,
+		data:     append([]byte(nil), data...),
+		queuedAt: now,
+		sendAt:   start,
+	}
+	select {
+	case s.queue <- d:
+		s.next = start.Add(time.Duration(float64(len(data)) / s.rate * float64(time.Second)))
+	default:
+		s.mutex.Unlock()
+		s.stats.inc(s.names.drops)
+		return
+	}
+	s.mutex.Unlock()
+	s.stats.set(s.names.queueDepth, uint64(len(s.queue)))
+}
+
+// paceLoop sends the queued datagrams at their scheduled times
+func (s *shaper) paceLoop(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for {
+		var d shapedDatagram
+		select {
+		case <-ctx.Done():
+			return
+		case d = <-s.queue:
+		}
+		if wait := time.Until(d.sendAt); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+		}
+		s.send(d.conn, d.addr, d.data)
+		delay := uint64(time.Since(d.queuedAt) / time.Microsecond)
+		s.stats.inc(s.names.sent)
+		s.stats.set(s.names.queueDepth, uint64(len(s.queue)))
+		s.stats.set(s.names.delayLast, delay)
+		s.stats.max(s.names.delayMax, delay)
+		s.stats.add(s.names.delayTotal, delay)
+	}
+}
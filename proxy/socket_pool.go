@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// socketPool keeps a set of pre-bound upstream sockets so that new sessions
+// don't have to pay for a bind on the packet handling path
+type socketPool struct {
+	logger         *zap.Logger
+	stats          *stats
+	bind           func() (*net.UDPConn, error)
+	release        func(*net.UDPConn)
+	refillInterval time.Duration
+	sockets        chan *net.UDPConn
+	refill         chan struct{}
+	done           chan struct{}
+	mutex          sync.Mutex
+	closed         bool
+}
+
+func newSocketPool(logger *zap.Logger, st *stats, size int, refillInterval time.Duration, bind func() (*net.UDPConn, error), release func(*net.UDPConn)) *socketPool {
+	return &socketPool{
+		logger:         logger,
+		stats:          st,
+		bind:           bind,
+		release:        release,
+		refillInterval: refillInterval,
+		sockets:        make(chan *net.UDPConn, size),
+		refill:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+}
+
+// get takes a socket from the pool, binding a new one if the pool is empty
+func (s *socketPool) get() (*net.UDPConn, error) {
+	select {
+	case conn := <-s.sockets:
+		s.stats.inc(statSocketPoolHits)
+		s.stats.set(statSocketPoolSize, uint64(len(s.sockets)))
+		s.requestRefill()
+		return conn, nil
+	default:
+	}
+	s.stats.inc(statSocketPoolMisses)
+	s.requestRefill()
+	return s.bind()
+}
+
+// put gives back a socket that was never used, closing it if the pool is full
+func (s *socketPool) put(conn *net.UDPConn) {
+	if !s.push(conn) {
+		s.release(conn)
+	}
+}
+
+// push adds conn to the pool, it returns false if the pool is full or closed
+func (s *socketPool) push(conn *net.UDPConn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.sockets <- conn:
+		s.stats.set(statSocketPoolSize, uint64(len(s.sockets)))
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *socketPool) requestRefill() {
+	select {
+	case s.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (s *socketPool) fill() {
+	for len(s.sockets) < cap(s.sockets) {
+		conn, err := s.bind()
+		if err != nil {
+			s.stats.inc(statSocketBindErrors)
+			s.logger.Error("socket pool failed to bind upstream socket", zap.Error(err))
+			return
+		}
+		if !s.push(conn) {
+			s.release(conn)
+			return
+		}
+	}
+}
+
+func (s *socketPool) refillLoop() {
+	ticker := time.NewTicker(s.refillInterval)
+	defer ticker.Stop()
+	for {
+		s.fill()
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		case <-s.refill:
+		}
+	}
+}
+
+// close stops the refill loop and releases every pooled socket
+func (s *socketPool) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	for {
+		select {
+		case conn := <-s.sockets:
+			s.release(conn)
+		default:
+			s.stats.set(statSocketPoolSize, 0)
+			return
+		}
+	}
+}
@@ -0,0 +1,455 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/felipejfc/udpx/socks5"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSOCKS5HandshakeTimeout = 10 * time.Second
+	defaultSOCKS5ResolveTTL       = time.Minute
+	// socksMaxResolved bounds the resolved destination names kept
+	socksMaxResolved = 4096
+)
+
+var errSOCKS5NotAssociated = errors.New("no socks5 udp association for client")
+
+// SOCKS5User is a username and password accepted by a socks5 proxy
+type SOCKS5User struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SOCKS5 configures a socks5 proxy, clients ask for a UDP association on
+// the TCP bind port and send their datagrams to the UDP bind port
+type SOCKS5 struct {
+	// Users requires the username/password method, clients need no
+	// authentication when it is empty
+	Users []SOCKS5User `json:"users"`
+	// Destinations allows or denies the destinations clients send to, with
+	// the semantics of the acl, except that loopback, private and link-local
+	// destinations no rule matches are denied
+	Destinations []ACLRule `json:"destinations"`
+	// HandshakeTimeout is how many milliseconds a client has to send its
+	// request, it defaults to 10 seconds
+	HandshakeTimeout int `json:"handshakeTimeout"`
+}
+
+// Validate checks the socks5 settings
+func (s SOCKS5) Validate() error {
+	for _, u := range s.Users {
+		if u.Username == "" || len(u.Username) > 255 || len(u.Password) > 255 {
+			return fmt.Errorf("invalid socks5 user %q", u.Username)
+		}
+	}
+	if s.HandshakeTimeout < 0 {
+		return errors.New("socks5 handshake timeout must not be negative")
+	}
+	return ValidateACL(s.Destinations)
+}
+
+func (p *Proxy) isSOCKS5() bool {
+	return p.Type == ProxyTypeSOCKS5
+}
+
+// validateSOCKS5 checks that the proxy type can be combined with the rest of
+// the config
+func (p *Proxy) validateSOCKS5() error {
+	if !p.isSOCKS5() {
+		return nil
+	}
+	if err := p.SOCKS5.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case len(p.SOCKS5.Users) == 0 && !p.client.IP.IsLoopback():
+		return errors.New("a socks5 proxy without users must bind a loopback address")
+	case !p.usesUpstreamSockets():
+		return errors.New("a socks5 proxy requires the socket upstream mode")
+	case p.Tunnel.Role != "":
+		return errors.New("a socks5 proxy cannot be part of a tunnel")
+	case p.DTLS.Mode != "":
+		return errors.New("a socks5 proxy cannot be combined with dtls")
+	case p.FEC.Role != "":
+		return errors.New("a socks5 proxy cannot be combined with fec")
+	case p.ProxyProtocol.Ingress != "":
+		return errors.New("a socks5 proxy cannot parse proxy protocol headers")
+	case len(p.Authentication.Keys) > 0:
+		return errors.New("a socks5 proxy authenticates its users instead of tokens")
+	}
+	return nil
+}
+
+// socksAssociation is the UDP association of a control connection, it
+// matches the datagrams of its client IP and of the port the client asked
+// for, or of any port when it asked for port 0
+type socksAssociation struct {
+	ip     net.IP
+	port   int
+	mutex  sync.Mutex
+	closed bool
+	conns  map[*connection]struct{}
+}
+
+func (a *socksAssociation) add(conn *connection) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.closed {
+		return false
+	}
+	a.conns[conn] = struct{}{}
+	return true
+}
+
+func (a *socksAssociation) remove(conn *connection) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.conns, conn)
+}
+
+// close ends the association and returns its sessions
+func (a *socksAssociation) close() []*connection {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.closed = true
+	conns := make([]*connection, 0, len(a.conns))
+	for conn := range a.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// socksSession is the SOCKS state of a client session, destinations holds
+// the addresses and the ip:port pairs the client sent to, replies are
+// filtered against them
+type socksSession struct {
+	association  *socksAssociation
+	destinations sync.Map
+}
+
+type resolvedAddr struct {
+	addr    *net.UDPAddr
+	expires time.Time
+}
+
+// socksServer accepts the control connections of a socks5 proxy
+type socksServer struct {
+	listener     net.Listener
+	credentials  socks5.Credentials
+	destinations *ACL
+	mutex        sync.Mutex
+	closed       bool
+	controls     map[net.Conn]struct{}
+	associations map[string][]*socksAssociation
+	resolveMutex sync.Mutex
+	resolved     map[string]resolvedAddr
+}
+
+func (s *socksServer) track(c net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.controls[c] = struct{}{}
+	return true
+}
+
+func (s *socksServer) untrack(c net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.controls, c)
+}
+
+func (s *socksServer) associate(a *socksAssociation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := a.ip.String()
+	s.associations[key] = append(s.associations[key], a)
+}
+
+func (s *socksServer) dissociate(a *socksAssociation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := a.ip.String()
+	list := s.associations[key]
+	for i, other := range list {
+		if other == a {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(s.associations, key)
+	} else {
+		s.associations[key] = list
+	}
+}
+
+// lookup returns the association of a client, preferring one for its port
+func (s *socksServer) lookup(client *net.UDPAddr) *socksAssociation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var any *socksAssociation
+	for _, a := range s.associations[client.IP.String()] {
+		if a.port == client.Port {
+			return a
+		}
+		if a.port == 0 && any == nil {
+			any = a
+		}
+	}
+	return any
+}
+
+// close stops accepting control connections and closes every one of them,
+// which ends their associations
+func (s *socksServer) close() {
+	s.mutex.Lock()
+	s.closed = true
+	for c := range s.controls {
+		c.Close()
+	}
+	s.mutex.Unlock()
+	s.listener.Close()
+}
+
+// resolve returns the UDP address of a destination, names are resolved
+// once per ttl
+func (s *socksServer) resolve(addr socks5.Addr, ttl time.Duration, now time.Time) (*net.UDPAddr, error) {
+	if addr.Host == "" {
+		return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+	}
+	key := addr.String()
+	s.resolveMutex.Lock()
+	r, found := s.resolved[key]
+	s.resolveMutex.Unlock()
+	if found && now.Before(r.expires) {
+		return r.addr, nil
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", key)
+	if err != nil {
+		return nil, err
+	}
+	s.resolveMutex.Lock()
+	if len(s.resolved) >= socksMaxResolved {
+		s.resolved = map[string]resolvedAddr{}
+	}
+	s.resolved[key] = resolvedAddr{addr: udpAddr, expires: now.Add(ttl)}
+	s.resolveMutex.Unlock()
+	return udpAddr, nil
+}
+
+// startSOCKS5 binds the TCP bind port clients negotiate their associations
+// on
+func (p *Proxy) startSOCKS5() error {
+	destinations, err := NewACL(p.SOCKS5.Destinations)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", p.BindAddress, p.BindPort))
+	if err != nil {
+		return err
+	}
+	p.socks = &socksServer{
+		listener:     listener,
+		destinations: destinations,
+		controls:     map[net.Conn]struct{}{},
+		associations: map[string][]*socksAssociation{},
+		resolved:     map[string]resolvedAddr{},
+	}
+	if len(p.SOCKS5.Users) > 0 {
+		users := make(map[string]string, len(p.SOCKS5.Users))
+		for _, u := range p.SOCKS5.Users {
+			users[u.Username] = u.Password
+		}
+		p.socks.credentials = socks5.StaticCredentials(users)
+	}
+	p.goTracked(&p.backgroundWg, p.socksAcceptLoop)
+	return nil
+}
+
+func (p *Proxy) socksAcceptLoop() {
+	for {
+		c, err := p.socks.listener.Accept()
+		if err != nil {
+			if p.closing() {
+				return
+			}
+			p.Logger.Error("socks5 accept error", zap.Error(err))
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		ip := c.RemoteAddr().(*net.TCPAddr).IP
+		if !p.allowsSource(ip) {
+			p.stats.inc(statACLDrops)
+			c.Close()
+			continue
+		}
+		if p.banList.banned(ip.String(), time.Now()) {
+			p.stats.inc(statBanDrops)
+			c.Close()
+			continue
+		}
+		if !p.socks.track(c) {
+			c.Close()
+			return
+		}
+		p.goTracked(&p.backgroundWg, func() { p.serveSOCKSControl(c) })
+	}
+}
+
+// serveSOCKSControl negotiates a UDP association on a control connection,
+// the association lasts until the connection is closed
+func (p *Proxy) serveSOCKSControl(c net.Conn) {
+	defer p.socks.untrack(c)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(millisOr(p.SOCKS5.HandshakeTimeout, defaultSOCKS5HandshakeTimeout)))
+	request, err := socks5.ServerHandshake(c, p.socks.credentials)
+	if err != nil {
+		if err == socks5.ErrAuthFailed {
+			p.stats.inc(statSOCKS5AuthFailures)
+		} else {
+			p.stats.inc(statSOCKS5HandshakeFailures)
+		}
+		p.Logger.Debug("socks5 handshake failed", zap.String("client", c.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	if request.Command != socks5.CommandUDPAssociate {
+		p.stats.inc(statSOCKS5HandshakeFailures)
+		socks5.WriteReply(c, socks5.ReplyCommandNotSupported, socks5.Addr{})
+		return
+	}
+	relay := p.listenerConn.LocalAddr().(*net.UDPAddr)
+	bound := socks5.Addr{IP: relay.IP, Port: relay.Port}
+	if bound.IP == nil || bound.IP.IsUnspecified() {
+		// tell the client the address it reached the proxy on
+		bound.IP = c.LocalAddr().(*net.TCPAddr).IP
+	}
+	if err := socks5.WriteReply(c, socks5.ReplySucceeded, bound); err != nil {
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	association := &socksAssociation{
+		ip:    c.RemoteAddr().(*net.TCPAddr).IP,
+		port:  request.Addr.Port,
+		conns: map[*connection]struct{}{},
+	}
+	p.socks.associate(association)
+	p.stats.inc(statSOCKS5Associations)
+	p.Logger.Debug("socks5 udp association", zap.String("client", c.RemoteAddr().String()), zap.String("requested", request.Addr.String()))
+
+	// nothing else is expected on the control connection, the association
+	// ends when it is closed
+	io.Copy(ioutil.Discard, c)
+
+	p.socks.dissociate(association)
+	p.stats.dec(statSOCKS5Associations)
+	for _, conn := range association.close() {
+		p.closeConnection(conn)
+		p.removeConnection(conn)
+	}
+}
+
+// newSOCKSSession finds the association of a new client session, the
+// session is added to it once created
+func (p *Proxy) newSOCKSSession(client *net.UDPAddr) (*socksSession, error) {
+	association := p.socks.lookup(client)
+	if association == nil {
+		return nil, errSOCKS5NotAssociated
+	}
+	return &socksSession{association: association}, nil
+}
+
+// fromSOCKSClient strips the SOCKS header of a client datagram and forwards
+// its payload to the destination in the header
+func (p *Proxy) fromSOCKSClient(conn *connection, data []byte) {
+	addr, payload, err := socks5.DecodeUDP(data)
+	if err != nil {
+		p.stats.inc(statSOCKS5InvalidDatagrams)
+		p.reportOffense(conn.clientAddr().IP, OffenseMalformed)
+		return
+	}
+	ttl := p.ResolveTTL
+	if ttl <= 0 {
+		ttl = defaultSOCKS5ResolveTTL
+	}
+	dst, err := p.socks.resolve(addr, ttl, time.Now())
+	if err != nil {
+		p.stats.inc(statSOCKS5ResolveErrors)
+		p.Logger.Debug("failed to resolve socks5 destination", zap.String("destination", addr.String()), zap.Error(err))
+		return
+	}
+	if !allowsDestination(p.socks.destinations, dst.IP) {
+		p.stats.inc(statSOCKS5DeniedDestinations)
+		return
+	}
+	for _, key := range []string{dst.String(), dst.IP.String()} {
+		if _, seen := conn.socks.destinations.Load(key); !seen {
+			conn.socks.destinations.Store(key, struct{}{})
+		}
+	}
+	p.forwardToUpstream(conn, payload, dst)
+}
+
+// acceptSOCKSReply applies the filtering mode to a datagram received on the
+// upstream socket of a socks5 session, replies are expected from the
+// destinations the client sent to
+func (p *Proxy) acceptSOCKSReply(conn *connection, src *net.UDPAddr) bool {
+	var accepted bool
+	switch p.FilteringMode {
+	case FilteringEndpointIndependent:
+		accepted = true
+	case FilteringAddressDependent:
+		_, accepted = conn.socks.destinations.Load(src.IP.String())
+	default:
+		_, accepted = conn.socks.destinations.Load(src.String())
+	}
+	if !accepted {
+		p.stats.inc(statFilteredReplies)
+		p.Logger.Debug("dropping datagram from unexpected source", zap.String("src address", src.String()))
+	}
+	return accepted
+}
+
+// withSOCKSHeader prepends the SOCKS header carrying the source of a reply
+// read into msg, it returns the size of the datagram
+func withSOCKSHeader(msg []byte, size int, src *net.UDPAddr) int {
+	addr := socks5.AddrFromUDP(src)
+	n := socks5.UDPHeaderSize(addr)
+	buf := msg[:cap(msg)]
+	copy(buf[n:n+size], buf[:size])
+	socks5.AppendUDPHeader(buf[:0], addr)
+	return n + size
+}
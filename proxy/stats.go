@@ -0,0 +1,325 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import "sync/atomic"
+
+type stat int
+
+// counters and gauges exposed by every proxy, keep statNames in sync
+const (
+	statSocketPoolHits stat = iota
+	statSocketPoolMisses
+	statSocketPoolSize
+	statSocketBindErrors
+	statPacketsDropped
+	statSourcePortsInUse
+	statSourcePortsExhausted
+	statSourcePortMappingHits
+	statSourcePortMappingMisses
+	statMuxSessions
+	statMuxInvalidDatagrams
+	statMuxUnknownSessions
+	statSessionsExpired
+	statExpiryLagLastMicros
+	statExpiryLagMaxMicros
+	statExpiryLagTotalMicros
+	statTruncatedFromClients
+	statTruncatedFromUpstream
+	statOversizeDrops
+	statMaxSizeDropsToUpstream
+	statMaxSizeDropsToClients
+	statMsgSizeErrorsToUpstream
+	statMsgSizeErrorsToClients
+	statWriteErrorsToUpstream
+	statWriteErrorsToClients
+	statRateLimitDropsToUpstream
+	statRateLimitDropsToClients
+	statShapingToUpstreamQueueDepth
+	statShapingToUpstreamDelayLastMicros
+	statShapingToUpstreamDelayMaxMicros
+	statShapingToUpstreamDelayTotalMicros
+	statShapingToUpstreamSent
+	statShapingToUpstreamDrops
+	statShapingToClientsQueueDepth
+	statShapingToClientsDelayLastMicros
+	statShapingToClientsDelayMaxMicros
+	statShapingToClientsDelayTotalMicros
+	statShapingToClientsSent
+	statShapingToClientsDrops
+	statAdmissionRejectsMaxSessions
+	statAdmissionRejectsPerIP
+	statAdmissionRejectsPerPrefix
+	statAdmissionRejectsRate
+	statAdmissionEvictions
+	statAmplificationDrops
+	statAmplificationDroppedBytes
+	statAmplificationValidatedSessions
+	statACLDrops
+	statACLSessionsClosed
+	statBans
+	statBanDrops
+	statFilteredReplies
+	statAuthSuccesses
+	statAuthFailures
+	statProxyProtocolInvalid
+	statProxyProtocolUntrusted
+	statTunnelOpenErrors
+	statTunnelReplays
+	statTunnelSealErrors
+	statDTLSHandshakes
+	statDTLSHandshakeFailures
+	statDTLSHandshakeTimeouts
+	statDTLSHandshakeDrops
+	statDTLSSessions
+	statDTLSRecordErrors
+	statDTLSInputDrops
+	statDTLSPendingDrops
+	statFECParityDatagrams
+	statFECRecovered
+	statFECLost
+	statFECDuplicates
+	statFECLate
+	statFECInvalid
+	statStreamSessions
+	statStreamDialErrors
+	statStreamPendingDrops
+	statWebSocketConnections
+	statWebSocketRejectedOrigins
+	statSOCKS5Associations
+	statSOCKS5HandshakeFailures
+	statSOCKS5AuthFailures
+	statSOCKS5UnassociatedDrops
+	statSOCKS5InvalidDatagrams
+	statSOCKS5DeniedDestinations
+	statSOCKS5ResolveErrors
+	statTURNAllocations
+	statTURNPermissions
+	statTURNChannelBindings
+	statTURNAuthFailures
+	statTURNStaleNonces
+	statTURNRequestErrors
+	statTURNInvalidMessages
+	statTURNPermissionDrops
+	statQUICRoutedSessions
+	statQUICUnmatched
+	statQUICUnmatchedDrops
+	statQUICServerIDRoutes
+	statQUICHeldPackets
+	statQUICHoldDrops
+	statQUICInitialErrors
+	statQUICInvalidPackets
+	statQUICMigrations
+	statSessionKeyDrops
+	statSessionRebinds
+	statSessionRebindDrops
+	statDNSQueries
+	statDNSResponses
+	statDNSTimeouts
+	statDNSPendingQueries
+	statDNSInvalidQueries
+	statDNSUnexpectedResponses
+	statDNSOverloadDrops
+	statDNSClientPendingDrops
+	statGoroutines
+	statCount
+)
+
+var statNames = [statCount]string{
+	statSocketPoolHits:                    "socketPoolHits",
+	statSocketPoolMisses:                  "socketPoolMisses",
+	statSocketPoolSize:                    "socketPoolSize",
+	statSocketBindErrors:                  "socketBindErrors",
+	statPacketsDropped:                    "packetsDropped",
+	statSourcePortsInUse:                  "sourcePortsInUse",
+	statSourcePortsExhausted:              "sourcePortsExhausted",
+	statSourcePortMappingHits:             "sourcePortMappingHits",
+	statSourcePortMappingMisses:           "sourcePortMappingMisses",
+	statMuxSessions:                       "muxSessions",
+	statMuxInvalidDatagrams:               "muxInvalidDatagrams",
+	statMuxUnknownSessions:                "muxUnknownSessions",
+	statSessionsExpired:                   "sessionsExpired",
+	statExpiryLagLastMicros:               "expiryLagLastMicros",
+	statExpiryLagMaxMicros:                "expiryLagMaxMicros",
+	statExpiryLagTotalMicros:              "expiryLagTotalMicros",
+	statTruncatedFromClients:              "truncatedFromClients",
+	statTruncatedFromUpstream:             "truncatedFromUpstream",
+	statOversizeDrops:                     "oversizeDrops",
+	statMaxSizeDropsToUpstream:            "maxSizeDropsToUpstream",
+	statMaxSizeDropsToClients:             "maxSizeDropsToClients",
+	statMsgSizeErrorsToUpstream:           "msgSizeErrorsToUpstream",
+	statMsgSizeErrorsToClients:            "msgSizeErrorsToClients",
+	statWriteErrorsToUpstream:             "writeErrorsToUpstream",
+	statWriteErrorsToClients:              "writeErrorsToClients",
+	statRateLimitDropsToUpstream:          "rateLimitDropsToUpstream",
+	statRateLimitDropsToClients:           "rateLimitDropsToClients",
+	statShapingToUpstreamQueueDepth:       "shapingToUpstreamQueueDepth",
+	statShapingToUpstreamDelayLastMicros:  "shapingToUpstreamDelayLastMicros",
+	statShapingToUpstreamDelayMaxMicros:   "shapingToUpstreamDelayMaxMicros",
+	statShapingToUpstreamDelayTotalMicros: "shapingToUpstreamDelayTotalMicros",
+	statShapingToUpstreamSent:             "shapingToUpstreamSent",
+	statShapingToUpstreamDrops:            "shapingToUpstreamDrops",
+	statShapingToClientsQueueDepth:        "shapingToClientsQueueDepth",
+	statShapingToClientsDelayLastMicros:   "shapingToClientsDelayLastMicros",
+	statShapingToClientsDelayMaxMicros:    "shapingToClientsDelayMaxMicros",
+	statShapingToClientsDelayTotalMicros:  "shapingToClientsDelayTotalMicros",
+	statShapingToClientsSent:              "shapingToClientsSent",
+	statShapingToClientsDrops:             "shapingToClientsDrops",
+	statAdmissionRejectsMaxSessions:       "admissionRejectsMaxSessions",
+	statAdmissionRejectsPerIP:             "admissionRejectsPerIp",
+	statAdmissionRejectsPerPrefix:         "admissionRejectsPerPrefix",
+	statAdmissionRejectsRate:              "admissionRejectsRate",
+	statAdmissionEvictions:                "admissionEvictions",
+	statAmplificationDrops:                "amplificationDrops",
+	statAmplificationDroppedBytes:         "amplificationDroppedBytes",
+	statAmplificationValidatedSessions:    "amplificationValidatedSessions",
+	statACLDrops:                          "aclDrops",
+	statACLSessionsClosed:                 "aclSessionsClosed",
+	statBans:                              "bans",
+	statBanDrops:                          "banDrops",
+	statFilteredReplies:                   "filteredReplies",
+	statAuthSuccesses:                     "authSuccesses",
+	statAuthFailures:                      "authFailures",
+	statProxyProtocolInvalid:              "proxyProtocolInvalid",
+	statProxyProtocolUntrusted:            "proxyProtocolUntrusted",
+	statTunnelOpenErrors:                  "tunnelOpenErrors",
+	statTunnelReplays:                     "tunnelReplays",
+	statTunnelSealErrors:                  "tunnelSealErrors",
+	statDTLSHandshakes:                    "dtlsHandshakes",
+	statDTLSHandshakeFailures:             "dtlsHandshakeFailures",
+	statDTLSHandshakeTimeouts:             "dtlsHandshakeTimeouts",
+	statDTLSHandshakeDrops:                "dtlsHandshakeDrops",
+	statDTLSSessions:                      "dtlsSessions",
+	statDTLSRecordErrors:                  "dtlsRecordErrors",
+	statDTLSInputDrops:                    "dtlsInputDrops",
+	statDTLSPendingDrops:                  "dtlsPendingDrops",
+	statFECParityDatagrams:                "fecParityDatagrams",
+	statFECRecovered:                      "fecRecovered",
+	statFECLost:                           "fecLost",
+	statFECDuplicates:                     "fecDuplicates",
+	statFECLate:                           "fecLate",
+	statFECInvalid:                        "fecInvalid",
+	statStreamSessions:                    "streamSessions",
+	statStreamDialErrors:                  "streamDialErrors",
+	statStreamPendingDrops:                "streamPendingDrops",
+	statWebSocketConnections:              "webSocketConnections",
+	statWebSocketRejectedOrigins:          "webSocketRejectedOrigins",
+	statSOCKS5Associations:                "socks5Associations",
+	statSOCKS5HandshakeFailures:           "socks5HandshakeFailures",
+	statSOCKS5AuthFailures:                "socks5AuthFailures",
+	statSOCKS5UnassociatedDrops:           "socks5UnassociatedDrops",
+	statSOCKS5InvalidDatagrams:            "socks5InvalidDatagrams",
+	statSOCKS5DeniedDestinations:          "socks5DeniedDestinations",
+	statSOCKS5ResolveErrors:               "socks5ResolveErrors",
+	statTURNAllocations:                   "turnAllocations",
+	statTURNPermissions:                   "turnPermissions",
+	statTURNChannelBindings:               "turnChannelBindings",
+	statTURNAuthFailures:                  "turnAuthFailures",
+	statTURNStaleNonces:                   "turnStaleNonces",
+	statTURNRequestErrors:                 "turnRequestErrors",
+	statTURNInvalidMessages:               "turnInvalidMessages",
+	statTURNPermissionDrops:               "turnPermissionDrops",
+	statQUICRoutedSessions:                "quicRoutedSessions",
+	statQUICUnmatched:                     "quicUnmatched",
+	statQUICUnmatchedDrops:                "quicUnmatchedDrops",
+	statQUICServerIDRoutes:                "quicServerIDRoutes",
+	statQUICHeldPackets:                   "quicHeldPackets",
+	statQUICHoldDrops:                     "quicHoldDrops",
+	statQUICInitialErrors:                 "quicInitialErrors",
+	statQUICInvalidPackets:                "quicInvalidPackets",
+	statQUICMigrations:                    "quicMigrations",
+	statSessionKeyDrops:                   "sessionKeyDrops",
+	statSessionRebinds:                    "sessionRebinds",
+	statSessionRebindDrops:                "sessionRebindDrops",
+	statDNSQueries:                        "dnsQueries",
+	statDNSResponses:                      "dnsResponses",
+	statDNSTimeouts:                       "dnsTimeouts",
+	statDNSPendingQueries:                 "dnsPendingQueries",
+	statDNSInvalidQueries:                 "dnsInvalidQueries",
+	statDNSUnexpectedResponses:            "dnsUnexpectedResponses",
+	statDNSOverloadDrops:                  "dnsOverloadDrops",
+	statDNSClientPendingDrops:             "dnsClientPendingDrops",
+	statGoroutines:                        "goroutines",
+}
+
+var upstreamShaperStats = shaperStats{
+	queueDepth: statShapingToUpstreamQueueDepth,
+	delayLast:  statShapingToUpstreamDelayLastMicros,
+	delayMax:   statShapingToUpstreamDelayMaxMicros,
+	delayTotal: statShapingToUpstreamDelayTotalMicros,
+	sent:       statShapingToUpstreamSent,
+	drops:      statShapingToUpstreamDrops,
+}
+
+var clientShaperStats = shaperStats{
+	queueDepth: statShapingToClientsQueueDepth,
+	delayLast:  statShapingToClientsDelayLastMicros,
+	delayMax:   statShapingToClientsDelayMaxMicros,
+	delayTotal: statShapingToClientsDelayTotalMicros,
+	sent:       statShapingToClientsSent,
+	drops:      statShapingToClientsDrops,
+}
+
+// stats holds the proxy counters, all values are updated atomically
+type stats struct {
+	values [statCount]uint64
+}
+
+func (s *stats) inc(st stat) {
+	atomic.AddUint64(&s.values[st], 1)
+}
+
+func (s *stats) dec(st stat) {
+	atomic.AddUint64(&s.values[st], ^uint64(0))
+}
+
+func (s *stats) add(st stat, delta uint64) {
+	atomic.AddUint64(&s.values[st], delta)
+}
+
+func (s *stats) set(st stat, value uint64) {
+	atomic.StoreUint64(&s.values[st], value)
+}
+
+// max raises st to value if it is lower
+func (s *stats) max(st stat, value uint64) {
+	for {
+		current := atomic.LoadUint64(&s.values[st])
+		if current >= value || atomic.CompareAndSwapUint64(&s.values[st], current, value) {
+			return
+		}
+	}
+}
+
+func (s *stats) get(st stat) uint64 {
+	return atomic.LoadUint64(&s.values[st])
+}
+
+// snapshot returns a copy of the current values indexed by name
+func (s *stats) snapshot() map[string]uint64 {
+	snap := make(map[string]uint64, statCount)
+	for i := stat(0); i < statCount; i++ {
+		snap[statNames[i]] = s.get(i)
+	}
+	return snap
+}
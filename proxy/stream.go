@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/felipejfc/udpx/stream"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultStreamDialTimeout = 10 * time.Second
+	// streamMaxPending is how many datagrams are kept for a session while
+	// its stream is being dialed
+	streamMaxPending = 32
+)
+
+var (
+	errStreamPending = errors.New("too many datagrams waiting for the stream")
+	errStreamClosed  = errors.New("stream session closed")
+)
+
+func (p *Proxy) isStream() bool {
+	return p.UpstreamMode == UpstreamModeTCP || p.UpstreamMode == UpstreamModeWebSocket
+}
+
+// usesUpstreamSockets reports whether every client has its own upstream
+// socket, which the tunnel entry, DTLS origination and the FEC entry need
+func (p *Proxy) usesUpstreamSockets() bool {
+	return p.UpstreamMode == "" || p.UpstreamMode == UpstreamModeSocket
+}
+
+// streamSession carries the datagrams of a connection to a udpx stream
+// server, they are kept until the stream is dialed
+type streamSession struct {
+	mutex   sync.Mutex
+	conn    stream.Conn
+	pending [][]byte
+	closed  bool
+}
+
+// write sends data over the stream or keeps it until the stream is dialed
+func (s *streamSession) write(data []byte) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return errStreamClosed
+	}
+	if s.conn == nil {
+		defer s.mutex.Unlock()
+		if len(s.pending) >= streamMaxPending {
+			return errStreamPending
+		}
+		s.pending = append(s.pending, append([]byte(nil), data...))
+		return nil
+	}
+	conn := s.conn
+	s.mutex.Unlock()
+	return conn.WriteDatagram(data)
+}
+
+// established makes conn the session stream and flushes what was kept while
+// dialing, it returns false if the session was closed meanwhile
+func (s *streamSession) established(conn stream.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conn = conn
+	for _, data := range s.pending {
+		conn.WriteDatagram(data)
+	}
+	s.pending = nil
+	return true
+}
+
+// close closes the stream, it returns whether the stream had been dialed
+func (s *streamSession) close() bool {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return false
+	}
+	s.closed = true
+	conn := s.conn
+	s.mutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return conn != nil
+}
+
+func (p *Proxy) writeStream(conn *connection, data []byte) (int, error) {
+	if err := conn.stream.write(data); err != nil {
+		if err == errStreamPending {
+			p.stats.inc(statStreamPendingDrops)
+			return 0, nil
+		}
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (p *Proxy) closeStream(conn *connection) {
+	if conn.stream != nil && conn.stream.close() {
+		p.stats.dec(statStreamSessions)
+	}
+}
+
+// streamSessionLoop dials the stream of a connection and forwards what the
+// stream server sends back to the client
+func (p *Proxy) streamSessionLoop(conn *connection) {
+	ctx, cancel := context.WithTimeout(p.ctx, defaultStreamDialTimeout)
+	sconn, err := stream.Dial(ctx, p.UpstreamMode, p.upstreamAddr().String(), p.UpstreamWebSocketPath)
+	cancel()
+	if err != nil {
+		if !conn.isClosed() && !p.closing() {
+			p.stats.inc(statStreamDialErrors)
+			p.Logger.Warn("failed to dial upstream stream", zap.String("client", conn.key), zap.Error(err))
+		}
+		p.closeConnection(conn)
+		p.removeConnection(conn)
+		return
+	}
+	if !conn.stream.established(sconn) {
+		sconn.Close()
+		return
+	}
+	p.stats.inc(statStreamSessions)
+	limit := p.BufferSize
+	for {
+		msg := p.bufferPool.Get().([]byte)
+		size, truncated, err := sconn.ReadDatagram(msg[:cap(msg)])
+		if err != nil {
+			p.bufferPool.Put(msg)
+			if !conn.isClosed() && !p.closing() {
+				p.Logger.Debug("upstream stream closed", zap.String("client", conn.key), zap.Error(err))
+			}
+			p.closeConnection(conn)
+			p.removeConnection(conn)
+			return
+		}
+		if size > limit {
+			size, truncated = limit, true
+		}
+		if truncated && !p.acceptTruncated(p.upstreamAddr(), false) {
+			p.bufferPool.Put(msg)
+			continue
+		}
+		conn.touch()
+		if !p.sendUpstreamPacket(packet{src: conn.replyAddr(), conn: conn, data: msg[:size]}) {
+			return
+		}
+	}
+}
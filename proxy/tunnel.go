@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/felipejfc/udpx/tunnel"
+	"go.uber.org/zap"
+)
+
+// Tunnel roles, an entry encrypts what it sends to its upstream, which has
+// to be the bind port of an exit, and an exit encrypts what it sends back
+const (
+	TunnelRoleEntry = "entry"
+	TunnelRoleExit  = "exit"
+)
+
+var errTunnelDisabled = errors.New("tunnel is not enabled")
+
+// TunnelKey is a pre-shared secret of a tunnel
+type TunnelKey struct {
+	ID     uint8  `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// Tunnel encrypts and authenticates the datagrams exchanged by a tunnel
+// entry and a tunnel exit, see the tunnel package. An empty role disables it
+type Tunnel struct {
+	Role string `json:"role"`
+	// Cipher is tunnel.CipherChaCha20Poly1305, the default, or
+	// tunnel.CipherAES256GCM
+	Cipher string      `json:"cipher"`
+	Keys   []TunnelKey `json:"keys"`
+	// ActiveKey is the id of the key datagrams are sealed with, the first
+	// key is used when no key has id 0
+	ActiveKey uint8 `json:"activeKey"`
+	// ReplayWindow is how many sequence numbers behind the highest one
+	// received are still accepted, it defaults to tunnel.DefaultReplayWindow
+	ReplayWindow int `json:"replayWindow"`
+	// MaxAge is how many milliseconds the timestamp of a datagram may be
+	// away from the clock of the receiver, it defaults to
+	// tunnel.DefaultMaxAge
+	MaxAge int `json:"maxAge"`
+}
+
+// Validate checks the tunnel settings
+func (t Tunnel) Validate() error {
+	switch t.Role {
+	case "":
+		return nil
+	case TunnelRoleEntry, TunnelRoleExit:
+	default:
+		return fmt.Errorf("invalid tunnel role %q", t.Role)
+	}
+	if err := tunnel.ValidateCipher(t.Cipher); err != nil {
+		return err
+	}
+	if len(t.Keys) == 0 {
+		return errors.New("tunnel requires at least one key")
+	}
+	for _, k := range t.Keys {
+		if k.Secret == "" {
+			return fmt.Errorf("tunnel key %d has no secret", k.ID)
+		}
+	}
+	if t.ReplayWindow < 0 {
+		return errors.New("tunnel replay window must not be negative")
+	}
+	if t.MaxAge < 0 {
+		return errors.New("tunnel max age must not be negative")
+	}
+	return nil
+}
+
+func (t Tunnel) activeKey() uint8 {
+	for _, k := range t.Keys {
+		if k.ID == t.ActiveKey {
+			return t.ActiveKey
+		}
+	}
+	return t.Keys[0].ID
+}
+
+func newTunnelCodec(config Tunnel) (*tunnel.Codec, error) {
+	if config.Role == "" {
+		return nil, nil
+	}
+	codec, err := tunnel.NewCodec(config.Cipher, config.ReplayWindow, millisOr(config.MaxAge, tunnel.DefaultMaxAge))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range config.Keys {
+		codec.AddKey(k.ID, []byte(k.Secret))
+	}
+	return codec, codec.SetActiveKey(config.activeKey())
+}
+
+// tunnelSendDirection is the direction of what this side of the tunnel seals
+func (p *Proxy) tunnelSendDirection() tunnel.Direction {
+	if p.Tunnel.Role == TunnelRoleExit {
+		return tunnel.Reverse
+	}
+	return tunnel.Forward
+}
+
+// openTunnel decrypts a datagram read into buf in place, moving the
+// plaintext to the start of buf, it returns the plaintext size or false if
+// the datagram must be dropped
+func (p *Proxy) openTunnel(direction tunnel.Direction, buf []byte, size int) (int, bool) {
+	plaintext, err := p.tunnelCodec.Open(direction, buf[:size], time.Now())
+	if err != nil {
+		if err == tunnel.ErrReplayed {
+			p.stats.inc(statTunnelReplays)
+		} else {
+			p.stats.inc(statTunnelOpenErrors)
+		}
+		return 0, false
+	}
+	return copy(buf, plaintext), true
+}
+
+// sealTunnel encrypts data with the sender of conn
+func (p *Proxy) sealTunnel(conn *connection, data []byte) ([]byte, bool) {
+	sealed, err := conn.tunnelSender.Seal(make([]byte, 0, len(data)+tunnel.Overhead), data, time.Now())
+	if err != nil {
+		p.stats.inc(statTunnelSealErrors)
+		p.Logger.Error("failed to seal tunnel datagram", zap.Error(err))
+		return nil, false
+	}
+	return sealed, true
+}
+
+func (p *Proxy) tunnelExpireLoop() {
+	ticker := time.NewTicker(p.tunnelCodec.MaxAge())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.tunnelCodec.Expire(now)
+		}
+	}
+}
+
+// TunnelKeys returns the active tunnel key and the ids of every key
+func (p *Proxy) TunnelKeys() (uint8, []uint8, error) {
+	if p.tunnelCodec == nil {
+		return 0, nil, errTunnelDisabled
+	}
+	return p.tunnelCodec.ActiveKey(), p.tunnelCodec.Keys(), nil
+}
+
+// AddTunnelKey adds or replaces a tunnel key, datagrams sealed with it are
+// accepted right away but it is only used to seal once activated
+func (p *Proxy) AddTunnelKey(key TunnelKey) error {
+	if p.tunnelCodec == nil {
+		return errTunnelDisabled
+	}
+	if key.Secret == "" {
+		return fmt.Errorf("tunnel key %d has no secret", key.ID)
+	}
+	p.tunnelCodec.AddKey(key.ID, []byte(key.Secret))
+	return nil
+}
+
+// ActivateTunnelKey seals the following datagrams with the key id
+func (p *Proxy) ActivateTunnelKey(id uint8) error {
+	if p.tunnelCodec == nil {
+		return errTunnelDisabled
+	}
+	return p.tunnelCodec.SetActiveKey(id)
+}
+
+// RemoveTunnelKey stops accepting datagrams sealed with the key id
+func (p *Proxy) RemoveTunnelKey(id uint8) error {
+	if p.tunnelCodec == nil {
+		return errTunnelDisabled
+	}
+	return p.tunnelCodec.RemoveKey(id)
+}
+
+// newTunnelSender is used by newConnection
+func (p *Proxy) newTunnelSender() (*tunnel.Sender, error) {
+	if p.tunnelCodec == nil {
+		return nil, nil
+	}
+	return p.tunnelCodec.NewSender(p.tunnelSendDirection())
+}
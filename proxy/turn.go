@@ -0,0 +1,838 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/felipejfc/udpx/turn"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTURNLifetime      = 10 * time.Minute
+	defaultTURNMaxLifetime   = time.Hour
+	defaultTURNNonceLifetime = 10 * time.Minute
+	turnPermissionLifetime   = 5 * time.Minute
+	turnChannelLifetime      = 10 * time.Minute
+	// turnOverhead bounds what a Data indication or a Send indication adds
+	// to a datagram, ChannelData messages add less
+	turnOverhead = 64
+)
+
+var (
+	errTURNDisabled = errors.New("turn is not enabled")
+	turnSoftware    = []byte("udpx " + VERSION)
+)
+
+// TURNUser is a username and password accepted by a turn proxy
+type TURNUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// TURN configures a turn proxy, clients allocate relayed addresses with the
+// long-term credential mechanism and relay datagrams to the peers they gave
+// a permission to
+type TURN struct {
+	Realm string     `json:"realm"`
+	Users []TURNUser `json:"users"`
+	// RelayAddress is the IP advertised in relayed addresses, it defaults to
+	// the bind address, which then must not be a wildcard
+	RelayAddress string `json:"relayAddress"`
+	// Peers allows or denies the peers clients can give a permission to,
+	// with the semantics of the acl, except that loopback, private and
+	// link-local peers no rule matches are denied
+	Peers []ACLRule `json:"peers"`
+	// DefaultLifetime and MaxLifetime bound the lifetime of allocations in
+	// seconds, they default to 10 minutes and an hour
+	DefaultLifetime int `json:"defaultLifetime"`
+	MaxLifetime     int `json:"maxLifetime"`
+	// NonceLifetime is how many seconds a nonce is accepted, it defaults to
+	// 10 minutes
+	NonceLifetime int `json:"nonceLifetime"`
+}
+
+// Validate checks the turn settings
+func (t TURN) Validate() error {
+	if t.Realm == "" {
+		return errors.New("turn requires a realm")
+	}
+	if len(t.Users) == 0 {
+		return errors.New("turn requires at least one user")
+	}
+	for _, u := range t.Users {
+		if u.Username == "" || u.Password == "" {
+			return fmt.Errorf("invalid turn user %q", u.Username)
+		}
+	}
+	if t.RelayAddress != "" && net.ParseIP(t.RelayAddress) == nil {
+		return fmt.Errorf("invalid turn relay address %q", t.RelayAddress)
+	}
+	if t.DefaultLifetime < 0 || t.MaxLifetime < 0 || t.NonceLifetime < 0 {
+		return errors.New("turn lifetimes must not be negative")
+	}
+	if t.MaxLifetime > 0 && t.MaxLifetime < int(t.defaultLifetime()/time.Second) {
+		return errors.New("turn max lifetime must not be shorter than the default lifetime")
+	}
+	return ValidateACL(t.Peers)
+}
+
+func (t TURN) defaultLifetime() time.Duration {
+	if t.DefaultLifetime > 0 {
+		return time.Duration(t.DefaultLifetime) * time.Second
+	}
+	return defaultTURNLifetime
+}
+
+func (t TURN) maxLifetime() time.Duration {
+	if t.MaxLifetime > 0 {
+		return time.Duration(t.MaxLifetime) * time.Second
+	}
+	if d := t.defaultLifetime(); d > defaultTURNMaxLifetime {
+		return d
+	}
+	return defaultTURNMaxLifetime
+}
+
+// lifetime is what an allocation is granted for a requested LIFETIME
+func (t TURN) lifetime(msg *turn.Message) time.Duration {
+	lifetime := t.defaultLifetime()
+	if value, ok := msg.Get(turn.AttrLifetime); ok && len(value) == 4 {
+		if requested := time.Duration(binary.BigEndian.Uint32(value)) * time.Second; requested > lifetime {
+			lifetime = requested
+		}
+	}
+	if max := t.maxLifetime(); lifetime > max {
+		lifetime = max
+	}
+	return lifetime
+}
+
+func (p *Proxy) isTURN() bool {
+	return p.Type == ProxyTypeTURN
+}
+
+// validateTURN checks that the proxy type can be combined with the rest of
+// the config
+func (p *Proxy) validateTURN() error {
+	if !p.isTURN() {
+		return nil
+	}
+	if err := p.TURN.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case !p.usesUpstreamSockets():
+		return errors.New("a turn proxy requires the socket upstream mode")
+	case p.Tunnel.Role != "":
+		return errors.New("a turn proxy cannot be part of a tunnel")
+	case p.DTLS.Mode != "":
+		return errors.New("a turn proxy cannot be combined with dtls")
+	case p.FEC.Role != "":
+		return errors.New("a turn proxy cannot be combined with fec")
+	case p.ProxyProtocol.Ingress != "" || p.ProxyProtocol.Egress != "":
+		return errors.New("a turn proxy cannot be combined with the proxy protocol")
+	case len(p.Authentication.Keys) > 0:
+		return errors.New("a turn proxy authenticates its users instead of tokens")
+	}
+	return nil
+}
+
+// turnServer holds the credentials and the nonce key of a turn proxy
+type turnServer struct {
+	realm    []byte
+	keys     map[string][]byte
+	nonceKey []byte
+	nonceTTL time.Duration
+	peers    *ACL
+	relayIP  net.IP
+}
+
+func (p *Proxy) newTURNServer() (*turnServer, error) {
+	peers, err := NewACL(p.TURN.Peers)
+	if err != nil {
+		return nil, err
+	}
+	relayIP := p.client.IP
+	if p.TURN.RelayAddress != "" {
+		relayIP = net.ParseIP(p.TURN.RelayAddress)
+	}
+	if relayIP == nil || relayIP.IsUnspecified() {
+		return nil, errors.New("a turn proxy bound to every address requires a relay address")
+	}
+	if ip4 := relayIP.To4(); ip4 != nil {
+		relayIP = ip4
+	}
+	s := &turnServer{
+		realm:    []byte(p.TURN.Realm),
+		keys:     make(map[string][]byte, len(p.TURN.Users)),
+		nonceKey: make([]byte, 32),
+		nonceTTL: defaultTURNNonceLifetime,
+		peers:    peers,
+		relayIP:  relayIP,
+	}
+	if p.TURN.NonceLifetime > 0 {
+		s.nonceTTL = time.Duration(p.TURN.NonceLifetime) * time.Second
+	}
+	for _, u := range p.TURN.Users {
+		s.keys[u.Username] = turn.LongTermKey(u.Username, p.TURN.Realm, u.Password)
+	}
+	if _, err := rand.Read(s.nonceKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// nonce returns a nonce for a client, nonces are not stored, they carry the
+// time they were issued at and a mac binding it to the client IP
+func (s *turnServer) nonce(client net.IP, now time.Time) []byte {
+	issued := make([]byte, 8)
+	binary.BigEndian.PutUint64(issued, uint64(now.UnixNano()))
+	nonce := make([]byte, 0, 48)
+	nonce = append(nonce, hex.EncodeToString(issued)...)
+	return append(nonce, hex.EncodeToString(s.nonceMAC(client, issued))...)
+}
+
+func (s *turnServer) validNonce(nonce []byte, client net.IP, now time.Time) bool {
+	b, err := hex.DecodeString(string(nonce))
+	if err != nil || len(b) != 24 || !hmac.Equal(b[8:], s.nonceMAC(client, b[:8])) {
+		return false
+	}
+	age := now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(b))))
+	return age >= 0 && age < s.nonceTTL
+}
+
+func (s *turnServer) nonceMAC(client net.IP, issued []byte) []byte {
+	mac := hmac.New(sha256.New, s.nonceKey)
+	mac.Write(issued)
+	mac.Write(client.To16())
+	return mac.Sum(nil)[:16]
+}
+
+// sameFamily reports whether a peer can be reached from the relayed address
+func (s *turnServer) sameFamily(ip net.IP) bool {
+	return (ip.To4() != nil) == (s.relayIP.To4() != nil)
+}
+
+// turnAllocation is the TURN state of a client session, the session is
+// created by an authenticated Allocate request and its upstream socket is
+// the relayed address
+type turnAllocation struct {
+	mutex         sync.Mutex
+	allocated     bool
+	transactionID [turn.TransactionIDSize]byte
+	username      string
+	key           []byte
+	expires       time.Time
+	// permissions maps peer IPs to their expiry
+	permissions map[string]time.Time
+	channels    map[uint16]*turnChannel
+	// peerChannels maps peer addresses to their channel
+	peerChannels map[string]uint16
+}
+
+type turnChannel struct {
+	peer    *net.UDPAddr
+	expires time.Time
+}
+
+func newTURNAllocation() *turnAllocation {
+	return &turnAllocation{
+		permissions:  map[string]time.Time{},
+		channels:     map[uint16]*turnChannel{},
+		peerChannels: map[string]uint16{},
+	}
+}
+
+// expiry is when the allocation ends, unallocated sessions are already due
+func (a *turnAllocation) expiry() time.Time {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.expires
+}
+
+func (a *turnAllocation) credentials() (string, []byte, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.username, a.key, a.allocated
+}
+
+// release ends the allocation and reports whether it was allocated
+func (a *turnAllocation) release() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	allocated := a.allocated
+	a.allocated = false
+	return allocated
+}
+
+func (a *turnAllocation) permit(ip net.IP, now time.Time) {
+	a.permissions[ip.String()] = now.Add(turnPermissionLifetime)
+	// expired permissions and channels are dropped lazily
+	for key, expires := range a.permissions {
+		if now.After(expires) {
+			delete(a.permissions, key)
+		}
+	}
+	for number, c := range a.channels {
+		if now.After(c.expires) {
+			delete(a.channels, number)
+			delete(a.peerChannels, c.peer.String())
+		}
+	}
+}
+
+func (a *turnAllocation) permitted(ip net.IP, now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	expires, found := a.permissions[ip.String()]
+	return found && now.Before(expires)
+}
+
+// channelPeer returns the peer bound to a channel
+func (a *turnAllocation) channelPeer(number uint16, now time.Time) *net.UDPAddr {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if c, found := a.channels[number]; found && now.Before(c.expires) {
+		return c.peer
+	}
+	return nil
+}
+
+// peerChannel returns the channel bound to a peer and whether the peer has
+// a permission
+func (a *turnAllocation) peerChannel(peer *net.UDPAddr, now time.Time) (uint16, bool, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	expires, found := a.permissions[peer.IP.String()]
+	if !found || now.After(expires) {
+		return 0, false, false
+	}
+	number, bound := a.peerChannels[peer.String()]
+	if bound && now.After(a.channels[number].expires) {
+		bound = false
+	}
+	return number, bound, true
+}
+
+// bind binds a channel to a peer, a channel and a peer can only be bound to
+// each other
+func (a *turnAllocation) bind(number uint16, peer *net.UDPAddr, now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if c, found := a.channels[number]; found && now.Before(c.expires) && c.peer.String() != peer.String() {
+		return false
+	}
+	if other, found := a.peerChannels[peer.String()]; found && other != number && now.Before(a.channels[other].expires) {
+		return false
+	}
+	a.channels[number] = &turnChannel{peer: peer, expires: now.Add(turnChannelLifetime)}
+	a.peerChannels[peer.String()] = number
+	a.permit(peer.IP, now)
+	return true
+}
+
+// TURNAllocationInfo describes the allocation of a turn session
+type TURNAllocationInfo struct {
+	Client         string            `json:"client"`
+	Username       string            `json:"username"`
+	RelayedAddress string            `json:"relayedAddress"`
+	Expires        time.Time         `json:"expires"`
+	Permissions    []string          `json:"permissions"`
+	Channels       map[uint16]string `json:"channels"`
+}
+
+func (p *Proxy) allocationInfo(conn *connection, now time.Time) (TURNAllocationInfo, bool) {
+	a := conn.allocation
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.allocated {
+		return TURNAllocationInfo{}, false
+	}
+	info := TURNAllocationInfo{
+		Client:         conn.key,
+		Username:       a.username,
+		RelayedAddress: p.relayedAddress(conn).String(),
+		Expires:        a.expires,
+		Permissions:    []string{},
+		Channels:       map[uint16]string{},
+	}
+	for ip, expires := range a.permissions {
+		if now.Before(expires) {
+			info.Permissions = append(info.Permissions, ip)
+		}
+	}
+	sort.Strings(info.Permissions)
+	for number, c := range a.channels {
+		if now.Before(c.expires) {
+			info.Channels[number] = c.peer.String()
+		}
+	}
+	return info, true
+}
+
+// TURNAllocations returns the allocations of a turn proxy sorted by client
+// address
+func (p *Proxy) TURNAllocations() ([]TURNAllocationInfo, error) {
+	if p.turnServer == nil {
+		return nil, errTURNDisabled
+	}
+	now := time.Now()
+	allocations := []TURNAllocationInfo{}
+	p.connsMap.Range(func(_, c interface{}) bool {
+		if info, ok := p.allocationInfo(c.(*connection), now); ok {
+			allocations = append(allocations, info)
+		}
+		return true
+	})
+	sort.Slice(allocations, func(i, j int) bool {
+		return allocations[i].Client < allocations[j].Client
+	})
+	return allocations, nil
+}
+
+func (p *Proxy) relayedAddress(conn *connection) *net.UDPAddr {
+	return &net.UDPAddr{IP: p.turnServer.relayIP, Port: conn.udp.LocalAddr().(*net.UDPAddr).Port}
+}
+
+// sessionDeadline is when a session expires, turn sessions last for the
+// lifetime of their allocation and other sessions until they see no
+// traffic for ConnTimeout
+func (p *Proxy) sessionDeadline(conn *connection) time.Time {
+	if conn.allocation != nil {
+		return conn.allocation.expiry()
+	}
+	return conn.lastActive().Add(p.ConnTimeout)
+}
+
+// writeTURN answers a client with a STUN message, signed with key unless it
+// is nil
+func (p *Proxy) writeTURN(client *net.UDPAddr, msg *turn.Message, key []byte) {
+	msg.Add(turn.AttrSoftware, turnSoftware)
+	if _, err := p.listenerConn.WriteToUDP(msg.Encode(make([]byte, 0, 256), key), client); err != nil {
+		p.countWriteError(err, statMsgSizeErrorsToClients, statWriteErrorsToClients)
+	}
+}
+
+func (p *Proxy) writeTURNError(client *net.UDPAddr, request *turn.Message, key []byte, code int, reason string) {
+	p.stats.inc(statTURNRequestErrors)
+	response := turn.NewMessage(request.Method, turn.ClassError, request.TransactionID)
+	response.Add(turn.AttrErrorCode, turn.ErrorCode(code, reason))
+	p.writeTURN(client, response, key)
+}
+
+// challengeTURN answers a request that failed authentication with a new
+// nonce
+func (p *Proxy) challengeTURN(client *net.UDPAddr, request *turn.Message, code int, reason string) {
+	response := turn.NewMessage(request.Method, turn.ClassError, request.TransactionID)
+	response.Add(turn.AttrErrorCode, turn.ErrorCode(code, reason))
+	response.Add(turn.AttrRealm, p.turnServer.realm)
+	response.Add(turn.AttrNonce, p.turnServer.nonce(client.IP, time.Now()))
+	p.writeTURN(client, response, nil)
+}
+
+func (p *Proxy) answerBinding(client *net.UDPAddr, request *turn.Message) {
+	response := turn.NewMessage(turn.MethodBinding, turn.ClassSuccess, request.TransactionID)
+	response.Add(turn.AttrXORMappedAddress, turn.AppendXORAddress(nil, client, request.TransactionID))
+	p.writeTURN(client, response, nil)
+}
+
+// authenticateTURN applies the long-term credential mechanism to a request,
+// it returns the username and the key of the client or answers the request
+// with an error
+func (p *Proxy) authenticateTURN(client *net.UDPAddr, request *turn.Message) (string, []byte, bool) {
+	if !request.HasIntegrity() {
+		p.challengeTURN(client, request, turn.CodeUnauthorized, "Unauthorized")
+		return "", nil, false
+	}
+	username, hasUsername := request.Get(turn.AttrUsername)
+	_, hasRealm := request.Get(turn.AttrRealm)
+	nonce, hasNonce := request.Get(turn.AttrNonce)
+	if !hasUsername || !hasRealm || !hasNonce {
+		p.writeTURNError(client, request, nil, turn.CodeBadRequest, "Bad Request")
+		return "", nil, false
+	}
+	if !p.turnServer.validNonce(nonce, client.IP, time.Now()) {
+		p.stats.inc(statTURNStaleNonces)
+		p.challengeTURN(client, request, turn.CodeStaleNonce, "Stale Nonce")
+		return "", nil, false
+	}
+	key, found := p.turnServer.keys[string(username)]
+	if !found || !request.CheckIntegrity(key) {
+		p.stats.inc(statTURNAuthFailures)
+		p.Logger.Debug("turn authentication failed", zap.String("client", client.String()), zap.ByteString("username", username))
+		p.reportOffense(client.IP, OffenseAuthFailed)
+		p.challengeTURN(client, request, turn.CodeUnauthorized, "Unauthorized")
+		return "", nil, false
+	}
+	return string(username), key, true
+}
+
+func knownTURNAttribute(t uint16) bool {
+	switch t {
+	case turn.AttrUsername, turn.AttrRealm, turn.AttrNonce, turn.AttrLifetime,
+		turn.AttrXORPeerAddress, turn.AttrData, turn.AttrChannelNumber,
+		turn.AttrRequestedTransport, turn.AttrRequestedAddressFamily:
+		return true
+	}
+	return false
+}
+
+// checkTURNRequest answers requests carrying attributes that are not
+// supported
+func (p *Proxy) checkTURNRequest(client *net.UDPAddr, request *turn.Message, key []byte) bool {
+	unknown := request.Unknown(knownTURNAttribute)
+	if len(unknown) == 0 {
+		return true
+	}
+	p.stats.inc(statTURNRequestErrors)
+	value := make([]byte, 0, 2*len(unknown))
+	for _, t := range unknown {
+		value = append(value, byte(t>>8), byte(t))
+	}
+	response := turn.NewMessage(request.Method, turn.ClassError, request.TransactionID)
+	response.Add(turn.AttrErrorCode, turn.ErrorCode(turn.CodeUnknownAttribute, "Unknown Attribute"))
+	response.Add(turn.AttrUnknownAttributes, value)
+	p.writeTURN(client, response, key)
+	return false
+}
+
+// checkTURNAllocate checks what an Allocate request asks for
+func (p *Proxy) checkTURNAllocate(client *net.UDPAddr, request *turn.Message, key []byte) bool {
+	if !p.checkTURNRequest(client, request, key) {
+		return false
+	}
+	transport, ok := request.Get(turn.AttrRequestedTransport)
+	if !ok || len(transport) != 4 {
+		p.writeTURNError(client, request, key, turn.CodeBadRequest, "Bad Request")
+		return false
+	}
+	if transport[0] != turn.ProtocolUDP {
+		p.writeTURNError(client, request, key, turn.CodeUnsupportedTransport, "Unsupported Transport Protocol")
+		return false
+	}
+	if family, ok := request.Get(turn.AttrRequestedAddressFamily); ok {
+		relayFamily := turn.FamilyIPv4
+		if p.turnServer.relayIP.To4() == nil {
+			relayFamily = turn.FamilyIPv6
+		}
+		if len(family) != 4 || family[0] != relayFamily {
+			p.writeTURNError(client, request, key, turn.CodeAddressFamilyNotSupported, "Address Family not Supported")
+			return false
+		}
+	}
+	return true
+}
+
+// acceptTURNAllocation answers the datagrams of clients without a session,
+// it returns the key of the client when the datagram is an authenticated
+// Allocate request, which creates the session
+func (p *Proxy) acceptTURNAllocation(client *net.UDPAddr, data []byte) []byte {
+	request, err := turn.Decode(data)
+	if err != nil {
+		p.stats.inc(statTURNInvalidMessages)
+		return nil
+	}
+	if request.Class != turn.ClassRequest {
+		return nil
+	}
+	switch request.Method {
+	case turn.MethodBinding:
+		p.answerBinding(client, request)
+		return nil
+	case turn.MethodAllocate:
+	default:
+		p.writeTURNError(client, request, nil, turn.CodeAllocationMismatch, "Allocation Mismatch")
+		return nil
+	}
+	_, key, ok := p.authenticateTURN(client, request)
+	if !ok || !p.checkTURNAllocate(client, request, key) {
+		return nil
+	}
+	return key
+}
+
+// refuseTURNAllocation answers an Allocate request that could not create a
+// session
+func (p *Proxy) refuseTURNAllocation(client *net.UDPAddr, data []byte, key []byte, code int, reason string) {
+	if key == nil {
+		return
+	}
+	if request, err := turn.Decode(data); err == nil {
+		p.writeTURNError(client, request, key, code, reason)
+	}
+}
+
+// fromTURNClient handles the datagrams of a turn session, ChannelData
+// messages and Send indications are relayed to their peer and requests are
+// answered
+func (p *Proxy) fromTURNClient(conn *connection, data []byte) {
+	now := time.Now()
+	if turn.IsChannelData(data) {
+		number, payload, err := turn.DecodeChannelData(data)
+		if err != nil {
+			p.stats.inc(statTURNInvalidMessages)
+			p.reportOffense(conn.clientAddr().IP, OffenseMalformed)
+			return
+		}
+		peer := conn.allocation.channelPeer(number, now)
+		if peer == nil {
+			p.stats.inc(statTURNPermissionDrops)
+			return
+		}
+		p.forwardToUpstream(conn, payload, peer)
+		return
+	}
+	msg, err := turn.Decode(data)
+	if err != nil {
+		p.stats.inc(statTURNInvalidMessages)
+		p.reportOffense(conn.clientAddr().IP, OffenseMalformed)
+		return
+	}
+	switch msg.Class {
+	case turn.ClassIndication:
+		if msg.Method == turn.MethodSend {
+			p.turnSend(conn, msg, now)
+		}
+		return
+	case turn.ClassRequest:
+	default:
+		return
+	}
+	if msg.Method == turn.MethodBinding {
+		p.answerBinding(conn.replyAddr(), msg)
+		return
+	}
+	username, key, ok := p.authenticateTURN(conn.replyAddr(), msg)
+	if !ok {
+		return
+	}
+	allocatedUsername, _, allocated := conn.allocation.credentials()
+	if msg.Method == turn.MethodAllocate {
+		p.turnAllocate(conn, msg, username, key, now)
+		return
+	}
+	if !allocated {
+		p.writeTURNError(conn.replyAddr(), msg, key, turn.CodeAllocationMismatch, "Allocation Mismatch")
+		return
+	}
+	if username != allocatedUsername {
+		p.writeTURNError(conn.replyAddr(), msg, key, turn.CodeWrongCredentials, "Wrong Credentials")
+		return
+	}
+	if !p.checkTURNRequest(conn.replyAddr(), msg, key) {
+		return
+	}
+	switch msg.Method {
+	case turn.MethodRefresh:
+		p.turnRefresh(conn, msg, key, now)
+	case turn.MethodCreatePermission:
+		p.turnCreatePermission(conn, msg, key, now)
+	case turn.MethodChannelBind:
+		p.turnChannelBind(conn, msg, key, now)
+	default:
+		p.writeTURNError(conn.replyAddr(), msg, key, turn.CodeBadRequest, "Bad Request")
+	}
+}
+
+// turnAllocate handles the Allocate request that created the session, or
+// its retransmissions
+func (p *Proxy) turnAllocate(conn *connection, request *turn.Message, username string, key []byte, now time.Time) {
+	a := conn.allocation
+	a.mutex.Lock()
+	if a.allocated && a.transactionID != request.TransactionID {
+		a.mutex.Unlock()
+		p.writeTURNError(conn.replyAddr(), request, key, turn.CodeAllocationMismatch, "Allocation Mismatch")
+		return
+	}
+	a.mutex.Unlock()
+	if !p.checkTURNAllocate(conn.replyAddr(), request, key) {
+		return
+	}
+	lifetime := p.TURN.lifetime(request)
+	a.mutex.Lock()
+	if !a.allocated {
+		a.allocated = true
+		a.transactionID = request.TransactionID
+		a.username = username
+		a.key = key
+		a.expires = now.Add(lifetime)
+		p.stats.inc(statTURNAllocations)
+		p.Logger.Debug("turn allocation", zap.String("client", conn.key), zap.String("username", username))
+	}
+	lifetime = a.expires.Sub(now)
+	a.mutex.Unlock()
+
+	response := turn.NewMessage(turn.MethodAllocate, turn.ClassSuccess, request.TransactionID)
+	response.Add(turn.AttrXORRelayedAddress, turn.AppendXORAddress(nil, p.relayedAddress(conn), request.TransactionID))
+	response.Add(turn.AttrLifetime, turn.Uint32(uint32(lifetime/time.Second)))
+	response.Add(turn.AttrXORMappedAddress, turn.AppendXORAddress(nil, conn.replyAddr(), request.TransactionID))
+	p.writeTURN(conn.replyAddr(), response, key)
+}
+
+// turnRefresh extends the lifetime of an allocation, a zero lifetime ends
+// it
+func (p *Proxy) turnRefresh(conn *connection, request *turn.Message, key []byte, now time.Time) {
+	var lifetime time.Duration
+	if value, ok := request.Get(turn.AttrLifetime); !ok || len(value) != 4 || binary.BigEndian.Uint32(value) != 0 {
+		lifetime = p.TURN.lifetime(request)
+	}
+	a := conn.allocation
+	a.mutex.Lock()
+	a.expires = now.Add(lifetime)
+	a.mutex.Unlock()
+
+	response := turn.NewMessage(turn.MethodRefresh, turn.ClassSuccess, request.TransactionID)
+	response.Add(turn.AttrLifetime, turn.Uint32(uint32(lifetime/time.Second)))
+	p.writeTURN(conn.replyAddr(), response, key)
+	if lifetime == 0 {
+		p.Logger.Debug("turn allocation deleted", zap.String("client", conn.key))
+		p.closeConnection(conn)
+		p.removeConnection(conn)
+	}
+}
+
+// turnPeer decodes and checks a XOR-PEER-ADDRESS, it returns the error to
+// answer with when the peer is refused
+func (p *Proxy) turnPeer(value []byte, transactionID [turn.TransactionIDSize]byte) (*net.UDPAddr, int, string) {
+	peer, err := turn.XORAddress(value, transactionID)
+	if err != nil {
+		return nil, turn.CodeBadRequest, "Bad Request"
+	}
+	if !p.turnServer.sameFamily(peer.IP) {
+		return nil, turn.CodePeerAddressFamilyMismatch, "Peer Address Family Mismatch"
+	}
+	if !allowsDestination(p.turnServer.peers, peer.IP) {
+		return nil, turn.CodeForbidden, "Forbidden"
+	}
+	return peer, 0, ""
+}
+
+// turnCreatePermission installs or refreshes the permissions of every
+// XOR-PEER-ADDRESS, or of none of them if one is refused
+func (p *Proxy) turnCreatePermission(conn *connection, request *turn.Message, key []byte, now time.Time) {
+	var peers []*net.UDPAddr
+	for _, attr := range request.Attributes {
+		if attr.Type != turn.AttrXORPeerAddress {
+			continue
+		}
+		peer, code, reason := p.turnPeer(attr.Value, request.TransactionID)
+		if peer == nil {
+			p.writeTURNError(conn.replyAddr(), request, key, code, reason)
+			return
+		}
+		peers = append(peers, peer)
+	}
+	if len(peers) == 0 {
+		p.writeTURNError(conn.replyAddr(), request, key, turn.CodeBadRequest, "Bad Request")
+		return
+	}
+	a := conn.allocation
+	a.mutex.Lock()
+	for _, peer := range peers {
+		a.permit(peer.IP, now)
+	}
+	a.mutex.Unlock()
+	p.stats.add(statTURNPermissions, uint64(len(peers)))
+	p.writeTURN(conn.replyAddr(), turn.NewMessage(turn.MethodCreatePermission, turn.ClassSuccess, request.TransactionID), key)
+}
+
+// turnChannelBind binds a channel to a peer, which also gives the peer a
+// permission
+func (p *Proxy) turnChannelBind(conn *connection, request *turn.Message, key []byte, now time.Time) {
+	value, hasChannel := request.Get(turn.AttrChannelNumber)
+	peerValue, hasPeer := request.Get(turn.AttrXORPeerAddress)
+	if !hasChannel || !hasPeer || len(value) != 4 {
+		p.writeTURNError(conn.replyAddr(), request, key, turn.CodeBadRequest, "Bad Request")
+		return
+	}
+	number := binary.BigEndian.Uint16(value)
+	if number < turn.MinChannel || number > turn.MaxChannel {
+		p.writeTURNError(conn.replyAddr(), request, key, turn.CodeBadRequest, "Bad Request")
+		return
+	}
+	peer, code, reason := p.turnPeer(peerValue, request.TransactionID)
+	if peer == nil {
+		p.writeTURNError(conn.replyAddr(), request, key, code, reason)
+		return
+	}
+	if !conn.allocation.bind(number, peer, now) {
+		p.writeTURNError(conn.replyAddr(), request, key, turn.CodeBadRequest, "Bad Request")
+		return
+	}
+	p.stats.inc(statTURNChannelBindings)
+	p.writeTURN(conn.replyAddr(), turn.NewMessage(turn.MethodChannelBind, turn.ClassSuccess, request.TransactionID), key)
+}
+
+// turnSend relays the DATA of a Send indication to a peer with a permission
+func (p *Proxy) turnSend(conn *connection, indication *turn.Message, now time.Time) {
+	peerValue, hasPeer := indication.Get(turn.AttrXORPeerAddress)
+	payload, hasData := indication.Get(turn.AttrData)
+	if !hasPeer || !hasData {
+		p.stats.inc(statTURNInvalidMessages)
+		return
+	}
+	peer, err := turn.XORAddress(peerValue, indication.TransactionID)
+	if err != nil {
+		p.stats.inc(statTURNInvalidMessages)
+		return
+	}
+	if !conn.allocation.permitted(peer.IP, now) {
+		p.stats.inc(statTURNPermissionDrops)
+		return
+	}
+	p.forwardToUpstream(conn, payload, peer)
+}
+
+// toTURNClient wraps a datagram a peer sent to the relayed address of conn
+// in a ChannelData message when a channel is bound to the peer and in a
+// Data indication otherwise, it returns false if the peer has no permission
+func (p *Proxy) toTURNClient(conn *connection, msg []byte, size int, peer *net.UDPAddr) ([]byte, bool) {
+	number, bound, permitted := conn.allocation.peerChannel(peer, time.Now())
+	if !permitted {
+		p.stats.inc(statTURNPermissionDrops)
+		p.Logger.Debug("dropping datagram from peer without permission", zap.String("peer", peer.String()))
+		return nil, false
+	}
+	buf := p.bufferPool.Get().([]byte)
+	if bound {
+		return turn.AppendChannelData(buf[:0], number, msg[:size]), true
+	}
+	var transactionID [turn.TransactionIDSize]byte
+	rand.Read(transactionID[:])
+	indication := turn.NewMessage(turn.MethodData, turn.ClassIndication, transactionID)
+	indication.Add(turn.AttrXORPeerAddress, turn.AppendXORAddress(nil, peer, transactionID))
+	indication.Add(turn.AttrData, msg[:size])
+	return indication.Encode(buf[:0], nil), true
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/felipejfc/udpx/stream"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+var errClientGone = errors.New("client stream closed")
+
+// WebSocketGateway configures how a websocket proxy accepts its clients
+type WebSocketGateway struct {
+	// Path is the URL path served on the bind port, it defaults to /
+	Path string `json:"path"`
+	// APIOnly skips binding the bind port, clients then connect through
+	// the API at /proxy/:port/websocket
+	APIOnly bool `json:"apiOnly"`
+	// AllowedOrigins are the origins browsers may connect from besides the
+	// origin of the gateway itself, "*" allows any origin
+	AllowedOrigins []string `json:"allowedOrigins"`
+}
+
+// Validate checks the websocket gateway settings
+func (w WebSocketGateway) Validate() error {
+	if w.Path != "" && !strings.HasPrefix(w.Path, "/") {
+		return fmt.Errorf("websocket path %q must start with /", w.Path)
+	}
+	return nil
+}
+
+// allowsOrigin tells if a handshake request may connect, requests without
+// an origin do not come from browsers and same origin requests are always
+// allowed
+func (w WebSocketGateway) allowsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range w.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func (p *Proxy) isWebSocketGateway() bool {
+	return p.Type == ProxyTypeWebSocket
+}
+
+// validateWebSocketGateway checks that the proxy type can be combined with
+// the rest of the config
+func (p *Proxy) validateWebSocketGateway() error {
+	if !p.isWebSocketGateway() {
+		return nil
+	}
+	if err := p.WebSocket.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case p.Tunnel.Role == TunnelRoleExit:
+		return errors.New("a websocket proxy cannot be a tunnel exit")
+	case p.DTLS.Mode == DTLSModeTerminate:
+		return errors.New("a websocket proxy cannot terminate dtls")
+	case p.FEC.Role == FECRoleExit:
+		return errors.New("a websocket proxy cannot be a fec exit")
+	case p.ProxyProtocol.Ingress != "":
+		return errors.New("a websocket proxy cannot parse proxy protocol headers")
+	}
+	return nil
+}
+
+// gateway holds the WebSocket streams of the clients of a websocket proxy
+type gateway struct {
+	mutex      sync.Mutex
+	closed     bool
+	streams    map[string]stream.Conn
+	httpServer *http.Server
+}
+
+// add registers the stream of a client, tracking its reader in wg, it
+// returns false once the gateway is closed
+func (g *gateway) add(key string, conn stream.Conn, wg *sync.WaitGroup) bool {
+	if g == nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.closed {
+		return false
+	}
+	g.streams[key] = conn
+	wg.Add(1)
+	return true
+}
+
+func (g *gateway) remove(key string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.streams, key)
+}
+
+func (g *gateway) stream(key string) stream.Conn {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.streams[key]
+}
+
+// close stops accepting clients and closes every stream
+func (g *gateway) close() {
+	g.mutex.Lock()
+	g.closed = true
+	for _, conn := range g.streams {
+		conn.Close()
+	}
+	g.mutex.Unlock()
+	if g.httpServer != nil {
+		g.httpServer.Close()
+	}
+}
+
+// startWebSocketGateway serves the clients of a websocket proxy on the
+// bind port unless they only come through the API
+func (p *Proxy) startWebSocketGateway() error {
+	p.gateway = &gateway{streams: map[string]stream.Conn{}}
+	if p.WebSocket.APIOnly {
+		return nil
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", p.BindAddress, p.BindPort))
+	if err != nil {
+		return err
+	}
+	path := p.WebSocket.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, p.WebSocketHandler())
+	p.gateway.httpServer = &http.Server{Handler: mux}
+	p.goTracked(&p.backgroundWg, func() { p.gateway.httpServer.Serve(listener) })
+	return nil
+}
+
+// WebSocketHandler accepts the clients of a websocket proxy, it can be
+// mounted on any HTTP server
+func (p *Proxy) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if !p.WebSocket.allowsOrigin(r) {
+				p.stats.inc(statWebSocketRejectedOrigins)
+				return fmt.Errorf("origin %q not allowed", r.Header.Get("Origin"))
+			}
+			return nil
+		},
+		Handler: p.serveWebSocket,
+	}
+}
+
+// serveWebSocket reads the datagrams of a WebSocket client, which is known
+// by the address of its TCP connection, and hands them to the client
+// handlers like the datagrams read from the bind port
+func (p *Proxy) serveWebSocket(ws *websocket.Conn) {
+	conn := stream.NewWebSocketConn(ws)
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		conn.Close()
+		return
+	}
+	client := &net.UDPAddr{IP: remote.IP, Port: remote.Port, Zone: remote.Zone}
+	key := client.String()
+	if !p.gateway.add(key, conn, &p.readersWg) {
+		conn.Close()
+		return
+	}
+	defer p.readersWg.Done()
+	p.stats.inc(statWebSocketConnections)
+	defer p.stats.dec(statWebSocketConnections)
+	p.Logger.Debug("new websocket client", zap.String("client", key))
+	for {
+		msg := p.bufferPool.Get().([]byte)
+		size, truncated, err := conn.ReadDatagram(msg[:cap(msg)])
+		if err != nil {
+			p.bufferPool.Put(msg)
+			break
+		}
+		if size > p.BufferSize {
+			size, truncated = p.BufferSize, true
+		}
+		if !p.dispatchClientDatagram(client, msg, size, truncated) {
+			break
+		}
+	}
+	p.gateway.remove(key)
+	conn.Close()
+	// the session ends with the stream of its client
+	if c, found := p.connsMap.Load(key); found && c.(*connection).clientStream == conn {
+		p.closeConnection(c.(*connection))
+		p.removeConnection(c.(*connection))
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package proxyproto encodes and decodes the binary PROXY protocol version 2
+// header for UDP datagrams, which carries the address of the original client
+// across proxies and load balancers.
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Signature starts every PROXY protocol v2 header
+var Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	fixedSize = 16
+	ipv4Size  = 12
+	ipv6Size  = 36
+
+	version2     = 0x20
+	commandLocal = 0x00
+	commandProxy = 0x01
+
+	familyInet  = 0x10
+	familyInet6 = 0x20
+	transDgram  = 0x02
+)
+
+// ErrNoSignature is returned when a datagram does not start with the PROXY
+// protocol v2 signature
+var ErrNoSignature = errors.New("datagram does not start with a proxy protocol v2 signature")
+
+// ErrInvalidHeader is returned when a datagram starts with the signature but
+// the header is malformed or not for UDP
+var ErrInvalidHeader = errors.New("invalid proxy protocol v2 header")
+
+// Header is a PROXY protocol v2 header, Source and Destination are nil for
+// LOCAL headers, which are sent by proxies for their own traffic
+type Header struct {
+	Source      *net.UDPAddr
+	Destination *net.UDPAddr
+}
+
+// Size returns the length of the encoded header
+func (h Header) Size() int {
+	if h.Source == nil {
+		return fixedSize
+	}
+	if h.Source.IP.To4() != nil {
+		return fixedSize + ipv4Size
+	}
+	return fixedSize + ipv6Size
+}
+
+// Append appends the encoded header to b, the destination is converted to
+// the address family of the source
+func (h Header) Append(b []byte) []byte {
+	b = append(b, Signature...)
+	if h.Source == nil {
+		return append(b, version2|commandLocal, 0, 0, 0)
+	}
+	dst := h.Destination
+	if dst == nil {
+		dst = &net.UDPAddr{}
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(h.Source.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+	if src4 := h.Source.IP.To4(); src4 != nil {
+		dst4 := dst.IP.To4()
+		if dst4 == nil {
+			dst4 = net.IPv4zero.To4()
+		}
+		b = append(b, version2|commandProxy, familyInet|transDgram, 0, ipv4Size)
+		b = append(b, src4...)
+		b = append(b, dst4...)
+		return append(b, ports...)
+	}
+	dst16 := dst.IP.To16()
+	if dst16 == nil {
+		dst16 = net.IPv6unspecified
+	}
+	b = append(b, version2|commandProxy, familyInet6|transDgram, 0, ipv6Size)
+	b = append(b, h.Source.IP.To16()...)
+	b = append(b, dst16...)
+	return append(b, ports...)
+}
+
+// Decode parses the header at the start of a datagram and returns it with
+// the payload, TLVs following the addresses are skipped
+func Decode(b []byte) (Header, []byte, error) {
+	if len(b) < fixedSize || string(b[:len(Signature)]) != string(Signature) {
+		return Header{}, nil, ErrNoSignature
+	}
+	verCmd, family := b[12], b[13]
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	if verCmd&0xF0 != version2 || len(b) < fixedSize+length {
+		return Header{}, nil, ErrInvalidHeader
+	}
+	addresses, payload := b[fixedSize:fixedSize+length], b[fixedSize+length:]
+	switch verCmd & 0x0F {
+	case commandLocal:
+		return Header{}, payload, nil
+	case commandProxy:
+	default:
+		return Header{}, nil, ErrInvalidHeader
+	}
+	var h Header
+	switch family {
+	case familyInet | transDgram:
+		if length < ipv4Size {
+			return Header{}, nil, ErrInvalidHeader
+		}
+		h.Source = &net.UDPAddr{IP: net.IP(append([]byte(nil), addresses[0:4]...)), Port: int(binary.BigEndian.Uint16(addresses[8:10]))}
+		h.Destination = &net.UDPAddr{IP: net.IP(append([]byte(nil), addresses[4:8]...)), Port: int(binary.BigEndian.Uint16(addresses[10:12]))}
+	case familyInet6 | transDgram:
+		if length < ipv6Size {
+			return Header{}, nil, ErrInvalidHeader
+		}
+		h.Source = &net.UDPAddr{IP: net.IP(append([]byte(nil), addresses[0:16]...)), Port: int(binary.BigEndian.Uint16(addresses[32:34]))}
+		h.Destination = &net.UDPAddr{IP: net.IP(append([]byte(nil), addresses[16:32]...)), Port: int(binary.BigEndian.Uint16(addresses[34:36]))}
+	default:
+		return Header{}, nil, ErrInvalidHeader
+	}
+	return h, payload, nil
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package proxyproto_test
+
+import (
+	"net"
+
+	. "github.com/felipejfc/udpx/proxyproto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Header", func() {
+	It("should encode and decode ipv4 and ipv6 headers", func() {
+		for _, h := range []Header{
+			{Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, Destination: &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 7777}},
+			{Source: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, Destination: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 7777}},
+		} {
+			b := h.Append(nil)
+			Expect(b).To(HaveLen(h.Size()))
+			decoded, payload, err := Decode(append(b, "hello"...))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.Source.String()).To(Equal(h.Source.String()))
+			Expect(decoded.Destination.String()).To(Equal(h.Destination.String()))
+			Expect(string(payload)).To(Equal("hello"))
+		}
+	})
+
+	It("should convert the destination to the family of the source", func() {
+		h := Header{Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, Destination: &net.UDPAddr{IP: net.IPv6unspecified, Port: 7777}}
+		decoded, _, err := Decode(h.Append(nil))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded.Destination.String()).To(Equal("0.0.0.0:7777"))
+	})
+
+	It("should decode local headers and reject invalid ones", func() {
+		h, payload, err := Decode(append(Header{}.Append(nil), "hello"...))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(h.Source).To(BeNil())
+		Expect(string(payload)).To(Equal("hello"))
+
+		_, _, err = Decode([]byte("hello"))
+		Expect(err).To(Equal(ErrNoSignature))
+		b := Header{Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}.Append(nil)
+		_, _, err = Decode(b[:20])
+		Expect(err).To(Equal(ErrInvalidHeader))
+	})
+})
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package quic
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Frame types found in Initial packets
+const (
+	framePadding         = 0x00
+	framePing            = 0x01
+	frameAck             = 0x02
+	frameAckECN          = 0x03
+	frameCrypto          = 0x06
+	frameConnectionClose = 0x1c
+)
+
+const (
+	handshakeClientHello = 0x01
+	extensionServerName  = 0x0000
+	serverNameHost       = 0x00
+	handshakeHeaderSize  = 4
+)
+
+var (
+	// ErrInvalidFrame is returned for frames that are malformed or not
+	// allowed in Initial packets
+	ErrInvalidFrame = errors.New("invalid quic initial frame")
+	// ErrCryptoTooLarge is returned when the CRYPTO data of a ClientHello
+	// exceeds the size a CryptoStream keeps
+	ErrCryptoTooLarge = errors.New("quic crypto data too large")
+	// ErrInvalidClientHello is returned for malformed ClientHello messages
+	ErrInvalidClientHello = errors.New("invalid tls client hello")
+)
+
+// CryptoFrames calls f with the offset and the data of every CRYPTO frame in
+// the frames of an Initial packet
+func CryptoFrames(frames []byte, f func(offset uint64, data []byte) error) error {
+	for len(frames) > 0 {
+		frameType := frames[0]
+		frames = frames[1:]
+		switch frameType {
+		case framePadding, framePing:
+		case frameAck, frameAckECN:
+			// largest acknowledged, ack delay, range count and first range
+			var fields [4]uint64
+			for i := range fields {
+				v, n := ReadVarint(frames)
+				if n == 0 {
+					return ErrInvalidFrame
+				}
+				fields[i], frames = v, frames[n:]
+			}
+			skip := 2 * fields[2]
+			if frameType == frameAckECN {
+				skip += 3
+			}
+			for ; skip > 0; skip-- {
+				_, n := ReadVarint(frames)
+				if n == 0 {
+					return ErrInvalidFrame
+				}
+				frames = frames[n:]
+			}
+		case frameCrypto:
+			offset, n := ReadVarint(frames)
+			if n == 0 {
+				return ErrInvalidFrame
+			}
+			frames = frames[n:]
+			size, n := ReadVarint(frames)
+			if n == 0 || uint64(len(frames)-n) < size {
+				return ErrInvalidFrame
+			}
+			frames = frames[n:]
+			if err := f(offset, frames[:size]); err != nil {
+				return err
+			}
+			frames = frames[size:]
+		case frameConnectionClose:
+			// error code, frame type and reason phrase
+			for i := 0; i < 2; i++ {
+				_, n := ReadVarint(frames)
+				if n == 0 {
+					return ErrInvalidFrame
+				}
+				frames = frames[n:]
+			}
+			size, n := ReadVarint(frames)
+			if n == 0 || uint64(len(frames)-n) < size {
+				return ErrInvalidFrame
+			}
+			frames = frames[n+int(size):]
+		default:
+			return ErrInvalidFrame
+		}
+	}
+	return nil
+}
+
+type cryptoChunk struct {
+	offset uint64
+	data   []byte
+}
+
+// CryptoStream reassembles the CRYPTO data of the Initial packets of a
+// client, which may arrive out of order and split across packets
+type CryptoStream struct {
+	max    int
+	size   int
+	chunks []cryptoChunk
+}
+
+// NewCryptoStream creates a stream keeping at most max bytes
+func NewCryptoStream(max int) *CryptoStream {
+	return &CryptoStream{max: max}
+}
+
+// Add copies the data of a CRYPTO frame
+func (s *CryptoStream) Add(offset uint64, data []byte) error {
+	if offset+uint64(len(data)) > uint64(s.max) || s.size+len(data) > s.max {
+		return ErrCryptoTooLarge
+	}
+	s.size += len(data)
+	s.chunks = append(s.chunks, cryptoChunk{offset: offset, data: append([]byte(nil), data...)})
+	return nil
+}
+
+// Contiguous returns the data received from offset 0 without gaps
+func (s *CryptoStream) Contiguous() []byte {
+	sort.Slice(s.chunks, func(i, j int) bool { return s.chunks[i].offset < s.chunks[j].offset })
+	var out []byte
+	for _, c := range s.chunks {
+		end := c.offset + uint64(len(c.data))
+		if c.offset > uint64(len(out)) {
+			break
+		}
+		if end > uint64(len(out)) {
+			out = append(out, c.data[uint64(len(out))-c.offset:]...)
+		}
+	}
+	return out
+}
+
+// ServerName returns the server name of the ClientHello b starts with, it
+// returns false if b does not hold the whole ClientHello yet. A complete
+// ClientHello without the server_name extension has an empty name
+func ServerName(b []byte) (string, bool, error) {
+	if len(b) < handshakeHeaderSize {
+		return "", false, nil
+	}
+	if b[0] != handshakeClientHello {
+		return "", false, ErrInvalidClientHello
+	}
+	size := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	if len(b) < handshakeHeaderSize+size {
+		return "", false, nil
+	}
+	hello := reader(b[handshakeHeaderSize : handshakeHeaderSize+size])
+	// legacy version and random
+	if !hello.skip(2+32) || !hello.skipVector(1) || !hello.skipVector(2) || !hello.skipVector(1) {
+		return "", false, ErrInvalidClientHello
+	}
+	if len(hello) == 0 {
+		return "", true, nil
+	}
+	extensions, ok := hello.vector(2)
+	if !ok {
+		return "", false, ErrInvalidClientHello
+	}
+	for len(extensions) > 0 {
+		extensionType, ok := extensions.uint16()
+		if !ok {
+			return "", false, ErrInvalidClientHello
+		}
+		data, ok := extensions.vector(2)
+		if !ok {
+			return "", false, ErrInvalidClientHello
+		}
+		if extensionType != extensionServerName {
+			continue
+		}
+		names, ok := data.vector(2)
+		if !ok {
+			return "", false, ErrInvalidClientHello
+		}
+		for len(names) > 0 {
+			nameType := names[0]
+			names = names[1:]
+			name, ok := names.vector(2)
+			if !ok {
+				return "", false, ErrInvalidClientHello
+			}
+			if nameType == serverNameHost {
+				return string(name), true, nil
+			}
+		}
+	}
+	return "", true, nil
+}
+
+// reader consumes the fields of a TLS message
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector consumes a vector whose length takes lengthSize bytes
+func (r *reader) vector(lengthSize int) (reader, bool) {
+	if len(*r) < lengthSize {
+		return nil, false
+	}
+	size := 0
+	for _, c := range (*r)[:lengthSize] {
+		size = size<<8 | int(c)
+	}
+	*r = (*r)[lengthSize:]
+	if len(*r) < size {
+		return nil, false
+	}
+	v := (*r)[:size]
+	*r = (*r)[size:]
+	return v, true
+}
+
+func (r *reader) skipVector(lengthSize int) bool {
+	_, ok := r.vector(lengthSize)
+	return ok
+}
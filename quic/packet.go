@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package quic reads what a proxy needs from QUIC packets (RFC 9000) without
+// terminating QUIC: the connection ids of their headers and the TLS
+// ClientHello carried by client Initial packets, whose protection only
+// depends on public values (RFC 9001)
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Versions whose Initial packets can be opened
+const (
+	Version1 = 0x00000001
+	Version2 = 0x6b3343cf
+)
+
+const (
+	// MaxConnectionIDSize is the longest connection id of QUIC v1
+	MaxConnectionIDSize = 20
+
+	headerFormLong = 0x80
+	fixedBit       = 0x40
+	sampleSize     = 16
+	maxPNSize      = 4
+)
+
+var (
+	// ErrNotInitial is returned for packets that are not client Initial
+	// packets of a known version
+	ErrNotInitial = errors.New("not a quic initial packet")
+	// ErrInvalidPacket is returned for malformed packets
+	ErrInvalidPacket = errors.New("invalid quic packet")
+	// ErrDecrypt is returned when an Initial packet cannot be authenticated
+	ErrDecrypt = errors.New("quic initial packet authentication failed")
+
+	saltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	saltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+)
+
+// IsLongHeader reports whether b starts with a long header packet
+func IsLongHeader(b []byte) bool {
+	return len(b) > 0 && b[0]&headerFormLong != 0
+}
+
+// IsShortHeader reports whether b starts with a short header packet
+func IsShortHeader(b []byte) bool {
+	return len(b) > 0 && b[0]&(headerFormLong|fixedBit) == fixedBit
+}
+
+// LongHeader is the unprotected part of a long header
+type LongHeader struct {
+	Version uint32
+	DCID    []byte
+	SCID    []byte
+	// Initial reports an Initial packet of a known version, Token,
+	// PNOffset and End are only set for them
+	Initial  bool
+	Token    []byte
+	PNOffset int
+	// End is where the packet ends, other packets may follow it in the
+	// same datagram
+	End int
+}
+
+// ParseLongHeader parses the long header b starts with
+func ParseLongHeader(b []byte) (LongHeader, error) {
+	var h LongHeader
+	if !IsLongHeader(b) || len(b) < 7 {
+		return h, ErrInvalidPacket
+	}
+	h.Version = binary.BigEndian.Uint32(b[1:])
+	offset := 5
+	var ok bool
+	if h.DCID, offset, ok = readConnectionID(b, offset); !ok {
+		return h, ErrInvalidPacket
+	}
+	if h.SCID, offset, ok = readConnectionID(b, offset); !ok {
+		return h, ErrInvalidPacket
+	}
+	packetType := b[0] >> 4 & 0x03
+	switch {
+	case h.Version == Version1 && packetType == 0, h.Version == Version2 && packetType == 1:
+		h.Initial = true
+	default:
+		return h, nil
+	}
+	tokenSize, n := ReadVarint(b[offset:])
+	if n == 0 || uint64(len(b)-offset-n) < tokenSize {
+		return h, ErrInvalidPacket
+	}
+	offset += n
+	h.Token = b[offset : offset+int(tokenSize)]
+	offset += int(tokenSize)
+	length, n := ReadVarint(b[offset:])
+	if n == 0 || uint64(len(b)-offset-n) < length || length < maxPNSize+sampleSize {
+		return h, ErrInvalidPacket
+	}
+	h.PNOffset = offset + n
+	h.End = h.PNOffset + int(length)
+	return h, nil
+}
+
+func readConnectionID(b []byte, offset int) ([]byte, int, bool) {
+	if offset >= len(b) {
+		return nil, 0, false
+	}
+	size := int(b[offset])
+	offset++
+	if size > MaxConnectionIDSize || offset+size > len(b) {
+		return nil, 0, false
+	}
+	return b[offset : offset+size], offset + size, true
+}
+
+// ShortHeaderDCID returns the destination connection id of a short header
+// packet, its length is not encoded so it has to be known
+func ShortHeaderDCID(b []byte, size int) ([]byte, bool) {
+	if !IsShortHeader(b) || len(b) < 1+size {
+		return nil, false
+	}
+	return b[1 : 1+size], true
+}
+
+// ReadVarint decodes a variable-length integer, it returns 0 bytes read if
+// b is too short
+func ReadVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	size := 1 << (b[0] >> 6)
+	if len(b) < size {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:size] {
+		v = v<<8 | uint64(c)
+	}
+	return v, size
+}
+
+// AppendVarint appends the shortest encoding of v
+func AppendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// InitialKeys protect the Initial packets a client sends
+type InitialKeys struct {
+	Key []byte
+	IV  []byte
+	HP  []byte
+}
+
+// ClientInitialKeys derives the keys of the Initial packets a client sends
+// to dcid
+func ClientInitialKeys(version uint32, dcid []byte) (InitialKeys, error) {
+	salt, prefix := saltV1, "quic "
+	switch version {
+	case Version1:
+	case Version2:
+		salt, prefix = saltV2, "quicv2 "
+	default:
+		return InitialKeys{}, ErrNotInitial
+	}
+	initial := hkdf.Extract(sha256.New, dcid, salt)
+	client := expandLabel(initial, "client in", sha256.Size)
+	return InitialKeys{
+		Key: expandLabel(client, prefix+"key", 16),
+		IV:  expandLabel(client, prefix+"iv", 12),
+		HP:  expandLabel(client, prefix+"hp", 16),
+	}, nil
+}
+
+// expandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context
+func expandLabel(secret []byte, label string, size int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(size>>8), byte(size), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out := make([]byte, size)
+	hkdf.Expand(sha256.New, secret, info).Read(out)
+	return out
+}
+
+// OpenInitial removes the protection of the client Initial packet b starts
+// with and returns its header and its frames, b is left untouched
+func OpenInitial(b []byte) (LongHeader, []byte, error) {
+	h, err := ParseLongHeader(b)
+	if err != nil {
+		return h, nil, err
+	}
+	if !h.Initial {
+		return h, nil, ErrNotInitial
+	}
+	keys, err := ClientInitialKeys(h.Version, h.DCID)
+	if err != nil {
+		return h, nil, err
+	}
+	hp, err := aes.NewCipher(keys.HP)
+	if err != nil {
+		return h, nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, b[h.PNOffset+maxPNSize:h.PNOffset+maxPNSize+sampleSize])
+
+	header := make([]byte, h.PNOffset+maxPNSize)
+	copy(header, b)
+	header[0] ^= mask[0] & 0x0f
+	pnSize := int(header[0]&0x03) + 1
+	header = header[:h.PNOffset+pnSize]
+	var pn uint64
+	for i := 0; i < pnSize; i++ {
+		header[h.PNOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[h.PNOffset+i])
+	}
+	aead, err := newAEAD(keys.Key)
+	if err != nil {
+		return h, nil, err
+	}
+	frames, err := aead.Open(nil, nonce(keys.IV, pn), b[len(header):h.End], header)
+	if err != nil {
+		return h, nil, ErrDecrypt
+	}
+	return h, frames, nil
+}
+
+// SealInitial builds a client Initial packet carrying frames, which tools
+// and tests use to produce what OpenInitial reads
+func SealInitial(version uint32, dcid, scid, token []byte, pn uint32, frames []byte) ([]byte, error) {
+	keys, err := ClientInitialKeys(version, dcid)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(keys.Key)
+	if err != nil {
+		return nil, err
+	}
+	packetType := byte(0)
+	if version == Version2 {
+		packetType = 1
+	}
+	b := []byte{headerFormLong | fixedBit | packetType<<4 | (maxPNSize - 1), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], version)
+	b = append(append(b, byte(len(dcid))), dcid...)
+	b = append(append(b, byte(len(scid))), scid...)
+	b = append(AppendVarint(b, uint64(len(token))), token...)
+	b = AppendVarint(b, uint64(maxPNSize+len(frames)+aead.Overhead()))
+	pnOffset := len(b)
+	b = append(b, byte(pn>>24), byte(pn>>16), byte(pn>>8), byte(pn))
+	b = aead.Seal(b, nonce(keys.IV, uint64(pn)), frames, b)
+
+	hp, err := aes.NewCipher(keys.HP)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < pnOffset+maxPNSize+sampleSize {
+		return nil, ErrInvalidPacket
+	}
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, b[pnOffset+maxPNSize:pnOffset+maxPNSize+sampleSize])
+	b[0] ^= mask[0] & 0x0f
+	for i := 0; i < maxPNSize; i++ {
+		b[pnOffset+i] ^= mask[1+i]
+	}
+	return b, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(iv []byte, pn uint64) []byte {
+	n := make([]byte, len(iv))
+	copy(n, iv)
+	for i := 0; i < 8; i++ {
+		n[len(n)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return n
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package quic_test
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+
+	. "github.com/felipejfc/udpx/quic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// clientHello returns the ClientHello crypto/tls sends for serverName
+func clientHello(serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS13}).Handshake()
+	header := make([]byte, 5)
+	_, err := io.ReadFull(server, header)
+	Expect(err).NotTo(HaveOccurred())
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	_, err = io.ReadFull(server, record)
+	Expect(err).NotTo(HaveOccurred())
+	client.Close()
+	return record
+}
+
+func cryptoFrame(offset int, data []byte) []byte {
+	frame := AppendVarint(AppendVarint([]byte{0x06}, uint64(offset)), uint64(len(data)))
+	return append(frame, data...)
+}
+
+var _ = Describe("Quic", func() {
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+
+	It("should derive the initial keys of RFC 9001 and RFC 9369", func() {
+		keys, err := ClientInitialKeys(Version1, dcid)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hex.EncodeToString(keys.Key)).To(Equal("1f369613dd76d5467730efcbe3b1a22d"))
+		Expect(hex.EncodeToString(keys.IV)).To(Equal("fa044b2f42a3fd3b46fb255c"))
+		Expect(hex.EncodeToString(keys.HP)).To(Equal("9f50449e04a0e810283a1e9933adedd2"))
+
+		keys, err = ClientInitialKeys(Version2, dcid)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hex.EncodeToString(keys.Key)).To(Equal("8b1a0bc121284290a29e0971b5cd045d"))
+		Expect(hex.EncodeToString(keys.IV)).To(Equal("91f73e2351d8fa91660e909f"))
+		Expect(hex.EncodeToString(keys.HP)).To(Equal("45b95e15235d6f45a6b19cbcb0294ba9"))
+
+		_, err = ClientInitialKeys(0xff00001d, dcid)
+		Expect(err).To(Equal(ErrNotInitial))
+	})
+
+	It("should open sealed initial packets", func() {
+		for _, version := range []uint32{Version1, Version2} {
+			frames := append([]byte{0x01}, cryptoFrame(0, []byte("hello"))...)
+			packet, err := SealInitial(version, dcid, []byte{1, 2, 3}, nil, 7, frames)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(IsLongHeader(packet)).To(BeTrue())
+
+			header, opened, err := OpenInitial(append(packet, 0, 0, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(header.Version).To(Equal(version))
+			Expect(header.DCID).To(Equal(dcid))
+			Expect(header.SCID).To(Equal([]byte{1, 2, 3}))
+			Expect(header.End).To(Equal(len(packet)))
+			Expect(opened).To(Equal(frames))
+
+			packet[len(packet)-1] ^= 1
+			_, _, err = OpenInitial(packet)
+			Expect(err).To(Equal(ErrDecrypt))
+		}
+	})
+
+	It("should read the server name of a ClientHello split across packets", func() {
+		hello := clientHello("api.example.com")
+		half := len(hello) / 2
+		first, err := SealInitial(Version1, dcid, nil, nil, 0, append([]byte{0x02, 0x00, 0x00, 0x00, 0x00}, cryptoFrame(half, hello[half:])...))
+		Expect(err).NotTo(HaveOccurred())
+		second, err := SealInitial(Version1, dcid, nil, nil, 1, cryptoFrame(0, hello[:half]))
+		Expect(err).NotTo(HaveOccurred())
+
+		stream := NewCryptoStream(16 * 1024)
+		add := func(packet []byte) (string, bool) {
+			_, frames, err := OpenInitial(packet)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(CryptoFrames(frames, stream.Add)).To(Succeed())
+			name, complete, err := ServerName(stream.Contiguous())
+			Expect(err).NotTo(HaveOccurred())
+			return name, complete
+		}
+		_, complete := add(first)
+		Expect(complete).To(BeFalse())
+		name, complete := add(second)
+		Expect(complete).To(BeTrue())
+		Expect(name).To(Equal("api.example.com"))
+	})
+
+	It("should report incomplete and malformed ClientHello messages", func() {
+		hello := clientHello("example.com")
+		_, complete, err := ServerName(hello[:len(hello)-1])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(complete).To(BeFalse())
+		_, _, err = ServerName([]byte{0x02, 0, 0, 0})
+		Expect(err).To(Equal(ErrInvalidClientHello))
+	})
+
+	It("should bound the crypto stream", func() {
+		stream := NewCryptoStream(8)
+		Expect(stream.Add(0, []byte("12345"))).To(Succeed())
+		Expect(stream.Add(5, []byte("6789"))).To(Equal(ErrCryptoTooLarge))
+	})
+
+	It("should reject unexpected frames", func() {
+		Expect(CryptoFrames([]byte{0x08, 0x00}, func(uint64, []byte) error { return nil })).To(Equal(ErrInvalidFrame))
+	})
+
+	It("should parse headers", func() {
+		packet := []byte{0x41, 1, 2, 3, 4, 5}
+		Expect(IsShortHeader(packet)).To(BeTrue())
+		cid, ok := ShortHeaderDCID(packet, 4)
+		Expect(ok).To(BeTrue())
+		Expect(cid).To(Equal([]byte{1, 2, 3, 4}))
+		_, ok = ShortHeaderDCID(packet, 8)
+		Expect(ok).To(BeFalse())
+
+		handshake := []byte{0xe0, 0, 0, 0, 1, 2, 9, 9, 1, 7}
+		header, err := ParseLongHeader(handshake)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(header.Initial).To(BeFalse())
+		Expect(header.DCID).To(Equal([]byte{9, 9}))
+		Expect(header.SCID).To(Equal([]byte{7}))
+	})
+
+	It("should round trip varints", func() {
+		for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1} {
+			decoded, n := ReadVarint(AppendVarint(nil, v))
+			Expect(n).NotTo(BeZero())
+			Expect(decoded).To(Equal(v))
+		}
+	})
+})
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package socks5
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+)
+
+// userPassVersion is the version of the username/password sub-negotiation
+const userPassVersion = 0x01
+
+var (
+	// ErrVersion is returned when a peer does not speak SOCKS 5
+	ErrVersion = errors.New("unsupported socks version")
+	// ErrNoAcceptableMethod is returned when client and server share no
+	// authentication method
+	ErrNoAcceptableMethod = errors.New("no acceptable socks5 authentication method")
+	// ErrAuthFailed is returned when the username or password is wrong
+	ErrAuthFailed = errors.New("socks5 authentication failed")
+)
+
+// Credentials checks the username and password of a client
+type Credentials func(username, password string) bool
+
+// StaticCredentials accepts the username and password pairs of users
+func StaticCredentials(users map[string]string) Credentials {
+	return func(username, password string) bool {
+		expected, found := users[username]
+		// compare anyway so that unknown users take as long as known ones
+		equal := subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+		return found && equal
+	}
+}
+
+// Request is what a client asks for on the control connection
+type Request struct {
+	Command byte
+	Addr    Addr
+}
+
+// ServerHandshake negotiates the authentication method with a client and
+// reads its request, the username/password method is required when
+// credentials is not nil. The caller answers the request with WriteReply
+func ServerHandshake(rw io.ReadWriter, credentials Credentials) (Request, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return Request{}, err
+	}
+	if header[0] != Version {
+		return Request{}, ErrVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return Request{}, err
+	}
+	method := byte(MethodNoAuth)
+	if credentials != nil {
+		method = MethodUserPass
+	}
+	if !containsMethod(methods, method) {
+		rw.Write([]byte{Version, MethodNoAcceptable})
+		return Request{}, ErrNoAcceptableMethod
+	}
+	if _, err := rw.Write([]byte{Version, method}); err != nil {
+		return Request{}, err
+	}
+	if method == MethodUserPass {
+		if err := authenticate(rw, credentials); err != nil {
+			return Request{}, err
+		}
+	}
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(rw, request); err != nil {
+		return Request{}, err
+	}
+	if request[0] != Version {
+		return Request{}, ErrVersion
+	}
+	addr, err := readAddr(rw)
+	if err != nil {
+		if err == ErrInvalidAddr {
+			WriteReply(rw, ReplyAddrNotSupported, Addr{})
+		}
+		return Request{}, err
+	}
+	return Request{Command: request[1], Addr: addr}, nil
+}
+
+func containsMethod(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate runs the username/password sub-negotiation of RFC 1929
+func authenticate(rw io.ReadWriter, credentials Credentials) error {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != userPassVersion {
+		return ErrVersion
+	}
+	username := make([]byte, buf[1])
+	if _, err := io.ReadFull(rw, username); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return err
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(rw, password); err != nil {
+		return err
+	}
+	if !credentials(string(username), string(password)) {
+		rw.Write([]byte{userPassVersion, 0x01})
+		return ErrAuthFailed
+	}
+	_, err := rw.Write([]byte{userPassVersion, 0x00})
+	return err
+}
+
+// WriteReply answers a request, bound is the address of the UDP relay for
+// UDP ASSOCIATE requests
+func WriteReply(w io.Writer, code byte, bound Addr) error {
+	_, err := w.Write(bound.Append([]byte{Version, code, 0x00}))
+	return err
+}
+
+// ClientHandshake sends a request to a server, authenticating with the
+// username and password when username is not empty, and returns the
+// address bound by the server
+func ClientHandshake(rw io.ReadWriter, username, password string, request Request) (Addr, error) {
+	method := byte(MethodNoAuth)
+	if username != "" {
+		method = MethodUserPass
+	}
+	if _, err := rw.Write([]byte{Version, 1, method}); err != nil {
+		return Addr{}, err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return Addr{}, err
+	}
+	if buf[0] != Version {
+		return Addr{}, ErrVersion
+	}
+	if buf[1] != method {
+		return Addr{}, ErrNoAcceptableMethod
+	}
+	if method == MethodUserPass {
+		b := append([]byte{userPassVersion, byte(len(username))}, username...)
+		b = append(append(b, byte(len(password))), password...)
+		if _, err := rw.Write(b); err != nil {
+			return Addr{}, err
+		}
+		if _, err := io.ReadFull(rw, buf); err != nil {
+			return Addr{}, err
+		}
+		if buf[1] != 0x00 {
+			return Addr{}, ErrAuthFailed
+		}
+	}
+	if _, err := rw.Write(request.Addr.Append([]byte{Version, request.Command, 0x00})); err != nil {
+		return Addr{}, err
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		return Addr{}, err
+	}
+	if reply[0] != Version {
+		return Addr{}, ErrVersion
+	}
+	bound, err := readAddr(rw)
+	if err != nil {
+		return Addr{}, err
+	}
+	if reply[1] != ReplySucceeded {
+		return bound, ReplyError(reply[1])
+	}
+	return bound, nil
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package socks5 implements the parts of SOCKS version 5 (RFC 1928) needed
+// to relay UDP: the method negotiation with the username/password method of
+// RFC 1929, the requests and replies of the control connection and the
+// header of relayed UDP datagrams.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Version is the protocol version of every SOCKS 5 message
+const Version = 0x05
+
+// Authentication methods
+const (
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xff
+)
+
+// Request commands
+const (
+	CommandConnect      = 0x01
+	CommandBind         = 0x02
+	CommandUDPAssociate = 0x03
+)
+
+// Address types
+const (
+	AddrTypeIPv4   = 0x01
+	AddrTypeDomain = 0x03
+	AddrTypeIPv6   = 0x04
+)
+
+// Reply codes
+const (
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyNotAllowed          = 0x02
+	ReplyCommandNotSupported = 0x07
+	ReplyAddrNotSupported    = 0x08
+)
+
+// MaxUDPHeaderSize is the size of the largest UDP header, the one carrying
+// a 255 bytes long domain name
+const MaxUDPHeaderSize = 3 + 1 + 1 + 255 + 2
+
+var (
+	// ErrInvalidDatagram is returned for UDP datagrams without a valid header
+	ErrInvalidDatagram = errors.New("invalid socks5 udp datagram")
+	// ErrFragmented is returned for fragmented UDP datagrams, which are not
+	// supported
+	ErrFragmented = errors.New("fragmented socks5 udp datagram")
+	// ErrInvalidAddr is returned for addresses of an unknown type
+	ErrInvalidAddr = errors.New("invalid socks5 address")
+)
+
+// Addr is a SOCKS address, either an IP or a domain name and a port
+type Addr struct {
+	IP   net.IP
+	Host string
+	Port int
+}
+
+// AddrFromUDP converts a UDP address
+func AddrFromUDP(addr *net.UDPAddr) Addr {
+	return Addr{IP: addr.IP, Port: addr.Port}
+}
+
+func (a Addr) String() string {
+	host := a.Host
+	if host == "" {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
+
+// Size returns the length of the encoded address
+func (a Addr) Size() int {
+	switch {
+	case a.Host != "":
+		return 1 + 1 + len(a.Host) + 2
+	case a.IP.To4() != nil:
+		return 1 + net.IPv4len + 2
+	}
+	return 1 + net.IPv6len + 2
+}
+
+// Append appends the encoded address to b, a nil IP is encoded as 0.0.0.0
+func (a Addr) Append(b []byte) []byte {
+	switch {
+	case a.Host != "":
+		b = append(b, AddrTypeDomain, byte(len(a.Host)))
+		b = append(b, a.Host...)
+	case a.IP == nil:
+		b = append(b, AddrTypeIPv4)
+		b = append(b, net.IPv4zero.To4()...)
+	case a.IP.To4() != nil:
+		b = append(b, AddrTypeIPv4)
+		b = append(b, a.IP.To4()...)
+	default:
+		b = append(b, AddrTypeIPv6)
+		b = append(b, a.IP.To16()...)
+	}
+	return append(b, byte(a.Port>>8), byte(a.Port))
+}
+
+// decodeAddr decodes the address at the start of b and returns its size
+func decodeAddr(b []byte) (Addr, int, error) {
+	if len(b) < 1 {
+		return Addr{}, 0, io.ErrUnexpectedEOF
+	}
+	var a Addr
+	n := 1
+	switch b[0] {
+	case AddrTypeIPv4:
+		if len(b) < n+net.IPv4len+2 {
+			return Addr{}, 0, io.ErrUnexpectedEOF
+		}
+		a.IP = net.IP(append([]byte(nil), b[n:n+net.IPv4len]...))
+		n += net.IPv4len
+	case AddrTypeIPv6:
+		if len(b) < n+net.IPv6len+2 {
+			return Addr{}, 0, io.ErrUnexpectedEOF
+		}
+		a.IP = net.IP(append([]byte(nil), b[n:n+net.IPv6len]...))
+		n += net.IPv6len
+	case AddrTypeDomain:
+		if len(b) < 2 || len(b) < 2+int(b[1])+2 {
+			return Addr{}, 0, io.ErrUnexpectedEOF
+		}
+		a.Host = string(b[2 : 2+b[1]])
+		n = 2 + int(b[1])
+	default:
+		return Addr{}, 0, ErrInvalidAddr
+	}
+	a.Port = int(binary.BigEndian.Uint16(b[n:]))
+	return a, n + 2, nil
+}
+
+// readAddr reads an encoded address from r
+func readAddr(r io.Reader) (Addr, error) {
+	buf := make([]byte, 1+1+255+2)
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return Addr{}, err
+	}
+	var size int
+	switch buf[0] {
+	case AddrTypeIPv4:
+		size = 1 + net.IPv4len + 2
+	case AddrTypeIPv6:
+		size = 1 + net.IPv6len + 2
+	case AddrTypeDomain:
+		size = 2 + int(buf[1]) + 2
+	default:
+		return Addr{}, ErrInvalidAddr
+	}
+	if _, err := io.ReadFull(r, buf[2:size]); err != nil {
+		return Addr{}, err
+	}
+	a, _, err := decodeAddr(buf[:size])
+	return a, err
+}
+
+// UDPHeaderSize returns the size of the UDP header carrying addr
+func UDPHeaderSize(addr Addr) int {
+	return 3 + addr.Size()
+}
+
+// AppendUDPHeader appends the header of a datagram relayed from or to addr
+func AppendUDPHeader(b []byte, addr Addr) []byte {
+	return addr.Append(append(b, 0, 0, 0))
+}
+
+// DecodeUDP splits a relayed datagram into the address in its header and
+// its payload
+func DecodeUDP(b []byte) (Addr, []byte, error) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 {
+		return Addr{}, nil, ErrInvalidDatagram
+	}
+	if b[2] != 0 {
+		return Addr{}, nil, ErrFragmented
+	}
+	addr, n, err := decodeAddr(b[3:])
+	if err != nil {
+		return Addr{}, nil, ErrInvalidDatagram
+	}
+	return addr, b[3+n:], nil
+}
+
+// ReplyError is returned by ClientHandshake when the server refuses a
+// request
+type ReplyError byte
+
+func (e ReplyError) Error() string {
+	return fmt.Sprintf("socks5 request failed with reply %d", byte(e))
+}
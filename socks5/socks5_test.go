@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package socks5_test
+
+import (
+	"net"
+
+	. "github.com/felipejfc/udpx/socks5"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Socks5", func() {
+	handshake := func(credentials Credentials, username, password string, request Request) (Request, error, Addr, error) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		type result struct {
+			request Request
+			err     error
+		}
+		done := make(chan result, 1)
+		go func() {
+			r, err := ServerHandshake(server, credentials)
+			if err == nil {
+				err = WriteReply(server, ReplySucceeded, Addr{IP: net.ParseIP("192.0.2.1"), Port: 1080})
+			}
+			server.Close()
+			done <- result{r, err}
+		}()
+		bound, clientErr := ClientHandshake(client, username, password, request)
+		r := <-done
+		return r.request, r.err, bound, clientErr
+	}
+
+	It("should negotiate an udp associate request without authentication", func() {
+		request := Request{Command: CommandUDPAssociate, Addr: Addr{IP: net.IPv4zero, Port: 0}}
+		received, err, bound, clientErr := handshake(nil, "", "", request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clientErr).NotTo(HaveOccurred())
+		Expect(received.Command).To(Equal(byte(CommandUDPAssociate)))
+		Expect(received.Addr.String()).To(Equal("0.0.0.0:0"))
+		Expect(bound.String()).To(Equal("192.0.2.1:1080"))
+	})
+
+	It("should authenticate with a username and password", func() {
+		credentials := StaticCredentials(map[string]string{"user": "secret"})
+		request := Request{Command: CommandUDPAssociate, Addr: Addr{Host: "example.com", Port: 53}}
+		received, err, _, clientErr := handshake(credentials, "user", "secret", request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clientErr).NotTo(HaveOccurred())
+		Expect(received.Addr.String()).To(Equal("example.com:53"))
+
+		_, err, _, clientErr = handshake(credentials, "user", "wrong", request)
+		Expect(err).To(Equal(ErrAuthFailed))
+		Expect(clientErr).To(Equal(ErrAuthFailed))
+
+		_, err, _, clientErr = handshake(credentials, "", "", request)
+		Expect(err).To(Equal(ErrNoAcceptableMethod))
+		Expect(clientErr).To(Equal(ErrNoAcceptableMethod))
+	})
+
+	It("should encode and decode udp headers", func() {
+		for _, addr := range []Addr{
+			{IP: net.ParseIP("192.0.2.1").To4(), Port: 53},
+			{IP: net.ParseIP("2001:db8::1"), Port: 5353},
+			{Host: "example.com", Port: 443},
+		} {
+			b := AppendUDPHeader(nil, addr)
+			Expect(b).To(HaveLen(UDPHeaderSize(addr)))
+			decoded, payload, err := DecodeUDP(append(b, "hello"...))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.String()).To(Equal(addr.String()))
+			Expect(string(payload)).To(Equal("hello"))
+		}
+	})
+
+	It("should reject fragmented and invalid udp datagrams", func() {
+		b := AppendUDPHeader(nil, Addr{IP: net.ParseIP("192.0.2.1"), Port: 53})
+		b[2] = 1
+		_, _, err := DecodeUDP(b)
+		Expect(err).To(Equal(ErrFragmented))
+		_, _, err = DecodeUDP([]byte{0, 0, 0, 0x09, 1, 2})
+		Expect(err).To(Equal(ErrInvalidDatagram))
+		_, _, err = DecodeUDP([]byte{0, 0, 0, AddrTypeIPv4, 1, 2})
+		Expect(err).To(Equal(ErrInvalidDatagram))
+	})
+})
@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package stream
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/felipejfc/udpx/expiry"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// DefaultMaxSessions is how many streams a server serves at once when
+// MaxSessions is not set
+const DefaultMaxSessions = 10000
+
+type session struct {
+	conn         Conn
+	udp          *net.UDPConn
+	mutex        sync.Mutex
+	lastActivity time.Time
+	closed       bool
+	closeOnce    sync.Once
+}
+
+func (s *session) touch() {
+	s.mutex.Lock()
+	s.lastActivity = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *session) lastActive() (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastActivity, s.closed
+}
+
+// Server accepts streams from udpx proxies running with a stream upstream
+// mode, or from any other client of this package, and forwards the datagrams
+// of each stream through its own socket to the upstream
+type Server struct {
+	Logger      *zap.Logger
+	BindAddress string
+	BindPort    int
+	// Transport is TransportTCP or TransportWebSocket
+	Transport string
+	// WebSocketPath is the URL path WebSocket connections are accepted on
+	WebSocketPath   string
+	UpstreamAddress string
+	UpstreamPort    int
+	BufferSize      int
+	SessionTimeout  time.Duration
+	// MaxSessions is how many streams are served at once, further streams
+	// are closed right away, it defaults to DefaultMaxSessions
+	MaxSessions int
+	listener    net.Listener
+	httpServer  *http.Server
+	sessions    sync.Map
+	slots       chan struct{}
+	expiryWheel *expiry.Wheel
+	done        chan struct{}
+	startOnce   sync.Once
+	closeOnce   sync.Once
+}
+
+// NewServer creates a stream server, call Start to begin serving or serve
+// streams accepted elsewhere with Serve or WebSocketHandler
+func NewServer(logger *zap.Logger, bindAddress string, bindPort int, transport string, upstreamAddress string, upstreamPort int, bufferSize int, sessionTimeout time.Duration) *Server {
+	return &Server{
+		Logger:          logger,
+		BindAddress:     bindAddress,
+		BindPort:        bindPort,
+		Transport:       transport,
+		WebSocketPath:   "/",
+		UpstreamAddress: upstreamAddress,
+		UpstreamPort:    upstreamPort,
+		BufferSize:      bufferSize,
+		SessionTimeout:  sessionTimeout,
+		done:            make(chan struct{}),
+	}
+}
+
+// Start binds the server port and starts accepting streams
+func (s *Server) Start() error {
+	if s.Transport != TransportTCP && s.Transport != TransportWebSocket {
+		return fmt.Errorf("invalid stream transport %q", s.Transport)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.BindAddress, s.BindPort))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.init()
+	if s.Transport == TransportWebSocket {
+		mux := http.NewServeMux()
+		mux.Handle(s.WebSocketPath, s.WebSocketHandler())
+		s.httpServer = &http.Server{Handler: mux}
+		go s.httpServer.Serve(listener)
+	} else {
+		go s.acceptLoop()
+	}
+	s.Logger.Info("stream server started!", zap.String("transport", s.Transport))
+	return nil
+}
+
+// init sets up the session slots and expiry, it runs once whether the server
+// is started or only serves streams accepted elsewhere
+func (s *Server) init() {
+	s.startOnce.Do(func() {
+		maxSessions := s.MaxSessions
+		if maxSessions <= 0 {
+			maxSessions = DefaultMaxSessions
+		}
+		s.slots = make(chan struct{}, maxSessions)
+		if s.SessionTimeout > 0 {
+			s.expiryWheel = expiry.NewWheel(expiry.TickFor(s.SessionTimeout), s.expireSession)
+			go s.expiryWheel.Run(s.done)
+		}
+	})
+}
+
+// Addr returns the address the server is bound to
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server and closes every session
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.httpServer != nil {
+			s.httpServer.Close()
+		} else if s.listener != nil {
+			s.listener.Close()
+		}
+		s.sessions.Range(func(k, v interface{}) bool {
+			s.closeSession(k.(*session))
+			return true
+		})
+	})
+}
+
+func (s *Server) closing() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) acceptLoop() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			if s.closing() {
+				return
+			}
+			s.Logger.Error("stream server accept error", zap.Error(err))
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go s.Serve(NewTCPConn(c))
+	}
+}
+
+// WebSocketHandler accepts WebSocket connections and serves them, it can be
+// mounted on any HTTP server. The origin of the connections is not checked
+func (s *Server) WebSocketHandler() http.Handler {
+	return websocket.Server{Handler: func(ws *websocket.Conn) {
+		s.Serve(NewWebSocketConn(ws))
+	}}
+}
+
+// Serve forwards the datagrams of conn to the upstream through a new socket
+// and the replies back, it returns when either side closes or the session
+// is idle for longer than SessionTimeout
+func (s *Server) Serve(conn Conn) {
+	s.init()
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.Logger.Warn("too many streams, closing", zap.String("peer", conn.RemoteAddr().String()))
+		conn.Close()
+		return
+	}
+	upstream, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", s.UpstreamAddress, s.UpstreamPort))
+	if err != nil {
+		s.Logger.Error("failed to resolve upstream", zap.Error(err))
+		conn.Close()
+		<-s.slots
+		return
+	}
+	udp, err := net.DialUDP("udp", nil, upstream)
+	if err != nil {
+		s.Logger.Error("failed to open session socket", zap.Error(err))
+		conn.Close()
+		<-s.slots
+		return
+	}
+	ss := &session{conn: conn, udp: udp, lastActivity: time.Now()}
+	s.sessions.Store(ss, struct{}{})
+	if s.expiryWheel != nil {
+		s.expiryWheel.Schedule(ss, ss.lastActivity.Add(s.SessionTimeout))
+	}
+	if s.closing() {
+		s.closeSession(ss)
+		return
+	}
+	s.Logger.Debug("new stream session", zap.String("peer", conn.RemoteAddr().String()), zap.String("local address", udp.LocalAddr().String()))
+	go s.upstreamReadLoop(ss)
+	buf := make([]byte, s.BufferSize)
+	for {
+		n, truncated, err := conn.ReadDatagram(buf)
+		if err != nil {
+			s.closeSession(ss)
+			return
+		}
+		ss.touch()
+		if truncated {
+			s.Logger.Debug("dropping datagram larger than buffer size", zap.String("peer", conn.RemoteAddr().String()))
+			continue
+		}
+		if _, err := udp.Write(buf[:n]); err != nil {
+			s.Logger.Debug("failed to write to upstream", zap.Error(err))
+		}
+	}
+}
+
+func (s *Server) upstreamReadLoop(ss *session) {
+	buf := make([]byte, s.BufferSize)
+	for {
+		n, err := ss.udp.Read(buf)
+		if err != nil {
+			s.closeSession(ss)
+			return
+		}
+		ss.touch()
+		if err := ss.conn.WriteDatagram(buf[:n]); err != nil {
+			s.closeSession(ss)
+			return
+		}
+	}
+}
+
+func (s *Server) closeSession(ss *session) {
+	ss.closeOnce.Do(func() {
+		ss.mutex.Lock()
+		ss.closed = true
+		ss.mutex.Unlock()
+		ss.conn.Close()
+		ss.udp.Close()
+		s.sessions.Delete(ss)
+		<-s.slots
+	})
+}
+
+// expireSession is fired by the expiry wheel when a session may have timed
+// out, sessions that saw activity since are scheduled again
+func (s *Server) expireSession(expired interface{}) {
+	ss := expired.(*session)
+	lastActivity, closed := ss.lastActive()
+	if closed {
+		return
+	}
+	if deadline := lastActivity.Add(s.SessionTimeout); time.Now().Before(deadline) {
+		s.expiryWheel.Schedule(ss, deadline)
+		return
+	}
+	s.Logger.Debug("stream session timeout", zap.String("peer", ss.conn.RemoteAddr().String()))
+	s.closeSession(ss)
+}
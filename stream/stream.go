@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package stream carries UDP datagrams over TCP and WebSocket connections,
+// for networks that block UDP. Over TCP every datagram is sent as a frame
+// prefixed with its 2 byte big endian length, over WebSocket every datagram
+// is sent as a binary message.
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// HeaderSize is the size of the length prefix of TCP frames
+	HeaderSize = 2
+	// MaxDatagramSize is the largest datagram a frame can carry
+	MaxDatagramSize = 0xffff
+)
+
+// Transports a stream can use
+const (
+	TransportTCP       = "tcp"
+	TransportWebSocket = "websocket"
+)
+
+// ErrDatagramTooLarge is returned when writing a datagram that does not fit
+// in a frame
+var ErrDatagramTooLarge = errors.New("datagram too large for a stream frame")
+
+// Conn carries datagrams over a stream, a datagram can be written while
+// another one is read but concurrent writes must be serialized by the caller
+// unless the transport does it, which both transports of this package do
+type Conn interface {
+	// ReadDatagram reads the next datagram into buf, datagrams larger than
+	// buf are truncated and reported as such
+	ReadDatagram(buf []byte) (n int, truncated bool, err error)
+	WriteDatagram(datagram []byte) error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// AppendFrame appends the TCP frame of a datagram to dst
+func AppendFrame(dst, datagram []byte) ([]byte, error) {
+	if len(datagram) > MaxDatagramSize {
+		return dst, ErrDatagramTooLarge
+	}
+	dst = append(dst, byte(len(datagram)>>8), byte(len(datagram)))
+	return append(dst, datagram...), nil
+}
+
+// ReadFrame reads a TCP frame into buf, the part of a datagram that does
+// not fit in buf is discarded
+func ReadFrame(r io.Reader, buf []byte) (int, bool, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, false, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	n := size
+	if n > len(buf) {
+		n = len(buf)
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, false, unexpectedEOF(err)
+	}
+	if n < size {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size-n)); err != nil {
+			return 0, false, unexpectedEOF(err)
+		}
+		return n, true, nil
+	}
+	return n, false, nil
+}
+
+// unexpectedEOF reports a stream that ended in the middle of a frame
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+type tcpConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// NewTCPConn carries datagrams over c as length prefixed frames
+func NewTCPConn(c net.Conn) Conn {
+	return &tcpConn{Conn: c, reader: bufio.NewReader(c)}
+}
+
+func (c *tcpConn) ReadDatagram(buf []byte) (int, bool, error) {
+	return ReadFrame(c.reader, buf)
+}
+
+func (c *tcpConn) WriteDatagram(datagram []byte) error {
+	frame, err := AppendFrame(make([]byte, 0, HeaderSize+len(datagram)), datagram)
+	if err != nil {
+		return err
+	}
+	// a single write keeps concurrent frames from interleaving
+	_, err = c.Write(frame)
+	return err
+}
+
+type webSocketConn struct {
+	ws     *websocket.Conn
+	remote net.Addr
+}
+
+// NewWebSocketConn carries datagrams over ws as binary messages
+func NewWebSocketConn(ws *websocket.Conn) Conn {
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = MaxDatagramSize
+	c := &webSocketConn{ws: ws, remote: ws.RemoteAddr()}
+	// on the server side the remote address of a websocket.Conn is the
+	// origin of the client, which may be missing
+	if r := ws.Request(); r != nil {
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			c.remote = addr
+		}
+	}
+	return c
+}
+
+func (c *webSocketConn) ReadDatagram(buf []byte) (int, bool, error) {
+	var message []byte
+	if err := websocket.Message.Receive(c.ws, &message); err != nil {
+		if err == websocket.ErrFrameTooLarge {
+			// the rest of the message is discarded by the next read
+			return 0, true, nil
+		}
+		return 0, false, err
+	}
+	n := copy(buf, message)
+	return n, n < len(message), nil
+}
+
+func (c *webSocketConn) WriteDatagram(datagram []byte) error {
+	if len(datagram) > MaxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+	return websocket.Message.Send(c.ws, datagram)
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *webSocketConn) RemoteAddr() net.Addr { return c.remote }
+func (c *webSocketConn) Close() error         { return c.ws.Close() }
+
+// Dial opens a stream to address, path is the URL path of WebSocket
+// connections. Canceling ctx aborts the dial and the WebSocket handshake
+func Dial(ctx context.Context, transport, address, path string) (Conn, error) {
+	var dialer net.Dialer
+	switch transport {
+	case TransportTCP:
+		c, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return NewTCPConn(c), nil
+	case TransportWebSocket:
+		if path == "" {
+			path = "/"
+		}
+		config, err := websocket.NewConfig(fmt.Sprintf("ws://%s%s", address, path), fmt.Sprintf("http://%s", address))
+		if err != nil {
+			return nil, err
+		}
+		c, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		// the handshake does not take a context, cancellation is turned into
+		// an expired deadline on the connection
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				c.SetDeadline(time.Now())
+			case <-stop:
+			}
+		}()
+		ws, err := websocket.NewClient(config, c)
+		close(stop)
+		<-stopped
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return NewWebSocketConn(ws), nil
+	}
+	return nil, fmt.Errorf("invalid stream transport %q", transport)
+}
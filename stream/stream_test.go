@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package stream_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	. "github.com/felipejfc/udpx/stream"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stream", func() {
+	It("should frame datagrams and truncate the ones larger than the buffer", func() {
+		var b []byte
+		b, err := AppendFrame(b, []byte("hello"))
+		Expect(err).NotTo(HaveOccurred())
+		b, err = AppendFrame(b, []byte("a longer datagram"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = AppendFrame(nil, make([]byte, MaxDatagramSize+1))
+		Expect(err).To(Equal(ErrDatagramTooLarge))
+
+		r := bytes.NewReader(b)
+		buf := make([]byte, 8)
+		n, truncated, err := ReadFrame(r, buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(truncated).To(BeFalse())
+		Expect(string(buf[:n])).To(Equal("hello"))
+		n, truncated, err = ReadFrame(r, buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(truncated).To(BeTrue())
+		Expect(string(buf[:n])).To(Equal("a longer"))
+		Expect(r.Len()).To(BeZero())
+	})
+
+	Describe("Server", func() {
+		var upstream *net.UDPConn
+
+		BeforeEach(func() {
+			var err error
+			upstream, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			Expect(err).NotTo(HaveOccurred())
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, addr, err := upstream.ReadFromUDP(buf)
+					if err != nil {
+						return
+					}
+					upstream.WriteToUDP(append([]byte("echo "), buf[:n]...), addr)
+				}
+			}()
+		})
+
+		AfterEach(func() {
+			upstream.Close()
+		})
+
+		for _, transport := range []string{TransportTCP, TransportWebSocket} {
+			transport := transport
+			It("should forward the datagrams of "+transport+" streams", func() {
+				port := upstream.LocalAddr().(*net.UDPAddr).Port
+				server := NewServer(zap.NewNop(), "127.0.0.1", 0, transport, "127.0.0.1", port, 1024, 200*time.Millisecond)
+				server.WebSocketPath = "/udp"
+				Expect(server.Start()).To(Succeed())
+				defer server.Close()
+
+				conn, err := Dial(context.Background(), transport, server.Addr().String(), "/udp")
+				Expect(err).NotTo(HaveOccurred())
+				defer conn.Close()
+				Expect(conn.WriteDatagram([]byte("ping"))).To(Succeed())
+				buf := make([]byte, 64)
+				n, _, err := conn.ReadDatagram(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(buf[:n])).To(Equal("echo ping"))
+
+				// idle sessions are closed
+				_, _, err = conn.ReadDatagram(buf)
+				Expect(err).To(HaveOccurred())
+			})
+		}
+
+		It("should close streams beyond the session limit", func() {
+			port := upstream.LocalAddr().(*net.UDPAddr).Port
+			server := NewServer(zap.NewNop(), "127.0.0.1", 0, TransportTCP, "127.0.0.1", port, 1024, time.Second)
+			server.MaxSessions = 1
+			Expect(server.Start()).To(Succeed())
+			defer server.Close()
+
+			first, err := Dial(context.Background(), TransportTCP, server.Addr().String(), "")
+			Expect(err).NotTo(HaveOccurred())
+			defer first.Close()
+			Expect(first.WriteDatagram([]byte("ping"))).To(Succeed())
+			buf := make([]byte, 64)
+			_, _, err = first.ReadDatagram(buf)
+			Expect(err).NotTo(HaveOccurred())
+
+			second, err := Dial(context.Background(), TransportTCP, server.Addr().String(), "")
+			Expect(err).NotTo(HaveOccurred())
+			defer second.Close()
+			_, _, err = second.ReadDatagram(buf)
+			Expect(err).To(HaveOccurred())
+
+			// the slot is given back when a stream ends
+			first.Close()
+			Eventually(func() error {
+				third, err := Dial(context.Background(), TransportTCP, server.Addr().String(), "")
+				if err != nil {
+					return err
+				}
+				defer third.Close()
+				if err := third.WriteDatagram([]byte("ping")); err != nil {
+					return err
+				}
+				_, _, err = third.ReadDatagram(buf)
+				return err
+			}).Should(Succeed())
+		})
+	})
+})
@@ -0,0 +1,376 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package tunnel encrypts and authenticates the datagrams exchanged by a
+// udpx tunnel entry and exit, with ChaCha20-Poly1305 or AES-256-GCM keys
+// derived per session from pre-shared secrets, and rejects replays with a
+// sliding window and a timestamp.
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Supported ciphers
+const (
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+	CipherAES256GCM        = "aes-256-gcm"
+)
+
+const (
+	// SaltSize is the length of the random salt identifying a sender
+	SaltSize = 16
+	// HeaderSize is the length of the header in front of the ciphertext
+	HeaderSize = 1 + SaltSize + 8 + 8
+	// Overhead is how many bytes sealing adds to a datagram
+	Overhead = HeaderSize + 16
+
+	// DefaultReplayWindow is the number of sequence numbers tracked behind
+	// the highest one received when no window is configured
+	DefaultReplayWindow = 1024
+	// DefaultMaxAge is how far the timestamp of a datagram may be from the
+	// time it is opened when no maximum age is configured
+	DefaultMaxAge = 30 * time.Second
+)
+
+// Direction tells the two directions of a tunnel apart, keys are derived
+// per direction so that both ends can use the same secrets
+type Direction byte
+
+const (
+	// Forward is the direction from the tunnel entry to the tunnel exit
+	Forward Direction = 0
+	// Reverse is the direction from the tunnel exit to the tunnel entry
+	Reverse Direction = 1
+)
+
+// Errors returned when a datagram cannot be opened
+var (
+	ErrShortDatagram = errors.New("datagram shorter than tunnel overhead")
+	ErrUnknownKey    = errors.New("datagram sealed with an unknown key")
+	ErrOpen          = errors.New("datagram failed authentication")
+	ErrReplayed      = errors.New("datagram replayed or too old")
+)
+
+type receiverKey struct {
+	keyID     uint8
+	direction Direction
+	salt      [SaltSize]byte
+}
+
+type receiver struct {
+	lastSeen int64
+	aead     cipher.AEAD
+	mutex    sync.Mutex
+	window   *replayWindow
+}
+
+// Codec seals and opens tunnel datagrams, it is safe for concurrent use.
+//
+// A datagram is laid out as
+//
+//	+--------+------------+--------------------+-------------------+--------------------+
+//	| key id | salt (16B) | timestamp (8B, BE) | sequence (8B, BE) | ciphertext and tag |
+//	+--------+------------+--------------------+-------------------+--------------------+
+//
+// Every sender picks a random salt and numbers its datagrams from 1, the
+// key of a sender is HMAC-SHA256(secret, direction | salt) so nonces, the
+// sequence number padded to 12 bytes, are never reused under the same key.
+// The header is authenticated as additional data. The timestamp, in unix
+// seconds, has to be within the maximum age of the time a datagram is
+// opened, so datagrams captured before the replay window of their sender
+// expired are still rejected.
+type Codec struct {
+	cipher       string
+	replayWindow int
+	maxAge       time.Duration
+	mutex        sync.RWMutex
+	secrets      map[uint8][]byte
+	active       uint8
+	receivers    map[receiverKey]*receiver
+}
+
+// NewCodec creates a codec for cipherName, a zero replayWindow uses
+// DefaultReplayWindow and a zero maxAge DefaultMaxAge
+func NewCodec(cipherName string, replayWindow int, maxAge time.Duration) (*Codec, error) {
+	if err := ValidateCipher(cipherName); err != nil {
+		return nil, err
+	}
+	if cipherName == "" {
+		cipherName = CipherChaCha20Poly1305
+	}
+	if replayWindow <= 0 {
+		replayWindow = DefaultReplayWindow
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	return &Codec{
+		cipher:       cipherName,
+		replayWindow: replayWindow,
+		maxAge:       maxAge,
+		secrets:      make(map[uint8][]byte),
+		receivers:    make(map[receiverKey]*receiver),
+	}, nil
+}
+
+// ValidateCipher checks a cipher name, empty selects ChaCha20-Poly1305
+func ValidateCipher(cipherName string) error {
+	switch cipherName {
+	case "", CipherChaCha20Poly1305, CipherAES256GCM:
+		return nil
+	}
+	return fmt.Errorf("invalid tunnel cipher %q", cipherName)
+}
+
+// AddKey adds or replaces a secret, datagrams sealed with it are accepted
+// right away but it is only used to seal once it is made active
+func (c *Codec) AddKey(id uint8, secret []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.secrets[id] = append([]byte(nil), secret...)
+	c.dropReceivers(id)
+}
+
+// RemoveKey forgets a secret, the active key cannot be removed
+func (c *Codec) RemoveKey(id uint8) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, found := c.secrets[id]; !found {
+		return ErrUnknownKey
+	}
+	if id == c.active {
+		return errors.New("the active tunnel key cannot be removed")
+	}
+	delete(c.secrets, id)
+	c.dropReceivers(id)
+	return nil
+}
+
+func (c *Codec) dropReceivers(id uint8) {
+	for k := range c.receivers {
+		if k.keyID == id {
+			delete(c.receivers, k)
+		}
+	}
+}
+
+// SetActiveKey selects the key new datagrams are sealed with
+func (c *Codec) SetActiveKey(id uint8) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, found := c.secrets[id]; !found {
+		return ErrUnknownKey
+	}
+	c.active = id
+	return nil
+}
+
+// ActiveKey returns the id of the key new datagrams are sealed with
+func (c *Codec) ActiveKey() uint8 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.active
+}
+
+// Keys returns the ids of the keys sorted
+func (c *Codec) Keys() []uint8 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	ids := []uint8{}
+	for id := range c.secrets {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func (c *Codec) newAEAD(secret []byte, direction Direction, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte{byte(direction)})
+	mac.Write(salt)
+	key := mac.Sum(nil)
+	if c.cipher == CipherAES256GCM {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return chacha20poly1305.New(key)
+}
+
+func nonce(seq uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
+
+// Sender seals the datagrams of one side of a session
+type Sender struct {
+	seq       uint64
+	codec     *Codec
+	direction Direction
+	salt      [SaltSize]byte
+	mutex     sync.Mutex
+	keyID     uint8
+	aead      cipher.AEAD
+}
+
+// NewSender creates a sender with a random salt
+func (c *Codec) NewSender(direction Direction) (*Sender, error) {
+	s := &Sender{codec: c, direction: direction}
+	if _, err := rand.Read(s.salt[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// aeadFor returns the cipher of the active key, deriving it again after the
+// active key changed
+func (s *Sender) aeadFor() (uint8, cipher.AEAD, error) {
+	s.codec.mutex.RLock()
+	id := s.codec.active
+	secret, found := s.codec.secrets[id]
+	s.codec.mutex.RUnlock()
+	if !found {
+		return 0, nil, ErrUnknownKey
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.aead == nil || s.keyID != id {
+		aead, err := s.codec.newAEAD(secret, s.direction, s.salt[:])
+		if err != nil {
+			return 0, nil, err
+		}
+		s.keyID, s.aead = id, aead
+	}
+	return s.keyID, s.aead, nil
+}
+
+// Seal appends the payload sealed at now to dst
+func (s *Sender) Seal(dst, payload []byte, now time.Time) ([]byte, error) {
+	id, aead, err := s.aeadFor()
+	if err != nil {
+		return nil, err
+	}
+	seq := atomic.AddUint64(&s.seq, 1)
+	start := len(dst)
+	dst = append(dst, id)
+	dst = append(dst, s.salt[:]...)
+	dst = append(dst, make([]byte, 16)...)
+	binary.BigEndian.PutUint64(dst[start+1+SaltSize:], uint64(now.Unix()))
+	binary.BigEndian.PutUint64(dst[start+1+SaltSize+8:], seq)
+	header := dst[start : start+HeaderSize]
+	return aead.Seal(dst, nonce(seq), payload, header), nil
+}
+
+// Open authenticates and decrypts a datagram sealed in direction, the
+// plaintext overwrites b
+func (c *Codec) Open(direction Direction, b []byte, now time.Time) ([]byte, error) {
+	if len(b) < Overhead {
+		return nil, ErrShortDatagram
+	}
+	key := receiverKey{keyID: b[0], direction: direction}
+	copy(key.salt[:], b[1:1+SaltSize])
+	sealedAt := time.Unix(int64(binary.BigEndian.Uint64(b[1+SaltSize:])), 0)
+	seq := binary.BigEndian.Uint64(b[1+SaltSize+8 : HeaderSize])
+	if age := now.Sub(sealedAt); age > c.maxAge || age < -c.maxAge {
+		return nil, ErrReplayed
+	}
+
+	c.mutex.RLock()
+	r, found := c.receivers[key]
+	secret, known := c.secrets[key.keyID]
+	c.mutex.RUnlock()
+	if !known {
+		return nil, ErrUnknownKey
+	}
+	if !found {
+		aead, err := c.newAEAD(secret, direction, key.salt[:])
+		if err != nil {
+			return nil, err
+		}
+		r = &receiver{aead: aead, window: newReplayWindow(c.replayWindow)}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.window.check(seq) {
+		return nil, ErrReplayed
+	}
+	plaintext, err := r.aead.Open(b[HeaderSize:HeaderSize], nonce(seq), b[HeaderSize:], b[:HeaderSize])
+	if err != nil {
+		return nil, ErrOpen
+	}
+	r.window.accept(seq)
+	atomic.StoreInt64(&r.lastSeen, now.UnixNano())
+	if !found {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if existing, raced := c.receivers[key]; raced {
+			// another datagram of the sender got here first, keep its window
+			existing.mutex.Lock()
+			defer existing.mutex.Unlock()
+			if !existing.window.check(seq) {
+				return nil, ErrReplayed
+			}
+			existing.window.accept(seq)
+		} else if _, known := c.secrets[key.keyID]; known {
+			c.receivers[key] = r
+		}
+	}
+	return plaintext, nil
+}
+
+// MaxAge is how far the timestamp of a datagram may be from the time it is
+// opened
+func (c *Codec) MaxAge() time.Duration {
+	return c.maxAge
+}
+
+// Expire forgets the senders that were not heard from for twice the maximum
+// age, by then every datagram they sealed before is too old to be replayed
+func (c *Codec) Expire(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k, r := range c.receivers {
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&r.lastSeen))) > 2*c.maxAge {
+			delete(c.receivers, k)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package tunnel
+
+// replayWindow remembers which of the last size sequence numbers were
+// received, like the anti-replay window of IPsec
+type replayWindow struct {
+	size    uint64
+	highest uint64
+	bitmap  []uint64
+}
+
+func newReplayWindow(size int) *replayWindow {
+	words := (size + 63) / 64
+	return &replayWindow{size: uint64(words * 64), bitmap: make([]uint64, words)}
+}
+
+func (w *replayWindow) bit(seq uint64) (int, uint64) {
+	i := seq % w.size
+	return int(i / 64), 1 << (i % 64)
+}
+
+// check reports whether seq was not received yet and is recent enough
+func (w *replayWindow) check(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > w.highest {
+		return true
+	}
+	if w.highest-seq >= w.size {
+		return false
+	}
+	word, mask := w.bit(seq)
+	return w.bitmap[word]&mask == 0
+}
+
+// accept records seq, which has to pass check first
+func (w *replayWindow) accept(seq uint64) {
+	if seq > w.highest {
+		if seq-w.highest >= w.size {
+			for i := range w.bitmap {
+				w.bitmap[i] = 0
+			}
+		} else {
+			for s := w.highest + 1; s < seq; s++ {
+				word, mask := w.bit(s)
+				w.bitmap[word] &^= mask
+			}
+		}
+		w.highest = seq
+	}
+	word, mask := w.bit(seq)
+	w.bitmap[word] |= mask
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package tunnel_test
+
+import (
+	"time"
+
+	. "github.com/felipejfc/udpx/tunnel"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Codec", func() {
+	newCodec := func(cipherName string) *Codec {
+		c, err := NewCodec(cipherName, 64, 0)
+		Expect(err).NotTo(HaveOccurred())
+		c.AddKey(1, []byte("secret"))
+		Expect(c.SetActiveKey(1)).To(Succeed())
+		return c
+	}
+
+	It("should seal and open with both ciphers", func() {
+		for _, cipherName := range []string{CipherChaCha20Poly1305, CipherAES256GCM} {
+			entry, exit := newCodec(cipherName), newCodec(cipherName)
+			sender, err := entry.NewSender(Forward)
+			Expect(err).NotTo(HaveOccurred())
+			sealed, err := sender.Seal(nil, []byte("hello"), time.Now())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sealed).To(HaveLen(Overhead + 5))
+
+			plaintext, err := exit.Open(Forward, sealed, time.Now())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(plaintext)).To(Equal("hello"))
+		}
+	})
+
+	It("should reject tampered, replayed and misdirected datagrams", func() {
+		entry, exit := newCodec(""), newCodec("")
+		sender, _ := entry.NewSender(Forward)
+		sealed, _ := sender.Seal(nil, []byte("hello"), time.Now())
+		replay := append([]byte(nil), sealed...)
+		misdirected := append([]byte(nil), sealed...)
+		tampered := append([]byte(nil), sealed...)
+		tampered[len(tampered)-1] ^= 1
+
+		_, err := exit.Open(Forward, tampered, time.Now())
+		Expect(err).To(Equal(ErrOpen))
+		_, err = exit.Open(Forward, sealed, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		_, err = exit.Open(Forward, replay, time.Now())
+		Expect(err).To(Equal(ErrReplayed))
+		_, err = exit.Open(Reverse, misdirected, time.Now())
+		Expect(err).To(Equal(ErrOpen))
+	})
+
+	It("should accept reordered datagrams within the replay window", func() {
+		entry, exit := newCodec(""), newCodec("")
+		sender, _ := entry.NewSender(Forward)
+		var sealed [][]byte
+		for i := 0; i < 100; i++ {
+			b, _ := sender.Seal(nil, []byte("hello"), time.Now())
+			sealed = append(sealed, b)
+		}
+		_, err := exit.Open(Forward, sealed[99], time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		_, err = exit.Open(Forward, sealed[50], time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		_, err = exit.Open(Forward, sealed[10], time.Now())
+		Expect(err).To(Equal(ErrReplayed))
+	})
+
+	It("should reject datagrams sealed too long ago or in the future", func() {
+		entry, exit := newCodec(""), newCodec("")
+		sender, _ := entry.NewSender(Forward)
+		now := time.Now()
+		old, _ := sender.Seal(nil, []byte("hello"), now.Add(-time.Minute))
+		_, err := exit.Open(Forward, old, now)
+		Expect(err).To(Equal(ErrReplayed))
+		future, _ := sender.Seal(nil, []byte("hello"), now.Add(time.Minute))
+		_, err = exit.Open(Forward, future, now)
+		Expect(err).To(Equal(ErrReplayed))
+	})
+
+	It("should reject replays after the sender expired", func() {
+		entry, exit := newCodec(""), newCodec("")
+		sender, _ := entry.NewSender(Forward)
+		now := time.Now()
+		sealed, _ := sender.Seal(nil, []byte("hello"), now)
+		replay := append([]byte(nil), sealed...)
+		_, err := exit.Open(Forward, sealed, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		later := now.Add(2*DefaultMaxAge + time.Second)
+		exit.Expire(later)
+		_, err = exit.Open(Forward, replay, later)
+		Expect(err).To(Equal(ErrReplayed))
+	})
+
+	It("should rotate keys", func() {
+		entry, exit := newCodec(""), newCodec("")
+		sender, _ := entry.NewSender(Forward)
+		entry.AddKey(2, []byte("rotated"))
+		Expect(entry.SetActiveKey(2)).To(Succeed())
+		sealed, _ := sender.Seal(nil, []byte("hello"), time.Now())
+		_, err := exit.Open(Forward, sealed, time.Now())
+		Expect(err).To(Equal(ErrUnknownKey))
+
+		exit.AddKey(2, []byte("rotated"))
+		sealed, _ = sender.Seal(nil, []byte("hello"), time.Now())
+		_, err = exit.Open(Forward, sealed, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.RemoveKey(2)).NotTo(Succeed())
+		Expect(entry.RemoveKey(1)).To(Succeed())
+		Expect(entry.Keys()).To(Equal([]uint8{2}))
+	})
+})
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package turn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// ChannelDataHeaderSize is the size of the ChannelData header
+	ChannelDataHeaderSize = 4
+	// MinChannel and MaxChannel bound the channel numbers clients can bind
+	MinChannel = 0x4000
+	MaxChannel = 0x4FFF
+)
+
+// ErrInvalidChannelData is returned for malformed ChannelData messages
+var ErrInvalidChannelData = errors.New("invalid channel data message")
+
+// IsChannelData reports whether b looks like a ChannelData message
+func IsChannelData(b []byte) bool {
+	return len(b) >= ChannelDataHeaderSize && b[0]&0xc0 == 0x40
+}
+
+// DecodeChannelData returns the channel number and the payload of a
+// ChannelData message, which may be followed by padding
+func DecodeChannelData(b []byte) (uint16, []byte, error) {
+	if !IsChannelData(b) {
+		return 0, nil, ErrInvalidChannelData
+	}
+	channel := binary.BigEndian.Uint16(b)
+	size := int(binary.BigEndian.Uint16(b[2:]))
+	if channel > MaxChannel || ChannelDataHeaderSize+size > len(b) {
+		return 0, nil, ErrInvalidChannelData
+	}
+	return channel, b[ChannelDataHeaderSize : ChannelDataHeaderSize+size], nil
+}
+
+// AppendChannelData appends a ChannelData message to b, without padding
+// since it is sent over UDP
+func AppendChannelData(b []byte, channel uint16, payload []byte) []byte {
+	b = append(b, byte(channel>>8), byte(channel), byte(len(payload)>>8), byte(len(payload)))
+	return append(b, payload...)
+}
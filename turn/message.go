@@ -0,0 +1,380 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package turn encodes and decodes the STUN messages (RFC 8489) and the
+// ChannelData messages used by TURN (RFC 8656), including the long-term
+// credential mechanism, MESSAGE-INTEGRITY and FINGERPRINT.
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	// HeaderSize is the size of the STUN message header
+	HeaderSize = 20
+	// MagicCookie is carried by every STUN message
+	MagicCookie = 0x2112A442
+	// TransactionIDSize is the size of a transaction id
+	TransactionIDSize = 12
+
+	fingerprintXOR  = 0x5354554e
+	integritySize   = sha1.Size
+	attrHeaderSize  = 4
+	fingerprintSize = 4
+)
+
+// Methods
+const (
+	MethodBinding          = 0x001
+	MethodAllocate         = 0x003
+	MethodRefresh          = 0x004
+	MethodSend             = 0x006
+	MethodData             = 0x007
+	MethodCreatePermission = 0x008
+	MethodChannelBind      = 0x009
+)
+
+// Classes
+const (
+	ClassRequest    = 0x0000
+	ClassIndication = 0x0010
+	ClassSuccess    = 0x0100
+	ClassError      = 0x0110
+)
+
+// Attributes
+const (
+	AttrMappedAddress          = 0x0001
+	AttrUsername               = 0x0006
+	AttrMessageIntegrity       = 0x0008
+	AttrErrorCode              = 0x0009
+	AttrUnknownAttributes      = 0x000A
+	AttrChannelNumber          = 0x000C
+	AttrLifetime               = 0x000D
+	AttrXORPeerAddress         = 0x0012
+	AttrData                   = 0x0013
+	AttrRealm                  = 0x0014
+	AttrNonce                  = 0x0015
+	AttrXORRelayedAddress      = 0x0016
+	AttrRequestedAddressFamily = 0x0017
+	AttrEvenPort               = 0x0018
+	AttrRequestedTransport     = 0x0019
+	AttrDontFragment           = 0x001A
+	AttrXORMappedAddress       = 0x0020
+	AttrReservationToken       = 0x0022
+	AttrSoftware               = 0x8022
+	AttrFingerprint            = 0x8028
+)
+
+// Error codes
+const (
+	CodeBadRequest                = 400
+	CodeUnauthorized              = 401
+	CodeForbidden                 = 403
+	CodeUnknownAttribute          = 420
+	CodeAllocationMismatch        = 437
+	CodeStaleNonce                = 438
+	CodeAddressFamilyNotSupported = 440
+	CodeWrongCredentials          = 441
+	CodeUnsupportedTransport      = 442
+	CodePeerAddressFamilyMismatch = 443
+	CodeAllocationQuotaReached    = 486
+	CodeServerError               = 500
+	CodeInsufficientCapacity      = 508
+)
+
+// Address families of address attributes and REQUESTED-ADDRESS-FAMILY
+const (
+	FamilyIPv4 byte = 0x01
+	FamilyIPv6 byte = 0x02
+)
+
+// ProtocolUDP is the REQUESTED-TRANSPORT value of UDP allocations
+const ProtocolUDP = 17
+
+var (
+	// ErrInvalidMessage is returned for malformed STUN messages
+	ErrInvalidMessage = errors.New("invalid stun message")
+	// ErrFingerprint is returned for messages with a wrong FINGERPRINT
+	ErrFingerprint = errors.New("invalid stun fingerprint")
+	// ErrInvalidAddress is returned for malformed address attributes
+	ErrInvalidAddress = errors.New("invalid stun address attribute")
+)
+
+// Attribute is a STUN attribute, Value has no padding
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// Message is a STUN message
+type Message struct {
+	Method        uint16
+	Class         uint16
+	TransactionID [TransactionIDSize]byte
+	Attributes    []Attribute
+	// raw and integrity locate MESSAGE-INTEGRITY in a decoded message
+	raw       []byte
+	integrity int
+}
+
+// NewMessage creates a message with no attributes
+func NewMessage(method, class uint16, transactionID [TransactionIDSize]byte) *Message {
+	return &Message{Method: method, Class: class, TransactionID: transactionID}
+}
+
+// IsMessage reports whether b looks like a STUN message, as opposed to a
+// ChannelData message
+func IsMessage(b []byte) bool {
+	return len(b) >= HeaderSize && b[0]&0xc0 == 0 && binary.BigEndian.Uint32(b[4:]) == MagicCookie
+}
+
+func messageType(method, class uint16) uint16 {
+	return method&0x000f | (method&0x0070)<<1 | (method&0x0f80)<<2 | class
+}
+
+// Decode parses a STUN message, checking its FINGERPRINT when present.
+// Attributes following MESSAGE-INTEGRITY other than FINGERPRINT are ignored
+func Decode(b []byte) (*Message, error) {
+	if !IsMessage(b) {
+		return nil, ErrInvalidMessage
+	}
+	t := binary.BigEndian.Uint16(b)
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length%4 != 0 || HeaderSize+length != len(b) {
+		return nil, ErrInvalidMessage
+	}
+	m := &Message{
+		Method:    t&0x000f | (t&0x00e0)>>1 | (t&0x3e00)>>2,
+		Class:     t & 0x0110,
+		raw:       b,
+		integrity: -1,
+	}
+	copy(m.TransactionID[:], b[8:HeaderSize])
+	for offset := HeaderSize; offset < len(b); {
+		if len(b)-offset < attrHeaderSize {
+			return nil, ErrInvalidMessage
+		}
+		attrType := binary.BigEndian.Uint16(b[offset:])
+		size := int(binary.BigEndian.Uint16(b[offset+2:]))
+		value := offset + attrHeaderSize
+		if value+size > len(b) {
+			return nil, ErrInvalidMessage
+		}
+		switch {
+		case attrType == AttrFingerprint:
+			if size != fingerprintSize || value+size != len(b) {
+				return nil, ErrInvalidMessage
+			}
+			if binary.BigEndian.Uint32(b[value:]) != fingerprint(b[:offset]) {
+				return nil, ErrFingerprint
+			}
+		case m.integrity >= 0:
+		case attrType == AttrMessageIntegrity:
+			if size != integritySize {
+				return nil, ErrInvalidMessage
+			}
+			m.integrity = offset
+		default:
+			m.Attributes = append(m.Attributes, Attribute{Type: attrType, Value: b[value : value+size]})
+		}
+		offset = value + padded(size)
+	}
+	return m, nil
+}
+
+func padded(size int) int {
+	return (size + 3) &^ 3
+}
+
+// fingerprint computes the FINGERPRINT of the message that precedes it,
+// whose length field must already account for the FINGERPRINT attribute
+func fingerprint(b []byte) uint32 {
+	// the length field covers the FINGERPRINT attribute itself
+	header := make([]byte, 4)
+	copy(header, b[:4])
+	binary.BigEndian.PutUint16(header[2:], uint16(len(b)-HeaderSize+attrHeaderSize+fingerprintSize))
+	crc := crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, b[4:])
+	return crc ^ fingerprintXOR
+}
+
+// Get returns the value of the first attribute of type t
+func (m *Message) Get(t uint16) ([]byte, bool) {
+	for _, a := range m.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Add appends an attribute
+func (m *Message) Add(t uint16, value []byte) {
+	m.Attributes = append(m.Attributes, Attribute{Type: t, Value: value})
+}
+
+// HasIntegrity reports whether a decoded message carries MESSAGE-INTEGRITY
+func (m *Message) HasIntegrity() bool {
+	return m.integrity >= 0
+}
+
+// CheckIntegrity verifies the MESSAGE-INTEGRITY of a decoded message
+func (m *Message) CheckIntegrity(key []byte) bool {
+	if m.integrity < 0 {
+		return false
+	}
+	expected := m.raw[m.integrity+attrHeaderSize : m.integrity+attrHeaderSize+integritySize]
+	return hmac.Equal(integrity(m.raw[:m.integrity], key), expected)
+}
+
+// integrity computes the MESSAGE-INTEGRITY of the message that precedes it
+func integrity(b []byte, key []byte) []byte {
+	header := make([]byte, 4)
+	copy(header, b[:4])
+	binary.BigEndian.PutUint16(header[2:], uint16(len(b)-HeaderSize+attrHeaderSize+integritySize))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(header)
+	mac.Write(b[4:])
+	return mac.Sum(nil)
+}
+
+// Unknown returns the comprehension-required attributes that known does
+// not accept
+func (m *Message) Unknown(known func(uint16) bool) []uint16 {
+	var unknown []uint16
+	for _, a := range m.Attributes {
+		if a.Type < 0x8000 && !known(a.Type) {
+			unknown = append(unknown, a.Type)
+		}
+	}
+	return unknown
+}
+
+// Encode appends the encoded message to b, followed by MESSAGE-INTEGRITY
+// when key is not nil and by FINGERPRINT
+func (m *Message) Encode(b []byte, key []byte) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, 0x21, 0x12, 0xa4, 0x42)
+	binary.BigEndian.PutUint16(b[start:], messageType(m.Method, m.Class))
+	b = append(b, m.TransactionID[:]...)
+	for _, a := range m.Attributes {
+		b = appendAttr(b, a.Type, a.Value)
+	}
+	if key != nil {
+		b = appendAttr(b, AttrMessageIntegrity, integrity(b[start:], key))
+	}
+	b = appendAttr(b, AttrFingerprint, make([]byte, fingerprintSize))
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start-HeaderSize))
+	fp := len(b) - fingerprintSize
+	binary.BigEndian.PutUint32(b[fp:], fingerprint(b[start:fp-attrHeaderSize]))
+	return b
+}
+
+func appendAttr(b []byte, t uint16, value []byte) []byte {
+	b = append(b, byte(t>>8), byte(t), byte(len(value)>>8), byte(len(value)))
+	b = append(b, value...)
+	for i := len(value); i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// LongTermKey derives the key of the long-term credential mechanism
+func LongTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+// XORAddress decodes an XOR-MAPPED-ADDRESS, XOR-PEER-ADDRESS or
+// XOR-RELAYED-ADDRESS value
+func XORAddress(value []byte, transactionID [TransactionIDSize]byte) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, ErrInvalidAddress
+	}
+	mask := xorMask(transactionID)
+	port := int(binary.BigEndian.Uint16(value[2:]) ^ MagicCookie>>16)
+	var size int
+	switch value[1] {
+	case FamilyIPv4:
+		size = net.IPv4len
+	case FamilyIPv6:
+		size = net.IPv6len
+	default:
+		return nil, ErrInvalidAddress
+	}
+	if len(value) != 4+size {
+		return nil, ErrInvalidAddress
+	}
+	ip := make(net.IP, size)
+	for i := range ip {
+		ip[i] = value[4+i] ^ mask[i]
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// AppendXORAddress appends the XOR encoded value of addr to b
+func AppendXORAddress(b []byte, addr *net.UDPAddr, transactionID [TransactionIDSize]byte) []byte {
+	ip, family := addr.IP.To4(), FamilyIPv4
+	if ip == nil {
+		ip, family = addr.IP.To16(), FamilyIPv6
+	}
+	port := uint16(addr.Port) ^ MagicCookie>>16
+	b = append(b, 0, family, byte(port>>8), byte(port))
+	mask := xorMask(transactionID)
+	for i := range ip {
+		b = append(b, ip[i]^mask[i])
+	}
+	return b
+}
+
+func xorMask(transactionID [TransactionIDSize]byte) []byte {
+	mask := make([]byte, 4, 4+TransactionIDSize)
+	binary.BigEndian.PutUint32(mask, MagicCookie)
+	return append(mask, transactionID[:]...)
+}
+
+// ErrorCode encodes an ERROR-CODE value
+func ErrorCode(code int, reason string) []byte {
+	return append([]byte{0, 0, byte(code / 100), byte(code % 100)}, reason...)
+}
+
+// DecodeErrorCode decodes an ERROR-CODE value
+func DecodeErrorCode(value []byte) (int, string, error) {
+	if len(value) < 4 {
+		return 0, "", ErrInvalidMessage
+	}
+	return int(value[2]&0x07)*100 + int(value[3]), string(value[4:]), nil
+}
+
+// Uint32 encodes the value of LIFETIME and similar attributes
+func Uint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2020 Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ * Author: Felipe Cavalcanti <fjfcavalcanti@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package turn_test
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+
+	. "github.com/felipejfc/udpx/turn"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Turn", func() {
+	transactionID := [TransactionIDSize]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+	Describe("Message", func() {
+		It("should decode the sample request of RFC 5769", func() {
+			sample, err := hex.DecodeString(strings.Join([]string{
+				"000100582112a442b7e7a701bc34d686fa87dfae",
+				"802200105354554e20746573742063" + "6c69656e74",
+				"002400046e0001ff",
+				"80290008932ff9b151263b36",
+				"000600096576746a3a68367659202020",
+				"000800149aeaa70cbfd8cb56781ef2b5b2d3f249c1b571a2",
+				"80280004e57a3bcf",
+			}, ""))
+			Expect(err).NotTo(HaveOccurred())
+			m, err := Decode(sample)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m.Method).To(Equal(uint16(MethodBinding)))
+			Expect(m.Class).To(Equal(uint16(ClassRequest)))
+			username, ok := m.Get(AttrUsername)
+			Expect(ok).To(BeTrue())
+			Expect(string(username)).To(Equal("evtj:h6vY"))
+			Expect(m.CheckIntegrity([]byte("VOkJxbRl1RmTxUk/WvJxBt"))).To(BeTrue())
+			Expect(m.CheckIntegrity([]byte("wrong"))).To(BeFalse())
+
+			sample[len(sample)-1] ^= 1
+			_, err = Decode(sample)
+			Expect(err).To(Equal(ErrFingerprint))
+		})
+
+		It("should encode messages with integrity and fingerprint", func() {
+			key := LongTermKey("user", "example.org", "secret")
+			m := NewMessage(MethodAllocate, ClassSuccess, transactionID)
+			m.Add(AttrLifetime, Uint32(600))
+			m.Add(AttrSoftware, []byte("udpx"))
+			b := m.Encode(nil, key)
+			Expect(IsMessage(b)).To(BeTrue())
+			Expect(IsChannelData(b)).To(BeFalse())
+
+			decoded, err := Decode(b)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.Method).To(Equal(uint16(MethodAllocate)))
+			Expect(decoded.Class).To(Equal(uint16(ClassSuccess)))
+			Expect(decoded.TransactionID).To(Equal(transactionID))
+			Expect(decoded.HasIntegrity()).To(BeTrue())
+			Expect(decoded.CheckIntegrity(key)).To(BeTrue())
+			Expect(decoded.CheckIntegrity(LongTermKey("user", "example.org", "other"))).To(BeFalse())
+			lifetime, ok := decoded.Get(AttrLifetime)
+			Expect(ok).To(BeTrue())
+			Expect(lifetime).To(Equal(Uint32(600)))
+
+			unauthenticated, err := Decode(m.Encode(nil, nil))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(unauthenticated.HasIntegrity()).To(BeFalse())
+		})
+
+		It("should reject malformed messages", func() {
+			b := NewMessage(MethodBinding, ClassRequest, transactionID).Encode(nil, nil)
+			_, err := Decode(b[:len(b)-4])
+			Expect(err).To(Equal(ErrInvalidMessage))
+			_, err = Decode([]byte{0x40, 0, 0, 4, 1, 2, 3, 4})
+			Expect(err).To(Equal(ErrInvalidMessage))
+		})
+
+		It("should report unknown comprehension-required attributes", func() {
+			m := NewMessage(MethodAllocate, ClassRequest, transactionID)
+			m.Add(AttrRequestedTransport, []byte{ProtocolUDP, 0, 0, 0})
+			m.Add(AttrDontFragment, nil)
+			m.Add(AttrSoftware, []byte("client"))
+			unknown := m.Unknown(func(t uint16) bool { return t == AttrRequestedTransport })
+			Expect(unknown).To(Equal([]uint16{AttrDontFragment}))
+		})
+
+		It("should encode error codes", func() {
+			code, reason, err := DecodeErrorCode(ErrorCode(CodeStaleNonce, "Stale Nonce"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(code).To(Equal(CodeStaleNonce))
+			Expect(reason).To(Equal("Stale Nonce"))
+		})
+	})
+
+	Describe("XORAddress", func() {
+		It("should round trip ipv4 and ipv6 addresses", func() {
+			for _, addr := range []*net.UDPAddr{
+				{IP: net.ParseIP("192.0.2.1").To4(), Port: 32853},
+				{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853},
+			} {
+				value := AppendXORAddress(nil, addr, transactionID)
+				decoded, err := XORAddress(value, transactionID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(decoded.String()).To(Equal(addr.String()))
+			}
+		})
+
+		It("should match RFC 5769", func() {
+			value, _ := hex.DecodeString("0001a147e112a643")
+			addr, err := XORAddress(value, transactionID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addr.String()).To(Equal("192.0.2.1:32853"))
+		})
+
+		It("should reject malformed addresses", func() {
+			_, err := XORAddress([]byte{0, 3, 0, 0, 1, 2, 3, 4}, transactionID)
+			Expect(err).To(Equal(ErrInvalidAddress))
+			_, err = XORAddress([]byte{0, 1, 0, 0, 1, 2}, transactionID)
+			Expect(err).To(Equal(ErrInvalidAddress))
+		})
+	})
+
+	Describe("ChannelData", func() {
+		It("should round trip channel data", func() {
+			b := AppendChannelData(nil, MinChannel, []byte("ping"))
+			Expect(IsChannelData(b)).To(BeTrue())
+			Expect(IsMessage(b)).To(BeFalse())
+			channel, payload, err := DecodeChannelData(append(b, 0, 0, 0, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(channel).To(Equal(uint16(MinChannel)))
+			Expect(string(payload)).To(Equal("ping"))
+		})
+
+		It("should reject truncated channel data", func() {
+			b := AppendChannelData(nil, MinChannel, []byte("ping"))
+			_, _, err := DecodeChannelData(b[:6])
+			Expect(err).To(Equal(ErrInvalidChannelData))
+			_, _, err = DecodeChannelData(AppendChannelData(nil, 0x5000, nil))
+			Expect(err).To(Equal(ErrInvalidChannelData))
+		})
+	})
+})